@@ -3,6 +3,10 @@ package libschema
 import (
 	"context"
 	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/muir/libschema/internal"
 
@@ -28,12 +32,74 @@ type Driver interface {
 	// IsMigrationSupported exists to guard against additional migration
 	// options and features.  It should return nil except if there are new
 	// migration features added that haven't been included in all support
-	// libraries.
+	// libraries.  Drivers should also call Database.ValidateMigration.
+	// It is called for all migrations before the migration lock is taken.
 	IsMigrationSupported(*Database, *internal.Log, Migration) error
 
 	LoadStatus(context.Context, *internal.Log, *Database) ([]MigrationName, error)
 }
 
+// TrackingDBSupporter is an optional interface for Drivers.  It is
+// required for Database.SetTrackingDB.
+type TrackingDBSupporter interface {
+	SupportsTrackingDB()
+}
+
+// StatusMarker is an optional interface for Drivers.  It is required
+// for Database.Baseline.  MarkMigrationDone records a migration as done
+// in the tracking table without running it.
+type StatusMarker interface {
+	MarkMigrationDone(context.Context, *internal.Log, *Database, Migration) error
+}
+
+// StatusSetter is an optional interface for Drivers.  It is required
+// for Database.SetStatusManually.  SetMigrationStatus records a migration
+// as done, or not done, in the tracking table without running it.
+type StatusSetter interface {
+	SetMigrationStatus(_ context.Context, _ *internal.Log, _ *Database, _ Migration, done bool) error
+}
+
+// TrackingTableWriteChecker is an optional interface for Drivers.  It
+// is used by Database.Preflight.  CheckTrackingTableWrite inserts a row
+// into the tracking table in a transaction that is rolled back.
+type TrackingTableWriteChecker interface {
+	CheckTrackingTableWrite(context.Context, *internal.Log, *Database) error
+}
+
+// TrackingTableDropper is an optional interface for Drivers.  It
+// is required for Database.DropTrackingTable.
+type TrackingTableDropper interface {
+	DropTrackingTable(context.Context, *internal.Log, *Database) error
+}
+
+// ErrorClassifier is an optional interface for Drivers.  It keeps the
+// knowledge of how a database reports errors in the driver.
+// IsRetryable returns true for transient errors, like deadlocks and lost
+// connections, where trying again may succeed.  IsAlreadyExists returns
+// true for errors from creating something (a table, column, index, ...)
+// that already exists.  See Database.IsRetryable and
+// Database.IsAlreadyExists.
+type ErrorClassifier interface {
+	IsRetryable(error) bool
+	IsAlreadyExists(error) bool
+}
+
+// ScriptRenderer is an optional interface for Drivers.  It is required
+// for Database.ExportSQL.  RenderScript returns the SQL that a migration
+// would run, without running it.  For migrations that run Go code
+// (Computed) there is no SQL and it returns computed true.
+type ScriptRenderer interface {
+	RenderScript(context.Context, *internal.Log, *Database, Migration) (script string, computed bool, err error)
+}
+
+// ScriptChecker is an optional interface for Drivers.  It is used by
+// Database.DryRender.  CheckMigrationScript applies the checks that
+// the driver makes to the SQL of a migration just before running it.
+// The script is the one returned by RenderScript.
+type ScriptChecker interface {
+	CheckMigrationScript(_ *internal.Log, _ *Database, _ Migration, script string) error
+}
+
 // MigrationName holds both the name of the specific migration and the library to
 // which it belongs.
 type MigrationName struct {
@@ -52,8 +118,16 @@ type MigrationBase struct {
 	order           int // overall desired ordring across all libraries, ignores runAfter
 	status          MigrationStatus
 	skipIf          func() (bool, error)
+	skipIfTx        func(context.Context, *sql.Tx) (bool, error)
 	skipRemainingIf func() (bool, error)
 	repeatUntilNoOp bool
+	tags            []string
+	dedicatedConn   bool
+	txOptions       *sql.TxOptions
+	beginTx         func(context.Context, *sql.DB, *sql.TxOptions) (*sql.Tx, error)
+	continueOnError bool
+	onlineSafe      bool
+	comment         string
 }
 
 func (m MigrationBase) Copy() MigrationBase {
@@ -62,9 +136,62 @@ func (m MigrationBase) Copy() MigrationBase {
 		copy(ra, m.rawAfter)
 		m.rawAfter = ra
 	}
+	if m.tags != nil {
+		tags := make([]string, len(m.tags))
+		copy(tags, m.tags)
+		m.tags = tags
+	}
 	return m
 }
 
+// String describes the migration for logs and test failures, for
+// example "users: add_level [async, skipIf, tags=data]".
+func (m *MigrationBase) String() string {
+	return m.Describe()
+}
+
+// Describe is like String but details, like "script" or "computed",
+// are listed first in the brackets.  Drivers use it to implement String
+// for their migration types.
+func (m *MigrationBase) Describe(details ...string) string {
+	flags := append([]string{}, details...)
+	if m.async {
+		flags = append(flags, "async")
+	}
+	if m.HasSkipIf() {
+		flags = append(flags, "skipIf")
+	}
+	if m.skipRemainingIf != nil {
+		flags = append(flags, "skipRemainingIf")
+	}
+	if m.repeatUntilNoOp {
+		flags = append(flags, "repeatUntilNoOp")
+	}
+	if m.dedicatedConn {
+		flags = append(flags, "dedicatedConn")
+	}
+	if m.continueOnError {
+		flags = append(flags, "continueOnError")
+	}
+	if m.onlineSafe {
+		flags = append(flags, "onlineSafe")
+	}
+	if len(m.tags) != 0 {
+		flags = append(flags, "tags="+strings.Join(m.tags, ","))
+	}
+	if len(m.rawAfter) != 0 {
+		after := make([]string, len(m.rawAfter))
+		for i, name := range m.rawAfter {
+			after[i] = name.String()
+		}
+		flags = append(flags, "after="+strings.Join(after, ","))
+	}
+	if len(flags) == 0 {
+		return m.Name.String()
+	}
+	return m.Name.String() + " [" + strings.Join(flags, ", ") + "]"
+}
+
 // MigrationBase is a workaround for lacking object inheritance.
 type Migration interface {
 	Base() *MigrationBase
@@ -85,6 +212,8 @@ type Database struct {
 	migrationIndex    map[MigrationName]Migration
 	errors            []error
 	db                *sql.DB
+	statusDB          *sql.DB
+	trackingDB        *sql.DB
 	Name              string
 	driver            Driver
 	sequence          []Migration // in order of execution
@@ -94,6 +223,13 @@ type Database struct {
 	log               *internal.Log
 	asyncInProgress   bool
 	unknownMigrations []MigrationName
+	blockedBy         [][]int // indexed by MigrationBase.order
+	held              []bool  // indexed by MigrationBase.order
+	failed            []bool  // indexed by MigrationBase.order, WithContinueOnError failures
+	currentLock       sync.Mutex
+	current           MigrationName
+	summary           runSummary
+	lockAcquired      bool // set by prepare, used by MigrateWithin
 }
 
 // Options operate at the Database level but are specified at the Schema level
@@ -114,16 +250,133 @@ type Options struct {
 	SchemaOverride string
 
 	// These TxOptions will be used for all migration transactions.
+	// WithTxOptions overrides them for a single migration.
 	MigrationTxOptions *sql.TxOptions
 
+	// ErrorOnUnknownMigrations makes Migrate() and MigrateOne() fail,
+	// without running anything, if the tracking table has migrations
+	// that are done but not registered.  The status is loaded after the
+	// migration lock is taken, so an old binary that gets the lock
+	// after a newer one has migrated (for example, during a canary
+	// deploy) refuses to run and releases the lock instead of working
+	// on a schema that it does not know.
 	ErrorOnUnknownMigrations bool
 
+	// MigrationOrder, if set, is used to sort the migrations within each
+	// library when they are registered with Database.Migrations().  It
+	// must be set before Migrations() is called.  It reports whether a
+	// must run before b.  The sort is stable.  By default, migrations
+	// are not sorted: they run in the order that they are given to
+	// Migrations().  See NaturalNameOrder.
+	MigrationOrder func(a, b MigrationName) bool
+
+	// AllowDestructive must be set for Database.DropTrackingTable and
+	// Database.SetStatusManually to do anything.  It is meant for tests
+	// and for operators recovering from a failed migration.
+	AllowDestructive bool
+
+	// MigrationValidators reject migrations that violate a policy, see
+	// BanStatements.  All registered migrations are validated before
+	// the migration lock is taken so a rejected migration stops
+	// Migrate() before anything runs.
+	MigrationValidators []MigrationValidator
+
+	// AppliedBy is recorded in the applied_by column of the tracking
+	// table for each migration.  It is meant to identify the process
+	// that ran the migration, for example a pod name or a deploy ID.
+	// If not set, hostname:pid is used.
+	AppliedBy string
+
+	// RunID is recorded in the run_id column of the tracking table for
+	// each migration so that the migrations applied by one deploy can
+	// be found together.  If not set, a random UUID is generated for
+	// each call to Migrate().  See RunContext.RunID.
+	RunID string
+
+	// WithoutMigrationLock skips locking the migrations table.
+	//
+	// DANGER: the lock is what prevents two processes from running the
+	// same migrations at the same time.  Without it, concurrent calls
+	// to Migrate() can double-apply migrations and corrupt the
+	// schema.  Only set this when something else guarantees that a
+	// single process runs migrations (for example, a Kubernetes Job
+	// that is the only thing that calls Migrate()).
+	WithoutMigrationLock bool
+
+	// WithoutFailureStatus skips recording failed migrations in the
+	// tracking table.  By default, a failed migration is recorded as
+	// not done along with its error.  With WithoutFailureStatus, a
+	// failed attempt leaves no trace (a row left by an earlier failure
+	// is not removed).  OnMigrationFailure is still called.
+	WithoutFailureStatus bool
+
+	// OnlyTags, if set, limits migrations to those that have at least
+	// one of the tags (see WithTags).  SkipTags excludes migrations
+	// that have any of the tags.  Tags are a run-time filter only: they
+	// are not persisted.  Migrations that are excluded are not run and
+	// are not marked as done so they will run on a later Migrate()
+	// that does not exclude them.  Any migration that depends on an
+	// excluded migration that is not already done is also held back.
+	// That includes the implicit dependency that each migration has on
+	// the migration defined before it in the same library as well as
+	// dependencies added with After().
+	OnlyTags []string
+	SkipTags []string
+
+	// MigrationFilter, if set, is called for each migration that is
+	// not done.  Migrations for which it returns false are excluded
+	// just like migrations excluded by OnlyTags and SkipTags: they are
+	// not run, they are not marked as done, and the migrations that
+	// depend upon them are held back.  Use it to decide at run time,
+	// for example by tenant tier, which migrations apply.
+	MigrationFilter func(Migration) bool
+
+	// MigrateUpTo, if set, makes Migrate() stop after the named
+	// migration.  Migrations that come after it in the migration
+	// sequence are held back, like migrations excluded by tags, so that
+	// a later Migrate() without MigrateUpTo runs them.  MigrateUpTo
+	// only applies to the Databases that have a migration by that
+	// name but Migrate() returns an error, before taking any locks, if
+	// none of the Databases being migrated have it.
+	MigrateUpTo MigrationName
+
+	// ContextValues are attached, with context.WithValue, to the
+	// context.Context that is passed to Generate() and Computed()
+	// migrations.  Use them for deploy metadata, like a git SHA, that
+	// migrations want to record.  Hooks can read them from
+	// dbase.Options.ContextValues.  The values only apply to the
+	// Migrate() call that sees them: they are not persisted.  As with
+	// context.WithValue, keys should be of an unexported type.
+	ContextValues map[interface{}]interface{}
+
+	// OnUnknownMigration is called, after the migration lock is taken,
+	// for each migration that is recorded in the tracking table but is
+	// not registered.  That usually means that the code is older than
+	// the database.  If it returns an error, Migrate() stops for that
+	// Database without running any migrations.  It is called before
+	// ErrorOnUnknownMigrations is checked.
+	OnUnknownMigration func(dbase *Database, n MigrationName) error
+
+	// OnMigrationLock is called each time Migrate() or MigrateOne()
+	// tries to take the migration lock.  wait is how long it took to
+	// get the lock (or to fail to get it, in which case err is set).
+	// When another process holds the lock, wait includes the time
+	// until that process finished so it is the number to alert on
+	// when deploys are slow.  It is not called with
+	// WithoutMigrationLock.
+	OnMigrationLock func(dbase *Database, wait time.Duration, err error)
+
 	// OnMigrationFailure is only called when there is a failure
 	// of a specific migration.  OnMigrationsComplete will also
 	// be called.  OnMigrationFailure is called for each Database
 	// (if there is a failure).
 	OnMigrationFailure func(dbase *Database, n MigrationName, err error)
 
+	// OnMigrationProgress is called each time a migration reports its
+	// progress with Progress(ctx).Report().  total is zero if the
+	// migration does not know it.
+	OnMigrationProgress func(dbase *Database, n MigrationName, done, total int)
+
 	// OnMigrationsStarted is only called if migrations are needed
 	// OnMigrationsStarted is called for each Database (if needed).
 	OnMigrationsStarted func(dbase *Database)
@@ -143,6 +396,12 @@ type Schema struct {
 	databaseOrder []*Database
 	options       Options
 	context       context.Context
+	libraryAfter  []libraryDependency
+}
+
+type libraryDependency struct {
+	library string
+	after   string
 }
 
 // New creates a schema object.
@@ -181,6 +440,29 @@ func (s *Schema) NewDatabase(log *internal.Log, name string, db *sql.DB, driver
 	return database, nil
 }
 
+// LibraryAfter declares that all of the migrations of library must run after
+// all of the migrations of each of the after libraries.  The dependency
+// applies within each Database that has both libraries registered.  Libraries
+// that are not registered with any Database are an error, as are cyclic
+// dependencies between libraries.  Both are reported by Migrate().
+func (s *Schema) LibraryAfter(library string, after ...string) {
+	for _, a := range after {
+		s.libraryAfter = append(s.libraryAfter, libraryDependency{
+			library: library,
+			after:   a,
+		})
+	}
+}
+
+// LibraryOrder declares that the migrations of each library run after all
+// of the migrations of the library listed before it.  It is shorthand for
+// calling LibraryAfter for each adjacent pair.
+func (s *Schema) LibraryOrder(libraries ...string) {
+	for i := 1; i < len(libraries); i++ {
+		s.LibraryAfter(libraries[i], libraries[i-1])
+	}
+}
+
 // Asynchronous marks a migration is okay to run asynchronously.  If all of the
 // remaining migrations can be asynchronous, then schema.Migrate() will return
 // while the remaining migrations run.
@@ -223,6 +505,91 @@ func After(lib, migration string) MigrationOption {
 	}
 }
 
+// WithTags labels a migration so that it can be included or excluded
+// from a run with Options.OnlyTags and Options.SkipTags.
+func WithTags(tags ...string) MigrationOption {
+	return func(m Migration) {
+		base := m.Base()
+		newTags := make([]string, len(base.tags), len(base.tags)+len(tags))
+		copy(newTags, base.tags) // copy in case there is another reference
+		base.tags = append(newTags, tags...)
+	}
+}
+
+// WithDedicatedConn causes a migration to run on a connection that is
+// acquired just for that migration and is closed (not returned to the
+// connection pool) when the migration is finished.  Use this for
+// migrations that change session state, like
+// "SET FOREIGN_KEY_CHECKS=0", so that the state persists for the
+// whole migration but does not leak into other uses of the *sql.DB.
+func WithDedicatedConn() MigrationOption {
+	return func(m Migration) {
+		m.Base().dedicatedConn = true
+	}
+}
+
+// WithContinueOnError marks a migration as non-critical: if it fails,
+// the failure is recorded (in the tracking table and with
+// Options.OnMigrationFailure) and Migrate goes on to the remaining
+// migrations instead of stopping.  Migrations that come after it,
+// including those in the same library, still run.  Migrate returns an
+// error that lists all such failures.  The failed migration is not done
+// so it will be tried again by the next Migrate.  Use it for best-effort
+// data cleanups.
+func WithContinueOnError() MigrationOption {
+	return func(m Migration) {
+		m.Base().continueOnError = true
+	}
+}
+
+// WithOnlineSafe declares if a migration is safe to run while the
+// application is serving traffic.  It is metadata only: it does not
+// change how the migration is run.  Tooling can read it with
+// MigrationBase.OnlineSafe, for example to hold back migrations that are
+// not online-safe until a maintenance window.  Migrations are not
+// considered online-safe unless they are marked.
+func WithOnlineSafe(safe bool) MigrationOption {
+	return func(m Migration) {
+		m.Base().onlineSafe = safe
+	}
+}
+
+// WithComment records a comment, like a ticket number, in the comment
+// column of the tracking table when the status of the migration is saved.
+func WithComment(comment string) MigrationOption {
+	return func(m Migration) {
+		m.Base().comment = comment
+	}
+}
+
+// WithTxOptions overrides Options.MigrationTxOptions for the transaction
+// that a migration runs in.  Use it to pick an isolation level, like
+// sql.LevelReadCommitted, for a backfill.  The transaction that records
+// the status of a failed migration still uses Options.MigrationTxOptions.
+func WithTxOptions(opts *sql.TxOptions) MigrationOption {
+	return func(m Migration) {
+		m.Base().txOptions = opts
+	}
+}
+
+// WithBeginTx has a migration run in a transaction that is started by
+// begin instead of by libschema so that the application's own
+// transaction conventions, like instrumentation, apply.  begin is
+// given the *sql.DB and the options from WithTxOptions or
+// Options.MigrationTxOptions.  libschema still commits or rolls back
+// the transaction and, for drivers that record success in the
+// migration transaction, the status is saved in it so that the
+// migration and its status commit together.  begin must return a new
+// transaction that nothing else will commit or roll back: if the
+// transaction is committed early, a crash before the status is saved
+// leaves a migration that is applied but not recorded and it will be
+// run again.  WithBeginTx cannot be combined with WithDedicatedConn.
+func WithBeginTx(begin func(ctx context.Context, db *sql.DB, opts *sql.TxOptions) (*sql.Tx, error)) MigrationOption {
+	return func(m Migration) {
+		m.Base().beginTx = begin
+	}
+}
+
 // SkipIf is checked before the migration is run.  If the function returns true
 // then this migration is skipped.  For MySQL, this allows migrations
 // that are not idempotent to be checked before they're run and skipped
@@ -233,6 +600,23 @@ func SkipIf(pred func() (bool, error)) MigrationOption {
 	}
 }
 
+// WithSkipIf is checked by the driver inside the migration transaction,
+// before the migration is run.  If the function returns true then the
+// migration is not run but it is marked as done.  This allows migrations
+// that are not idempotent to be guarded with a check of the current state:
+//
+//	lsmysql.Script("addIndex", `CREATE INDEX ...`,
+//		libschema.WithSkipIf(func(ctx context.Context, tx *sql.Tx) (bool, error) {
+//			return mysql.TableHasIndex("users", "users_email")
+//		}))
+//
+// Drivers without transactions do not support WithSkipIf.
+func WithSkipIf(pred func(context.Context, *sql.Tx) (bool, error)) MigrationOption {
+	return func(m Migration) {
+		m.Base().skipIfTx = pred
+	}
+}
+
 // SkipRemainingIf is checked before the migration is run.  If the function
 // returns true then this migration and all following it are not run at this
 // time.  One use for this to hold back migrations that have not been released
@@ -251,27 +635,135 @@ func (d *Database) DB() *sql.DB {
 	return d.db
 }
 
+// SetStatusDB sets the *sql.DB that drivers use to read the migration
+// status in LoadStatus.  Use it when the *sql.DB given to NewDatabase
+// can send reads to a replica (for example, through a read/write
+// splitting proxy).  A replica that has not caught up can report a
+// migration that was just applied as not done and then it will be run
+// a second time.  The status DB should always reach the primary.
+func (d *Database) SetStatusDB(db *sql.DB) {
+	d.statusDB = db
+}
+
+// StatusDB returns the *sql.DB set with SetStatusDB or, if that was
+// not called, TrackingDB()
+func (d *Database) StatusDB() *sql.DB {
+	if d.statusDB != nil {
+		return d.statusDB
+	}
+	return d.TrackingDB()
+}
+
+// SetTrackingDB puts the tracking table, and with it the migration lock,
+// in a different database than the one being migrated.  Use it to record
+// the migrations of many shards in one central metadata database.  Give
+// each shard's Database its own Options.TrackingTable: the lock is per
+// tracking table so shards with their own tracking tables can be
+// migrated at the same time, but shards that share a tracking table
+// would also share their status.  The migration and its status can no
+// longer be committed together: the status is saved after the migration
+// commits and if the program dies in between, the migration will be run
+// again.  The driver must implement TrackingDBSupporter.
+func (d *Database) SetTrackingDB(db *sql.DB) {
+	d.trackingDB = db
+}
+
+// TrackingDB returns the *sql.DB set with SetTrackingDB or, if that was
+// not called, DB()
+func (d *Database) TrackingDB() *sql.DB {
+	if d.trackingDB != nil {
+		return d.trackingDB
+	}
+	return d.db
+}
+
+// HasTrackingDB returns true if SetTrackingDB was called with a
+// *sql.DB other than DB()
+func (d *Database) HasTrackingDB() bool {
+	return d.trackingDB != nil && d.trackingDB != d.db
+}
+
+// Current returns the name of the migration that is in progress.  If no
+// migration is in progress, the zero MigrationName is returned.  It is
+// safe to call concurrently with Migrate() so that, for example, a
+// status endpoint can report which migration a stuck deploy is waiting on.
+func (d *Database) Current() MigrationName {
+	d.currentLock.Lock()
+	defer d.currentLock.Unlock()
+	return d.current
+}
+
+func (d *Database) setCurrent(name MigrationName) {
+	d.currentLock.Lock()
+	defer d.currentLock.Unlock()
+	d.current = name
+}
+
 func (d *Database) Lookup(name MigrationName) (Migration, bool) {
 	m, ok := d.migrationIndex[name]
 	return m, ok
 }
 
+// MigrationNames returns the names of all of the registered migrations
+// in the order that they were registered (after Options.MigrationOrder
+// is applied within each library).  It does not use the database so it
+// can be used to generate a catalog of migrations or to compare the
+// migrations of two versions of a program.  Migrate() may run them in a
+// different order because of After() and LibraryAfter().
+func (d *Database) MigrationNames() []MigrationName {
+	names := make([]MigrationName, len(d.migrations))
+	for i, m := range d.migrations {
+		names[i] = m.Base().Name
+	}
+	return names
+}
+
 // Migrations specifies the migrations needed for a library.  By default, each
 // migration is dependent upon the prior migration and they'll run in the order
-// given.  By default, all the migrations for a library will run in the order in
+// given.  If Options.MigrationOrder is set, the migrations are sorted with it
+// first.  By default, all the migrations for a library will run in the order in
 // which the library migrations are defined.
+//
+// Migrations are tracked by library and name so the library name is the
+// namespace for migration names: different libraries can use the same
+// migration names but the names within a library must be unique and each
+// library can only be registered once per Database.  Violations are
+// reported by Migrate().
 func (d *Database) Migrations(libraryName string, migrations ...Migration) {
 	if _, ok := d.byLibrary[libraryName]; ok {
 		d.errors = append(d.errors, errors.Errorf("duplicate library '%s' registered with a call to Database.Migrations()", libraryName))
 		return
 	}
-	d.libraries = append(d.libraries, libraryName)
 	mList := make([]Migration, len(migrations))
+	seen := make(map[string]bool, len(migrations))
+	var duplicates []string
 	for i, migration := range migrations {
 		migration := migration.Copy()
 		migration.Base().Name.Library = libraryName
-		d.migrationIndex[migration.Base().Name] = migration
 		mList[i] = migration
+		if migration.Base().beginTx != nil && migration.Base().dedicatedConn {
+			d.errors = append(d.errors, errors.Errorf("migration %s: WithBeginTx cannot be combined with WithDedicatedConn",
+				migration.Base().Name))
+		}
+		name := migration.Base().Name.Name
+		if seen[name] {
+			duplicates = append(duplicates, "'"+name+"'")
+		}
+		seen[name] = true
+	}
+	if len(duplicates) != 0 {
+		d.errors = append(d.errors, errors.Errorf("library '%s' has duplicate migration names: %s",
+			libraryName, strings.Join(duplicates, ", ")))
+		return
+	}
+	d.libraries = append(d.libraries, libraryName)
+	if d.Options.MigrationOrder != nil {
+		sort.SliceStable(mList, func(i, j int) bool {
+			return d.Options.MigrationOrder(mList[i].Base().Name, mList[j].Base().Name)
+		})
+	}
+	for _, migration := range mList {
+		d.migrationIndex[migration.Base().Name] = migration
 		migration.Base().order = len(d.migrations)
 		d.migrations = append(d.migrations, migration)
 	}
@@ -286,8 +778,117 @@ func (m *MigrationBase) SetStatus(status MigrationStatus) {
 	m.status = status
 }
 
+// HasSkipIf returns true if either SkipIf or WithSkipIf was used
 func (m *MigrationBase) HasSkipIf() bool {
-	return m.skipIf != nil
+	return m.skipIf != nil || m.skipIfTx != nil
+}
+
+// HasSkipIfTx returns true if WithSkipIf was used
+func (m *MigrationBase) HasSkipIfTx() bool {
+	return m.skipIfTx != nil
+}
+
+// SkipIfTx evaluates the WithSkipIf predicate, if any.  It is
+// expected to be called by drivers with the ctx given to
+// DoOneMigration.  When it returns true, the migration is counted as
+// skipped rather than applied.
+func (m *MigrationBase) SkipIfTx(ctx context.Context, tx *sql.Tx) (bool, error) {
+	if m.skipIfTx == nil {
+		return false, nil
+	}
+	skip, err := m.skipIfTx(ctx, tx)
+	if err != nil {
+		return false, errors.Wrapf(err, "SkipIf %s", m.Name)
+	}
+	if skip {
+		noteSkipped(ctx)
+	}
+	return skip, nil
+}
+
+// HasDedicatedConn returns true if WithDedicatedConn was used
+func (m *MigrationBase) HasDedicatedConn() bool {
+	return m.dedicatedConn
+}
+
+// TxOptions returns the options for the transaction that a migration
+// runs in: the ones from WithTxOptions if set, otherwise
+// Options.MigrationTxOptions.  It is expected to be called by drivers.
+func (d *Database) TxOptions(m Migration) *sql.TxOptions {
+	if opts := m.Base().txOptions; opts != nil {
+		return opts
+	}
+	return d.Options.MigrationTxOptions
+}
+
+// BeginTx starts the transaction that a migration runs in, with the
+// function from WithBeginTx if there is one.  It is expected to be
+// called by drivers.
+func (d *Database) BeginTx(ctx context.Context, m Migration) (*sql.Tx, error) {
+	if begin := m.Base().beginTx; begin != nil {
+		return begin(ctx, d.DB(), d.TxOptions(m))
+	}
+	return d.DB().BeginTx(ctx, d.TxOptions(m))
+}
+
+// DedicatedConn acquires the connection for a migration that uses
+// WithDedicatedConn.  For other migrations, conn is nil.  release
+// discards the connection and does nothing on later calls.  Drivers
+// should defer release before deferring the Commit of the migration
+// (deferred calls run last-in, first-out) so that the connection
+// outlives the transaction.  Drivers should also call release before
+// beginning another transaction, like the one that saves a failure
+// status, so that a pool of one connection does not deadlock.  It is
+// expected to be called by drivers.
+func (d *Database) DedicatedConn(ctx context.Context, m Migration) (conn *sql.Conn, release func(), err error) {
+	if !m.Base().HasDedicatedConn() {
+		return nil, func() {}, nil
+	}
+	conn, err = d.DB().Conn(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Get connection for migration %s", m.Base().Name)
+	}
+	held := conn
+	return conn, func() {
+		if held != nil {
+			internal.DiscardConn(held)
+			held = nil
+		}
+	}, nil
+}
+
+// IsRetryable returns true if the driver is an ErrorClassifier and it
+// considers err to be transient.  Otherwise it returns false.
+func (d *Database) IsRetryable(err error) bool {
+	if ec, ok := d.driver.(ErrorClassifier); ok && err != nil {
+		return ec.IsRetryable(err)
+	}
+	return false
+}
+
+// IsAlreadyExists returns true if the driver is an ErrorClassifier and
+// it considers err to be from creating something that already exists.
+// Otherwise it returns false.
+func (d *Database) IsAlreadyExists(err error) bool {
+	if ec, ok := d.driver.(ErrorClassifier); ok && err != nil {
+		return ec.IsAlreadyExists(err)
+	}
+	return false
+}
+
+// Tags returns the tags set with WithTags
+func (m *MigrationBase) Tags() []string {
+	return m.tags
+}
+
+// Comment returns the comment set with WithComment
+func (m *MigrationBase) Comment() string {
+	return m.comment
+}
+
+// OnlineSafe returns true if WithOnlineSafe(true) was used
+func (m *MigrationBase) OnlineSafe() bool {
+	return m.onlineSafe
 }
 
 func (n MigrationName) String() string {
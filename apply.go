@@ -2,8 +2,11 @@ package libschema
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/muir/libschema/internal"
 
@@ -18,6 +21,11 @@ import (
 //
 // A lock is held while migrations are in progress so that there is no chance of
 // double migrations.
+//
+// Each Database is migrated, under its own lock, in the order that the
+// Databases were created with NewDatabase.  A failure for one Database
+// does not stop the others from being migrated.  If any fail, the
+// returned error is a *DatabaseErrors.
 func (s *Schema) Migrate(ctx context.Context) (err error) {
 	if s.options.Overrides.MigrateOnly {
 		defer func() {
@@ -33,6 +41,7 @@ func (s *Schema) Migrate(ctx context.Context) (err error) {
 	if s.options.Overrides.NoMigrate {
 		return nil
 	}
+	ctx = withRunContext(ctx, s.options.RunID)
 	todo := s.databaseOrder
 	if s.options.Overrides.MigrateDatabase != "" {
 		if d, ok := s.databases[s.options.Overrides.MigrateDatabase]; ok {
@@ -44,43 +53,353 @@ func (s *Schema) Migrate(ctx context.Context) (err error) {
 	if s.options.Overrides.MigrateDSN != "" && len(todo) > 1 {
 		return errors.Errorf("--migrate-dsn can only be used when there is only one database to migrate")
 	}
-	for _, d := range todo {
-		if len(d.errors) != 0 {
-			return multierror.Append(d.errors[0], d.errors[1:]...)
-		}
-		err := func(d *Database) (finalErr error) {
-			if s.options.Overrides.MigrateDSN != "" {
-				var err error
-				d.db, err = OpenAnyDB(s.options.Overrides.MigrateDSN)
-				if err != nil {
-					return errors.Wrap(err, "Could not open database")
-				}
+	err = s.checkLibraryDependencies()
+	if err != nil {
+		return err
+	}
+	err = checkMigrateUpTo(todo)
+	if err != nil {
+		return err
+	}
+	dbErrors := &DatabaseErrors{
+		Results: make(map[string]error, len(todo)),
+	}
+	for i, d := range todo {
+		err := s.migrateDatabase(ctx, d)
+		dbErrors.Results[d.Name] = err
+		if err != nil {
+			dbErrors.Failed = append(dbErrors.Failed, d.Name)
+			if i < len(todo)-1 {
+				d.log.Info("Migrations failed, continuing with other databases", map[string]interface{}{
+					"database": d.Name,
+					"error":    err.Error(),
+				})
 			}
-			err = d.prepare(ctx)
-			if err != nil {
-				return err
+		}
+	}
+	if len(dbErrors.Failed) != 0 {
+		return dbErrors
+	}
+	return nil
+}
+
+func (s *Schema) migrateDatabase(ctx context.Context, d *Database) error {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	if s.options.Overrides.MigrateDSN != "" {
+		var err error
+		d.db, err = OpenAnyDB(s.options.Overrides.MigrateDSN)
+		if err != nil {
+			return errors.Wrap(err, "Could not open database")
+		}
+	}
+	return d.lockAndMigrate(ctx, s.options.Overrides.ErrorIfMigrateNeeded)
+}
+
+// lockAndMigrate runs the migrations that are not done while holding the
+// migration lock.  With errorIfMigrateNeeded, it returns an error instead
+// of running them.
+func (d *Database) lockAndMigrate(ctx context.Context, errorIfMigrateNeeded bool) (finalErr error) {
+	ctx = d.withContextValues(ctx)
+	err := d.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := d.unlock()
+		if err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+	if errorIfMigrateNeeded && !d.done(d.parent) {
+		return errors.Errorf("Migrations required for %s", d.Name)
+	}
+	return d.migrate(ctx, d.parent)
+}
+
+// MigrateOne applies a single migration, under the migration lock, and
+// nothing else.  It is meant for incident response when running all
+// pending migrations is not wanted.  Every migration that the named
+// migration depends upon must already be done: otherwise it returns an
+// error without running anything.  Migrations that are not done but
+// have a SkipIf or WithContinueOnError are not required.
+// Tags (Options.OnlyTags and Options.SkipTags) are ignored.  If the
+// migration is already done, MigrateOne does nothing.
+func (d *Database) MigrateOne(ctx context.Context, name MigrationName) (finalErr error) {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	m, ok := d.Lookup(name)
+	if !ok {
+		return errors.Errorf("Migration %s is not registered with database %s", name, d.Name)
+	}
+	ctx = d.withContextValues(withRunContext(ctx, d.Options.RunID))
+	err := d.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := d.unlock()
+		if err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+	err = d.checkUnknownMigrations()
+	if err != nil {
+		return err
+	}
+	if m.Base().Status().Done {
+		d.log.Info("Migration already done", map[string]interface{}{
+			"database": d.Name,
+			"library":  name.Library,
+			"name":     name.Name,
+		})
+		return nil
+	}
+	if missing := d.notDoneBefore(m); len(missing) != 0 {
+		return errors.Errorf("Migration %s depends upon migrations that are not done: %s", name, strings.Join(missing, ", "))
+	}
+	d.log.Info("Applying one migration", map[string]interface{}{
+		"database": d.Name,
+		"library":  name.Library,
+		"name":     name.Name,
+	})
+	_, err = d.doOneMigration(ctx, m)
+	return err
+}
+
+// TimeoutError is returned by MigrateWithin when time runs out
+type TimeoutError struct {
+	Database string
+	Timeout  time.Duration
+	// Locking is true if time ran out before the migration lock was
+	// acquired, false if it ran out while migrations were running.
+	Locking bool
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Locking {
+		return fmt.Sprintf("database %s: could not get the migration lock within %s: %s", e.Database, e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("database %s: migrations did not finish within %s: %s", e.Database, e.Timeout, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// MigrateWithin migrates one Database, like Migrate, but gives up
+// after timeout.  The timeout covers getting the migration lock and
+// running the migrations.  If time runs out, the error is a
+// *TimeoutError that says if the lock was acquired.  Other errors, like
+// a migration failing, are returned as-is.  Asynchronous migrations
+// that are still running when MigrateWithin returns are also stopped
+// when time runs out.  The migration lock is released when MigrateWithin
+// returns, not when time runs out, so drivers must not tie the lock to
+// ctx.  Like MigrateOne, MigrateWithin does not act on OverrideOptions:
+// it uses the database it was given and runs the migrations even when
+// ErrorIfMigrateNeeded is set.
+func (d *Database) MigrateWithin(ctx context.Context, timeout time.Duration) (err error) {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	err = d.parent.checkLibraryDependencies()
+	if err != nil {
+		return err
+	}
+	err = checkMigrateUpTo([]*Database{d})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer func() {
+		if !d.asyncInProgress {
+			cancel()
+		}
+	}()
+	d.lockAcquired = false
+	err = d.lockAndMigrate(withRunContext(ctx, d.Options.RunID), false)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{
+			Database: d.Name,
+			Timeout:  timeout,
+			Locking:  !d.lockAcquired,
+			Err:      err,
+		}
+	}
+	return err
+}
+
+// notDoneBefore returns the names of the migrations that m depends upon,
+// directly or indirectly, that are not done.  Migrations that have a
+// SkipIf or WithContinueOnError are looked past.
+func (d *Database) notDoneBefore(m Migration) []string {
+	var missing []string
+	visited := make(map[int]bool)
+	todo := append([]int{}, d.blockedBy[m.Base().order]...)
+	for len(todo) > 0 {
+		b := todo[0]
+		todo = todo[1:]
+		if visited[b] {
+			continue
+		}
+		visited[b] = true
+		blocker := d.migrations[b].Base()
+		if blocker.Status().Done {
+			continue
+		}
+		todo = append(todo, d.blockedBy[b]...)
+		if !blocker.HasSkipIf() && !blocker.continueOnError {
+			missing = append(missing, blocker.Name.String())
+		}
+	}
+	return missing
+}
+
+// DatabaseErrors is returned by Schema.Migrate when the migrations for
+// one or more Databases fail.
+type DatabaseErrors struct {
+	// Results has an entry for each Database that Migrate attempted.
+	// The error is nil for the Databases that succeeded.
+	Results map[string]error
+
+	// Failed lists the names of the Databases that failed, in the
+	// order that they were migrated.
+	Failed []string
+}
+
+func (e *DatabaseErrors) Error() string {
+	messages := make([]string, len(e.Failed))
+	for i, name := range e.Failed {
+		messages[i] = fmt.Sprintf("database %s: %s", name, e.Results[name])
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the error of the first Database that failed
+func (e *DatabaseErrors) Unwrap() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e.Results[e.Failed[0]]
+}
+
+// checkLibraryDependencies validates the dependencies declared with
+// LibraryAfter: the libraries must exist and there cannot be cycles.
+func (s *Schema) checkLibraryDependencies() error {
+	if len(s.libraryAfter) == 0 {
+		return nil
+	}
+	index := make(map[string]int)
+	var names []string
+	for _, d := range s.databaseOrder {
+		for _, library := range d.libraries {
+			if _, ok := index[library]; !ok {
+				index[library] = len(names)
+				names = append(names, library)
 			}
-			defer func() {
-				err := d.unlock()
-				if err != nil && finalErr == nil {
-					finalErr = err
-				}
-			}()
-			if s.options.Overrides.ErrorIfMigrateNeeded && !d.done(s) {
-				return errors.Errorf("Migrations required for %s", d.Name)
+		}
+	}
+	nodes := make([]dgorder.Node, len(names))
+	for _, dep := range s.libraryAfter {
+		for _, library := range []string{dep.library, dep.after} {
+			if _, ok := index[library]; !ok {
+				return errors.Errorf("Library '%s' (used in LibraryAfter) is not registered with any database", library)
 			}
-			return d.migrate(ctx, s)
-		}(d)
+		}
+		nodes[index[dep.after]].Blocking = append(nodes[index[dep.after]].Blocking, index[dep.library])
+	}
+	_, err := dgorder.Order(nodes, func(i int) string {
+		return "library " + names[i]
+	})
+	return err
+}
+
+func (d *Database) withContextValues(ctx context.Context) context.Context {
+	for k, v := range d.Options.ContextValues {
+		ctx = context.WithValue(ctx, k, v)
+	}
+	return ctx
+}
+
+func (d *Database) prepare(ctx context.Context) error {
+	err := d.checkTrackingDB()
+	if err != nil {
+		return err
+	}
+	err = d.computeSequence()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range d.migrations {
+		err = d.driver.IsMigrationSupported(d, d.log, m)
 		if err != nil {
 			return err
 		}
 	}
-	return
+
+	err = d.driver.CreateSchemaTableIfNotExists(ctx, d.log, d)
+	if err != nil {
+		return err
+	}
+
+	if d.Options.WithoutMigrationLock {
+		d.log.Warn("Running migrations without a lock", map[string]interface{}{
+			"database": d.Name,
+		})
+		d.lockAcquired = true
+	} else {
+		start := time.Now()
+		err = d.driver.LockMigrationsTable(ctx, d.log, d)
+		wait := time.Since(start)
+		if d.Options.OnMigrationLock != nil {
+			d.Options.OnMigrationLock(d, wait, err)
+		}
+		if err != nil {
+			return err
+		}
+		d.lockAcquired = true
+		d.log.Info("Got migrations lock", map[string]interface{}{
+			"database": d.Name,
+			"wait":     wait.String(),
+		})
+	}
+
+	d.unknownMigrations, err = d.driver.LoadStatus(ctx, d.log, d)
+	if err != nil {
+		// Callers only unlock after prepare succeeds so the lock must
+		// be released here or it is held for the rest of the process.
+		unlockErr := d.unlock()
+		if unlockErr != nil {
+			d.log.Warn("Could not release migrations lock", map[string]interface{}{
+				"database": d.Name,
+				"error":    unlockErr.Error(),
+			})
+		}
+		return err
+	}
+
+	d.holdBack()
+	return nil
 }
 
-func (d *Database) prepare(ctx context.Context) error {
-	var err error
+func (d *Database) checkTrackingDB() error {
+	if d.trackingDB == nil {
+		return nil
+	}
+	if _, ok := d.driver.(TrackingDBSupporter); !ok {
+		return errors.Errorf("The driver for %s does not support SetTrackingDB", d.Name)
+	}
+	return nil
+}
+
+// computeSequence resolves the dependencies between migrations and
+// determines the order in which they will be run.
+func (d *Database) computeSequence() error {
 	nodes := make([]dgorder.Node, len(d.migrations))
+	d.blockedBy = make([][]int, len(d.migrations))
 	for i, migration := range d.migrations {
 		for _, ref := range migration.Base().rawAfter {
 			after, ok := d.migrationIndex[ref]
@@ -89,12 +408,24 @@ func (d *Database) prepare(ctx context.Context) error {
 					migration.Base().Name.Name, migration.Base().Name.Library, ref.Name, ref.Library)
 			}
 			nodes[after.Base().order].Blocking = append(nodes[after.Base().order].Blocking, migration.Base().order)
+			d.blockedBy[migration.Base().order] = append(d.blockedBy[migration.Base().order], after.Base().order)
 		}
 		if i < len(d.migrations)-1 && migration.Base().Name.Library == d.migrations[i+1].Base().Name.Library {
 			nodes[i].Blocking = append(nodes[i].Blocking, i+1)
+			d.blockedBy[i+1] = append(d.blockedBy[i+1], i)
 		}
 
 	}
+	for _, dep := range d.parent.libraryAfter {
+		later, earlier := d.byLibrary[dep.library], d.byLibrary[dep.after]
+		if len(later) == 0 || len(earlier) == 0 {
+			continue
+		}
+		from := earlier[len(earlier)-1].Base().order
+		to := later[0].Base().order
+		nodes[from].Blocking = append(nodes[from].Blocking, to)
+		d.blockedBy[to] = append(d.blockedBy[to], from)
+	}
 	executionOrder, err := dgorder.Order(nodes, func(i int) string {
 		return d.migrations[i].Base().Name.String()
 	})
@@ -114,29 +445,117 @@ func (d *Database) prepare(ctx context.Context) error {
 			})
 		}
 	}
+	return nil
+}
 
-	err = d.driver.CreateSchemaTableIfNotExists(ctx, d.log, d)
-	if err != nil {
-		return err
+// checkMigrateUpTo verifies that Options.MigrateUpTo names a migration
+// in at least one of the Databases
+func checkMigrateUpTo(todo []*Database) error {
+	var missing MigrationName
+	for _, d := range todo {
+		name := d.Options.MigrateUpTo
+		if name == (MigrationName{}) {
+			continue
+		}
+		if _, ok := d.Lookup(name); ok {
+			return nil
+		}
+		missing = name
 	}
+	if missing != (MigrationName{}) {
+		return errors.Errorf("MigrateUpTo migration %s is not registered", missing)
+	}
+	return nil
+}
 
-	err = d.driver.LockMigrationsTable(ctx, d.log, d)
-	if err != nil {
-		return err
+// holdBack marks the migrations that will not be run because they
+// are excluded by the Options, because they come after
+// Options.MigrateUpTo, or because they depend upon a migration
+// that is excluded and not done.  It must be called after the status
+// has been loaded.
+func (d *Database) holdBack() {
+	d.held = make([]bool, len(d.migrations))
+	upTo := -1
+	if d.Options.MigrateUpTo != (MigrationName{}) {
+		for i, m := range d.sequence {
+			if m.Base().Name == d.Options.MigrateUpTo {
+				upTo = i
+				break
+			}
+		}
+	}
+	for i, m := range d.sequence {
+		base := m.Base()
+		if base.Status().Done {
+			continue
+		}
+		if !d.wanted(m) {
+			d.held[base.order] = true
+			d.log.Info("Migration excluded", map[string]interface{}{
+				"database": d.Name,
+				"library":  base.Name.Library,
+				"name":     base.Name.Name,
+			})
+			continue
+		}
+		if upTo != -1 && i > upTo {
+			d.held[base.order] = true
+			d.log.Info("Migration held back by MigrateUpTo", map[string]interface{}{
+				"database": d.Name,
+				"library":  base.Name.Library,
+				"name":     base.Name.Name,
+			})
+			continue
+		}
+		for _, b := range d.blockedBy[base.order] {
+			if d.held[b] {
+				d.held[base.order] = true
+				d.log.Info("Migration held back by excluded dependency", map[string]interface{}{
+					"database":  d.Name,
+					"library":   base.Name.Library,
+					"name":      base.Name.Name,
+					"dependsOn": d.migrations[b].Base().Name.String(),
+				})
+				break
+			}
+		}
 	}
+}
 
-	d.unknownMigrations, err = d.driver.LoadStatus(ctx, d.log, d)
-	if err != nil {
-		return err
+// wanted applies the run-time filters in Options
+func (d *Database) wanted(m Migration) bool {
+	tags := m.Base().tags
+	if len(d.Options.OnlyTags) != 0 && !anyTag(tags, d.Options.OnlyTags) {
+		return false
+	}
+	if anyTag(tags, d.Options.SkipTags) {
+		return false
+	}
+	if d.Options.MigrationFilter != nil && !d.Options.MigrationFilter(m) {
+		return false
 	}
+	return true
+}
 
-	return nil
+func anyTag(tags []string, want []string) bool {
+	for _, tag := range tags {
+		for _, w := range want {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *Database) isHeld(m Migration) bool {
+	return d.held != nil && d.held[m.Base().order]
 }
 
 func (d *Database) done(s *Schema) bool {
 	lastUnfishedSyncronous := d.lastUnfinishedSynchrnous()
 	for i, m := range d.sequence {
-		if m.Base().Status().Done {
+		if m.Base().Status().Done || d.isHeld(m) {
 			continue
 		}
 		if m.Base().async && i > lastUnfishedSyncronous && !s.options.Overrides.EverythingSynchronous {
@@ -150,9 +569,29 @@ func (d *Database) done(s *Schema) bool {
 	return true
 }
 
-func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
+// checkUnknownMigrations applies OnUnknownMigration and
+// ErrorOnUnknownMigrations to the status that prepare loaded under the
+// migration lock.
+func (d *Database) checkUnknownMigrations() error {
+	if d.Options.OnUnknownMigration != nil {
+		for _, name := range d.unknownMigrations {
+			err := d.Options.OnUnknownMigration(d, name)
+			if err != nil {
+				return errors.Wrapf(err, "unknown migration %s", name)
+			}
+		}
+	}
 	if d.Options.ErrorOnUnknownMigrations && len(d.unknownMigrations) > 0 {
-		return errors.Errorf("%d unknown migrations, including %s", len(d.unknownMigrations), d.unknownMigrations[0])
+		return errors.Errorf("%d unknown migrations, including %s: refusing to migrate with code that is older than the database",
+			len(d.unknownMigrations), d.unknownMigrations[0])
+	}
+	return nil
+}
+
+func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
+	err = d.checkUnknownMigrations()
+	if err != nil {
+		return err
 	}
 
 	defer func() {
@@ -161,6 +600,26 @@ func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
 		}
 	}()
 
+	d.failed = make([]bool, len(d.migrations))
+	d.summary = runSummary{start: time.Now()}
+	for _, m := range d.sequence {
+		switch {
+		case m.Base().Status().Done:
+			d.summary.alreadyDone++
+		case d.isHeld(m):
+			d.summary.skipped++
+		}
+	}
+	var failures *multierror.Error
+	defer func() {
+		if failures != nil {
+			if err != nil {
+				failures = multierror.Append(failures, err)
+			}
+			err = failures
+		}
+	}()
+
 	if d.done(s) {
 		d.log.Info("No migrations needed", map[string]interface{}{
 			"database": d.Name,
@@ -190,6 +649,9 @@ func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
 
 			continue
 		}
+		if d.isHeld(m) {
+			continue
+		}
 		if m.Base().async && i > lastUnfishedSyncronous && !s.options.Overrides.EverythingSynchronous {
 			// This and all following migrations are async
 			d.log.Info("The remaining migrations are async starting from", map[string]interface{}{
@@ -205,6 +667,10 @@ func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
 		}
 		var stop bool
 		stop, err = d.doOneMigration(ctx, m)
+		if err != nil && d.continuePastFailure(m, err) {
+			failures = multierror.Append(failures, err)
+			continue
+		}
 		if err != nil || stop {
 			return err
 		}
@@ -212,7 +678,43 @@ func (d *Database) migrate(ctx context.Context, s *Schema) (err error) {
 	return nil
 }
 
-func (d *Database) doOneMigration(ctx context.Context, m Migration) (bool, error) {
+// continuePastFailure reports whether the remaining migrations should
+// run even though m failed: only if m has WithContinueOnError.
+func (d *Database) continuePastFailure(m Migration, err error) bool {
+	if !m.Base().continueOnError {
+		return false
+	}
+	d.failed[m.Base().order] = true
+	d.log.Warn("Migration failed, continuing with the remaining migrations", map[string]interface{}{
+		"database": d.Name,
+		"library":  m.Base().Name.Library,
+		"name":     m.Base().Name.Name,
+		"error":    err.Error(),
+	})
+	return true
+}
+
+// runSummary counts what happened to the migrations in a Migrate()
+type runSummary struct {
+	start       time.Time
+	applied     int
+	skipped     int // SkipIf, WithSkipIf, SkipRemainingIf, ErrSkipped, and held back
+	alreadyDone int
+	failed      int
+}
+
+func (d *Database) doOneMigration(ctx context.Context, m Migration) (stop bool, err error) {
+	var skipped bool
+	defer func() {
+		switch {
+		case err != nil:
+			d.summary.failed++
+		case skipped:
+			d.summary.skipped++
+		default:
+			d.summary.applied++
+		}
+	}()
 	if d.Options.DebugLogging {
 		d.log.Debug("Starting migration", map[string]interface{}{
 			"database": d.Name,
@@ -220,8 +722,13 @@ func (d *Database) doOneMigration(ctx context.Context, m Migration) (bool, error
 			"name":     m.Base().Name.Name,
 		})
 	}
-	if err := d.driver.IsMigrationSupported(d, d.log, m); err != nil {
-		return false, err
+	if status := m.Base().Status(); status.Error != "" {
+		d.log.Warn("Last attempt failed, retrying", map[string]interface{}{
+			"database": d.Name,
+			"library":  m.Base().Name.Library,
+			"name":     m.Base().Name.Name,
+			"error":    status.Error,
+		})
 	}
 	if m.Base().skipIf != nil {
 		skip, err := m.Base().skipIf()
@@ -229,6 +736,7 @@ func (d *Database) doOneMigration(ctx context.Context, m Migration) (bool, error
 			return false, errors.Wrapf(err, "SkipIf %s", m.Base().Name)
 		}
 		if skip {
+			skipped = true
 			return false, nil
 		}
 	}
@@ -238,15 +746,24 @@ func (d *Database) doOneMigration(ctx context.Context, m Migration) (bool, error
 			return false, errors.Wrapf(err, "SkipRemainingIf %s", m.Base().Name)
 		}
 		if skip {
+			skipped = true
 			return true, nil
 		}
 	}
+	d.setCurrent(m.Base().Name)
+	defer d.setCurrent(MigrationName{})
+	ctx = withProgress(ctx, d, m.Base().Name)
+	ctx, computedSkip := withSkipped(ctx)
 	var repeatCount int
 	for {
 		result, err := d.driver.DoOneMigration(ctx, d.log, d, m)
 		if err != nil && d.Options.OnMigrationFailure != nil {
 			d.Options.OnMigrationFailure(d, m.Base().Name, err)
 		}
+		if err == nil && *computedSkip {
+			skipped = true
+			return false, nil
+		}
 		if m.Base().repeatUntilNoOp && err == nil && result != nil {
 			ra, err := result.RowsAffected()
 			if err != nil {
@@ -273,6 +790,9 @@ func (d *Database) lastUnfinishedSynchrnous() int {
 		if ok && s.Done {
 			continue
 		}
+		if d.isHeld(m) {
+			continue
+		}
 		if m.Base().async {
 			continue
 		}
@@ -289,21 +809,26 @@ func (d *Database) allDone(m Migration, err error) {
 	if d.Options.OnMigrationsComplete != nil {
 		d.Options.OnMigrationsComplete(d, err)
 	}
+	fields := map[string]interface{}{
+		"database":    d.Name,
+		"applied":     d.summary.applied,
+		"skipped":     d.summary.skipped,
+		"alreadyDone": d.summary.alreadyDone,
+		"failed":      d.summary.failed,
+		"duration":    time.Since(d.summary.start).String(),
+	}
 	if err == nil {
-		d.log.Info("Migrations complete", map[string]interface{}{
-			"database": d.Name,
-		})
+		d.log.Info("Migrations complete", fields)
 	} else {
-		d.log.Info("Migrations failed", map[string]interface{}{
-			"database": d.Name,
-			"error":    err,
-		})
+		fields["error"] = err
+		d.log.Info("Migrations failed", fields)
 	}
 }
 
 func (d *Database) asyncMigrate(ctx context.Context) {
 	var err error
 	var m Migration
+	var failures *multierror.Error
 	d.log.Info("Starting async migrations")
 	defer func() {
 		d.asyncInProgress = false
@@ -311,15 +836,27 @@ func (d *Database) asyncMigrate(ctx context.Context) {
 		if err == nil {
 			err = e
 		}
+		if failures != nil {
+			if err != nil {
+				failures = multierror.Append(failures, err)
+			}
+			err = failures
+			m = nil
+		}
 		d.allDone(m, err)
 		d.log.Info("Done with async migrations")
 	}()
 	for _, m = range d.sequence {
-		if m.Base().Status().Done {
+		if m.Base().Status().Done || d.isHeld(m) || d.failed[m.Base().order] {
 			continue
 		}
 		var stop bool
 		stop, err = d.doOneMigration(ctx, m)
+		if err != nil && d.continuePastFailure(m, err) {
+			failures = multierror.Append(failures, err)
+			err = nil
+			continue
+		}
 		if err != nil || stop {
 			return
 		}
@@ -327,6 +864,9 @@ func (d *Database) asyncMigrate(ctx context.Context) {
 }
 
 func (d *Database) unlock() error {
+	if d.Options.WithoutMigrationLock {
+		return nil
+	}
 	if !d.asyncInProgress {
 		return d.driver.UnlockMigrationsTable(d.log)
 	}
@@ -0,0 +1,925 @@
+package libschema_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver is an in-memory libschema.Driver that records
+// which migrations are run
+type fakeDriver struct {
+	applied   []string
+	baselined []string
+	done      map[libschema.MigrationName]bool
+	locked    bool
+	locks     int
+	lockErr   error
+	lockWait  bool // LockMigrationsTable waits for ctx to be done
+	writeErr  error
+	current   []libschema.MigrationName
+}
+
+type fakeMigration struct {
+	libschema.MigrationBase
+	action func(context.Context) error
+	script string
+}
+
+func (m *fakeMigration) Base() *libschema.MigrationBase { return &m.MigrationBase }
+
+func (m *fakeMigration) Copy() libschema.Migration {
+	return &fakeMigration{MigrationBase: m.MigrationBase.Copy(), action: m.action, script: m.script}
+}
+
+func fake(name string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := &fakeMigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// fakeAction is a fake migration that calls action when it is run
+func fakeAction(name string, action func(context.Context) error, opts ...libschema.MigrationOption) libschema.Migration {
+	m := fake(name, opts...)
+	m.(*fakeMigration).action = action
+	return m
+}
+
+// fakeScript is a fake migration that has a script for validators
+func fakeScript(name string, script string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := fake(name, opts...)
+	m.(*fakeMigration).script = script
+	return m
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{
+		done: make(map[libschema.MigrationName]bool),
+	}
+}
+
+func (f *fakeDriver) CreateSchemaTableIfNotExists(context.Context, *internal.Log, *libschema.Database) error {
+	return nil
+}
+
+func (f *fakeDriver) LockMigrationsTable(ctx context.Context, _ *internal.Log, _ *libschema.Database) error {
+	if f.lockWait {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.lockErr != nil {
+		return f.lockErr
+	}
+	f.locked = true
+	f.locks++
+	return nil
+}
+
+func (f *fakeDriver) UnlockMigrationsTable(*internal.Log) error {
+	f.locked = false
+	return nil
+}
+
+func (f *fakeDriver) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (sql.Result, error) {
+	f.current = append(f.current, d.Current())
+	skip, err := m.Base().SkipIfTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if action := m.(*fakeMigration).action; action != nil && !skip {
+		if err := libschema.ComputedResult(ctx, log, m.Base().Name, action(ctx)); err != nil {
+			return nil, err
+		}
+	}
+	f.applied = append(f.applied, m.Base().Name.String())
+	f.done[m.Base().Name] = true
+	m.Base().SetStatus(libschema.MigrationStatus{Done: true})
+	return nil, nil
+}
+
+func (f *fakeDriver) IsMigrationSupported(d *libschema.Database, _ *internal.Log, m libschema.Migration) error {
+	return d.ValidateMigration(m, m.(*fakeMigration).script)
+}
+
+func (f *fakeDriver) LoadStatus(_ context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	var unknowns []libschema.MigrationName
+	for name, done := range f.done {
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(libschema.MigrationStatus{Done: done})
+		} else if done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+func (f *fakeDriver) MarkMigrationDone(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration) error {
+	f.baselined = append(f.baselined, m.Base().Name.String())
+	f.done[m.Base().Name] = true
+	return nil
+}
+
+func (f *fakeDriver) CheckTrackingTableWrite(context.Context, *internal.Log, *libschema.Database) error {
+	return f.writeErr
+}
+
+func (f *fakeDriver) SetMigrationStatus(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration, done bool) error {
+	f.done[m.Base().Name] = done
+	return nil
+}
+
+func (f *fakeDriver) RenderScript(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration) (string, bool, error) {
+	fm := m.(*fakeMigration)
+	return fm.script, fm.action != nil, nil
+}
+
+func (f *fakeDriver) DropTrackingTable(context.Context, *internal.Log, *libschema.Database) error {
+	f.done = make(map[libschema.MigrationName]bool)
+	return nil
+}
+
+func fakeSchema(t *testing.T, options libschema.Options, driver *fakeDriver, define func(*libschema.Database)) *libschema.Schema {
+	s := libschema.New(context.Background(), options)
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	define(dbase)
+	return s
+}
+
+func TestTags(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("schema1", libschema.WithTags("schema")),
+			fake("backfill1", libschema.WithTags("data")),
+			fake("schema2", libschema.WithTags("schema")),
+		)
+		dbase.Migrations("L2",
+			fake("schema3", libschema.WithTags("schema")),
+			fake("backfill2", libschema.WithTags("data"), libschema.After("L1", "schema1")),
+		)
+		dbase.Migrations("L3",
+			fake("schema4", libschema.WithTags("schema", "other"), libschema.After("L2", "backfill2")),
+		)
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{
+		SkipTags: []string{"data"},
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: schema1",
+		"L2: schema3",
+	}, driver.applied, "skip data")
+
+	t.Log("held back migrations run later")
+	driver.applied = nil
+	s = fakeSchema(t, libschema.Options{}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: backfill1",
+		"L1: schema2",
+		"L2: backfill2",
+		"L3: schema4",
+	}, driver.applied, "second run")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{
+		OnlyTags: []string{"schema"},
+		SkipTags: []string{"other"},
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: schema1",
+		"L2: schema3",
+	}, driver.applied, "only schema")
+}
+
+func TestMigrationFilter(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+			fake("a2"),
+		)
+		dbase.Migrations("L2",
+			fake("b1"),
+			fake("b2", libschema.After("L1", "a2")),
+		)
+		dbase.Migrations("L3",
+			fake("c1"),
+		)
+	}
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{
+		MigrationFilter: func(m libschema.Migration) bool {
+			return m.Base().Name.Name != "a2"
+		},
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: a1", "L2: b1", "L3: c1"}, driver.applied, "a2 and b2 excluded")
+	assert.False(t, driver.done[libschema.MigrationName{Library: "L1", Name: "a2"}], "not marked done")
+
+	driver.applied = nil
+	s = fakeSchema(t, libschema.Options{
+		MigrationFilter: func(libschema.Migration) bool { return true },
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: a2", "L2: b2"}, driver.applied, "second run")
+}
+
+func TestMigrationString(t *testing.T) {
+	m := fake("a1")
+	m.Base().Name.Library = "L1"
+	assert.Equal(t, "L1: a1", fmt.Sprint(m))
+
+	m = fake("a2", libschema.Asynchronous(), libschema.WithTags("data", "slow"), libschema.After("L0", "z9"))
+	m.Base().Name.Library = "L1"
+	assert.Equal(t, "L1: a2 [async, tags=data,slow, after=L0: z9]", fmt.Sprint(m))
+	assert.Equal(t, "L1: a2 [script, async, tags=data,slow, after=L0: z9]", m.Base().Describe("script"))
+}
+
+func TestOnMigrationLock(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1", fake("a1"))
+	}
+	var calls int
+	var lockErr error
+	options := libschema.Options{
+		OnMigrationLock: func(_ *libschema.Database, wait time.Duration, err error) {
+			calls++
+			lockErr = err
+			assert.GreaterOrEqual(t, int64(wait), int64(0))
+		},
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, options, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 1, calls)
+	assert.NoError(t, lockErr)
+
+	driver = newFakeDriver()
+	driver.lockErr = errors.New("lock wait timeout")
+	s = fakeSchema(t, options, driver, define)
+	assert.Error(t, s.Migrate(context.Background()))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, driver.lockErr, lockErr)
+	assert.Empty(t, driver.applied)
+
+	options.WithoutMigrationLock = true
+	s = fakeSchema(t, options, newFakeDriver(), define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 2, calls, "not called without a lock")
+}
+
+func TestMigrateWithin(t *testing.T) {
+	newDatabase := func(driver *fakeDriver, migrations ...libschema.Migration) *libschema.Database {
+		s := libschema.New(context.Background(), libschema.Options{})
+		dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+		require.NoError(t, err)
+		dbase.Migrations("L1", migrations...)
+		return dbase
+	}
+
+	driver := newFakeDriver()
+	dbase := newDatabase(driver, fake("a1"), fake("a2"))
+	require.NoError(t, dbase.MigrateWithin(context.Background(), time.Minute))
+	assert.Equal(t, []string{"L1: a1", "L1: a2"}, driver.applied)
+
+	driver = newFakeDriver()
+	driver.lockWait = true
+	dbase = newDatabase(driver, fake("a1"))
+	err := dbase.MigrateWithin(context.Background(), 10*time.Millisecond)
+	var timeoutErr *libschema.TimeoutError
+	require.True(t, errors.As(err, &timeoutErr), "%+v", err)
+	assert.True(t, timeoutErr.Locking)
+	assert.Contains(t, err.Error(), "could not get the migration lock within 10ms")
+	assert.Empty(t, driver.applied)
+
+	driver = newFakeDriver()
+	dbase = newDatabase(driver, fakeAction("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	err = dbase.MigrateWithin(context.Background(), 10*time.Millisecond)
+	require.True(t, errors.As(err, &timeoutErr), "%+v", err)
+	assert.False(t, timeoutErr.Locking)
+	assert.Contains(t, err.Error(), "migrations did not finish within 10ms")
+
+	driver = newFakeDriver()
+	dbase = newDatabase(driver, fakeAction("broken", func(context.Context) error {
+		return errors.New("bad migration")
+	}))
+	err = dbase.MigrateWithin(context.Background(), time.Minute)
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &timeoutErr), "not a timeout")
+
+	driver = newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{
+		Overrides: &libschema.OverrideOptions{ErrorIfMigrateNeeded: true},
+	})
+	dbase, err = s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1", fake("a1"))
+	require.NoError(t, dbase.MigrateWithin(context.Background(), time.Minute), "overrides are not used")
+	assert.Equal(t, []string{"L1: a1"}, driver.applied)
+}
+
+func TestMigrateUpTo(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+			fake("a2"),
+			fake("a3"),
+		)
+		dbase.Migrations("L2",
+			fake("b1"),
+			fake("b2", libschema.After("L1", "a3")),
+		)
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{
+		MigrateUpTo: libschema.MigrationName{Library: "L1", Name: "a2"},
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: a1",
+		"L1: a2",
+	}, driver.applied, "phase 1")
+
+	t.Log("the rest run later")
+	driver.applied = nil
+	s = fakeSchema(t, libschema.Options{}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: a3",
+		"L2: b1",
+		"L2: b2",
+	}, driver.applied, "phase 2")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{
+		MigrateUpTo: libschema.MigrationName{Library: "L1", Name: "a4"},
+	}, driver, define)
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "L1: a4 is not registered")
+	}
+	assert.Empty(t, driver.applied, "nothing runs")
+	assert.Zero(t, driver.locks, "not locked")
+}
+
+func TestDuplicateMigrationNames(t *testing.T) {
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("initial_schema"),
+			fake("a2"),
+		)
+		dbase.Migrations("L2",
+			fake("initial_schema"),
+			fake("b2"),
+			fake("b2"),
+			fake("initial_schema"),
+		)
+	})
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "library 'L2' has duplicate migration names: 'b2', 'initial_schema'")
+		assert.NotContains(t, err.Error(), "'L1'", "same name in different libraries is fine")
+	}
+	assert.Empty(t, driver.applied)
+}
+
+func TestWithBeginTx(t *testing.T) {
+	var gotOpts *sql.TxOptions
+	begin := libschema.WithBeginTx(func(_ context.Context, _ *sql.DB, opts *sql.TxOptions) (*sql.Tx, error) {
+		gotOpts = opts
+		return nil, errors.New("app tx")
+	})
+	readCommitted := &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+	var dbase *libschema.Database
+	fakeSchema(t, libschema.Options{}, newFakeDriver(), func(d *libschema.Database) {
+		dbase = d
+		d.Migrations("L1", fake("a1", begin, libschema.WithTxOptions(readCommitted)))
+	})
+	m, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "a1"})
+	require.True(t, ok)
+	_, err := dbase.BeginTx(context.Background(), m)
+	assert.EqualError(t, err, "app tx")
+	assert.Equal(t, readCommitted, gotOpts)
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, func(d *libschema.Database) {
+		d.Migrations("L1", fake("a1", begin, libschema.WithDedicatedConn()))
+	})
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "WithBeginTx cannot be combined with WithDedicatedConn")
+	}
+	assert.Empty(t, driver.applied)
+}
+
+func TestLibraryOrder(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+			fake("a2"),
+		)
+		dbase.Migrations("L2",
+			fake("b1"),
+			fake("b2"),
+		)
+		dbase.Migrations("L3",
+			fake("c1"),
+		)
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, define)
+	s.LibraryOrder("L3", "L2", "L1")
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L3: c1",
+		"L2: b1",
+		"L2: b2",
+		"L1: a1",
+		"L1: a2",
+	}, driver.applied, "reversed")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{}, driver, define)
+	s.LibraryAfter("L1", "L3")
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L2: b1",
+		"L2: b2",
+		"L3: c1",
+		"L1: a1",
+		"L1: a2",
+	}, driver.applied, "L1 after L3")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{}, driver, define)
+	s.LibraryAfter("L1", "L2")
+	s.LibraryAfter("L2", "L3")
+	s.LibraryAfter("L3", "L1")
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err, "cycle") {
+		assert.Contains(t, err.Error(), "Circular dependency")
+	}
+	assert.Empty(t, driver.applied, "cycle")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{}, driver, define)
+	s.LibraryAfter("L1", "L4")
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err, "unknown") {
+		assert.Contains(t, err.Error(), "not registered")
+	}
+}
+
+func TestWithoutMigrationLock(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+		)
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 1, driver.locks, "locked by default")
+	assert.False(t, driver.locked, "unlocked")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{
+		WithoutMigrationLock: true,
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 0, driver.locks, "no lock")
+	assert.Equal(t, []string{"L1: a1"}, driver.applied)
+}
+
+func TestWithSkipIf(t *testing.T) {
+	m := fake("m1")
+	assert.False(t, m.Base().HasSkipIf())
+	skip, err := m.Base().SkipIfTx(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.False(t, skip)
+
+	m = fake("m2", libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+		return true, nil
+	}))
+	assert.True(t, m.Base().HasSkipIf())
+	assert.True(t, m.Base().HasSkipIfTx())
+	skip, err = m.Base().SkipIfTx(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.True(t, skip)
+
+	m = fake("m3", libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+		return true, errors.New("oops")
+	}))
+	_, err = m.Base().SkipIfTx(context.Background(), nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "m3")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2"),
+	)
+	assert.Equal(t, libschema.MigrationName{}, dbase.Current(), "before")
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []libschema.MigrationName{
+		{Library: "L1", Name: "a1"},
+		{Library: "L1", Name: "a2"},
+	}, driver.current, "during")
+	assert.Equal(t, libschema.MigrationName{}, dbase.Current(), "after")
+}
+
+func TestMigrateMultipleDatabases(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{})
+	logur := &infoLogur{info: make(map[string]map[string]interface{})}
+	log := libschema.LogFromLogur(logur)
+	driver1 := newFakeDriver()
+	primary, err := s.NewDatabase(log, "primary", nil, driver1)
+	require.NoError(t, err)
+	driver2 := newFakeDriver()
+	reporting, err := s.NewDatabase(log, "reporting", nil, driver2)
+	require.NoError(t, err)
+	driver3 := newFakeDriver()
+	archive, err := s.NewDatabase(log, "archive", nil, driver3)
+	require.NoError(t, err)
+
+	primary.Migrations("L1",
+		fakeAction("a1", func(context.Context) error {
+			return errors.New("primary broke")
+		}),
+	)
+	reporting.Migrations("L1", fake("r1"))
+	archive.Migrations("L1",
+		fakeAction("x1", func(context.Context) error {
+			return errors.New("archive broke")
+		}),
+	)
+
+	err = s.Migrate(context.Background())
+	require.Error(t, err)
+	var dbErrors *libschema.DatabaseErrors
+	require.True(t, errors.As(err, &dbErrors), "DatabaseErrors")
+	assert.Equal(t, []string{"primary", "archive"}, dbErrors.Failed)
+	assert.Len(t, dbErrors.Results, 3)
+	assert.NoError(t, dbErrors.Results["reporting"])
+	assert.Contains(t, dbErrors.Results["primary"].Error(), "primary broke")
+	assert.Contains(t, err.Error(), "archive broke")
+	assert.Equal(t, []string{"L1: r1"}, driver2.applied, "reporting migrated after primary failed")
+	assert.False(t, driver1.locked || driver2.locked || driver3.locked, "all unlocked")
+	assert.Equal(t, "primary", logur.info["Migrations failed, continuing with other databases"]["database"], "archive is last")
+}
+
+func TestMigrateOne(t *testing.T) {
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2", libschema.SkipIf(func() (bool, error) { return true, nil })),
+		fake("a3"),
+		fake("a4"),
+	)
+	ctx := context.Background()
+
+	err = dbase.MigrateOne(ctx, libschema.MigrationName{Library: "L1", Name: "a3"})
+	if assert.Error(t, err, "a1 not done") {
+		assert.Contains(t, err.Error(), "not done: L1: a1")
+	}
+	assert.Empty(t, driver.applied)
+	assert.False(t, driver.locked, "unlocked after error")
+
+	require.NoError(t, dbase.MigrateOne(ctx, libschema.MigrationName{Library: "L1", Name: "a1"}))
+	require.NoError(t, dbase.MigrateOne(ctx, libschema.MigrationName{Library: "L1", Name: "a3"}), "past SkipIf")
+	require.NoError(t, dbase.MigrateOne(ctx, libschema.MigrationName{Library: "L1", Name: "a3"}), "already done")
+	assert.Equal(t, []string{"L1: a1", "L1: a3"}, driver.applied)
+	assert.Equal(t, 4, driver.locks)
+	assert.False(t, driver.locked)
+
+	err = dbase.MigrateOne(ctx, libschema.MigrationName{Library: "L1", Name: "a9"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not registered")
+	}
+}
+
+func TestWithTxOptions(t *testing.T) {
+	defaults := &sql.TxOptions{Isolation: sql.LevelSerializable}
+	readCommitted := &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{
+		MigrationTxOptions: defaults,
+	})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("schema"),
+		fake("backfill", libschema.WithTxOptions(readCommitted)),
+	)
+	schema, _ := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "schema"})
+	backfill, _ := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "backfill"})
+	assert.Same(t, defaults, dbase.TxOptions(schema))
+	assert.Same(t, readCommitted, dbase.TxOptions(backfill))
+	assert.Same(t, readCommitted, dbase.TxOptions(backfill.Copy()), "copied")
+}
+
+func TestWithContinueOnError(t *testing.T) {
+	var failures []string
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{
+		OnMigrationFailure: func(_ *libschema.Database, n libschema.MigrationName, _ error) {
+			failures = append(failures, n.String())
+		},
+	}, driver, func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+			fakeAction("cleanup1", func(context.Context) error {
+				return errors.New("cleanup1 broke")
+			}, libschema.WithContinueOnError()),
+			fake("a2"),
+		)
+		dbase.Migrations("L2",
+			fakeAction("cleanup2", func(context.Context) error {
+				return errors.New("cleanup2 broke")
+			}, libschema.WithContinueOnError()),
+			fake("b1"),
+		)
+	})
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cleanup1 broke")
+		assert.Contains(t, err.Error(), "cleanup2 broke")
+	}
+	assert.Equal(t, []string{"L1: a1", "L1: a2", "L2: b1"}, driver.applied)
+	assert.Equal(t, []string{"L1: cleanup1", "L2: cleanup2"}, failures)
+	assert.False(t, driver.locked)
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{}, driver, func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fakeAction("cleanup", func(context.Context) error {
+				return errors.New("cleanup broke")
+			}, libschema.WithContinueOnError()),
+			fakeAction("critical", func(context.Context) error {
+				return errors.New("critical broke")
+			}),
+			fake("a1"),
+		)
+	})
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cleanup broke")
+		assert.Contains(t, err.Error(), "critical broke")
+	}
+	assert.Empty(t, driver.applied, "fail-fast on critical migration")
+}
+
+func TestSetTrackingDBUnsupported(t *testing.T) {
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, func(dbase *libschema.Database) {
+		dbase.SetTrackingDB(&sql.DB{})
+		dbase.Migrations("L1", fake("a1"))
+	})
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support SetTrackingDB")
+	}
+	assert.Empty(t, driver.applied)
+	assert.Equal(t, 0, driver.locks)
+}
+
+func TestOnUnknownMigration(t *testing.T) {
+	var unknowns []string
+	driver := newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "future"}] = true
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+		)
+	}
+	s := fakeSchema(t, libschema.Options{
+		OnUnknownMigration: func(_ *libschema.Database, n libschema.MigrationName) error {
+			unknowns = append(unknowns, n.String())
+			return nil
+		},
+	}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: future"}, unknowns)
+	assert.Equal(t, []string{"L1: a1"}, driver.applied)
+
+	driver = newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "future"}] = true
+	s = fakeSchema(t, libschema.Options{
+		OnUnknownMigration: func(_ *libschema.Database, n libschema.MigrationName) error {
+			return errors.New("code is older than the database")
+		},
+	}, driver, define)
+	err := s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "code is older than the database")
+		assert.Contains(t, err.Error(), "L1: future")
+	}
+	assert.Empty(t, driver.applied, "aborted")
+	assert.False(t, driver.locked)
+}
+
+// infoLogur keeps the fields of Info messages
+type infoLogur struct {
+	info map[string]map[string]interface{}
+}
+
+func (l *infoLogur) Trace(msg string, fields ...map[string]interface{}) {}
+func (l *infoLogur) Debug(msg string, fields ...map[string]interface{}) {}
+func (l *infoLogur) Warn(msg string, fields ...map[string]interface{})  {}
+func (l *infoLogur) Error(msg string, fields ...map[string]interface{}) {}
+func (l *infoLogur) Info(msg string, fields ...map[string]interface{}) {
+	if len(fields) != 0 {
+		l.info[msg] = fields[0]
+	}
+}
+
+func TestMigrateSummary(t *testing.T) {
+	driver := newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "a1"}] = true
+	logur := &infoLogur{info: make(map[string]map[string]interface{})}
+	s := libschema.New(context.Background(), libschema.Options{
+		SkipTags: []string{"data"},
+	})
+	dbase, err := s.NewDatabase(libschema.LogFromLogur(logur), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2"),
+		fake("a3", libschema.SkipIf(func() (bool, error) { return true, nil })),
+		fake("backfill", libschema.WithTags("data")),
+	)
+	dbase.Migrations("L2",
+		fakeAction("b1", func(context.Context) error {
+			return errors.New("b1 broke")
+		}, libschema.WithContinueOnError()),
+		fake("b2"),
+	)
+	assert.Error(t, s.Migrate(context.Background()))
+	summary := logur.info["Migrations failed"]
+	if assert.NotNil(t, summary) {
+		assert.Equal(t, 2, summary["applied"], "applied")
+		assert.Equal(t, 2, summary["skipped"], "skipped")
+		assert.Equal(t, 1, summary["alreadyDone"], "already done")
+		assert.Equal(t, 1, summary["failed"], "failed")
+		assert.NotEmpty(t, summary["duration"])
+	}
+}
+
+func TestErrSkipped(t *testing.T) {
+	driver := newFakeDriver()
+	logur := &infoLogur{info: make(map[string]map[string]interface{})}
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLogur(logur), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fakeAction("a2", func(context.Context) error {
+			return errors.Wrap(libschema.ErrSkipped, "users already backfilled")
+		}),
+		fakeAction("a3", func(context.Context) error {
+			return libschema.ErrSkipped
+		}),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: a1", "L1: a2", "L1: a3"}, driver.applied, "skipped migrations are marked done")
+	summary := logur.info["Migrations complete"]
+	if assert.NotNil(t, summary) {
+		assert.Equal(t, 1, summary["applied"], "applied")
+		assert.Equal(t, 2, summary["skipped"], "skipped")
+		assert.Equal(t, 0, summary["failed"], "failed")
+	}
+	assert.NotNil(t, logur.info["Migration skipped, marking it done"])
+}
+
+func TestWithSkipIfSummary(t *testing.T) {
+	driver := newFakeDriver()
+	logur := &infoLogur{info: make(map[string]map[string]interface{})}
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLogur(logur), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2", libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+			return true, nil
+		})),
+		fake("a3", libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+			return false, nil
+		})),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.True(t, driver.done[libschema.MigrationName{Library: "L1", Name: "a2"}], "skipped migrations are marked done")
+	summary := logur.info["Migrations complete"]
+	if assert.NotNil(t, summary) {
+		assert.Equal(t, 2, summary["applied"], "applied")
+		assert.Equal(t, 1, summary["skipped"], "skipped")
+	}
+}
+
+func TestErrorOnUnknownMigrations(t *testing.T) {
+	driver := newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "newer"}] = true
+	s := libschema.New(context.Background(), libschema.Options{
+		ErrorOnUnknownMigrations: true,
+	})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+	)
+
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err, "migrate") {
+		assert.Contains(t, err.Error(), "L1: newer")
+	}
+	assert.Empty(t, driver.applied, "migrate")
+	assert.False(t, driver.locked, "migrate unlocked")
+
+	err = dbase.MigrateOne(context.Background(), libschema.MigrationName{Library: "L1", Name: "a1"})
+	if assert.Error(t, err, "migrate one") {
+		assert.Contains(t, err.Error(), "L1: newer")
+	}
+	assert.Empty(t, driver.applied, "migrate one")
+	assert.False(t, driver.locked, "migrate one unlocked")
+}
+
+func TestMigrationNames(t *testing.T) {
+	driver := newFakeDriver()
+	var dbase *libschema.Database
+	fakeSchema(t, libschema.Options{}, driver, func(d *libschema.Database) {
+		dbase = d
+		d.Migrations("L2",
+			fake("b1"),
+			fake("b2", libschema.After("L1", "a1")),
+		)
+		d.Migrations("L1",
+			fake("a1"),
+		)
+	})
+	assert.Equal(t, []libschema.MigrationName{
+		{Library: "L2", Name: "b1"},
+		{Library: "L2", Name: "b2"},
+		{Library: "L1", Name: "a1"},
+	}, dbase.MigrationNames())
+	assert.Empty(t, driver.applied, "nothing runs")
+	assert.Zero(t, driver.locks, "not locked")
+}
+
+type classifyingDriver struct {
+	*fakeDriver
+}
+
+func (classifyingDriver) IsRetryable(err error) bool     { return err.Error() == "transient" }
+func (classifyingDriver) IsAlreadyExists(err error) bool { return err.Error() == "exists" }
+
+func TestErrorClassifier(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{})
+	plain, err := s.NewDatabase(libschema.LogFromLog(t), "plain", nil, newFakeDriver())
+	require.NoError(t, err)
+	assert.False(t, plain.IsRetryable(errors.New("transient")), "driver does not classify")
+	assert.False(t, plain.IsAlreadyExists(errors.New("exists")), "driver does not classify")
+
+	classified, err := s.NewDatabase(libschema.LogFromLog(t), "classified", nil, classifyingDriver{newFakeDriver()})
+	require.NoError(t, err)
+	assert.True(t, classified.IsRetryable(errors.New("transient")))
+	assert.False(t, classified.IsRetryable(errors.New("exists")))
+	assert.False(t, classified.IsRetryable(nil))
+	assert.True(t, classified.IsAlreadyExists(errors.New("exists")))
+	assert.False(t, classified.IsAlreadyExists(nil))
+}
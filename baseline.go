@@ -0,0 +1,116 @@
+package libschema
+
+import (
+	"context"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// Baseline records migrations as done without running them.  It is for
+// adopting libschema on a database whose schema was created some other
+// way: baseline the migrations that describe the existing schema and
+// then Migrate runs only the ones after them.  The migration named by
+// upTo is marked done along with every migration that it depends upon,
+// directly or indirectly (including all of the migrations before it in
+// its library).  Migrations that are already done are left alone.
+// Baseline takes the migration lock.  The driver must implement
+// StatusMarker.
+func (d *Database) Baseline(ctx context.Context, upTo MigrationName) (finalErr error) {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	marker, ok := d.driver.(StatusMarker)
+	if !ok {
+		return errors.Errorf("The driver for %s does not support Baseline", d.Name)
+	}
+	target, ok := d.Lookup(upTo)
+	if !ok {
+		return errors.Errorf("Migration %s is not registered with database %s", upTo, d.Name)
+	}
+	err := d.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := d.unlock()
+		if err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+	include := map[int]bool{target.Base().order: true}
+	todo := append([]int{}, d.blockedBy[target.Base().order]...)
+	for len(todo) > 0 {
+		b := todo[0]
+		todo = todo[1:]
+		if include[b] {
+			continue
+		}
+		include[b] = true
+		todo = append(todo, d.blockedBy[b]...)
+	}
+	for _, m := range d.sequence {
+		if !include[m.Base().order] || m.Base().Status().Done {
+			continue
+		}
+		d.log.Info("Baseline: marking migration done without running it", map[string]interface{}{
+			"database": d.Name,
+			"library":  m.Base().Name.Library,
+			"name":     m.Base().Name.Name,
+		})
+		err := marker.MarkMigrationDone(ctx, d.log, d, m)
+		if err != nil {
+			return err
+		}
+		m.Base().SetStatus(MigrationStatus{Done: true})
+	}
+	return nil
+}
+
+// SetStatusManually records the migration called name as done, or not
+// done, without running it.  It is the recovery path for a migration
+// whose status is wrong, for example because the program was terminated
+// after the DDL succeeded but before the status was saved.  Unlike
+// Baseline, it only changes the one migration and it can mark a
+// migration as not done so that Migrate runs it again.  It returns an
+// error unless Options.AllowDestructive is set and the driver implements
+// StatusSetter.  SetStatusManually takes the migration lock.
+func (d *Database) SetStatusManually(ctx context.Context, name MigrationName, done bool) (finalErr error) {
+	if !d.Options.AllowDestructive {
+		return errors.Errorf("SetStatusManually for %s requires Options.AllowDestructive", d.Name)
+	}
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	setter, ok := d.driver.(StatusSetter)
+	if !ok {
+		return errors.Errorf("The driver for %s does not support SetStatusManually", d.Name)
+	}
+	m, ok := d.Lookup(name)
+	if !ok {
+		return errors.Errorf("Migration %s is not registered with database %s", name, d.Name)
+	}
+	err := d.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := d.unlock()
+		if err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+	d.log.Warn("Setting migration status manually", map[string]interface{}{
+		"database": d.Name,
+		"library":  name.Library,
+		"name":     name.Name,
+		"done":     done,
+		"was":      m.Base().Status().Done,
+	})
+	err = setter.SetMigrationStatus(ctx, d.log, d, m, done)
+	if err != nil {
+		return err
+	}
+	m.Base().SetStatus(MigrationStatus{Done: done})
+	return nil
+}
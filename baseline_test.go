@@ -0,0 +1,94 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseline(t *testing.T) {
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2"),
+		fake("a3"),
+	)
+	dbase.Migrations("L2",
+		fake("b1"),
+		fake("b2", libschema.After("L1", "a2")),
+		fake("b3"),
+	)
+	ctx := context.Background()
+
+	require.NoError(t, dbase.Baseline(ctx, libschema.MigrationName{Library: "L2", Name: "b2"}))
+	assert.ElementsMatch(t, []string{"L1: a1", "L1: a2", "L2: b1", "L2: b2"}, driver.baselined)
+	assert.Empty(t, driver.applied, "nothing run")
+	assert.False(t, driver.locked)
+
+	require.NoError(t, dbase.Baseline(ctx, libschema.MigrationName{Library: "L2", Name: "b2"}), "again")
+	assert.Len(t, driver.baselined, 4, "done migrations left alone")
+
+	require.NoError(t, s.Migrate(ctx))
+	assert.Equal(t, []string{"L1: a3", "L2: b3"}, driver.applied)
+
+	err = dbase.Baseline(ctx, libschema.MigrationName{Library: "L1", Name: "a9"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not registered")
+	}
+}
+
+func TestBaselineUnsupported(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, noDropDriver{Driver: newFakeDriver()})
+	require.NoError(t, err)
+	dbase.Migrations("L1", fake("a1"))
+	err = dbase.Baseline(context.Background(), libschema.MigrationName{Library: "L1", Name: "a1"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support Baseline")
+	}
+}
+
+func TestSetStatusManually(t *testing.T) {
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2"),
+	)
+	ctx := context.Background()
+	a2 := libschema.MigrationName{Library: "L1", Name: "a2"}
+
+	err = dbase.SetStatusManually(ctx, a2, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires Options.AllowDestructive")
+	}
+
+	dbase.Options.AllowDestructive = true
+	require.NoError(t, dbase.SetStatusManually(ctx, a2, true))
+	assert.True(t, driver.done[a2])
+	assert.False(t, driver.locked)
+	m, _ := dbase.Lookup(a2)
+	assert.True(t, m.Base().Status().Done)
+
+	require.NoError(t, s.Migrate(ctx))
+	assert.Equal(t, []string{"L1: a1"}, driver.applied, "a2 is not run")
+
+	require.NoError(t, dbase.SetStatusManually(ctx, a2, false))
+	assert.False(t, driver.done[a2])
+	require.NoError(t, s.Migrate(ctx))
+	assert.Equal(t, []string{"L1: a1", "L1: a2"}, driver.applied, "a2 is run again")
+
+	err = dbase.SetStatusManually(ctx, libschema.MigrationName{Library: "L1", Name: "a9"}, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not registered")
+	}
+}
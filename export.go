@@ -0,0 +1,158 @@
+package libschema
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// ExportSQL writes the SQL of the migrations that Migrate() would run,
+// in the order that they would run, without running them.  It is meant
+// for having a person review the schema changes before Migrate() is
+// called.  Each migration is preceded by a comment with its name.
+// Computed migrations are written as a comment since they run Go code.
+// Generate() migrations are rendered in a transaction that is rolled
+// back so generators that only read work as expected.  Options.OnlyTags,
+// Options.SkipTags, and Options.MigrateUpTo are honored.  ExportSQL
+// does not take the migration lock so if something else is migrating
+// at the same time, the output may already be out of date.  Like
+// Migrate(), it creates the tracking table if it does not exist.  The
+// Driver must implement ScriptRenderer.
+func (d *Database) ExportSQL(ctx context.Context, w io.Writer) error {
+	renderer, ctx, err := d.prepareRender(ctx, "ExportSQL")
+	if err != nil {
+		return err
+	}
+	for _, m := range d.pendingRender() {
+		script, computed, err := renderer.RenderScript(ctx, d.log, d, m)
+		if err != nil {
+			return errors.Wrapf(err, "render %s", m.Base().Name)
+		}
+		header := "-- Migration " + m.Base().Name.String() + "\n"
+		if m.Base().HasSkipIf() {
+			header += "-- Has a SkipIf: it may be skipped\n"
+		}
+		if m.Base().OnlineSafe() {
+			header += "-- Online-safe: can run while the application is serving traffic\n"
+		}
+		if computed {
+			_, err = io.WriteString(w, header+"-- Computed: runs Go code, there is no SQL to show\n\n")
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s\n\n", header, strings.TrimSpace(script))
+		}
+		if err != nil {
+			return errors.Wrap(err, "write SQL")
+		}
+	}
+	return nil
+}
+
+// DryRender renders the SQL of the migrations that Migrate() would run,
+// without running them, and checks it.  It is meant to be called in CI
+// or at the start of a deploy so that a broken generator is found before
+// the migration lock is taken.  Generate() migrations are rendered in a
+// transaction that is rolled back and a generator that panics is
+// reported as an error.  Each script is checked with
+// Options.MigrationValidators and, if the Driver implements
+// ScriptChecker, with the checks that the driver makes just before
+// running a script (lsmysql.CheckScript for lsmysql).  Computed
+// migrations run Go code so they are not included.  The scripts are
+// returned by migration name along with all of the problems found.
+// Like ExportSQL, it creates the tracking table if it does not exist and
+// the Driver must implement ScriptRenderer.
+func (d *Database) DryRender(ctx context.Context) (map[MigrationName]string, error) {
+	renderer, ctx, err := d.prepareRender(ctx, "DryRender")
+	if err != nil {
+		return nil, err
+	}
+	checker, _ := d.driver.(ScriptChecker)
+	scripts := make(map[MigrationName]string)
+	var result *multierror.Error
+	for _, m := range d.pendingRender() {
+		name := m.Base().Name
+		script, computed, err := renderSafely(ctx, d, renderer, m)
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "render %s", name))
+			continue
+		}
+		if computed {
+			continue
+		}
+		scripts[name] = script
+		err = d.ValidateMigration(m, script)
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+		if checker != nil {
+			err = checker.CheckMigrationScript(d.log, d, m, script)
+			if err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "check %s", name))
+			}
+		}
+	}
+	return scripts, result.ErrorOrNil()
+}
+
+// renderSafely calls RenderScript and turns a panic, from a generator,
+// into an error.
+func renderSafely(ctx context.Context, d *Database, renderer ScriptRenderer, m Migration) (script string, computed bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+	}()
+	return renderer.RenderScript(ctx, d.log, d, m)
+}
+
+// prepareRender does the setup shared by ExportSQL and DryRender: it
+// checks the migrations and loads their status.  The returned context
+// is the one that migrations are given when they run.
+func (d *Database) prepareRender(ctx context.Context, what string) (ScriptRenderer, context.Context, error) {
+	if len(d.errors) != 0 {
+		return nil, ctx, multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	renderer, ok := d.driver.(ScriptRenderer)
+	if !ok {
+		return nil, ctx, errors.Errorf("driver for %s does not support %s", d.Name, what)
+	}
+	err := d.checkTrackingDB()
+	if err != nil {
+		return nil, ctx, err
+	}
+	err = d.computeSequence()
+	if err != nil {
+		return nil, ctx, err
+	}
+	for _, m := range d.migrations {
+		err = d.driver.IsMigrationSupported(d, d.log, m)
+		if err != nil {
+			return nil, ctx, err
+		}
+	}
+	err = d.driver.CreateSchemaTableIfNotExists(ctx, d.log, d)
+	if err != nil {
+		return nil, ctx, err
+	}
+	_, err = d.driver.LoadStatus(ctx, d.log, d)
+	if err != nil {
+		return nil, ctx, err
+	}
+	d.holdBack()
+	return renderer, d.withContextValues(withRunContext(ctx, d.Options.RunID)), nil
+}
+
+// pendingRender returns the migrations that Migrate() would run, in order
+func (d *Database) pendingRender() []Migration {
+	var pending []Migration
+	for _, m := range d.sequence {
+		if m.Base().Status().Done || d.isHeld(m) {
+			continue
+		}
+		pending = append(pending, m)
+	}
+	return pending
+}
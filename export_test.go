@@ -0,0 +1,99 @@
+package libschema_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportSQL(t *testing.T) {
+	driver := newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "a1"}] = true
+	var dbase *libschema.Database
+	fakeSchema(t, libschema.Options{
+		SkipTags: []string{"later"},
+	}, driver, func(d *libschema.Database) {
+		dbase = d
+		d.Migrations("L1",
+			fakeScript("a1", "CREATE TABLE a1 (id int)"),
+			fakeScript("a2", "CREATE TABLE a2 (id int);\n", libschema.WithOnlineSafe(true)),
+			fakeAction("a3", func(context.Context) error { return nil }),
+			fakeScript("a4", "DROP TABLE a1", libschema.WithTags("later")),
+		)
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, dbase.ExportSQL(context.Background(), &buf))
+	assert.Equal(t, "-- Migration L1: a2\n"+
+		"-- Online-safe: can run while the application is serving traffic\n"+
+		"CREATE TABLE a2 (id int);\n\n"+
+		"-- Migration L1: a3\n"+
+		"-- Computed: runs Go code, there is no SQL to show\n\n", buf.String())
+	assert.Empty(t, driver.applied, "nothing runs")
+	assert.Zero(t, driver.locks, "not locked")
+
+	m, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "a2"})
+	require.True(t, ok)
+	assert.True(t, m.Base().OnlineSafe())
+	m, ok = dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "a3"})
+	require.True(t, ok)
+	assert.False(t, m.Base().OnlineSafe(), "not online-safe unless marked")
+}
+
+// dryRenderer panics when rendering the migration named panicOn and
+// rejects scripts that drop tables
+type dryRenderer struct {
+	*fakeDriver
+	panicOn string
+}
+
+func (r dryRenderer) RenderScript(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (string, bool, error) {
+	if m.Base().Name.Name == r.panicOn {
+		panic("generator failed")
+	}
+	return r.fakeDriver.RenderScript(ctx, log, d, m)
+}
+
+func (r dryRenderer) CheckMigrationScript(_ *internal.Log, _ *libschema.Database, _ libschema.Migration, script string) error {
+	if strings.HasPrefix(script, "DROP") {
+		return errors.New("drops a table")
+	}
+	return nil
+}
+
+func TestDryRender(t *testing.T) {
+	driver := newFakeDriver()
+	driver.done[libschema.MigrationName{Library: "L1", Name: "a1"}] = true
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, dryRenderer{fakeDriver: driver, panicOn: "a4"})
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fakeScript("a1", "DROP TABLE a0"),
+		fakeScript("a2", "CREATE TABLE a2 (id int)"),
+		fakeAction("a3", func(context.Context) error { return nil }),
+		fakeScript("a4", "CREATE TABLE a4 (id int)"),
+		fakeScript("a5", "DROP TABLE a2"),
+	)
+
+	scripts, err := dbase.DryRender(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "render L1: a4: panic: generator failed")
+		assert.Contains(t, err.Error(), "check L1: a5: drops a table")
+		assert.NotContains(t, err.Error(), "a1", "done migrations are not checked")
+	}
+	assert.Equal(t, map[libschema.MigrationName]string{
+		{Library: "L1", Name: "a2"}: "CREATE TABLE a2 (id int)",
+		{Library: "L1", Name: "a5"}: "DROP TABLE a2",
+	}, scripts, "done, computed, and failed migrations are not included")
+	assert.Empty(t, driver.applied, "nothing runs")
+	assert.Zero(t, driver.locks, "not locked")
+}
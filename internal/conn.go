@@ -0,0 +1,18 @@
+package internal
+
+import (
+	"database/sql"
+	"database/sql/driver"
+)
+
+// DiscardConn closes a connection without returning it to the
+// connection pool so that any session state set on the connection
+// cannot leak into other uses of the pool.
+func DiscardConn(conn *sql.Conn) {
+	// Returning driver.ErrBadConn from Raw causes database/sql
+	// to close the underlying connection.
+	_ = conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
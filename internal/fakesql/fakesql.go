@@ -0,0 +1,205 @@
+// Package fakesql is a database/sql driver for testing libschema drivers
+// without a database.  It records every statement and answers each one
+// with a function supplied by the test.
+package fakesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Statement is a statement that was sent to the fake database.  Queries
+// have their whitespace collapsed.  Transactions are recorded as the
+// statements BEGIN, COMMIT, and ROLLBACK.
+type Statement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// Rows is the answer to a query
+type Rows struct {
+	Columns []string
+	Values  [][]driver.Value
+}
+
+// DB is a fake database
+type DB struct {
+	// Respond answers each statement.  The rows are ignored for Exec.
+	// When Respond is nil or returns nil rows, queries return no rows.
+	// Arguments that are sql.Out are passed through so that Respond
+	// can set them.
+	Respond func(query string, args []driver.Value) (*Rows, error)
+
+	mu         sync.Mutex
+	statements []Statement
+}
+
+// Open returns a *sql.DB that uses the fake database
+func (f *DB) Open() *sql.DB {
+	return sql.OpenDB(connector{db: f})
+}
+
+// Statements returns the statements run so far
+func (f *DB) Statements() []Statement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Statement(nil), f.statements...)
+}
+
+// Matching returns the statements that begin with prefix
+func (f *DB) Matching(prefix string) []Statement {
+	var matching []Statement
+	for _, statement := range f.Statements() {
+		if strings.HasPrefix(statement.Query, prefix) {
+			matching = append(matching, statement)
+		}
+	}
+	return matching
+}
+
+// Sequence reports whether statements beginning with each of the
+// prefixes were run in order.  Other statements may come between them.
+func (f *DB) Sequence(prefixes ...string) bool {
+	statements := f.Statements()
+	for _, prefix := range prefixes {
+		for {
+			if len(statements) == 0 {
+				return false
+			}
+			statement := statements[0]
+			statements = statements[1:]
+			if strings.HasPrefix(statement.Query, prefix) {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// String lists the statements run so far, for test failures
+func (f *DB) String() string {
+	var b strings.Builder
+	for _, statement := range f.Statements() {
+		fmt.Fprintf(&b, "%s %v\n", statement.Query, statement.Args)
+	}
+	return b.String()
+}
+
+func (f *DB) run(query string, args []driver.NamedValue) (*Rows, error) {
+	statement := Statement{
+		Query: strings.Join(strings.Fields(query), " "),
+	}
+	for _, arg := range args {
+		statement.Args = append(statement.Args, arg.Value)
+	}
+	f.mu.Lock()
+	f.statements = append(f.statements, statement)
+	f.mu.Unlock()
+	if f.Respond == nil {
+		return nil, nil
+	}
+	return f.Respond(statement.Query, statement.Args)
+}
+
+type connector struct {
+	db *DB
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return conn{db: c.db}, nil }
+func (c connector) Driver() driver.Driver                        { return nil }
+
+type conn struct {
+	db *DB
+}
+
+var (
+	_ driver.ConnBeginTx       = conn{}
+	_ driver.ExecerContext     = conn{}
+	_ driver.QueryerContext    = conn{}
+	_ driver.NamedValueChecker = conn{}
+)
+
+func (c conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakesql does not support prepared statements")
+}
+
+func (c conn) Close() error { return nil }
+
+func (c conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	_, err := c.db.run("BEGIN", nil)
+	if err != nil {
+		return nil, err
+	}
+	return tx{db: c.db}, nil
+}
+
+func (c conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &Rows{}
+	}
+	return &rows{answer: r}, nil
+}
+
+// CheckNamedValue lets sql.Out arguments through to Respond
+func (c conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if _, ok := nv.Value.(sql.Out); ok {
+		return nil
+	}
+	var err error
+	nv.Value, err = driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	return err
+}
+
+type tx struct {
+	db *DB
+}
+
+func (t tx) Commit() error {
+	_, err := t.db.run("COMMIT", nil)
+	return err
+}
+
+func (t tx) Rollback() error {
+	_, err := t.db.run("ROLLBACK", nil)
+	return err
+}
+
+type rows struct {
+	answer *Rows
+	next   int
+}
+
+func (r *rows) Columns() []string { return r.answer.Columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.answer.Values) {
+		return io.EOF
+	}
+	copy(dest, r.answer.Values[r.next])
+	r.next++
+	return nil
+}
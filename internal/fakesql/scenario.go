@@ -0,0 +1,129 @@
+package fakesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Scenario is the migration run that the driver unit tests share.  T1
+// is already done, T2 succeeds, T3 fails, and T4 is not attempted
+// because it follows the failure.  The tracking table also has "gone",
+// which is not registered.
+type Scenario struct {
+	// StatusQuery is the query that loads the tracking table
+	StatusQuery string
+	// SaveStatus is the start of the statement that saves a status
+	SaveStatus string
+	// True and False are how the tracking table stores done
+	True, False driver.Value
+	// Failure is returned by the T3 statement
+	Failure error
+	// Respond answers the statements that are not part of the scenario
+	Respond func(query string, args []driver.Value) (*Rows, error)
+	// New creates a Database with the driver being tested
+	New func(log *internal.Log, s *libschema.Schema, db *sql.DB) (*libschema.Database, libschema.Driver, error)
+	// Script creates a migration for the driver being tested
+	Script func(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration
+	// T2 is the T2 script.  The default is an INSERT.
+	T2 string
+	// Pool, when set, is the size of the connection pool and T3 uses
+	// libschema.WithDedicatedConn so that a driver that does not release
+	// the dedicated connection before saving the failure deadlocks.
+	Pool int
+}
+
+// Run migrates the scenario and checks what is the same for every
+// driver.  It returns the fake database so that the caller can check
+// the statements that are particular to the driver.
+func (sc Scenario) Run(t *testing.T) *DB {
+	fake := &DB{
+		Respond: func(query string, args []driver.Value) (*Rows, error) {
+			switch query {
+			case sc.StatusQuery:
+				return &Rows{
+					Columns: []string{"library", "migration", "done", "error"},
+					Values: [][]driver.Value{
+						{"L", "T1", sc.True, ""},
+						{"L", "gone", sc.True, ""},
+					},
+				}, nil
+			case "INSERT INTO t3 (id) VALUES (1)":
+				return nil, sc.Failure
+			}
+			if sc.Respond == nil {
+				return nil, nil
+			}
+			return sc.Respond(query, args)
+		},
+	}
+	db := fake.Open()
+	t.Cleanup(func() { _ = db.Close() })
+	var t3opts []libschema.MigrationOption
+	if sc.Pool != 0 {
+		db.SetMaxOpenConns(sc.Pool)
+		t3opts = append(t3opts, libschema.WithDedicatedConn())
+	}
+	t2 := sc.T2
+	if t2 == "" {
+		t2 = `INSERT INTO t2 (id) VALUES (1)`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := libschema.New(ctx, libschema.Options{AppliedBy: "tester"})
+	log := libschema.LogFromLog(t)
+	dbase, p, err := sc.New(log, s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L",
+		sc.Script("T1", `INSERT INTO t1 (id) VALUES (1)`),
+		sc.Script("T2", t2),
+		sc.Script("T3", `INSERT INTO t3 (id) VALUES (1)`, t3opts...),
+		sc.Script("T4", `INSERT INTO t4 (id) VALUES (1)`),
+	)
+
+	err = s.Migrate(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), sc.Failure.Error())
+	assert.NotContains(t, err.Error(), "also failed", "the failure was saved")
+
+	assert.Empty(t, fake.Matching("INSERT INTO t1"), "T1 was already done")
+	assert.Empty(t, fake.Matching("INSERT INTO t4"), "T4 follows the failure")
+
+	saved := fake.Matching(sc.SaveStatus)
+	require.Len(t, saved, 2, "statements:\n%s", fake)
+	assert.Equal(t, []driver.Value{"L", "T2", sc.True, "", "tester"}, saved[0].Args[:5], "success")
+	assert.Equal(t, []driver.Value{"L", "T3", sc.False}, saved[1].Args[:3], "failure")
+	assert.Contains(t, saved[1].Args[3], sc.Failure.Error(), "failure")
+
+	unknowns, err := p.LoadStatus(ctx, log, dbase)
+	require.NoError(t, err)
+	assert.Equal(t, []libschema.MigrationName{{Library: "L", Name: "gone"}}, unknowns)
+	m, ok := dbase.Lookup(libschema.MigrationName{Library: "L", Name: "T1"})
+	require.True(t, ok)
+	assert.True(t, m.Base().Status().Done, "T1 status")
+	m, ok = dbase.Lookup(libschema.MigrationName{Library: "L", Name: "T4"})
+	require.True(t, ok)
+	assert.False(t, m.Base().Status().Done, "T4 status")
+	return fake
+}
+
+// CheckLocking checks what every driver's lock does: locking twice is
+// an error, as is unlocking when not locked, and the lock can be taken
+// again once it is released.
+func CheckLocking(t *testing.T, lock func() error, unlock func() error) {
+	require.NoError(t, lock())
+	assert.Error(t, lock(), "double lock")
+	require.NoError(t, unlock())
+	assert.Error(t, unlock(), "not locked")
+	require.NoError(t, lock(), "lock again")
+	require.NoError(t, unlock())
+}
@@ -0,0 +1,67 @@
+//go:build go1.21
+// +build go1.21
+
+package libschema
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/muir/libschema/internal"
+)
+
+// LevelTrace is the slog level used for libschema's Trace messages
+const LevelTrace = slog.LevelDebug - 4
+
+// LogFromSlog creates a logger for libschema from a *slog.Logger.  The
+// fields of each message become attributes, sorted by key.  Trace
+// messages are logged at LevelTrace.  It requires Go 1.21 or later.
+func LogFromSlog(logger *slog.Logger) *internal.Log {
+	return &internal.Log{
+		Logur: slogToLogur{logger: logger},
+	}
+}
+
+type slogToLogur struct {
+	logger *slog.Logger
+}
+
+func (s slogToLogur) Trace(msg string, fields ...map[string]interface{}) {
+	s.log(LevelTrace, msg, fields)
+}
+
+func (s slogToLogur) Debug(msg string, fields ...map[string]interface{}) {
+	s.log(slog.LevelDebug, msg, fields)
+}
+
+func (s slogToLogur) Info(msg string, fields ...map[string]interface{}) {
+	s.log(slog.LevelInfo, msg, fields)
+}
+
+func (s slogToLogur) Warn(msg string, fields ...map[string]interface{}) {
+	s.log(slog.LevelWarn, msg, fields)
+}
+
+func (s slogToLogur) Error(msg string, fields ...map[string]interface{}) {
+	s.log(slog.LevelError, msg, fields)
+}
+
+func (s slogToLogur) log(level slog.Level, msg string, fields []map[string]interface{}) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+	var attrs []slog.Attr
+	for _, f := range fields {
+		keys := make([]string, 0, len(f))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			attrs = append(attrs, slog.Any(k, f[k]))
+		}
+	}
+	s.logger.LogAttrs(ctx, level, msg, attrs...)
+}
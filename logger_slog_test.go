@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package libschema_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFromSlog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	log := libschema.LogFromSlog(logger)
+
+	log.Info("Saving migration status", map[string]interface{}{
+		"migration": "L1: a1",
+		"done":      true,
+	})
+	assert.Contains(t, buf.String(), `level=INFO msg="Saving migration status" done=true migration="L1: a1"`)
+
+	buf.Reset()
+	log.Debug("hidden")
+	log.Trace("hidden")
+	assert.Empty(t, buf.String(), "below the handler level")
+
+	log.Warn("careful", map[string]interface{}{"a": 1}, map[string]interface{}{"b": 2})
+	assert.Contains(t, buf.String(), "level=WARN msg=careful a=1 b=2")
+}
@@ -0,0 +1,148 @@
+// Package lscli has command handlers for a "migrate" command line tool.
+//
+// It does not depend upon a command line framework: each handler is a
+// plain function that can be called from cobra, urfave/cli, flag, or
+// anything else.  Run dispatches on the first argument for programs that
+// do not use a framework at all.
+package lscli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/muir/libschema"
+
+	"github.com/pkg/errors"
+)
+
+// Commands lists the subcommands that Run understands
+var Commands = []string{"up", "status", "plan", "validate", "baseline"}
+
+// Run runs the subcommand named by args[0]:
+//
+//	up                          Schema.Migrate
+//	status                      list the migrations and if they are done
+//	plan                        Database.ExportSQL
+//	validate                    Database.Validate
+//	baseline library:migration  Database.Baseline
+//
+// Output is written to w.
+func Run(ctx context.Context, s *libschema.Schema, d *libschema.Database, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.Errorf("a command is required, one of: %s", strings.Join(Commands, ", "))
+	}
+	command, rest := args[0], args[1:]
+	if command != "baseline" && len(rest) != 0 {
+		return errors.Errorf("%s does not take arguments", command)
+	}
+	switch command {
+	case "up":
+		return Up(ctx, s, w)
+	case "status":
+		return Status(ctx, d, w)
+	case "plan":
+		return Plan(ctx, d, w)
+	case "validate":
+		return Validate(ctx, d, w)
+	case "baseline":
+		if len(rest) != 1 {
+			return errors.New("baseline requires one argument, library:migration")
+		}
+		return Baseline(ctx, d, w, rest[0])
+	default:
+		return errors.Errorf("unknown command '%s', use one of: %s", command, strings.Join(Commands, ", "))
+	}
+}
+
+// Up applies the pending migrations of every Database in the Schema
+func Up(ctx context.Context, s *libschema.Schema, w io.Writer) error {
+	err := s.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "Migrations complete")
+	return errors.Wrap(err, "write output")
+}
+
+// Status lists the registered migrations, in the order they were
+// registered, with their status: done, pending, or failed.  It does not
+// take the migration lock.  Problems found by Database.Validate are
+// written after the list and returned.
+func Status(ctx context.Context, d *libschema.Database, w io.Writer) error {
+	verr := d.Validate(ctx)
+	var validationErr *libschema.ValidationError
+	if verr != nil && !errors.As(verr, &validationErr) {
+		return verr
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range d.MigrationNames() {
+		m, _ := d.Lookup(name)
+		status := m.Base().Status()
+		state := "pending"
+		switch {
+		case status.Done:
+			state = "done"
+		case status.Error != "":
+			state = "failed: " + status.Error
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", name, state)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return errors.Wrap(err, "write output")
+	}
+	if verr != nil {
+		_, _ = fmt.Fprintln(w, verr.Error())
+	}
+	return verr
+}
+
+// Plan writes the SQL of the pending migrations without running them
+func Plan(ctx context.Context, d *libschema.Database, w io.Writer) error {
+	return d.ExportSQL(ctx, w)
+}
+
+// Validate checks that the database matches the registered migrations
+func Validate(ctx context.Context, d *libschema.Database, w io.Writer) error {
+	err := d.Validate(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "Database matches the registered migrations")
+	return errors.Wrap(err, "write output")
+}
+
+// Baseline marks migrations done, without running them, up to and
+// including upTo which is given as "library:migration".
+func Baseline(ctx context.Context, d *libschema.Database, w io.Writer, upTo string) error {
+	name, err := ParseMigrationName(upTo)
+	if err != nil {
+		return err
+	}
+	err = d.Baseline(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Baselined through %s\n", name)
+	return errors.Wrap(err, "write output")
+}
+
+// ParseMigrationName parses "library:migration".  Spaces around either
+// part are ignored so MigrationName.String() output is accepted too.
+func ParseMigrationName(s string) (libschema.MigrationName, error) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return libschema.MigrationName{}, errors.Errorf("migration name '%s' must be library:migration", s)
+	}
+	name := libschema.MigrationName{
+		Library: strings.TrimSpace(s[:i]),
+		Name:    strings.TrimSpace(s[i+1:]),
+	}
+	if name.Library == "" || name.Name == "" {
+		return libschema.MigrationName{}, errors.Errorf("migration name '%s' must be library:migration", s)
+	}
+	return name, nil
+}
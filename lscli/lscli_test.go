@@ -0,0 +1,149 @@
+package lscli_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/lscli"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type migration struct {
+	libschema.MigrationBase
+	script string
+}
+
+func (m *migration) Copy() libschema.Migration {
+	return &migration{
+		MigrationBase: m.MigrationBase.Copy(),
+		script:        m.script,
+	}
+}
+
+func (m *migration) Base() *libschema.MigrationBase { return &m.MigrationBase }
+
+func script(name string, sql string) libschema.Migration {
+	return &migration{
+		MigrationBase: libschema.MigrationBase{Name: libschema.MigrationName{Name: name}},
+		script:        sql,
+	}
+}
+
+// memoryDriver keeps the status in memory
+type memoryDriver struct {
+	done map[libschema.MigrationName]bool
+}
+
+func (f *memoryDriver) CreateSchemaTableIfNotExists(context.Context, *internal.Log, *libschema.Database) error {
+	return nil
+}
+func (f *memoryDriver) LockMigrationsTable(context.Context, *internal.Log, *libschema.Database) error {
+	return nil
+}
+func (f *memoryDriver) UnlockMigrationsTable(*internal.Log) error { return nil }
+func (f *memoryDriver) IsMigrationSupported(*libschema.Database, *internal.Log, libschema.Migration) error {
+	return nil
+}
+
+func (f *memoryDriver) DoOneMigration(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration) (sql.Result, error) {
+	f.done[m.Base().Name] = true
+	m.Base().SetStatus(libschema.MigrationStatus{Done: true})
+	return nil, nil
+}
+
+func (f *memoryDriver) MarkMigrationDone(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration) error {
+	f.done[m.Base().Name] = true
+	m.Base().SetStatus(libschema.MigrationStatus{Done: true})
+	return nil
+}
+
+func (f *memoryDriver) RenderScript(_ context.Context, _ *internal.Log, _ *libschema.Database, m libschema.Migration) (string, bool, error) {
+	return m.(*migration).script, false, nil
+}
+
+func (f *memoryDriver) LoadStatus(_ context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	var unknowns []libschema.MigrationName
+	for name, done := range f.done {
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(libschema.MigrationStatus{Done: done})
+		} else {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+func TestCommands(t *testing.T) {
+	driver := &memoryDriver{done: make(map[libschema.MigrationName]bool)}
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		script("a1", "CREATE TABLE a1 (id int)"),
+		script("a2", "CREATE TABLE a2 (id int)"),
+		script("a3", "CREATE TABLE a3 (id int)"),
+	)
+	ctx := context.Background()
+	run := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		err := lscli.Run(ctx, s, dbase, &buf, args)
+		return buf.String(), err
+	}
+
+	out, err := run("baseline", "L1:a1")
+	require.NoError(t, err)
+	assert.Equal(t, "Baselined through L1: a1\n", out)
+
+	out, err = run("status")
+	require.NoError(t, err)
+	assert.Equal(t, "L1: a1  done\nL1: a2  pending\nL1: a3  pending\n", out)
+
+	out, err = run("plan")
+	require.NoError(t, err)
+	assert.Equal(t, "-- Migration L1: a2\nCREATE TABLE a2 (id int)\n\n"+
+		"-- Migration L1: a3\nCREATE TABLE a3 (id int)\n\n", out)
+
+	out, err = run("up")
+	require.NoError(t, err)
+	assert.Equal(t, "Migrations complete\n", out)
+	assert.Len(t, driver.done, 3)
+
+	out, err = run("validate")
+	require.NoError(t, err)
+	assert.Equal(t, "Database matches the registered migrations\n", out)
+
+	driver.done[libschema.MigrationName{Library: "L0", Name: "gone"}] = true
+	out, err = run("status")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "L0: gone is applied but not registered")
+	}
+	assert.Contains(t, out, "L1: a3  done\n")
+
+	for _, args := range [][]string{
+		{},
+		{"down"},
+		{"up", "extra"},
+		{"baseline"},
+		{"baseline", "a1"},
+	} {
+		_, err = run(args...)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestParseMigrationName(t *testing.T) {
+	name, err := lscli.ParseMigrationName("L1: a1")
+	require.NoError(t, err)
+	assert.Equal(t, libschema.MigrationName{Library: "L1", Name: "a1"}, name)
+
+	_, err = lscli.ParseMigrationName(":a1")
+	assert.Error(t, err)
+	_, err = lscli.ParseMigrationName("L1:")
+	assert.Error(t, err)
+}
@@ -0,0 +1,463 @@
+// Package lsclickhouse has a libschema.Driver support ClickHouse
+package lsclickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/pkg/errors"
+)
+
+// ClickHouse is a libschema.Driver for connecting to ClickHouse databases.  It
+// uses only database/sql so it should work with
+// github.com/ClickHouse/clickhouse-go/v2 or another database/sql driver.
+//
+// ClickHouse databases have the following characteristics:
+// * NO transactions
+// * NO advisory locks
+// * Only one statement can be executed per Exec()
+// * Support IF NOT EXISTS / IF EXISTS for most DDL
+//
+// CRASH SAFETY: Because there are no transactions, a migration and the recording
+// of its status are separate steps.  If the program terminates after a migration
+// is applied but before its status is saved, the migration will be run again.
+// Migrations must be idempotent.  A migration that fails partway through
+// (for example an INSERT ... SELECT) may leave partial results behind.
+//
+// Locking is emulated by creating a lock table (the tracking table name with
+// a "_lock" suffix).  Creating a table that already exists fails, so only one
+// process can hold the lock.  If a process dies while holding the lock, the
+// lock table must be dropped by hand.
+type ClickHouse struct {
+	lockTable string
+	lockDB    *sql.DB
+	lock      sync.Mutex
+}
+
+// LockPollInterval is how often LockMigrationsTable checks to see if
+// a lock held by another process has been released.
+var LockPollInterval = time.Second
+
+// New creates a libschema.Database with a ClickHouse driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (*libschema.Database, *ClickHouse, error) {
+	c := &ClickHouse{}
+	d, err := schema.NewDatabase(log, name, db, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, c, nil
+}
+
+type cmigration struct {
+	libschema.MigrationBase
+	sqlText        string // set by Script()
+	script         func(context.Context, *sql.Conn) string
+	computed       func(context.Context, *sql.Conn) error
+	allowUnbounded bool
+}
+
+func (m *cmigration) Copy() libschema.Migration {
+	return &cmigration{
+		MigrationBase:  m.MigrationBase.Copy(),
+		sqlText:        m.sqlText,
+		script:         m.script,
+		computed:       m.computed,
+		allowUnbounded: m.allowUnbounded,
+	}
+}
+
+func (m *cmigration) Base() *libschema.MigrationBase {
+	return &m.MigrationBase
+}
+
+// String describes the migration for logs and test failures
+func (m *cmigration) String() string {
+	var details []string
+	switch {
+	case m.computed != nil:
+		details = append(details, "computed")
+	case m.sqlText != "":
+		details = append(details, "script")
+	default:
+		details = append(details, "generate")
+	}
+	if m.allowUnbounded {
+		details = append(details, "allowUnboundedMutation")
+	}
+	return m.Describe(details...)
+}
+
+// WithAllowUnboundedMutation allows a Script or Generate migration to
+// have UPDATE or DELETE statements without a WHERE clause.  Without it,
+// such migrations fail (see lsmysql.UnboundedMutation).
+func WithAllowUnboundedMutation() libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if pm, ok := m.(*cmigration); ok {
+			pm.allowUnbounded = true
+		}
+	}
+}
+
+// Script creates a libschema.Migration from a SQL string
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := Generate(name, func(_ context.Context, _ *sql.Conn) string {
+		return sqlText
+	}, opts...)
+	m.(*cmigration).sqlText = sqlText
+	return m
+}
+
+// Generate creates a libschema.Migration from a function that returns a SQL string.
+// Since ClickHouse does not have transactions, the function is given a
+// connection rather than a transaction.
+func Generate(
+	name string,
+	generator func(context.Context, *sql.Conn) string,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return cmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		script: generator,
+	}.applyOpts(opts)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.
+// Since ClickHouse does not have transactions, the function is given a
+// connection rather than a transaction.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Conn) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return cmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		computed: action,
+	}.applyOpts(opts)
+}
+
+func (m cmigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
+	lsm := libschema.Migration(&m)
+	for _, opt := range opts {
+		opt(lsm)
+	}
+	return lsm
+}
+
+// DoOneMigration applies a single migration.
+// It is expected to be called by libschema.
+func (p *ClickHouse) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (result sql.Result, err error) {
+	defer func() {
+		if err == nil {
+			m.Base().SetStatus(libschema.MigrationStatus{
+				Done: true,
+			})
+		}
+	}()
+	if d.Options.SchemaOverride != "" {
+		return nil, errors.Errorf("Options.SchemaOverride is not supported by lsclickhouse (migration %s)", m.Base().Name)
+	}
+	result, err = p.runMigration(ctx, log, d, m.(*cmigration))
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		if d.Options.WithoutFailureStatus {
+			return nil, err
+		}
+	}
+	txerr := p.saveStatus(ctx, log, d, m, err == nil, err)
+	if txerr != nil {
+		if err == nil {
+			err = txerr
+		} else {
+			err = errors.Wrapf(err, "Save status for %s also failed: %s", m.Base().Name, txerr)
+		}
+	}
+	return
+}
+
+// runMigration runs a migration on a connection of its own.  The
+// connection is released before the status is saved so that a pool
+// of one connection is enough.
+func (p *ClickHouse) runMigration(ctx context.Context, log *internal.Log, d *libschema.Database, pm *cmigration) (result sql.Result, err error) {
+	conn, err := d.DB().Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get connection for migration %s", pm.Base().Name)
+	}
+	if pm.Base().HasDedicatedConn() {
+		defer internal.DiscardConn(conn)
+	} else {
+		defer conn.Close()
+	}
+	if pm.script != nil {
+		script := pm.script(ctx, conn)
+		err = lsmysql.CheckScriptError(script, pm.Base().HasSkipIf(), pm.Base().HasDedicatedConn(), pm.allowUnbounded)
+		if err == nil {
+			result, err = conn.ExecContext(ctx, script)
+		}
+		err = errors.Wrap(err, script)
+	} else {
+		err = libschema.ComputedResult(ctx, log, pm.Base().Name, pm.computed(ctx, conn))
+	}
+	return result, err
+}
+
+// CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
+// It is expected to be called by libschema.
+func (p *ClickHouse) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if schema != "" {
+		_, err := d.DB().ExecContext(ctx, `CREATE DATABASE IF NOT EXISTS `+schema)
+		if err != nil {
+			return errors.Wrapf(err, "Could not create libschema database '%s'", schema)
+		}
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			library		String,
+			migration	String,
+			done		UInt8,
+			error		String,
+			applied_by	String DEFAULT '',
+			run_id		Nullable(String),
+			comment		Nullable(String),
+			updated_at	DateTime64(6)
+		)
+		ENGINE = ReplacingMergeTree(updated_at)
+		ORDER BY (library, migration)`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table.  If the tracking
+// table is in a database and that database is now empty, the database is
+// dropped too.
+// It is expected to be called by libschema.
+func (p *ClickHouse) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP TABLE IF EXISTS `+tableName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	if schema == "" {
+		return nil
+	}
+	var count uint64
+	err = d.DB().QueryRowContext(ctx, `
+		SELECT	count()
+		FROM	system.tables
+		WHERE	database = ?`, schema).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check if libschema database '%s' is empty", schema)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP DATABASE IF EXISTS `+schema)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema database '%s'", schema)
+	}
+	return nil
+}
+
+var simpleIdentifierRE = regexp.MustCompile(`\A[A-Za-z_][A-Za-z0-9_]*\z`)
+
+func trackingSchemaTable(d *libschema.Database) (string, string, error) {
+	tableName := d.Options.TrackingTable
+	s := strings.Split(tableName, ".")
+	switch len(s) {
+	case 2:
+		schema := s[0]
+		if !simpleIdentifierRE.MatchString(schema) {
+			return "", "", errors.Errorf("Tracking table schema name must be a simple identifier, not '%s'", schema)
+		}
+		table := s[1]
+		if !simpleIdentifierRE.MatchString(table) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", table)
+		}
+		return schema, schema + "." + table, nil
+	case 1:
+		if !simpleIdentifierRE.MatchString(tableName) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", tableName)
+		}
+		return "", tableName, nil
+	default:
+		return "", "", errors.Errorf("Tracking table '%s' is not valid", tableName)
+	}
+}
+
+// trackingTable returns the schema+table reference for the migration tracking table.
+func trackingTable(d *libschema.Database) string {
+	_, table, _ := trackingSchemaTable(d)
+	return table
+}
+
+// statusSaver inserts a new row.  ReplacingMergeTree keeps only the row with
+// the latest updated_at (eventually: LoadStatus uses FINAL).
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.QuestionPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			INSERT INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at)
+			VALUES (%s, %s, %s, %s, %s, %s, %s, now64(6))`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+	DoneValue: func(done bool) interface{} {
+		return boolToUInt8(done)
+	},
+}
+
+func (p *ClickHouse) saveStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	return statusSaver.Save(ctx, log, d.DB(), d, trackingTable(d), m, done, migrationError)
+}
+
+func boolToUInt8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *ClickHouse) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.saveStatus(ctx, log, d, m, true, nil)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *ClickHouse) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	return p.saveStatus(ctx, log, d, m, done, nil)
+}
+
+// LockMigrationsTable locks the migration tracking table for exclusive use by the
+// migrations running now.
+// It is expected to be called by libschema.
+//
+// The lock is a table: whoever creates it holds the lock.  If the lock
+// table already exists, LockMigrationsTable waits until it is dropped
+// or the context is cancelled.
+func (p *ClickHouse) LockMigrationsTable(ctx context.Context, log *internal.Log, d *libschema.Database) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if p.lockTable != "" {
+		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
+	}
+	lockTable := tableName + "_lock"
+	for {
+		_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
+			CREATE TABLE %s (
+				locked_at	DateTime DEFAULT now()
+			)
+			ENGINE = Log`, lockTable))
+		if err == nil {
+			p.lockTable = lockTable
+			p.lockDB = d.DB()
+			return nil
+		}
+		var exists uint8
+		existsErr := d.DB().QueryRowContext(ctx, `EXISTS TABLE `+lockTable).Scan(&exists)
+		if existsErr != nil || exists == 0 {
+			return errors.Wrapf(err, "Could not create lock table '%s' for libschema migrations", lockTable)
+		}
+		log.Info("Waiting for libschema migrations lock", map[string]interface{}{
+			"lockTable": lockTable,
+		})
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "Could not get lock table '%s' for libschema migrations", lockTable)
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
+
+// UnlockMigrationsTable unlocks the migration tracking table.
+// It is expected to be called by libschema.
+func (p *ClickHouse) UnlockMigrationsTable(_ *internal.Log) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.lockTable == "" {
+		return errors.Errorf("libschema migrations table, not locked")
+	}
+	_, err := p.lockDB.Exec(`DROP TABLE IF EXISTS ` + p.lockTable)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop lock table '%s' for libschema migrations", p.lockTable)
+	}
+	p.lockTable = ""
+	p.lockDB = nil
+	return nil
+}
+
+// LoadStatus loads the current status of all migrations from the migration tracking table.
+// It is expected to be called by libschema.
+func (p *ClickHouse) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	tableName := trackingTable(d)
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s FINAL`, tableName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	defer rows.Close()
+	var unknowns []libschema.MigrationName
+	for rows.Next() {
+		var (
+			name   libschema.MigrationName
+			done   uint8
+			status libschema.MigrationStatus
+		)
+		err := rows.Scan(&name.Library, &name.Name, &done, &status.Error)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot scan migration status")
+		}
+		status.Done = done != 0
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(status)
+		} else if status.Done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+// IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
+// should always return nil.
+// It is expected to be called by libschema.
+func (p *ClickHouse) IsMigrationSupported(d *libschema.Database, _ *internal.Log, migration libschema.Migration) error {
+	m, ok := migration.(*cmigration)
+	if !ok {
+		return fmt.Errorf("Non-clickhouse migration %s registered with clickhouse migrations", migration.Base().Name)
+	}
+	if m.HasSkipIfTx() {
+		return errors.Errorf("Migration %s uses WithSkipIf which requires transactions: use SkipIf instead", m.Name)
+	}
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
+	}
+	return d.ValidateMigration(m, m.sqlText)
+}
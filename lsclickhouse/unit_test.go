@@ -0,0 +1,138 @@
+package lsclickhouse
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const statusQuery = "SELECT library, migration, done, error FROM libschema.migration_status FINAL"
+
+func TestMigrate(t *testing.T) {
+	fake := fakesql.Scenario{
+		StatusQuery: statusQuery,
+		SaveStatus:  "INSERT INTO libschema.migration_status",
+		True:        int64(1),
+		False:       int64(0),
+		Failure:     errors.New("code: 60, table t3 does not exist"),
+		New: func(log *internal.Log, s *libschema.Schema, db *sql.DB) (*libschema.Database, libschema.Driver, error) {
+			return New(log, "test", s, db)
+		},
+		Script: Script,
+		Pool:   1,
+	}.Run(t)
+
+	creates := fake.Matching("CREATE TABLE IF NOT EXISTS libschema.migration_status ")
+	require.Len(t, creates, 1)
+	assert.Contains(t, creates[0].Query, "ENGINE = ReplacingMergeTree(updated_at)", "status rows are replaced, not updated")
+	assert.Empty(t, fake.Matching("BEGIN"), "no transactions")
+	assert.Empty(t, fake.Matching("ALTER TABLE"), "no mutations of the status")
+	assert.True(t, fake.Sequence(
+		"CREATE TABLE libschema.migration_status_lock",
+		statusQuery,
+		"INSERT INTO t2",
+		"INSERT INTO libschema.migration_status",
+		"INSERT INTO t3",
+		"INSERT INTO libschema.migration_status",
+		"DROP TABLE IF EXISTS libschema.migration_status_lock",
+	), "statements:\n%s", fake)
+}
+
+func TestUnboundedMutation(t *testing.T) {
+	fake := &fakesql.DB{}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	s := libschema.New(ctx, libschema.Options{})
+	dbase, _, err := New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L",
+		Script("T1", `DELETE FROM t1`, WithAllowUnboundedMutation()),
+		Script("T2", `UPDATE t2 SET x = 1`),
+	)
+
+	err = s.Migrate(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "without a WHERE clause")
+	assert.Len(t, fake.Matching("DELETE FROM t1"), 1, "allowed")
+	assert.Empty(t, fake.Matching("UPDATE t2"), "not run")
+	saved := fake.Matching("INSERT INTO libschema.migration_status")
+	require.Len(t, saved, 2)
+	assert.Equal(t, []driver.Value{"L", "T2", int64(0)}, saved[1].Args[:3], "failure")
+}
+
+func TestLockWait(t *testing.T) {
+	defer func(interval time.Duration) {
+		LockPollInterval = interval
+	}(LockPollInterval)
+	LockPollInterval = time.Millisecond
+
+	var creates int
+	lockHeld := true
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			switch {
+			case strings.HasPrefix(query, "CREATE TABLE libschema.migration_status_lock"):
+				creates++
+				if creates < 3 {
+					return nil, errors.New("code: 57, table already exists")
+				}
+			case query == "EXISTS TABLE libschema.migration_status_lock":
+				exists := int64(0)
+				if lockHeld {
+					exists = 1
+				}
+				return &fakesql.Rows{
+					Columns: []string{"result"},
+					Values:  [][]driver.Value{{exists}},
+				}, nil
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(ctx, libschema.Options{})
+	d, p, err := New(log, "test", s, db)
+	require.NoError(t, err)
+
+	fakesql.CheckLocking(t,
+		func() error { return p.LockMigrationsTable(ctx, log, d) },
+		func() error { return p.UnlockMigrationsTable(log) })
+	assert.Equal(t, 4, creates, "waited for the lock table to be dropped")
+	assert.Len(t, fake.Matching("DROP TABLE IF EXISTS libschema.migration_status_lock"), 2)
+
+	// a failure to create the lock table that is not because it exists
+	creates = 0
+	lockHeld = false
+	assert.Error(t, p.LockMigrationsTable(ctx, log, d), "create failed")
+	assert.Equal(t, 1, creates, "no waiting")
+
+	// waiting ends with the context
+	creates = 0
+	lockHeld = true
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	LockPollInterval = time.Hour
+	assert.Error(t, p.LockMigrationsTable(cctx, log, d), "cancelled")
+}
+
+func TestBoolToUInt8(t *testing.T) {
+	assert.Equal(t, uint8(1), boolToUInt8(true))
+	assert.Equal(t, uint8(0), boolToUInt8(false))
+}
@@ -0,0 +1,424 @@
+// Package lsduckdb has a libschema.Driver support DuckDB
+package lsduckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// DuckDB is a libschema.Driver for connecting to DuckDB databases.  It
+// uses only database/sql so it should work with github.com/marcboeker/go-duckdb.
+//
+// DuckDB databases have the following characteristics:
+// * Can do DDL commands inside transactions
+// * Support UPSERT using INSERT ... ON CONFLICT
+// * Are embedded in a single process
+//
+// Since only one process can open a DuckDB database for writing, the
+// migration lock is an in-process mutex.  It is shared by all DuckDB
+// drivers that use the same *sql.DB.
+type DuckDB struct {
+	locked bool
+	lockDB *sql.DB
+	lock   sync.Mutex
+}
+
+// locks holds a *sync.Mutex for each *sql.DB
+var locks sync.Map
+
+// New creates a libschema.Database with a DuckDB driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (*libschema.Database, error) {
+	return schema.NewDatabase(log, name, db, &DuckDB{})
+}
+
+type dmigration struct {
+	libschema.MigrationBase
+	sqlText  string // set by Script()
+	script   func(context.Context, *sql.Tx) string
+	computed func(context.Context, *sql.Tx) error
+}
+
+func (m *dmigration) Copy() libschema.Migration {
+	return &dmigration{
+		MigrationBase: m.MigrationBase.Copy(),
+		sqlText:       m.sqlText,
+		script:        m.script,
+		computed:      m.computed,
+	}
+}
+
+func (m *dmigration) Base() *libschema.MigrationBase {
+	return &m.MigrationBase
+}
+
+// String describes the migration for logs and test failures
+func (m *dmigration) String() string {
+	switch {
+	case m.computed != nil:
+		return m.Describe("computed")
+	case m.sqlText != "":
+		return m.Describe("script")
+	default:
+		return m.Describe("generate")
+	}
+}
+
+// Script creates a libschema.Migration from a SQL string
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := Generate(name, func(_ context.Context, _ *sql.Tx) string {
+		return sqlText
+	}, opts...)
+	m.(*dmigration).sqlText = sqlText
+	return m
+}
+
+// Generate creates a libschema.Migration from a function that returns a
+// SQL string
+func Generate(
+	name string,
+	generator func(context.Context, *sql.Tx) string,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return dmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		script: generator,
+	}.applyOpts(opts)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return dmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		computed: action,
+	}.applyOpts(opts)
+}
+
+func (m dmigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
+	lsm := libschema.Migration(&m)
+	for _, opt := range opts {
+		opt(lsm)
+	}
+	return lsm
+}
+
+// DoOneMigration applies a single migration.  The migration and its
+// status are committed together.
+// It is expected to be called by libschema.
+func (p *DuckDB) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (result sql.Result, err error) {
+	defer func() {
+		if err == nil {
+			m.Base().SetStatus(libschema.MigrationStatus{
+				Done: true,
+			})
+		}
+	}()
+	conn, release, err := d.DedicatedConn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var tx *sql.Tx
+	if conn != nil {
+		tx, err = conn.BeginTx(ctx, d.TxOptions(m))
+	} else {
+		tx, err = d.BeginTx(ctx, m)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = errors.Wrapf(tx.Commit(), "Commit migration %s", m.Base().Name)
+		}
+	}()
+	if d.Options.SchemaOverride != "" {
+		if !simpleIdentifierRE.MatchString(d.Options.SchemaOverride) {
+			return nil, errors.Errorf("Options.SchemaOverride must be a simple identifier, not '%s'", d.Options.SchemaOverride)
+		}
+		_, err := tx.ExecContext(ctx, `SET search_path = '`+d.Options.SchemaOverride+`'`)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Set search path to %s for %s", d.Options.SchemaOverride, m.Base().Name)
+		}
+	}
+	pm := m.(*dmigration)
+	var skip bool
+	skip, err = m.Base().SkipIfTx(ctx, tx)
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	case pm.script != nil:
+		script := pm.script(ctx, tx)
+		result, err = tx.ExecContext(ctx, script)
+		err = errors.Wrap(err, script)
+	default:
+		err = libschema.ComputedResult(ctx, log, m.Base().Name, pm.computed(ctx, tx))
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		_ = tx.Rollback()
+		if d.Options.WithoutFailureStatus {
+			return nil, err
+		}
+		release()
+		return nil, p.saveFailure(ctx, log, d, m, err)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil)
+	return
+}
+
+// saveFailure records a failed migration.  The migration transaction
+// has been rolled back so the status is saved in a transaction of its own.
+func (p *DuckDB) saveFailure(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error) error {
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, false, migrationError)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
+}
+
+// CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
+// It is expected to be called by libschema.
+func (p *DuckDB) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if schema != "" {
+		_, err := d.DB().ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema)
+		if err != nil {
+			return errors.Wrapf(err, "Could not create libschema schema '%s'", schema)
+		}
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			library		VARCHAR NOT NULL,
+			migration	VARCHAR NOT NULL,
+			done		BOOLEAN NOT NULL,
+			error		VARCHAR NOT NULL,
+			applied_by	VARCHAR,
+			run_id		VARCHAR,
+			comment		VARCHAR,
+			updated_at	TIMESTAMPTZ DEFAULT current_timestamp,
+			PRIMARY KEY	(library, migration)
+		)`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table.  If the tracking
+// table is in a schema and that schema is now empty, the schema is dropped
+// too.
+// It is expected to be called by libschema.
+func (p *DuckDB) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP TABLE IF EXISTS `+tableName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	if schema == "" {
+		return nil
+	}
+	var count int
+	err = d.DB().QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = ?`, schema).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check if libschema schema '%s' is empty", schema)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema schema '%s'", schema)
+	}
+	return nil
+}
+
+var simpleIdentifierRE = regexp.MustCompile(`\A[A-Za-z_][A-Za-z0-9_]*\z`)
+
+func trackingSchemaTable(d *libschema.Database) (string, string, error) {
+	tableName := d.Options.TrackingTable
+	s := strings.Split(tableName, ".")
+	switch len(s) {
+	case 2:
+		schema := s[0]
+		if !simpleIdentifierRE.MatchString(schema) {
+			return "", "", errors.Errorf("Tracking table schema name must be a simple identifier, not '%s'", schema)
+		}
+		table := s[1]
+		if !simpleIdentifierRE.MatchString(table) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", table)
+		}
+		return schema, schema + "." + table, nil
+	case 1:
+		if !simpleIdentifierRE.MatchString(tableName) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", tableName)
+		}
+		return "", tableName, nil
+	default:
+		return "", "", errors.Errorf("Tracking table '%s' is not valid", tableName)
+	}
+}
+
+// trackingTable returns the schema+table reference for the migration tracking table.
+func trackingTable(d *libschema.Database) string {
+	_, table, _ := trackingSchemaTable(d)
+	return table
+}
+
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.QuestionPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			INSERT INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at)
+			VALUES (%s, %s, %s, %s, %s, %s, %s, current_timestamp)
+			ON CONFLICT (library, migration) DO UPDATE
+			SET	done = EXCLUDED.done,
+				error = EXCLUDED.error,
+				applied_by = EXCLUDED.applied_by,
+				run_id = EXCLUDED.run_id,
+				comment = EXCLUDED.comment,
+				updated_at = EXCLUDED.updated_at`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+}
+
+func (p *DuckDB) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	return statusSaver.Save(ctx, log, tx, d, trackingTable(d), m, done, migrationError)
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *DuckDB) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.SetMigrationStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *DuckDB) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// LockMigrationsTable locks the migration tracking table for exclusive use by the
+// migrations running now.  The lock is an in-process mutex.
+// It is expected to be called by libschema.
+func (p *DuckDB) LockMigrationsTable(_ context.Context, _ *internal.Log, d *libschema.Database) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.locked {
+		return errors.Errorf("libschema migrations table, '%s' already locked", trackingTable(d))
+	}
+	mu, _ := locks.LoadOrStore(d.DB(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	p.locked = true
+	p.lockDB = d.DB()
+	return nil
+}
+
+// UnlockMigrationsTable unlocks the migration tracking table.
+// It is expected to be called by libschema.
+func (p *DuckDB) UnlockMigrationsTable(_ *internal.Log) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.locked {
+		return errors.Errorf("libschema migrations table, not locked")
+	}
+	mu, _ := locks.Load(p.lockDB)
+	mu.(*sync.Mutex).Unlock()
+	p.locked = false
+	p.lockDB = nil
+	return nil
+}
+
+// LoadStatus loads the current status of all migrations from the migration tracking table.
+// It is expected to be called by libschema.
+func (p *DuckDB) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	tableName := trackingTable(d)
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s`, tableName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	defer rows.Close()
+	var unknowns []libschema.MigrationName
+	for rows.Next() {
+		var (
+			name   libschema.MigrationName
+			status libschema.MigrationStatus
+		)
+		err := rows.Scan(&name.Library, &name.Name, &status.Done, &status.Error)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot scan migration status")
+		}
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(status)
+		} else if status.Done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+// IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
+// should always return nil.
+// It is expected to be called by libschema.
+func (p *DuckDB) IsMigrationSupported(d *libschema.Database, _ *internal.Log, migration libschema.Migration) error {
+	m, ok := migration.(*dmigration)
+	if !ok {
+		return fmt.Errorf("Non-duckdb migration %s registered with duckdb migrations", migration.Base().Name)
+	}
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
+	}
+	return d.ValidateMigration(m, m.sqlText)
+}
@@ -0,0 +1,98 @@
+package lsduckdb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const statusQuery = "SELECT library, migration, done, error FROM libschema.migration_status"
+
+func TestMigrate(t *testing.T) {
+	var p *DuckDB
+	fake := fakesql.Scenario{
+		StatusQuery: statusQuery,
+		SaveStatus:  "INSERT INTO libschema.migration_status",
+		True:        true,
+		False:       false,
+		Failure:     errors.New("Constraint Error: duplicate key"),
+		New: func(log *internal.Log, s *libschema.Schema, db *sql.DB) (*libschema.Database, libschema.Driver, error) {
+			p = &DuckDB{}
+			d, err := s.NewDatabase(log, "test", db, p)
+			return d, p, err
+		},
+		Script: Script,
+		T2:     `CREATE TABLE t2 (id INTEGER)`,
+		Pool:   1,
+	}.Run(t)
+
+	assert.True(t, fake.Sequence(
+		"CREATE SCHEMA IF NOT EXISTS libschema",
+		"CREATE TABLE IF NOT EXISTS libschema.migration_status",
+		statusQuery,
+		"BEGIN", "CREATE TABLE t2", "INSERT INTO libschema.migration_status", "COMMIT",
+		"BEGIN", "INSERT INTO t3", "ROLLBACK",
+		"BEGIN", "INSERT INTO libschema.migration_status", "COMMIT",
+	), "DDL is transactional, statements:\n%s", fake)
+	d := &libschema.Database{Options: libschema.Options{TrackingTable: "libschema.migration_status"}}
+	assert.NoError(t, p.LockMigrationsTable(context.Background(), nil, d), "unlocked after Migrate")
+	assert.NoError(t, p.UnlockMigrationsTable(nil))
+}
+
+func TestSchemaOverride(t *testing.T) {
+	fake := &fakesql.DB{}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	s := libschema.New(ctx, libschema.Options{SchemaOverride: "other"})
+	dbase, err := New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L", Script("T1", `CREATE TABLE t1 (id INTEGER)`))
+
+	require.NoError(t, s.Migrate(ctx))
+	assert.True(t, fake.Sequence(
+		"BEGIN", "SET search_path = 'other'", "CREATE TABLE t1", "INSERT INTO libschema.migration_status", "COMMIT",
+	), "statements:\n%s", fake)
+}
+
+func TestLock(t *testing.T) {
+	d := &libschema.Database{
+		Options: libschema.Options{
+			TrackingTable: "migration_status",
+		},
+	}
+	p1 := &DuckDB{}
+	p2 := &DuckDB{}
+	fakesql.CheckLocking(t,
+		func() error { return p1.LockMigrationsTable(context.Background(), nil, d) },
+		func() error { return p1.UnlockMigrationsTable(nil) })
+	require.NoError(t, p1.LockMigrationsTable(context.Background(), nil, d))
+
+	locked := make(chan struct{})
+	go func() {
+		assert.NoError(t, p2.LockMigrationsTable(context.Background(), nil, d))
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lock acquired while first held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, p1.UnlockMigrationsTable(nil))
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not acquired")
+	}
+	require.NoError(t, p2.UnlockMigrationsTable(nil))
+}
@@ -0,0 +1,112 @@
+package lsmysql
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Alter is an ALTER TABLE statement split into its clauses, see
+// ParseAlter.
+type Alter struct {
+	Database string // empty if the statement does not name one
+	Table    string
+	Clauses  []string
+}
+
+// ParseAlter splits a single ALTER TABLE statement into its clauses.  A
+// multi-clause ALTER TABLE is all-or-nothing: if it fails part way (or
+// the process dies), running it again fails on the clauses that were
+// applied.  With ParseAlter, a Computed migration can run only the
+// clauses that are not already in effect (see DoesColumnExist and
+// TableHasIndex) by removing the others from Clauses and executing
+// String().
+//
+// Clauses are split on commas that are not inside parentheses, quotes,
+// or comments.  Comments are kept with the clause they are in.
+func ParseAlter(script string) (*Alter, error) {
+	database, table, alter, err := parseAlterTable(script)
+	if err != nil {
+		return nil, errors.New("ParseAlter requires a single ALTER TABLE statement")
+	}
+	clauses, err := splitClauses(alter)
+	if err != nil {
+		return nil, err
+	}
+	return &Alter{
+		Database: database,
+		Table:    table,
+		Clauses:  clauses,
+	}, nil
+}
+
+// String reassembles the ALTER TABLE statement.  It returns an empty
+// string if there are no clauses.
+func (a Alter) String() string {
+	if len(a.Clauses) == 0 {
+		return ""
+	}
+	table := quoteName(a.Table)
+	if a.Database != "" {
+		table = quoteName(a.Database) + "." + table
+	}
+	return "ALTER TABLE " + table + "\n\t" + strings.Join(a.Clauses, ",\n\t")
+}
+
+// splitClauses splits on top-level commas
+func splitClauses(s string) ([]string, error) {
+	var clauses []string
+	add := func(clause string) error {
+		if !hasContent(clause) {
+			return errors.Errorf("ALTER TABLE has an empty clause")
+		}
+		clauses = append(clauses, strings.TrimSpace(clause))
+		return nil
+	}
+	depth := 0
+	start := 0
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(s, i)
+		case c == '#' || isDashComment(s[i:]):
+			if n := strings.IndexByte(s[i:], '\n'); n != -1 {
+				i += n + 1
+			} else {
+				i = len(s)
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			if n := strings.Index(s[i+2:], "*/"); n != -1 {
+				i += n + 4
+			} else {
+				i = len(s)
+			}
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			if depth == 0 {
+				return nil, errors.Errorf("ALTER TABLE has unbalanced parentheses")
+			}
+			depth--
+			i++
+		case c == ',' && depth == 0:
+			if err := add(s[start:i]); err != nil {
+				return nil, err
+			}
+			i++
+			start = i
+		default:
+			i++
+		}
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("ALTER TABLE has unbalanced parentheses")
+	}
+	if err := add(s[start:]); err != nil {
+		return nil, err
+	}
+	return clauses, nil
+}
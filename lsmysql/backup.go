@@ -0,0 +1,167 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBackupSizeLimit is the largest table, in bytes of data as
+// reported by information_schema, that WithBackupTables will copy unless
+// WithBackupSizeLimit is used.  The size is the server's estimate: for
+// InnoDB it comes from sampled statistics and can be off by a good
+// margin.
+const DefaultBackupSizeLimit = 1 << 30
+
+const backupTimestamp = "20060102150405"
+
+// maxBackupSourceLength is the longest table name that leaves room
+// for the backup suffix within MySQL's 64 character identifier limit
+var maxBackupSourceLength = 64 - len(backupTableName("", time.Time{}))
+
+// WithBackupTables copies each of the listed tables before the migration
+// runs so that there is a quick way back if the migration goes wrong.
+// The tables are not copied if WithSkipIf skips the migration.
+// Each table is copied with
+//
+//	CREATE TABLE table_bak_YYYYMMDDHHMMSS AS SELECT * FROM table
+//
+// using the UTC time.  The copy has the rows and columns of the table but
+// not its indexes.  Tables larger than the limit set with
+// WithBackupSizeLimit are not copied: the migration fails instead.  The
+// names of the copies are logged and saved in the backup_tables column
+// of the tracking table.  Backups are made on every attempt at the
+// migration and are never dropped by libschema.  Table names must be
+// simple identifiers, optionally qualified with a schema name.
+// Unqualified names are in the schema from WithUseSchema or
+// Options.SchemaOverride, if set.  Except for online schema changes, the
+// copies are made on a second connection while the migration
+// transaction is open, so WithBackupTables cannot be used with
+// WithMaxConnections(1) or a pool limited to one connection.
+func WithBackupTables(tables ...string) libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			backup := make([]string, len(mm.backup), len(mm.backup)+len(tables))
+			copy(backup, mm.backup)
+			mm.backup = append(backup, tables...)
+		}
+	}
+}
+
+// WithBackupSizeLimit sets the largest table, in bytes, that
+// WithBackupTables will copy.  The default is DefaultBackupSizeLimit.
+// A negative limit means there is no limit.  Sizes are read from
+// information_schema.tables with information_schema_stats_expiry set
+// to 0 so that MySQL 8 does not answer with a cached size.  They are
+// still estimates.
+func WithBackupSizeLimit(bytes int64) MySQLOpt {
+	return func(p *MySQL) {
+		p.backupSizeLimit = bytes
+	}
+}
+
+func backupTableName(table string, at time.Time) string {
+	return table + "_bak_" + at.UTC().Format(backupTimestamp)
+}
+
+// validBackupTable checks a table name given to WithBackupTables
+func validBackupTable(table string) bool {
+	if !validTableReference(table) {
+		return false
+	}
+	return len(table[strings.LastIndex(table, ".")+1:]) <= maxBackupSourceLength
+}
+
+// backupTables copies the tables of WithBackupTables.  The sizes of all
+// of the tables are checked before any are copied.  It returns the names
+// of the copies.
+func (p *MySQL) backupTables(ctx context.Context, log *internal.Log, d *libschema.Database, pm *mmigration) ([]string, error) {
+	limit := p.backupSizeLimit
+	if limit == 0 {
+		limit = DefaultBackupSizeLimit
+	}
+	defaultSchema := pm.useSchema
+	if defaultSchema == "" {
+		defaultSchema = d.Options.SchemaOverride
+	}
+	conn, err := d.DB().Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get a connection to back up tables for migration %s", pm.Base().Name)
+	}
+	defer conn.Close()
+	// MySQL 8 caches table sizes in information_schema for up to
+	// information_schema_stats_expiry seconds.  Older versions and
+	// MariaDB do not cache them and do not have the variable.
+	_, err = conn.ExecContext(ctx, `SET SESSION information_schema_stats_expiry = 0`)
+	if err != nil && !isUnknownVariable(err) {
+		return nil, errors.Wrapf(err, "Could not turn off cached table sizes to back up tables for migration %s", pm.Base().Name)
+	}
+	now := time.Now()
+	sources := make([]string, len(pm.backup))
+	backups := make([]string, len(pm.backup))
+	for i, table := range pm.backup {
+		schema := defaultSchema
+		if dot := strings.LastIndex(table, "."); dot != -1 {
+			schema, table = table[:dot], table[dot+1:]
+		}
+		var size sql.NullInt64
+		err := conn.QueryRowContext(ctx, `
+			SELECT	data_length
+			FROM	information_schema.tables
+			WHERE	table_schema = COALESCE(NULLIF(?, ''), DATABASE())
+			AND	table_name = ?`, schema, table).Scan(&size)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, errors.Errorf("Table '%s' for WithBackupTables in migration %s does not exist", pm.backup[i], pm.Base().Name)
+		case err != nil:
+			return nil, errors.Wrapf(err, "Could not check the size of '%s' to back it up for migration %s", pm.backup[i], pm.Base().Name)
+		case limit > 0 && size.Int64 > limit:
+			return nil, errors.Errorf("Table '%s' is %d bytes, more than the backup limit of %d, for migration %s", pm.backup[i], size.Int64, limit, pm.Base().Name)
+		}
+		sources[i] = table
+		backups[i] = backupTableName(table, now)
+		if schema != "" {
+			sources[i] = schema + "." + sources[i]
+			backups[i] = schema + "." + backups[i]
+		}
+	}
+	for i, source := range sources {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %s AS SELECT * FROM %s`, backups[i], source))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not back up '%s' for migration %s", source, pm.Base().Name)
+		}
+	}
+	log.Info("Backed up tables before migration", map[string]interface{}{
+		"migration": pm.Base().Name,
+		"backups":   backups,
+	})
+	return backups, nil
+}
+
+// isUnknownVariable returns true for setting a system variable that the
+// server does not have (1193)
+func isUnknownVariable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1193
+}
+
+// saveBackupTables records the names of the backups made for the latest
+// attempt at a migration
+func (p *MySQL) saveBackupTables(ctx context.Context, tx *sql.Tx, d *libschema.Database, pm *mmigration) error {
+	ph := p.placeholder
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE	%s
+		SET	backup_tables = %s
+		WHERE	library = %s
+		AND	migration = %s`, p.trackingTable(d), ph(1), ph(2), ph(3)),
+		strings.Join(pm.backupsMade, ","), pm.Base().Name.Library, pm.Base().Name.Name)
+	return errors.Wrapf(err, "Save backup tables for %s", pm.Base().Name)
+}
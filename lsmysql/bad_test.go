@@ -47,6 +47,16 @@ func TestBadMigrationsMysql(t *testing.T) {
 				dbase.Migrations("L2", lsmysql.Script("T5", `CREATE TABLE T2 (id text)`))
 			},
 		},
+		{
+			name:  "duplicate migration",
+			error: `library 'L2' has duplicate migration names: 'T4'`,
+			define: func(dbase *libschema.Database) {
+				dbase.Migrations("L2",
+					lsmysql.Script("T4", `CREATE TABLE T1 (id text)`),
+					lsmysql.Script("T4", `CREATE TABLE T2 (id text)`),
+				)
+			},
+		},
 		{
 			name:  "bad table1",
 			error: `Tracking table 'foo.bar.baz' is not valid`,
@@ -1,10 +1,14 @@
 package lsmysql
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/muir/libschema/internal"
 	"github.com/muir/sqltoken"
+	"github.com/pkg/errors"
 )
 
 type CheckResult string
@@ -13,41 +17,459 @@ const (
 	Safe             CheckResult = "safe"
 	DataAndDDL       CheckResult = "dataAndDDL"
 	NonIdempotentDDL CheckResult = "nonIdempotentDDL"
+	// ConnectionStateChange is for scripts with USE or SET statements.
+	// Those change the state of the connection and the change
+	// leaks back into the connection pool.
+	ConnectionStateChange CheckResult = "connectionStateChange"
+	// UnboundedMutation is for scripts with an UPDATE or DELETE that
+	// does not have a WHERE clause.
+	UnboundedMutation CheckResult = "unboundedMutation"
+	// TrackingTableAccess is for scripts that reference the libschema
+	// tracking table.  It is only found by CheckScriptTrackingTable.
+	TrackingTableAccess CheckResult = "trackingTableAccess"
 )
 
+// StatementPosition locates a statement within a script
+type StatementPosition struct {
+	Index  int    // zero-based statement number
+	Line   int    // one-based line where the statement starts
+	Column int    // one-based column (in characters) where the statement starts
+	Word   string // first word of the statement, lowercased
+}
+
+func (p StatementPosition) String() string {
+	return fmt.Sprintf("statement %d (%s) at line %d, column %d", p.Index+1, strings.ToUpper(p.Word), p.Line, p.Column)
+}
+
+// ScriptCheck is the detailed result of checking a script.  The
+// positions are nil if no such statement was found.
+type ScriptCheck struct {
+	Result                     CheckResult
+	FirstDDL                   *StatementPosition
+	FirstData                  *StatementPosition
+	FirstNonIdempotentDDL      *StatementPosition
+	FirstConnectionStateChange *StatementPosition
+	FirstUnboundedMutation     *StatementPosition
+	FirstTrackingTableAccess   *StatementPosition // only set by CheckScriptTrackingTable
+}
+
 var ifExistsRE = regexp.MustCompile(`(?i)\bIF (?:NOT )?EXISTS\b`)
 
 // CheckScript attempts to validate that an SQL command does not do
-// both schema changes (DDL) and data changes.
+// both schema changes (DDL) and data changes.  Use CheckScriptDetails
+// to find out which statements are a problem.
 func CheckScript(s string) CheckResult {
+	return CheckScriptDetails(s).Result
+}
+
+// CheckScriptDetails attempts to validate that an SQL command does not do
+// both schema changes (DDL) and data changes.  It also checks that DDL is
+// idempotent, that the script does not change the connection state
+// with USE or SET, and that every UPDATE and DELETE has a WHERE clause.
+// The position of the first problematic statements are returned.  If
+// there is more than one problem, Result is the first of DataAndDDL,
+// ConnectionStateChange, NonIdempotentDDL, and UnboundedMutation.
+func CheckScriptDetails(s string) ScriptCheck {
+	var check ScriptCheck
 	var seenDDL int
 	var seenData int
 	var idempotent int
-	ts := sqltoken.TokenizeMySQL(s)
-	for _, cmd := range ts.Strip().CmdSplit() {
-		word := strings.ToLower(cmd[0].Text)
-		switch word {
+	for _, cmd := range splitStatements(s) {
+		pos := cmd.position
+		switch pos.Word {
 		case "alter", "rename", "create", "drop", "comment":
 			seenDDL++
-			if ifExistsRE.MatchString(cmd.String()) {
+			if check.FirstDDL == nil {
+				check.FirstDDL = &pos
+			}
+			if ifExistsRE.MatchString(cmd.text) {
 				idempotent++
+			} else if check.FirstNonIdempotentDDL == nil {
+				check.FirstNonIdempotentDDL = &pos
 			}
 		case "truncate":
 			seenDDL++
 			idempotent++
+			if check.FirstDDL == nil {
+				check.FirstDDL = &pos
+			}
 		case "use", "set":
-			// neither
+			if check.FirstConnectionStateChange == nil {
+				check.FirstConnectionStateChange = &pos
+			}
 		case "values", "table", "select":
 			// doesn't modify anything
 		case "call", "delete", "do", "handler", "import", "insert", "load", "replace", "update", "with":
 			seenData++
+			if check.FirstData == nil {
+				check.FirstData = &pos
+			}
+			if (pos.Word == "update" || pos.Word == "delete") && !cmd.where && check.FirstUnboundedMutation == nil {
+				check.FirstUnboundedMutation = &pos
+			}
 		}
 	}
-	if seenDDL > 0 && seenData > 0 {
-		return DataAndDDL
+	switch {
+	case seenDDL > 0 && seenData > 0:
+		check.Result = DataAndDDL
+	case check.FirstConnectionStateChange != nil:
+		check.Result = ConnectionStateChange
+	case seenDDL > idempotent:
+		check.Result = NonIdempotentDDL
+	case check.FirstUnboundedMutation != nil:
+		check.Result = UnboundedMutation
+	default:
+		check.Result = Safe
+	}
+	return check
+}
+
+// CheckScriptTrackingTable is CheckScriptDetails plus a check that the
+// script does not reference the tracking table.  trackingTable is "table"
+// or "schema.table" and may be quoted.  A reference to the table that is
+// not qualified with a schema counts as a reference.  Columns and aliases
+// with the same name as the table do not.  If the script
+// references the tracking table, Result is TrackingTableAccess.
+func CheckScriptTrackingTable(s string, trackingTable string) ScriptCheck {
+	check := CheckScriptDetails(s)
+	check.FirstTrackingTableAccess = findTableReference(s, trackingTable)
+	if check.FirstTrackingTableAccess != nil {
+		check.Result = TrackingTableAccess
+	}
+	return check
+}
+
+// identifier is a word or quoted name in a statement.  dot is set for
+// punctuation that has a "." in it and other is set for other
+// punctuation.
+type identifier struct {
+	name    string
+	keyword string // upper case, for unquoted words only
+	dot     bool
+	comma   bool
+	other   bool
+}
+
+// tableKeywords are followed by table names
+var tableKeywords = map[string]bool{
+	"FROM":          true,
+	"JOIN":          true,
+	"STRAIGHT_JOIN": true,
+	"INTO":          true,
+	"UPDATE":        true,
+	"TABLE":         true,
+	"TABLES":        true,
+	"TRUNCATE":      true,
+	"REFERENCES":    true,
+	"USING":         true,
+}
+
+// tableModifiers can come between a table keyword and the table name
+var tableModifiers = map[string]bool{
+	"IF":           true,
+	"NOT":          true,
+	"EXISTS":       true,
+	"IGNORE":       true,
+	"LOW_PRIORITY": true,
+	"QUICK":        true,
+	"DELAYED":      true,
+}
+
+// statementTableKeywords are followed by a table name when they start
+// a statement
+var statementTableKeywords = map[string]bool{
+	"DELETE":   true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+}
+
+// findTableReference returns the position of the first statement that
+// names table where a table name can be.  Columns and aliases with the
+// same name do not count.  Double-quoted names are treated as
+// identifiers (as in ANSI_QUOTES mode).
+func findTableReference(s string, table string) *StatementPosition {
+	if table == "" {
+		return nil
+	}
+	var schema string
+	if i := strings.LastIndex(table, "."); i != -1 {
+		schema = unquoteIdentifier(table[:i])
+		table = table[i+1:]
 	}
-	if seenDDL > idempotent {
-		return NonIdempotentDDL
+	table = unquoteIdentifier(table)
+	for _, cmd := range splitStatements(s) {
+		var ids []identifier
+		for _, token := range sqltoken.TokenizeMySQL(cmd.text) {
+			// nolint:exhaustive
+			switch token.Type {
+			case sqltoken.Word:
+				ids = append(ids, identifier{name: token.Text, keyword: strings.ToUpper(token.Text)})
+			case sqltoken.Literal:
+				if strings.HasPrefix(token.Text, `"`) {
+					ids = append(ids, identifier{name: unquoteIdentifier(token.Text)})
+				} else {
+					ids = append(ids, identifier{other: true})
+				}
+			case sqltoken.Punctuation:
+				p := strings.Trim(token.Text, "`")
+				switch {
+				case p == "":
+				case strings.Contains(p, "."):
+					ids = append(ids, identifier{dot: true})
+				case p == ",":
+					ids = append(ids, identifier{comma: true})
+				default:
+					ids = append(ids, identifier{other: true})
+				}
+			case sqltoken.Whitespace, sqltoken.Comment:
+			default:
+				ids = append(ids, identifier{other: true})
+			}
+		}
+		if namesTable(ids, schema, table) {
+			pos := cmd.position
+			return &pos
+		}
+	}
+	return nil
+}
+
+// namesTable looks for schema.table, or just table, in the places in a
+// statement where a table name can be: after FROM, JOIN, INTO, UPDATE,
+// TABLE and the like, in comma-separated lists of tables, after TO in
+// RENAME, and after ON in index, trigger, and grant statements.
+func namesTable(ids []identifier, schema string, table string) bool {
+	var first, prev string
+	var expect, afterTable, aliased, onTable bool
+	for i := 0; i < len(ids); i++ {
+		id := ids[i]
+		if i == 0 {
+			first = id.keyword
+		}
+		switch id.keyword {
+		case "INDEX", "TRIGGER":
+			onTable = first == "CREATE" || first == "DROP"
+		case "GRANT", "REVOKE":
+			onTable = i == 0
+		}
+		switch {
+		case tableKeywords[id.keyword],
+			i == 0 && statementTableKeywords[id.keyword],
+			id.keyword == "TO" && ((afterTable && !aliased) || prev == "RENAME"),
+			id.keyword == "AS" && prev == "RENAME",
+			id.keyword == "ON" && onTable:
+			expect, afterTable = true, false
+		case expect && tableModifiers[id.keyword]:
+		case expect && id.name != "":
+			name, qualifier := id.name, ""
+			if i+2 < len(ids) && ids[i+1].dot && ids[i+2].name != "" {
+				qualifier, name = name, ids[i+2].name
+				i += 2
+			}
+			if strings.EqualFold(name, table) && (qualifier == "" || (schema != "" && strings.EqualFold(qualifier, schema))) {
+				return true
+			}
+			expect, afterTable, aliased = false, true, false
+		case id.comma:
+			expect, afterTable = afterTable, false
+		case afterTable && id.keyword == "AS":
+		case afterTable && !aliased && id.name != "":
+			aliased = true
+		default:
+			expect, afterTable = false, false
+		}
+		prev = id.keyword
+	}
+	return false
+}
+
+type statement struct {
+	position StatementPosition
+	text     string // without comments, whitespace collapsed
+	where    bool   // has WHERE outside of parenthesis
+}
+
+// splitStatements breaks a script into statements and records where
+// each one starts.  Comments are dropped and whitespace is collapsed.
+// WHERE is only noticed outside of strings, quoted identifiers, and
+// parenthesis (subqueries).
+// Empty statements are skipped.  DELIMITER directives are honored
+// (see SplitScript).
+func splitStatements(s string) []statement {
+	var statements []statement
+	chunks, _ := splitDelimited(s)
+	for _, c := range chunks {
+		var current *statement
+		var text []string
+		var depth int
+		var backquoted bool
+		offset := c.offset
+		for _, token := range sqltoken.TokenizeMySQL(c.text) {
+			// nolint:exhaustive
+			switch token.Type {
+			case sqltoken.Comment:
+			case sqltoken.Whitespace:
+				if current != nil {
+					text = append(text, " ")
+				}
+			default:
+				if current == nil {
+					line, column := lineColumn(s, offset)
+					current = &statement{
+						position: StatementPosition{
+							Index:  len(statements),
+							Line:   line,
+							Column: column,
+							Word:   strings.ToLower(token.Text),
+						},
+					}
+				}
+				text = append(text, token.Text)
+				switch token.Type {
+				case sqltoken.Punctuation:
+					depth += strings.Count(token.Text, "(") - strings.Count(token.Text, ")")
+					if strings.Count(token.Text, "`")%2 == 1 {
+						backquoted = !backquoted
+					}
+				case sqltoken.Word:
+					if depth == 0 && !backquoted && strings.EqualFold(token.Text, "where") {
+						current.where = true
+					}
+				}
+			}
+			offset += len(token.Text)
+		}
+		if current != nil {
+			current.text = strings.TrimSpace(strings.Join(text, ""))
+			statements = append(statements, *current)
+		}
+	}
+	return statements
+}
+
+// lineColumn returns the one-based line and column (in characters)
+// of a byte offset
+func lineColumn(s string, offset int) (int, int) {
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return line, column
+}
+
+// Severity is how a problem found by CheckScript is handled.  See
+// WithCheckSeverity.
+type Severity int
+
+const (
+	// SeverityError fails the migration.  This is the default.
+	SeverityError Severity = iota
+	// SeverityWarn logs a warning and runs the migration anyway.
+	SeverityWarn
+	// SeverityIgnore runs the migration without saying anything.
+	SeverityIgnore
+)
+
+// WithCheckSeverity changes how the problems that CheckScript finds in
+// Script() and Generate() migrations are handled.  The keys are
+// DataAndDDL, ConnectionStateChange, NonIdempotentDDL,
+// UnboundedMutation, and TrackingTableAccess.  Problems that are not in the map are errors.
+// The severity only applies to problems that are not already allowed:
+// NonIdempotentDDL is allowed with WithSkipIf, ConnectionStateChange
+// with WithDedicatedConn, and UnboundedMutation with
+// WithAllowUnboundedMutation.  TrackingTableAccess is allowed with
+// WithAllowTrackingTableAccess.
+func WithCheckSeverity(severities map[CheckResult]Severity) MySQLOpt {
+	return func(p *MySQL) {
+		p.checkSeverity = make(map[CheckResult]Severity, len(severities))
+		for result, severity := range severities {
+			p.checkSeverity[result] = severity
+		}
+	}
+}
+
+type checkProblem struct {
+	result CheckResult
+	err    error
+}
+
+// CheckScriptError is CheckScript for the other drivers that use the
+// MySQL script checks.  It returns the most serious problem with the
+// script, or nil.  Non-idempotent DDL is allowed when hasSkipIf,
+// connection state changes when dedicatedConn, and UPDATE or DELETE
+// without a WHERE clause when allowUnbounded.
+func CheckScriptError(script string, hasSkipIf bool, dedicatedConn bool, allowUnbounded bool) error {
+	return checkError(CheckScriptDetails(script), hasSkipIf, dedicatedConn, allowUnbounded)
+}
+
+// checkError turns a ScriptCheck into an error (or nil).  Connection
+// state changes are allowed when the migration has a dedicated connection
+// since that connection is discarded afterwards.
+func checkError(check ScriptCheck, hasSkipIf bool, dedicatedConn bool, allowUnbounded bool) error {
+	problems := checkProblems(check, hasSkipIf, dedicatedConn, allowUnbounded, false)
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems[0].err
+}
+
+// checkProblems lists the problems in a ScriptCheck, most serious first
+func checkProblems(check ScriptCheck, hasSkipIf bool, dedicatedConn bool, allowUnbounded bool, allowTrackingTable bool) []checkProblem {
+	var problems []checkProblem
+	if check.FirstTrackingTableAccess != nil && !allowTrackingTable {
+		problems = append(problems, checkProblem{
+			result: TrackingTableAccess,
+			err: errors.Errorf("Migration references the libschema tracking table in %s: use lsmysql.WithAllowTrackingTableAccess() if that is intended",
+				check.FirstTrackingTableAccess),
+		})
+	}
+	if check.FirstDDL != nil && check.FirstData != nil {
+		problems = append(problems, checkProblem{
+			result: DataAndDDL,
+			err: errors.Errorf("Migration combines DDL (Data Definition Language [schema changes]) and data manipulation: DDL in %s, data in %s",
+				check.FirstDDL, check.FirstData),
+		})
+	}
+	if check.FirstConnectionStateChange != nil && !dedicatedConn {
+		problems = append(problems, checkProblem{
+			result: ConnectionStateChange,
+			err: errors.Errorf("Migration changes the connection state (which leaks into the connection pool) in %s: use libschema.WithDedicatedConn()",
+				check.FirstConnectionStateChange),
+		})
+	}
+	if check.FirstNonIdempotentDDL != nil && !hasSkipIf {
+		problems = append(problems, checkProblem{
+			result: NonIdempotentDDL,
+			err: errors.Errorf("Unconditional migration has non-idempotent DDL (Data Definition Language [schema changes]) in %s",
+				check.FirstNonIdempotentDDL),
+		})
+	}
+	if check.FirstUnboundedMutation != nil && !allowUnbounded {
+		problems = append(problems, checkProblem{
+			result: UnboundedMutation,
+			err: errors.Errorf("Migration has an UPDATE or DELETE without a WHERE clause in %s: use WithAllowUnboundedMutation() if that is intended",
+				check.FirstUnboundedMutation),
+		})
+	}
+	return problems
+}
+
+// checkMigration applies WithCheckSeverity to the problems with a script.
+// trackingTable is the tracking table name from trackingSchemaTable.
+func (p *MySQL) checkMigration(log *internal.Log, pm *mmigration, script string, trackingTable string) error {
+	problems := checkProblems(CheckScriptTrackingTable(script, trackingTable), pm.Base().HasSkipIf(), pm.Base().HasDedicatedConn(), pm.allowUnbounded, pm.allowTracking)
+	for _, problem := range problems {
+		switch p.checkSeverity[problem.result] {
+		case SeverityIgnore:
+		case SeverityWarn:
+			log.Warn("Migration script check failed, running it anyway", map[string]interface{}{
+				"migration": pm.Base().Name,
+				"check":     string(problem.result),
+				"error":     problem.err.Error(),
+			})
+		default:
+			return problem.err
+		}
 	}
-	return Safe
+	return nil
 }
@@ -0,0 +1,124 @@
+package lsmysql_test
+
+import (
+	"testing"
+
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckScript(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   lsmysql.CheckResult
+	}{
+		{"empty", "", lsmysql.Safe},
+		{"idempotent", "CREATE TABLE IF NOT EXISTS x (id int)", lsmysql.Safe},
+		{"data", "INSERT INTO x VALUES (1); UPDATE x SET id = 2 WHERE id = 1", lsmysql.Safe},
+		{"non-idempotent", "CREATE TABLE x (id int)", lsmysql.NonIdempotentDDL},
+		{"comment does not count", "CREATE TABLE x (id int) /* IF NOT EXISTS */", lsmysql.NonIdempotentDDL},
+		{"internal comment", "CREATE TABLE IF NOT EXISTS x (id int) /* hi */ ; INSERT INTO x VALUES (1)", lsmysql.DataAndDDL},
+		{"empty statements", ";; SELECT 1;;", lsmysql.Safe},
+		{"truncate", "TRUNCATE x", lsmysql.Safe},
+		{"use", "USE other; CREATE TABLE IF NOT EXISTS x (id int)", lsmysql.ConnectionStateChange},
+		{"set global", "SET GLOBAL max_connections = 1000", lsmysql.ConnectionStateChange},
+		{"set session", "SET foreign_key_checks = 0; DELETE FROM x", lsmysql.ConnectionStateChange},
+		{"data and ddl wins", "SET @a = 1; CREATE TABLE IF NOT EXISTS x (id int); INSERT INTO x VALUES (1)", lsmysql.DataAndDDL},
+		{"update set is data", "UPDATE x SET id = 2 WHERE id = 1", lsmysql.Safe},
+		{"unbounded update", "UPDATE x SET id = 2", lsmysql.UnboundedMutation},
+		{"unbounded delete", "DELETE FROM x", lsmysql.UnboundedMutation},
+		{"bounded delete", "delete from x where id > 10", lsmysql.Safe},
+		{"where in a string", "UPDATE x SET note = 'WHERE'", lsmysql.UnboundedMutation},
+		{"where in a comment", "DELETE FROM x /* WHERE id = 1 */", lsmysql.UnboundedMutation},
+		{"where in a subquery", "UPDATE x SET id = (SELECT MAX(id) FROM y WHERE y.a = 1)", lsmysql.UnboundedMutation},
+		{"where in an identifier", "DELETE FROM `where`", lsmysql.UnboundedMutation},
+		{"where after a subquery", "DELETE FROM x WHERE id IN (SELECT id FROM y)", lsmysql.Safe},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, lsmysql.CheckScript(tc.script))
+		})
+	}
+}
+
+func TestCheckScriptDetails(t *testing.T) {
+	check := lsmysql.CheckScriptDetails(`
+		-- set up
+		SELECT 1;
+		CREATE TABLE IF NOT EXISTS x (id int);
+		ALTER TABLE x ADD COLUMN y int; INSERT INTO x (id) VALUES (1);
+	`)
+	assert.Equal(t, lsmysql.DataAndDDL, check.Result)
+	require.NotNil(t, check.FirstDDL)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 1, Line: 4, Column: 3, Word: "create"}, *check.FirstDDL)
+	require.NotNil(t, check.FirstNonIdempotentDDL)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 2, Line: 5, Column: 3, Word: "alter"}, *check.FirstNonIdempotentDDL)
+	require.NotNil(t, check.FirstData)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 3, Line: 5, Column: 35, Word: "insert"}, *check.FirstData)
+	assert.Equal(t, "statement 4 (INSERT) at line 5, column 35", check.FirstData.String())
+}
+
+func TestCheckScriptConnectionState(t *testing.T) {
+	check := lsmysql.CheckScriptDetails("CREATE TABLE x (id int);\nUSE other")
+	assert.Equal(t, lsmysql.ConnectionStateChange, check.Result)
+	require.NotNil(t, check.FirstConnectionStateChange)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 1, Line: 2, Column: 1, Word: "use"}, *check.FirstConnectionStateChange)
+	require.NotNil(t, check.FirstNonIdempotentDDL, "still reported")
+}
+
+func TestCheckScriptUnboundedMutation(t *testing.T) {
+	check := lsmysql.CheckScriptDetails("UPDATE x SET a = 1 WHERE b = 2;\nDELETE FROM x")
+	assert.Equal(t, lsmysql.UnboundedMutation, check.Result)
+	require.NotNil(t, check.FirstUnboundedMutation)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 1, Line: 2, Column: 1, Word: "delete"}, *check.FirstUnboundedMutation)
+}
+
+func TestCheckScriptTrackingTable(t *testing.T) {
+	cases := []struct {
+		name   string
+		table  string
+		script string
+		want   lsmysql.CheckResult
+	}{
+		{"drop", "libschema_migrations", "DROP TABLE libschema_migrations", lsmysql.TrackingTableAccess},
+		{"backquoted", "libschema.tracking", "DELETE FROM `libschema`.`tracking` WHERE library = 'x'", lsmysql.TrackingTableAccess},
+		{"qualified", "`libschema`.`tracking`", "TRUNCATE libschema.tracking", lsmysql.TrackingTableAccess},
+		{"unqualified", "libschema.tracking", "DROP TABLE IF EXISTS TRACKING", lsmysql.TrackingTableAccess},
+		{"double quoted", "libschema.tracking", `DROP TABLE IF EXISTS "libschema"."tracking"`, lsmysql.TrackingTableAccess},
+		{"other schema", "libschema.tracking", "DROP TABLE IF EXISTS other.tracking", lsmysql.Safe},
+		{"schema name", "tracking", "CREATE TABLE IF NOT EXISTS tracking.x (id int)", lsmysql.Safe},
+		{"string", "tracking", "INSERT INTO x VALUES ('tracking')", lsmysql.Safe},
+		{"comment", "tracking", "INSERT INTO x VALUES (1) /* tracking */", lsmysql.Safe},
+		{"other table", "tracking", "DROP TABLE IF EXISTS tracking_old", lsmysql.Safe},
+		{"second statement", "tracking", "SELECT 1; UPDATE tracking SET done = 1", lsmysql.TrackingTableAccess},
+		{"no table", "", "DROP TABLE IF EXISTS tracking", lsmysql.Safe},
+		{"join", "libschema.tracking", "SELECT * FROM x LEFT JOIN libschema.tracking t ON t.library = x.a", lsmysql.TrackingTableAccess},
+		{"table list", "tracking", "SELECT * FROM x AS a, tracking WHERE 1", lsmysql.TrackingTableAccess},
+		{"drop list", "tracking", "DROP TABLE IF EXISTS x, `tracking`", lsmysql.TrackingTableAccess},
+		{"rename to", "tracking", "RENAME TABLE x TO y, z TO tracking", lsmysql.TrackingTableAccess},
+		{"alter rename", "tracking", "ALTER TABLE x RENAME TO tracking", lsmysql.TrackingTableAccess},
+		{"insert", "tracking", "INSERT IGNORE INTO tracking (library) VALUES ('x')", lsmysql.TrackingTableAccess},
+		{"index", "tracking", "CREATE INDEX i ON tracking (library)", lsmysql.TrackingTableAccess},
+		{"column", "libschema.migration_status", "ALTER TABLE users ADD COLUMN migration_status int", lsmysql.NonIdempotentDDL},
+		{"column alias", "libschema.migration_status", "SELECT 1 AS migration_status", lsmysql.Safe},
+		{"table alias", "tracking", "SELECT * FROM x AS tracking, y", lsmysql.Safe},
+		{"bare alias", "tracking", "SELECT tracking.id FROM x tracking JOIN y ON tracking.id = y.id", lsmysql.Safe},
+		{"insert column", "tracking", "INSERT INTO x (id, tracking) VALUES (1, 2)", lsmysql.Safe},
+		{"update column", "tracking", "UPDATE x SET tracking = 1 WHERE tracking = 2", lsmysql.Safe},
+		{"rename column", "tracking", "ALTER TABLE x RENAME COLUMN y TO tracking", lsmysql.NonIdempotentDDL},
+		{"join on column", "tracking", "SELECT * FROM x JOIN y ON tracking = y.id", lsmysql.Safe},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, lsmysql.CheckScriptTrackingTable(tc.script, tc.table).Result)
+		})
+	}
+
+	check := lsmysql.CheckScriptTrackingTable("SELECT 1;\nDROP TABLE tracking", "tracking")
+	require.NotNil(t, check.FirstTrackingTableAccess)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 1, Line: 2, Column: 1, Word: "drop"}, *check.FirstTrackingTableAccess)
+	require.NotNil(t, check.FirstNonIdempotentDDL, "still reported")
+}
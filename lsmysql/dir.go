@@ -0,0 +1,114 @@
+package lsmysql
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/muir/libschema"
+
+	"github.com/pkg/errors"
+)
+
+// ScriptsFromDir reads the .sql files in dir and returns a Script
+// migration for each one.  See ScriptsFromFS.
+func ScriptsFromDir(dir string, opts ...libschema.MigrationOption) ([]libschema.Migration, error) {
+	migrations, err := ScriptsFromFS(os.DirFS(dir), opts...)
+	return migrations, errors.Wrap(err, dir)
+}
+
+// ScriptsFromFS reads the .sql files at the top level of fsys, which can
+// be an embed.FS, and returns a Script migration for each one.  Each
+// file name must start with a number, like a sequence number
+// ("0042_add_users.sql") or a timestamp ("20240131120000_add_users.sql").
+// The migrations are sorted by that number, numerically, and named by
+// the file name without ".sql".  Two files with the same number are an
+// error.  Gaps in the numbering are not: use CheckScriptSequence for
+// that.  Other files and directories are ignored.  The options are
+// applied to every migration.
+func ScriptsFromFS(fsys fs.FS, opts ...libschema.MigrationOption) ([]libschema.Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.Wrap(err, "read migrations directory")
+	}
+	type script struct {
+		file   string
+		number string
+	}
+	var scripts []script
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		number := leadingDigits(entry.Name())
+		if number == "" {
+			return nil, errors.Errorf("migration file '%s' does not start with a number", entry.Name())
+		}
+		scripts = append(scripts, script{
+			file:   entry.Name(),
+			number: strings.TrimLeft(number, "0"),
+		})
+	}
+	sort.SliceStable(scripts, func(i, j int) bool {
+		a, b := scripts[i].number, scripts[j].number
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	migrations := make([]libschema.Migration, len(scripts))
+	for i, s := range scripts {
+		if i > 0 && s.number == scripts[i-1].number {
+			return nil, errors.Errorf("migration files '%s' and '%s' have the same number", scripts[i-1].file, s.file)
+		}
+		sqlText, err := fs.ReadFile(fsys, s.file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read migration file '%s'", s.file)
+		}
+		migrations[i] = Script(strings.TrimSuffix(s.file, ".sql"), string(sqlText), opts...)
+	}
+	return migrations, nil
+}
+
+// CheckScriptSequence checks that the migrations from ScriptsFromFS or
+// ScriptsFromDir are numbered consecutively, starting from any number.
+// A gap usually means that a file was lost, for example in a merge.
+// ScriptsFromFS does not do this check because timestamp numbering
+// always has gaps.  The error lists the missing numbers.
+func CheckScriptSequence(migrations []libschema.Migration) error {
+	var missing []string
+	var previous uint64
+	for i, m := range migrations {
+		name := m.Base().Name.Name
+		number, err := strconv.ParseUint(leadingDigits(name), 10, 64)
+		if err != nil {
+			return errors.Errorf("migration '%s' does not start with a sequence number", name)
+		}
+		switch {
+		case i == 0 || number == previous+1:
+		case number <= previous:
+			return errors.Errorf("migration '%s' is out of order", name)
+		case number == previous+2:
+			missing = append(missing, strconv.FormatUint(previous+1, 10))
+		default:
+			missing = append(missing, strconv.FormatUint(previous+1, 10)+"-"+strconv.FormatUint(number-1, 10))
+		}
+		previous = number
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("migration numbers %s are missing", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func leadingDigits(s string) string {
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			return s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+package lsmysql_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptsFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"10_add_orders.sql":             {Data: []byte("CREATE TABLE orders (id int)")},
+		"9_add_users.sql":               {Data: []byte("CREATE TABLE users (id int)")},
+		"0002_add_accounts.sql":         {Data: []byte("CREATE TABLE accounts (id int)")},
+		"20240131120000_add_events.sql": {Data: []byte("CREATE TABLE events (id int)")},
+		"README.md":                     {Data: []byte("not a migration")},
+		"old/1_ignored.sql":             {Data: []byte("SELECT 1")},
+	}
+	migrations, err := lsmysql.ScriptsFromFS(fsys, libschema.WithTags("schema"))
+	require.NoError(t, err)
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.Base().Name.Name)
+		assert.Equal(t, []string{"schema"}, m.Base().Tags(), m.Base().Name.Name)
+	}
+	assert.Equal(t, []string{"0002_add_accounts", "9_add_users", "10_add_orders", "20240131120000_add_events"}, names)
+
+	fsys["09_add_people.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE people (id int)")}
+	_, err = lsmysql.ScriptsFromFS(fsys)
+	if assert.Error(t, err, "duplicate") {
+		assert.Contains(t, err.Error(), "have the same number")
+	}
+	delete(fsys, "09_add_people.sql")
+
+	fsys["add_people.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE people (id int)")}
+	_, err = lsmysql.ScriptsFromFS(fsys)
+	if assert.Error(t, err, "no number") {
+		assert.Contains(t, err.Error(), "does not start with a number")
+	}
+}
+
+func TestCheckScriptSequence(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0001_add_users.sql":    {Data: []byte("CREATE TABLE users (id int)")},
+		"0002_add_orders.sql":   {Data: []byte("CREATE TABLE orders (id int)")},
+		"0003_add_accounts.sql": {Data: []byte("CREATE TABLE accounts (id int)")},
+	}
+	migrations, err := lsmysql.ScriptsFromFS(fsys)
+	require.NoError(t, err)
+	assert.NoError(t, lsmysql.CheckScriptSequence(migrations), "consecutive")
+
+	fsys["0005_add_people.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE people (id int)")}
+	fsys["0009_add_places.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE places (id int)")}
+	migrations, err = lsmysql.ScriptsFromFS(fsys)
+	require.NoError(t, err, "gaps are allowed by ScriptsFromFS")
+	err = lsmysql.CheckScriptSequence(migrations)
+	if assert.Error(t, err, "gaps") {
+		assert.Contains(t, err.Error(), "migration numbers 4, 6-8 are missing")
+	}
+
+	assert.Error(t, lsmysql.CheckScriptSequence([]libschema.Migration{
+		lsmysql.Script("2_b", "SELECT 1"),
+		lsmysql.Script("1_a", "SELECT 1"),
+	}), "out of order")
+	assert.Error(t, lsmysql.CheckScriptSequence([]libschema.Migration{
+		lsmysql.Script("add_users", "SELECT 1"),
+	}), "no number")
+}
+
+func TestScriptsFromDir(t *testing.T) {
+	_, err := lsmysql.ScriptsFromDir("does-not-exist")
+	assert.Error(t, err)
+}
@@ -0,0 +1,355 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DumpSchema describes the tables in a database (schema) as CREATE TABLE
+// statements, built from information_schema, for golden-file tests
+// that catch unexpected schema changes.  The output is deterministic:
+// tables, indexes, and foreign keys are sorted by name; columns are in
+// table order; AUTO_INCREMENT counters, row counts, and other values
+// that change as data is added are left out.  Views, triggers, and
+// routines are not included.  MariaDB column defaults are converted to
+// the form MySQL uses so that the output is the same for both.
+func DumpSchema(ctx context.Context, db *sql.DB, schema string) (string, error) {
+	tables, err := dumpTables(ctx, db, schema)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, t := range tables {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(t.String())
+	}
+	return b.String(), nil
+}
+
+// dumpTables reads the tables of a schema from information_schema.  The
+// tables are sorted by name.
+func dumpTables(ctx context.Context, db *sql.DB, schema string) ([]*dumpTable, error) {
+	var version string
+	err := db.QueryRowContext(ctx, `SELECT @@version`).Scan(&version)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get server version")
+	}
+	mariaDB := isMariaDB(version)
+
+	tables := make(map[string]*dumpTable)
+	rows, err := db.QueryContext(ctx, `
+		SELECT	table_name, COALESCE(engine, ''), COALESCE(table_collation, '')
+		FROM	information_schema.tables
+		WHERE	table_schema = ?
+		AND	table_type = 'BASE TABLE'`, schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "List tables in %s", schema)
+	}
+	err = scanRows(rows, func() error {
+		t := &dumpTable{
+			indexes:     make(map[string]*dumpIndex),
+			foreignKeys: make(map[string]*dumpForeignKey),
+		}
+		err := rows.Scan(&t.name, &t.engine, &t.collation)
+		tables[t.name] = t
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "List tables in %s", schema)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT	table_name, column_name, column_type, is_nullable, column_default, extra, COALESCE(collation_name, ''),
+			COALESCE(generation_expression, '')
+		FROM	information_schema.columns
+		WHERE	table_schema = ?
+		ORDER	BY table_name, ordinal_position`, schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "List columns in %s", schema)
+	}
+	err = scanRows(rows, func() error {
+		var table string
+		var c dumpColumn
+		var nullable string
+		err := rows.Scan(&table, &c.name, &c.columnType, &nullable, &c.defaultValue, &c.extra, &c.collation, &c.generation)
+		if err != nil {
+			return err
+		}
+		c.nullable = nullable == "YES"
+		if mariaDB {
+			c.mariaDBDefault()
+		}
+		if t, ok := tables[table]; ok {
+			t.columns = append(t.columns, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "List columns in %s", schema)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT	table_name, index_name, non_unique, column_name, sub_part, index_type
+		FROM	information_schema.statistics
+		WHERE	table_schema = ?
+		ORDER	BY table_name, index_name, seq_in_index`, schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "List indexes in %s", schema)
+	}
+	err = scanRows(rows, func() error {
+		var table, index, indexType string
+		var nonUnique int
+		var column sql.NullString
+		var subPart sql.NullInt64
+		err := rows.Scan(&table, &index, &nonUnique, &column, &subPart, &indexType)
+		if err != nil {
+			return err
+		}
+		t, ok := tables[table]
+		if !ok {
+			return nil
+		}
+		i, ok := t.indexes[index]
+		if !ok {
+			i = &dumpIndex{unique: nonUnique == 0, indexType: indexType}
+			t.indexes[index] = i
+		}
+		part := "(expression)"
+		if column.Valid {
+			part = quoteName(column.String)
+			if subPart.Valid {
+				part += fmt.Sprintf("(%d)", subPart.Int64)
+			}
+		}
+		i.columns = append(i.columns, part)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "List indexes in %s", schema)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT	k.table_name, k.constraint_name, k.column_name,
+			k.referenced_table_name, k.referenced_column_name,
+			r.update_rule, r.delete_rule
+		FROM	information_schema.key_column_usage k
+		JOIN	information_schema.referential_constraints r
+		ON	r.constraint_schema = k.constraint_schema
+		AND	r.constraint_name = k.constraint_name
+		AND	r.table_name = k.table_name
+		WHERE	k.table_schema = ?
+		AND	k.referenced_table_name IS NOT NULL
+		ORDER	BY k.table_name, k.constraint_name, k.ordinal_position`, schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "List foreign keys in %s", schema)
+	}
+	err = scanRows(rows, func() error {
+		var table, name, column, refTable, refColumn, onUpdate, onDelete string
+		err := rows.Scan(&table, &name, &column, &refTable, &refColumn, &onUpdate, &onDelete)
+		if err != nil {
+			return err
+		}
+		t, ok := tables[table]
+		if !ok {
+			return nil
+		}
+		fk, ok := t.foreignKeys[name]
+		if !ok {
+			fk = &dumpForeignKey{
+				refTable: refTable,
+				onUpdate: onUpdate,
+				onDelete: onDelete,
+			}
+			t.foreignKeys[name] = fk
+		}
+		fk.columns = append(fk.columns, quoteName(column))
+		fk.refColumns = append(fk.refColumns, quoteName(refColumn))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "List foreign keys in %s", schema)
+	}
+
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := make([]*dumpTable, len(names))
+	for i, name := range names {
+		sorted[i] = tables[name]
+	}
+	return sorted, nil
+}
+
+func scanRows(rows *sql.Rows, scan func() error) error {
+	defer rows.Close()
+	for rows.Next() {
+		err := scan()
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+type dumpTable struct {
+	name        string
+	engine      string
+	collation   string
+	columns     []dumpColumn
+	indexes     map[string]*dumpIndex
+	foreignKeys map[string]*dumpForeignKey
+}
+
+type dumpColumn struct {
+	name              string
+	columnType        string
+	nullable          bool
+	defaultValue      sql.NullString
+	defaultExpression bool // set for MariaDB, MySQL marks these in extra
+	extra             string
+	collation         string
+	generation        string // expression of a generated column
+}
+
+type dumpIndex struct {
+	unique    bool
+	indexType string // BTREE, HASH, FULLTEXT, or SPATIAL
+	columns   []string
+}
+
+type dumpForeignKey struct {
+	columns    []string
+	refTable   string
+	refColumns []string
+	onUpdate   string
+	onDelete   string
+}
+
+func (t *dumpTable) String() string {
+	var lines []string
+	for _, c := range t.columns {
+		lines = append(lines, c.String())
+	}
+	if primary, ok := t.indexes["PRIMARY"]; ok {
+		lines = append(lines, "PRIMARY KEY ("+strings.Join(primary.columns, ", ")+")")
+	}
+	for _, name := range sortedIndexNames(t.indexes) {
+		if name == "PRIMARY" {
+			continue
+		}
+		i := t.indexes[name]
+		kind := "KEY"
+		switch {
+		case i.indexType == "FULLTEXT" || i.indexType == "SPATIAL":
+			kind = i.indexType + " KEY"
+		case i.unique:
+			kind = "UNIQUE KEY"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (%s)", kind, quoteName(name), strings.Join(i.columns, ", ")))
+	}
+	for _, name := range sortedForeignKeyNames(t.foreignKeys) {
+		fk := t.foreignKeys[name]
+		lines = append(lines, fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON UPDATE %s ON DELETE %s",
+			quoteName(name), strings.Join(fk.columns, ", "), quoteName(fk.refTable), strings.Join(fk.refColumns, ", "),
+			fk.onUpdate, fk.onDelete))
+	}
+	var options string
+	if t.engine != "" {
+		options += " ENGINE=" + t.engine
+	}
+	if t.collation != "" {
+		options += " COLLATE=" + t.collation
+	}
+	return "CREATE TABLE " + quoteName(t.name) + " (\n\t" + strings.Join(lines, ",\n\t") + "\n)" + options + ";\n"
+}
+
+func (c dumpColumn) String() string {
+	s := quoteName(c.name) + " " + c.columnType
+	if c.collation != "" {
+		s += " COLLATE " + c.collation
+	}
+	extra := c.extra
+	if c.generation != "" {
+		// extra is "VIRTUAL GENERATED" or "STORED GENERATED" (MariaDB
+		// also has "PERSISTENT GENERATED")
+		kind := "VIRTUAL"
+		if strings.Contains(extra, "STORED") || strings.Contains(extra, "PERSISTENT") {
+			kind = "STORED"
+		}
+		for _, word := range []string{"VIRTUAL GENERATED", "STORED GENERATED", "PERSISTENT GENERATED"} {
+			extra = strings.Replace(extra, word, "", 1)
+		}
+		s += " GENERATED ALWAYS AS (" + c.generation + ") " + kind
+	}
+	if !c.nullable {
+		s += " NOT NULL"
+	}
+	// MySQL 8 marks expression defaults with DEFAULT_GENERATED
+	marked := strings.Contains(extra, "DEFAULT_GENERATED")
+	extra = strings.TrimSpace(strings.Replace(extra, "DEFAULT_GENERATED", "", 1))
+	switch {
+	case c.generation != "":
+		// generated columns cannot have a default
+	case c.defaultValue.Valid && (marked || c.defaultExpression || strings.HasPrefix(strings.ToUpper(c.defaultValue.String), "CURRENT_TIMESTAMP")):
+		s += " DEFAULT " + c.defaultValue.String
+	case c.defaultValue.Valid:
+		s += " DEFAULT '" + strings.ReplaceAll(c.defaultValue.String, "'", "''") + "'"
+	case c.nullable:
+		s += " DEFAULT NULL"
+	}
+	if extra != "" {
+		s += " " + extra
+	}
+	return s
+}
+
+// mariaDBDefault converts a MariaDB column_default to the MySQL form.
+// MariaDB gives an SQL expression: literal strings are quoted, a NULL
+// default is "NULL", and numbers and expressions are not quoted.  MySQL
+// gives the value of a literal and marks expressions in extra.
+func (c *dumpColumn) mariaDBDefault() {
+	v := c.defaultValue.String
+	switch {
+	case !c.defaultValue.Valid:
+	case v == "NULL":
+		c.defaultValue = sql.NullString{}
+	case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+		c.defaultValue.String = strings.ReplaceAll(v[1:len(v)-1], "''", "'")
+	default:
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			c.defaultExpression = true
+		}
+	}
+}
+
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func sortedIndexNames(m map[string]*dumpIndex) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedForeignKeyNames(m map[string]*dumpForeignKey) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,76 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Flavor is the kind of MySQL-compatible server
+type Flavor string
+
+const (
+	// FlavorMySQL is MySQL, MariaDB, and any other server that is
+	// not recognized
+	FlavorMySQL Flavor = "mysql"
+
+	// FlavorVitess is Vitess, including PlanetScale
+	FlavorVitess Flavor = "vitess"
+
+	// FlavorTiDB is TiDB.  TiDB schema changes are online so
+	// WithOnlineSchemaChange migrations are run directly.  Older
+	// versions of TiDB accept GET_LOCK but do not lock so the
+	// migration lock is a RowLock.
+	FlavorTiDB Flavor = "tidb"
+)
+
+// ServerFlavor reports the kind of server, detected from @@version and
+// @@version_comment.  The answer is remembered so that migrations can
+// call ServerFlavor to decide what to do without querying the server
+// each time.
+func (p *MySQL) ServerFlavor(ctx context.Context) (Flavor, error) {
+	return p.serverFlavor(ctx, p.db)
+}
+
+func (p *MySQL) serverFlavor(ctx context.Context, db *sql.DB) (Flavor, error) {
+	p.flavorLock.Lock()
+	defer p.flavorLock.Unlock()
+	if p.flavor != "" {
+		return p.flavor, nil
+	}
+	var version, comment sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT @@version, @@version_comment`).Scan(&version, &comment)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not detect server type")
+	}
+	p.flavor = detectFlavor(version.String, comment.String)
+	return p.flavor, nil
+}
+
+func detectFlavor(version, comment string) Flavor {
+	switch {
+	case isTiDB(version, comment):
+		return FlavorTiDB
+	case isVitess(version, comment):
+		return FlavorVitess
+	}
+	return FlavorMySQL
+}
+
+func isVitess(version, comment string) bool {
+	return strings.Contains(strings.ToLower(version), "vitess") ||
+		strings.Contains(strings.ToLower(comment), "vitess")
+}
+
+// isMariaDB is not a Flavor because MariaDB migrations are run the
+// same way as MySQL migrations
+func isMariaDB(version string) bool {
+	return strings.Contains(strings.ToLower(version), "mariadb")
+}
+
+func isTiDB(version, comment string) bool {
+	return strings.Contains(strings.ToLower(version), "tidb") ||
+		strings.Contains(strings.ToLower(comment), "tidb")
+}
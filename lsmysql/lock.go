@@ -0,0 +1,434 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// LockStrategy controls how LockMigrationsTable prevents two processes
+// from running migrations at the same time.
+type LockStrategy int
+
+const (
+	// AdvisoryLock uses GET_LOCK/RELEASE_LOCK.  This is the default.
+	AdvisoryLock LockStrategy = iota
+
+	// RowLock uses a row in a lock table next to the tracking table
+	// (the tracking table name with "_lock" appended).  The row has an
+	// expiration time so that a lock held by a process that died is
+	// eventually released.  While the lock is held, the expiration is
+	// extended in the background.  Use RowLock for servers that do not
+	// support advisory locks, like Vitess and PlanetScale.
+	RowLock
+
+	// NoLock does not lock at all.  See the warnings on
+	// libschema.Options.WithoutMigrationLock.
+	NoLock
+
+	// DetectLock uses RowLock when the server reports that it is Vitess
+	// (in @@version or @@version_comment) and AdvisoryLock otherwise.
+	// With both DetectLock and AdvisoryLock, RowLock is used for TiDB.
+	DetectLock
+)
+
+// DefaultRowLockTTL is how long a RowLock lasts if the process holding it
+// stops extending it.
+const DefaultRowLockTTL = 5 * time.Minute
+
+// RowLockPollInterval is the time between attempts to get a RowLock
+// when WithLockAcquireBackoff is not used.
+var RowLockPollInterval = time.Second
+
+// WithLockStrategy chooses how the migration lock is acquired.  The
+// default is AdvisoryLock.
+func WithLockStrategy(strategy LockStrategy) MySQLOpt {
+	return func(p *MySQL) {
+		p.lockStrategy = strategy
+	}
+}
+
+// WithRowLockTTL overrides DefaultRowLockTTL for RowLock.
+func WithRowLockTTL(ttl time.Duration) MySQLOpt {
+	return func(p *MySQL) {
+		p.lockTTL = ttl
+	}
+}
+
+// DefaultLockKeepalive is how often an AdvisoryLock is checked while
+// it is held.  Servers close idle connections (wait_timeout) and closing
+// the connection releases the lock.  The check keeps the connection from
+// being idle and notices if the lock has been lost anyway.
+const DefaultLockKeepalive = time.Minute
+
+// WithLockKeepalive overrides DefaultLockKeepalive.  A negative interval
+// turns the check off.
+func WithLockKeepalive(interval time.Duration) MySQLOpt {
+	return func(p *MySQL) {
+		p.keepaliveInterval = interval
+	}
+}
+
+type lockKeepalive struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+type rowLock struct {
+	db    *sql.DB
+	table string
+	owner string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// WithMaxConnections tells libschema how many connections it can count
+// on having.  It does not limit the pool: use sql.DB.SetMaxOpenConns
+// for that.  It only affects the choice of lock: an AdvisoryLock holds
+// a connection for as long as migrations run and each migration needs
+// another, so when n is one, RowLock is used instead.  A limit set with
+// sql.DB.SetMaxOpenConns is respected the same way even without
+// WithMaxConnections.  With only one connection, a RowLock cannot be
+// extended while a migration is running so WithRowLockTTL should be
+// longer than the slowest migration.
+func WithMaxConnections(n int) MySQLOpt {
+	return func(p *MySQL) {
+		p.maxConns = n
+	}
+}
+
+// connectionLimit is the smaller of WithMaxConnections and the pool's
+// SetMaxOpenConns.  Zero means no limit.
+func (p *MySQL) connectionLimit(db *sql.DB) int {
+	limit := p.maxConns
+	if poolMax := db.Stats().MaxOpenConnections; poolMax > 0 && (limit <= 0 || poolMax < limit) {
+		limit = poolMax
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// resolveLockStrategy chooses the lock strategy that will actually be
+// used.  When only one connection is available, holding it for an
+// advisory lock would leave none for the migrations themselves.
+func (p *MySQL) resolveLockStrategy(ctx context.Context, log *internal.Log, d *libschema.Database) LockStrategy {
+	strategy := p.detectLockStrategy(ctx, log, d)
+	if strategy == AdvisoryLock && p.connectionLimit(d.DB()) == 1 {
+		log.Info("Only one connection is available, using row lock")
+		return RowLock
+	}
+	return strategy
+}
+
+// detectLockStrategy turns DetectLock into AdvisoryLock or RowLock.
+// TiDB gets RowLock even with AdvisoryLock because older versions of
+// TiDB accept GET_LOCK but do not lock anything.
+func (p *MySQL) detectLockStrategy(ctx context.Context, log *internal.Log, d *libschema.Database) LockStrategy {
+	if p.lockStrategy != DetectLock && p.lockStrategy != AdvisoryLock {
+		return p.lockStrategy
+	}
+	flavor, err := p.serverFlavor(ctx, d.DB())
+	if err != nil {
+		log.Warn("Could not detect server type, using advisory lock", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return AdvisoryLock
+	}
+	switch {
+	case flavor == FlavorTiDB:
+		log.Info("TiDB detected, using row lock")
+		return RowLock
+	case flavor == FlavorVitess && p.lockStrategy == DetectLock:
+		log.Info("Vitess detected, using row lock")
+		return RowLock
+	}
+	return AdvisoryLock
+}
+
+// lockTableName is the name of the RowLock table: the tracking table
+// name with "_lock" appended.
+func lockTableName(tableName string) string {
+	return appendToTableName(tableName, "_lock")
+}
+
+// appendToTableName appends suffix to a table name, inside the quotes
+// if it is quoted.
+func appendToTableName(tableName string, suffix string) string {
+	for _, q := range []string{"`", `"`} {
+		if strings.HasSuffix(tableName, q) {
+			return strings.TrimSuffix(tableName, q) + suffix + q
+		}
+	}
+	return tableName + suffix
+}
+
+func (p *MySQL) rowLockTTL() time.Duration {
+	if p.lockTTL <= 0 {
+		return DefaultRowLockTTL
+	}
+	return p.lockTTL
+}
+
+// lockWithRow claims the singleton row of the lock table.  A row that
+// has expired can be taken over.
+func (p *MySQL) lockWithRow(ctx context.Context, log *internal.Log, d *libschema.Database, tableName string) error {
+	lock := &rowLock{
+		db:    d.DB(),
+		table: lockTableName(tableName),
+		owner: fmt.Sprintf("%s:%016x", d.AppliedBy(), rand.Uint64()),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id		int NOT NULL,
+			owner		varchar(255) NOT NULL,
+			expires_at	timestamp(6) NOT NULL,
+			PRIMARY KEY	(id)
+		)`, lock.table))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema lock table '%s'", lock.table)
+	}
+	ttl := p.rowLockTTL().Microseconds()
+	for attempt := 0; ; attempt++ {
+		// Assignments are made left to right: the owner assignment
+		// sees the old expires_at and the expires_at assignment sees
+		// the new owner.
+		_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
+			INSERT INTO %s (id, owner, expires_at)
+			VALUES (1, ?, now(6) + INTERVAL ? MICROSECOND)
+			ON DUPLICATE KEY UPDATE
+				owner = IF(expires_at < now(6), VALUES(owner), owner),
+				expires_at = IF(owner = VALUES(owner), VALUES(expires_at), expires_at)`, lock.table),
+			lock.owner, ttl)
+		if err != nil {
+			return errors.Wrap(err, "Could not get lock for libschema migrations")
+		}
+		var owner string
+		err = d.DB().QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT	owner
+			FROM	%s
+			WHERE	id = 1`, lock.table)).Scan(&owner)
+		if err != nil {
+			return errors.Wrap(err, "Could not get lock for libschema migrations")
+		}
+		if owner == lock.owner {
+			break
+		}
+		delay := RowLockPollInterval
+		if p.lockBackoffInitial != 0 {
+			delay = p.lockBackoff(attempt)
+		}
+		log.Debug("Waiting for libschema migrations lock", map[string]interface{}{
+			"attempt": attempt + 1,
+			"owner":   owner,
+			"delay":   delay.String(),
+		})
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "Could not get lock for libschema migrations")
+		case <-time.After(delay):
+		}
+	}
+	go p.extendRowLock(log, lock)
+	p.rowLock = lock
+	return nil
+}
+
+// extendRowLock keeps pushing out the expiration until the lock is released
+func (p *MySQL) extendRowLock(log *internal.Log, lock *rowLock) {
+	defer close(lock.done)
+	ttl := p.rowLockTTL()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			_, err := lock.db.Exec(fmt.Sprintf(`
+				UPDATE	%s
+				SET	expires_at = now(6) + INTERVAL ? MICROSECOND
+				WHERE	id = 1
+				AND	owner = ?`, lock.table), ttl.Microseconds(), lock.owner)
+			if err != nil {
+				log.Warn("Could not extend libschema migrations lock", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+		}
+	}
+}
+
+func (p *MySQL) unlockRow() error {
+	lock := p.rowLock
+	p.rowLock = nil
+	close(lock.stop)
+	<-lock.done
+	// the database of the lock, which may not be p.db when the driver
+	// is shared
+	_, err := lock.db.Exec(fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE	id = 1
+		AND	owner = ?`, lock.table), lock.owner)
+	if err != nil {
+		return errors.Wrap(err, "Could not release row lock for schema migrations")
+	}
+	return nil
+}
+
+// holdAdvisoryLock records the connection that holds the migrations
+// lock and starts checking it periodically
+func (p *MySQL) holdAdvisoryLock(log *internal.Log, conn *sql.Conn) {
+	p.lockConn = conn
+	p.setLockLost(nil)
+	interval := p.keepaliveInterval
+	if interval == 0 {
+		interval = DefaultLockKeepalive
+	}
+	if interval < 0 {
+		return
+	}
+	p.keepalive = &lockKeepalive{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go p.keepAdvisoryLock(log, conn, p.lockStr, interval, p.keepalive)
+}
+
+// keepAdvisoryLock checks, until stopped, that the lock is still held
+// by conn.  Once the lock is lost, DoOneMigration and
+// UnlockMigrationsTable return errors.
+func (p *MySQL) keepAdvisoryLock(log *internal.Log, conn *sql.Conn, name string, interval time.Duration, keepalive *lockKeepalive) {
+	defer close(keepalive.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-keepalive.stop:
+			return
+		case <-ticker.C:
+			var held sql.NullInt64
+			err := conn.QueryRowContext(context.Background(), `SELECT IS_USED_LOCK(?) = CONNECTION_ID()`, name).Scan(&held)
+			switch {
+			case err != nil:
+				err = errors.Wrap(err, "libschema migrations lock connection failed, the lock is lost")
+			case !held.Valid || held.Int64 != 1:
+				err = errors.New("libschema migrations lock is no longer held")
+			default:
+				continue
+			}
+			log.Error("Lost the libschema migrations lock", map[string]interface{}{
+				"lock":  name,
+				"error": err.Error(),
+			})
+			p.setLockLost(err)
+			return
+		}
+	}
+}
+
+// stopKeepalive stops keepAdvisoryLock, if it is running
+func (p *MySQL) stopKeepalive() {
+	if p.keepalive == nil {
+		return
+	}
+	close(p.keepalive.stop)
+	<-p.keepalive.done
+	p.keepalive = nil
+}
+
+func (p *MySQL) setLockLost(err error) {
+	p.lockLostMu.Lock()
+	defer p.lockLostMu.Unlock()
+	p.lockLost = err
+}
+
+// lockLostError returns an error if keepAdvisoryLock found that the
+// migrations lock was lost
+func (p *MySQL) lockLostError() error {
+	p.lockLostMu.Lock()
+	defer p.lockLostMu.Unlock()
+	return p.lockLost
+}
+
+// TryLock gets a GET_LOCK advisory lock, the same kind of lock that
+// LockMigrationsTable uses, for application use, like leader election.
+// It waits up to timeout (rounded up to whole seconds) for the lock; a
+// negative timeout waits forever.  If the lock is not available in time,
+// TryLock returns false and no error.  ctx only limits the wait: once
+// the lock is acquired, it is held until release is called even if ctx
+// is cancelled.  Advisory locks belong to a connection so a connection
+// is taken out of the pool and held until release is called.  Call
+// release exactly once.  Lock names are
+// server-wide and at most 64 characters; avoid names that start with
+// "libschema_".
+func (p *MySQL) TryLock(ctx context.Context, name string, timeout time.Duration) (bool, func() error, error) {
+	seconds := int64(-1)
+	if timeout >= 0 {
+		seconds = int64((timeout + time.Second - 1) / time.Second)
+	}
+	conn, err := getAdvisoryLock(ctx, p.db, name, seconds)
+	if err != nil {
+		return false, nil, errors.Wrapf(err, "Could not get lock '%s'", name)
+	}
+	if conn == nil {
+		return false, nil, nil
+	}
+	release := func() error {
+		return errors.Wrapf(releaseAdvisoryLock(conn, name), "Could not release lock '%s'", name)
+	}
+	return true, release, nil
+}
+
+// getAdvisoryLock waits up to timeout seconds for a GET_LOCK lock.
+// MySQL locks belong to a connection so the connection that gets the
+// lock is taken out of the pool and returned.  ctx only limits the wait:
+// it is not used for anything that lasts as long as the lock so that
+// cancelling it later cannot return the connection, still holding the
+// lock, to the pool.  If the lock is not acquired, it returns a nil
+// connection.  Cancelling ctx stops the wait: the driver closes the
+// connection, which abandons the GET_LOCK on the server.
+func getAdvisoryLock(ctx context.Context, db *sql.DB, name string, timeout int64) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get connection")
+	}
+	var gotLock sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, name, timeout).Scan(&gotLock)
+	if err != nil {
+		// the lock may have been granted as the query was abandoned
+		internal.DiscardConn(conn)
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "Gave up waiting for GET_LOCK")
+		}
+		return nil, err
+	}
+	if !gotLock.Valid || gotLock.Int64 != 1 {
+		_ = conn.Close()
+		return nil, nil
+	}
+	return conn, nil
+}
+
+// releaseAdvisoryLock releases a lock from getAdvisoryLock and returns
+// the connection to the pool.  If the release fails, the connection is
+// closed instead, which releases the lock on the server.
+func releaseAdvisoryLock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, name)
+	if err != nil {
+		internal.DiscardConn(conn)
+		return err
+	}
+	return conn.Close()
+}
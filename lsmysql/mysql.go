@@ -4,14 +4,19 @@ package lsmysql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"math/rand"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/muir/libschema"
 	"github.com/muir/libschema/internal"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 )
 
@@ -20,8 +25,8 @@ import (
 // * CANNOT do DDL commands inside transactions
 // * Support UPSERT using INSERT ... ON DUPLICATE KEY UPDATE
 // * uses /* -- and # for comments
-// * supports advisory locks
-// * has quoting modes (ANSI_QUOTES)
+// * supports advisory locks (see WithLockStrategy for servers that do not)
+// * has quoting modes (ANSI_QUOTES, see WithANSIQuotes)
 //
 // Because mysql DDL commands cause transactions to autocommit, tracking the schema changes in
 // a secondary table (like libschema does) is inherently unsafe.  The MySQL driver will
@@ -39,33 +44,185 @@ import (
 // SchemaOverride be set when creating the libschema.Schema object.  That SchemaOverride will
 // be propagated into the MySQL object and be used as a default table for all of the
 // functions to interrogate data defintion status.
+//
+// One *MySQL can be shared by more than one libschema.Database, for example
+// by passing it to Schema.NewDatabase for each of several schemas.  The
+// migration lock that the driver holds belongs to one Database at a time:
+// if another Database that shares the driver is migrating, LockMigrationsTable
+// waits for it to finish.  The functions in skip.go and TrackingCreated
+// are not per-Database: they use the database name given to New (or
+// set with SetDatabaseName) and report on the most recent
+// CreateSchemaTableIfNotExists.
 type MySQL struct {
-	lockTx              *sql.Tx
+	lockConn            *sql.Conn
 	lockStr             string
 	db                  *sql.DB
 	databaseName        string // used in skip.go only
 	lock                sync.Mutex
 	trackingSchemaTable func(*libschema.Database) (string, string, error)
+	trackingSuffix      string
+	backupSizeLimit     int64
 	skipDatabase        bool
+	trackingEngine      string
+	trackingCharset     string
+	trackingCollation   string
+	placeholder         libschema.Placeholder
+	lockBackoffInitial  time.Duration
+	lockBackoffMax      time.Duration
+	lockBackoffJitter   bool
+	lockStrategy        LockStrategy
+	lockTTL             time.Duration
+	rowLock             *rowLock
+	noLockHeld          bool
+	flavor              Flavor // set by serverFlavor
+	flavorLock          sync.Mutex
+	maxConns            int
+	helperTimeout       time.Duration
+	helperQueryPrefix   string
+	sqlRewriter         func(script string) (string, error)
+	checkSeverity       map[CheckResult]Severity
+	deadlockRetries     int
+	schemaCreated       bool // set by CreateSchemaTableIfNotExists
+	tableCreated        bool // set by CreateSchemaTableIfNotExists
+	createdLock         sync.Mutex
+	lockHolder          *libschema.Database // the Database that holds the migration lock
+	lockReleased        chan struct{}       // closed when lockHolder releases the lock
+	deadlockBackoff     time.Duration
+	keepaliveInterval   time.Duration
+	keepalive           *lockKeepalive
+	lockLostMu          sync.Mutex
+	lockLost            error // set by keepAdvisoryLock
+	ansiQuotes          bool
+	ansiQuotesKnown     bool // set by WithANSIQuotes or detectANSIQuotes
+	ansiQuotesLock      sync.Mutex
 }
 
 type MySQLOpt func(*MySQL)
 
 // WithoutDatabase skips creating a *libschema.Database.  Without it,
-// functions for getting and setting the dbNames are required.
+// the database used by the functions in skip.go is not known in advance.
+// Use WithDatabaseName or SetDatabaseName to set it.
 func WithoutDatabase(p *MySQL) {
 	p.skipDatabase = true
 }
 
+// WithDatabaseName sets the database (schema) used by DatabaseName() and the
+// functions that interrogate data definition status, like DoesColumnExist().
+// It takes precedence over Options.SchemaOverride.  The name must be a simple
+// identifier or New will return an error.
+func WithDatabaseName(name string) MySQLOpt {
+	return func(p *MySQL) {
+		p.databaseName = name
+	}
+}
+
+// WithTrackingTableSuffix appends suffix to the name of the tracking
+// table, for example "_blue" turns libschema.migrations into
+// libschema.migrations_blue.  It lets two versions of an application,
+// like the blue and green sides of a cutover, migrate the same database
+// while tracking their migrations separately.  The suffix applies to
+// everything derived from the tracking table name: the table that is
+// created, loaded, and saved, the GET_LOCK name, and the RowLock table.
+// It applies to WithTrackingTable and WithTrackingTableQuoter too.  The
+// suffix may only have letters, digits, and underscores or New will
+// return an error.
+func WithTrackingTableSuffix(suffix string) MySQLOpt {
+	return func(p *MySQL) {
+		p.trackingSuffix = suffix
+	}
+}
+
+// WithTrackingTableOptions overrides the table options used when creating
+// the migration tracking table.  The defaults are ENGINE=InnoDB,
+// DEFAULT CHARSET=utf8mb4, and COLLATE=utf8mb4_bin so that migration names
+// are not mangled on servers with a latin1 default.  Empty values
+// are omitted from the CREATE TABLE so that the server default is used.
+// The options only apply when the tracking table is created.
+func WithTrackingTableOptions(engine, charset, collation string) MySQLOpt {
+	return func(p *MySQL) {
+		p.trackingEngine = engine
+		p.trackingCharset = charset
+		p.trackingCollation = collation
+	}
+}
+
+// WithPlaceholder sets the bind parameter style used when saving migration
+// status.  The default is libschema.QuestionPlaceholder.  This is only needed
+// for database/sql drivers that do not accept "?".
+func WithPlaceholder(placeholder libschema.Placeholder) MySQLOpt {
+	return func(p *MySQL) {
+		p.placeholder = placeholder
+	}
+}
+
+// WithSQLRewriter changes the SQL of Script() and Generate() migrations
+// just before it is run.  The rewriter is called after the script has
+// passed CheckScript so that it can add things like
+// "ALGORITHM=INPLACE, LOCK=NONE" to every ALTER TABLE.  If the rewriter
+// returns an error, the migration fails.  Migrations run with
+// WithOnlineSchemaChange are not rewritten.
+func WithSQLRewriter(rewriter func(script string) (string, error)) MySQLOpt {
+	return func(p *MySQL) {
+		p.sqlRewriter = rewriter
+	}
+}
+
+// WithLockAcquireBackoff changes how the migration lock is acquired.  By
+// default, LockMigrationsTable blocks in GET_LOCK until the lock is
+// available.  With WithLockAcquireBackoff, it polls with a non-blocking
+// GET_LOCK and does not hold a connection between attempts.  The delay
+// between attempts starts at initial and doubles up to max.  With jitter,
+// each delay is randomized to between half and all of its value so that
+// many processes starting at once spread out their attempts.
+func WithLockAcquireBackoff(initial, max time.Duration, jitter bool) MySQLOpt {
+	return func(p *MySQL) {
+		if initial <= 0 {
+			initial = time.Millisecond
+		}
+		if max < initial {
+			max = initial
+		}
+		p.lockBackoffInitial = initial
+		p.lockBackoffMax = max
+		p.lockBackoffJitter = jitter
+	}
+}
+
+// WithANSIQuotes says if the server is in ANSI_QUOTES mode.  In
+// ANSI_QUOTES mode, "name" is an identifier rather than a string, so the
+// tracking table name may be quoted with double quotes and names
+// given to WithTrackingTable are quoted with double quotes instead of
+// backquotes.  Without WithANSIQuotes, the mode is detected from
+// @@SESSION.sql_mode the first time the tracking table is needed.
+func WithANSIQuotes(on bool) MySQLOpt {
+	return func(p *MySQL) {
+		p.ansiQuotes = on
+		p.ansiQuotesKnown = true
+	}
+}
+
 // New creates a libschema.Database with a mysql driver built in.
 func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB, options ...MySQLOpt) (*libschema.Database, *MySQL, error) {
 	m := &MySQL{
-		db:                  db,
-		trackingSchemaTable: trackingSchemaTable,
+		db:                db,
+		trackingEngine:    "InnoDB",
+		trackingCharset:   "utf8mb4",
+		trackingCollation: "utf8mb4_bin",
+		placeholder:       libschema.QuestionPlaceholder,
 	}
+	m.trackingSchemaTable = m.defaultTrackingSchemaTable
 	for _, opt := range options {
 		opt(m)
 	}
+	if m.databaseName != "" && !simpleIdentifierRE.MatchString(m.databaseName) {
+		return nil, nil, errors.Errorf("Database name must be a simple identifier, not '%s'", m.databaseName)
+	}
+	if m.trackingSuffix != "" {
+		if !trackingSuffixRE.MatchString(m.trackingSuffix) {
+			return nil, nil, errors.Errorf("Tracking table suffix must be letters, digits, and underscores, not '%s'", m.trackingSuffix)
+		}
+		m.trackingSchemaTable = withTrackingSuffix(m.trackingSchemaTable, m.trackingSuffix)
+	}
 	var d *libschema.Database
 	if !m.skipDatabase {
 		var err error
@@ -73,22 +230,59 @@ func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB, o
 		if err != nil {
 			return nil, nil, err
 		}
-		m.databaseName = d.Options.SchemaOverride
+		if m.databaseName == "" {
+			m.databaseName = d.Options.SchemaOverride
+		}
 	}
 	return d, m, nil
 }
 
+// CreateDatabaseIfNotExists creates a database (schema) if it does not
+// already exist.  This is useful for fresh local and CI setups where the
+// application bootstraps its own database.  CREATE DATABASE does not need
+// a database to be selected, but connecting does fail if the DSN names a
+// database that does not exist.  Create the *sql.DB used for
+// CreateDatabaseIfNotExists from a DSN without a database name
+// (for example "user:password@tcp(localhost:3306)/") and use WithoutDatabase
+// if there is no libschema.Schema yet.
+func (p *MySQL) CreateDatabaseIfNotExists(ctx context.Context, name string) error {
+	if !simpleIdentifierRE.MatchString(name) {
+		return errors.Errorf("Database name must be a simple identifier, not '%s'", name)
+	}
+	_, err := p.db.ExecContext(ctx, `CREATE DATABASE IF NOT EXISTS `+name)
+	return errors.Wrapf(err, "create database %s", name)
+}
+
 type mmigration struct {
 	libschema.MigrationBase
-	script   func(context.Context, *sql.Tx) string
-	computed func(context.Context, *sql.Tx) error
+	sqlText        string // set by Script()
+	script         func(context.Context, *sql.Tx) string
+	computed       func(context.Context, *sql.Tx) error
+	useSchema      string
+	analyze        []string
+	osc            OSCTool
+	retries        int
+	allowUnbounded bool
+	allowTracking  bool
+	backup         []string
+	backupsMade    []string // by the latest attempt, not copied
+	renderErr      error    // set by ScriptTemplate()
 }
 
 func (m *mmigration) Copy() libschema.Migration {
 	return &mmigration{
-		MigrationBase: m.MigrationBase.Copy(),
-		script:        m.script,
-		computed:      m.computed,
+		MigrationBase:  m.MigrationBase.Copy(),
+		sqlText:        m.sqlText,
+		script:         m.script,
+		computed:       m.computed,
+		useSchema:      m.useSchema,
+		analyze:        m.analyze,
+		osc:            m.osc,
+		retries:        m.retries,
+		allowUnbounded: m.allowUnbounded,
+		allowTracking:  m.allowTracking,
+		backup:         m.backup,
+		renderErr:      m.renderErr,
 	}
 }
 
@@ -96,11 +290,48 @@ func (m *mmigration) Base() *libschema.MigrationBase {
 	return &m.MigrationBase
 }
 
+// String describes the migration for logs and test failures
+func (m *mmigration) String() string {
+	var details []string
+	switch {
+	case m.computed != nil:
+		details = append(details, "computed")
+	case m.sqlText != "":
+		details = append(details, "script")
+	default:
+		details = append(details, "generate")
+	}
+	if m.useSchema != "" {
+		details = append(details, "useSchema="+m.useSchema)
+	}
+	if m.osc != nil {
+		details = append(details, "onlineSchemaChange")
+	}
+	if m.retries != 0 {
+		details = append(details, "retries="+strconv.Itoa(m.retries))
+	}
+	if m.allowUnbounded {
+		details = append(details, "allowUnboundedMutation")
+	}
+	if m.allowTracking {
+		details = append(details, "allowTrackingTableAccess")
+	}
+	if len(m.analyze) != 0 {
+		details = append(details, "analyze="+strings.Join(m.analyze, ","))
+	}
+	if len(m.backup) != 0 {
+		details = append(details, "backup="+strings.Join(m.backup, ","))
+	}
+	return m.Describe(details...)
+}
+
 // Script creates a libschema.Migration from a SQL string
 func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
-	return Generate(name, func(_ context.Context, _ *sql.Tx) string {
+	m := Generate(name, func(_ context.Context, _ *sql.Tx) string {
 		return sqlText
 	}, opts...)
+	m.(*mmigration).sqlText = sqlText
+	return m
 }
 
 // Generate creates a libschema.Migration from a function that returns a SQL string
@@ -134,6 +365,163 @@ func Computed(
 	}.applyOpts(opts)
 }
 
+// ComputedRetryable is like Computed but if action fails with a
+// deadlock (error 1213) or a lock wait timeout (error 1205), the
+// transaction is rolled back and action is run again in a new
+// transaction, up to maxRetries more times.  Other errors fail the
+// migration right away.  Action must be safe to run again after a
+// rollback.  This is meant for chunked backfills that compete with
+// application traffic.
+func ComputedRetryable(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	maxRetries int,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	m := Computed(name, action, opts...)
+	m.(*mmigration).retries = maxRetries
+	return m
+}
+
+// WithDeadlockRetry retries Script() and Generate() migrations that
+// fail with a deadlock (error 1213) or a lock wait timeout (error 1205)
+// up to attempts more times.  The transaction is rolled back before
+// each retry.  The wait before the first retry is backoff and it
+// doubles after that.  Other errors, like constraint violations, are
+// not retried.  Computed() migrations are only retried if they are
+// created with ComputedRetryable, which then also uses the backoff.
+// The status of a migration that still fails is saved after the last
+// attempt.
+func WithDeadlockRetry(attempts int, backoff time.Duration) MySQLOpt {
+	return func(p *MySQL) {
+		p.deadlockRetries = attempts
+		p.deadlockBackoff = backoff
+	}
+}
+
+// maxRetries is the number of times a migration can be retried after
+// a deadlock
+func (p *MySQL) maxRetries(pm *mmigration) int {
+	if pm.script != nil && pm.retries < p.deadlockRetries {
+		return p.deadlockRetries
+	}
+	return pm.retries
+}
+
+// retryDelay is the wait after the nth (starting at 1) failed attempt
+func (p *MySQL) retryDelay(attempt int) time.Duration {
+	delay := p.deadlockBackoff
+	for i := 1; i < attempt && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// isRetryable returns true for errors that mean that the transaction
+// can be tried again: deadlocks and lock wait timeouts
+func isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1205, 1213:
+		return true
+	}
+	return false
+}
+
+// IsRetryable implements libschema.ErrorClassifier.  Deadlocks (1213),
+// lock wait timeouts (1205), and lost connections (2006, 2013, or
+// the go-sql-driver equivalents) are retryable.  Only deadlocks and lock
+// wait timeouts are retried by WithDeadlockRetry.
+func (p *MySQL) IsRetryable(err error) bool {
+	if isRetryable(err) {
+		return true
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 2006, 2013:
+		return true
+	}
+	return false
+}
+
+// IsAlreadyExists implements libschema.ErrorClassifier.  It returns true
+// for creating a database (1007), table (1050), column (1060), index
+// (1061), or foreign key (1826) that already exists.
+func (p *MySQL) IsAlreadyExists(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1007, 1050, 1060, 1061, 1826:
+		return true
+	}
+	return false
+}
+
+// WithUseSchema causes a single migration to run with "USE name" in
+// effect. The prior default database is restored when the migration
+// finishes. This is useful for migrations that must touch a schema
+// other than the SchemaOverride used for the rest of the migrations.
+// The name must be a simple identifier.  MySQL cannot go back to having
+// no default database so, like libschema.WithDedicatedConn, the
+// migration runs on a connection that is closed afterwards rather than
+// returned to the pool.
+func WithUseSchema(name string) libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			mm.useSchema = name
+		}
+	}
+}
+
+// WithAllowUnboundedMutation allows a Script or Generate migration to
+// have UPDATE or DELETE statements without a WHERE clause.  Without it,
+// such migrations fail (see UnboundedMutation).
+func WithAllowUnboundedMutation() libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			mm.allowUnbounded = true
+		}
+	}
+}
+
+// WithAllowTrackingTableAccess allows a Script or Generate migration to
+// reference the libschema tracking table.  Without it, such migrations
+// fail (see TrackingTableAccess) so that a migration cannot accidentally
+// clobber the record of which migrations have been applied.
+func WithAllowTrackingTableAccess() libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			mm.allowTracking = true
+		}
+	}
+}
+
+// WithPostMigrationAnalyze runs ANALYZE TABLE on the listed tables after
+// the migration has been committed so that table statistics are current
+// after large data changes.  ANALYZE TABLE is run as a separate statement
+// outside the migration transaction.  Failures of ANALYZE TABLE are logged
+// but do not fail the migration.  Table names must be simple identifiers,
+// optionally qualified with a schema name.
+func WithPostMigrationAnalyze(tables ...string) libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			analyze := make([]string, len(mm.analyze), len(mm.analyze)+len(tables))
+			copy(analyze, mm.analyze)
+			mm.analyze = append(analyze, tables...)
+		}
+	}
+}
+
 func (m mmigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
 	lsm := libschema.Migration(&m)
 	for _, opt := range opts {
@@ -155,63 +543,255 @@ func (p *MySQL) DoOneMigration(ctx context.Context, log *internal.Log, d *libsch
 			})
 		}
 	}()
-	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	pm := m.(*mmigration)
+	if err := p.lockLostError(); err != nil {
+		return nil, err
+	}
+	pm.backupsMade = nil
+	if len(pm.analyze) != 0 {
+		// deferred ahead of the Commit below so that ANALYZE TABLE sees
+		// the committed changes
+		defer func() {
+			if err == nil {
+				p.analyzeTables(ctx, log, d, pm.analyze)
+			}
+		}()
 	}
+	if pm.osc != nil {
+		if flavor, _ := p.serverFlavor(ctx, d.DB()); flavor == FlavorTiDB {
+			log.Info("TiDB schema changes are online, not using the online schema change tool", map[string]interface{}{
+				"migration": m.Base().Name,
+			})
+		} else {
+			return nil, p.doOnlineSchemaChange(ctx, log, d, pm)
+		}
+	}
+	if len(pm.backup) != 0 && p.connectionLimit(d.DB()) == 1 {
+		return nil, errors.Errorf("WithBackupTables in migration %s needs a second connection", m.Base().Name)
+	}
+	start := time.Now()
+	var conn *sql.Conn
+	if m.Base().HasDedicatedConn() || pm.useSchema != "" {
+		conn, err = d.DB().Conn(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Get connection for migration %s", m.Base().Name)
+		}
+		// deferred ahead of the Commit below because the transaction is
+		// on conn
+		defer func() {
+			if conn != nil {
+				internal.DiscardConn(conn)
+			}
+		}()
+	}
+	var tx *sql.Tx
 	defer func() {
+		if tx == nil {
+			return
+		}
 		if err != nil {
 			_ = tx.Rollback()
 		} else {
 			err = errors.Wrapf(tx.Commit(), "Commit migration %s", m.Base().Name)
 		}
 	}()
-	if d.Options.SchemaOverride != "" {
-		if !simpleIdentifierRE.MatchString(d.Options.SchemaOverride) {
-			return nil, errors.Errorf("Options.SchemaOverride must be a simple identifier, not '%s'", d.Options.SchemaOverride)
-		}
-		_, err := tx.Exec(`USE ` + d.Options.SchemaOverride)
+	for attempt := 1; ; attempt++ {
+		var restoreSchema func() error
+		tx, restoreSchema, err = p.beginMigration(ctx, d, conn, pm)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Set search path to %s for %s", d.Options.SchemaOverride, m.Base().Name)
+			return nil, err
 		}
-	}
-	pm := m.(*mmigration)
-	if pm.script != nil {
-		script := pm.script(ctx, tx)
-		switch CheckScript(script) {
-		case Safe:
-		case DataAndDDL:
-			err = errors.New("Migration combines DDL (Data Definition Language [schema changes]) and data manipulation")
-		case NonIdempotentDDL:
-			if !m.Base().HasSkipIf() {
-				err = errors.New("Unconditional migration has non-idempotent DDL (Data Definition Language [schema changes])")
+		result, err = p.runMigration(ctx, log, d, tx, pm)
+		if restoreSchema != nil {
+			// USE leaks out of transactions so this must be done before
+			// the connection is returned to the pool
+			rerr := restoreSchema()
+			if err == nil {
+				err = rerr
 			}
 		}
-		if err == nil {
-			result, err = tx.Exec(script)
+		if err == nil || attempt > p.maxRetries(pm) || !isRetryable(err) {
+			break
+		}
+		delay := p.retryDelay(attempt)
+		log.Warn("Migration hit a deadlock or lock wait timeout, retrying", map[string]interface{}{
+			"migration": m.Base().Name,
+			"attempt":   attempt,
+			"delay":     delay.String(),
+			"error":     err.Error(),
+		})
+		_ = tx.Rollback()
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				// the next BeginTx reports the cancellation
+			case <-time.After(delay):
+			}
 		}
-		err = errors.Wrap(err, script)
-	} else {
-		err = pm.computed(ctx, tx)
 	}
+	// measured before the status transaction is started
+	duration := time.Since(start)
 	if err != nil {
 		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
 		_ = tx.Rollback()
-		ntx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
-		if txerr != nil {
-			return nil, errors.Wrapf(err, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+		if d.Options.WithoutFailureStatus {
+			return nil, err
 		}
-		tx = ntx
+		if conn != nil {
+			// so that saving the status does not need a second connection
+			internal.DiscardConn(conn)
+			conn = nil
+		}
+		return nil, p.saveFailure(ctx, log, d, m, err, duration)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil, duration)
+	return
+}
+
+// saveFailure records a failed migration.  The migration transaction
+// has been rolled back so the status is saved in a transaction of its own.
+func (p *MySQL) saveFailure(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error, duration time.Duration) error {
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, false, migrationError, duration)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
 	}
-	txerr := p.saveStatus(log, tx, d, m, err == nil, err)
 	if txerr != nil {
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
+}
+
+// beginMigration starts the transaction for a migration and selects the
+// schema that it runs in.
+func (p *MySQL) beginMigration(ctx context.Context, d *libschema.Database, conn *sql.Conn, pm *mmigration) (tx *sql.Tx, restoreSchema func() error, err error) {
+	if conn != nil {
+		tx, err = conn.BeginTx(ctx, d.TxOptions(pm))
+	} else {
+		tx, err = d.BeginTx(ctx, pm)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Begin Tx for migration %s", pm.Base().Name)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			tx = nil
+		}
+	}()
+	if d.Options.SchemaOverride != "" {
+		if !simpleIdentifierRE.MatchString(d.Options.SchemaOverride) {
+			return nil, nil, errors.Errorf("Options.SchemaOverride must be a simple identifier, not '%s'", d.Options.SchemaOverride)
+		}
+		_, err = tx.Exec(`USE ` + d.Options.SchemaOverride)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Set search path to %s for %s", d.Options.SchemaOverride, pm.Base().Name)
+		}
+	}
+	if pm.useSchema != "" {
+		restoreSchema, err = useSchema(tx, pm.useSchema)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Use schema for %s", pm.Base().Name)
+		}
+	}
+	return tx, restoreSchema, nil
+}
+
+// runMigration runs a migration (other than an online schema change)
+// in tx
+func (p *MySQL) runMigration(ctx context.Context, log *internal.Log, d *libschema.Database, tx *sql.Tx, pm *mmigration) (result sql.Result, err error) {
+	var skip bool
+	skip, err = pm.Base().SkipIfTx(ctx, tx)
+	if err == nil && !skip && len(pm.backup) != 0 && pm.backupsMade == nil {
+		// once, even if the migration is retried
+		pm.backupsMade, err = p.backupTables(ctx, log, d, pm)
+	}
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": pm.Base().Name,
+		})
+	case pm.script != nil:
+		var script string
+		script, err = p.generate(ctx, d, tx, pm)
 		if err == nil {
-			err = txerr
-		} else {
-			err = errors.Wrapf(err, "Save status for %s also failed: %s", m.Base().Name, txerr)
+			err = p.checkMigration(log, pm, script, p.trackingTable(d))
+		}
+		if err == nil {
+			script, err = p.rewriteScript(script)
+		}
+		if err == nil {
+			result, err = execScript(tx, script)
 		}
+		err = errors.Wrap(err, script)
+	default:
+		err = libschema.ComputedResult(ctx, log, pm.Base().Name, pm.computed(ctx, tx))
 	}
-	return
+	return result, err
+}
+
+type databaseNameKey struct{}
+
+// DatabaseNameFromContext returns the name of the database (schema) that
+// a Generate() migration runs in so that the generator can qualify table
+// names.  It is the schema from WithUseSchema if that was used, otherwise
+// the name from WithDatabaseName or Options.SchemaOverride, otherwise the
+// current database of the migration's connection.  It returns "" outside
+// of a generator or if there is no current database.
+func DatabaseNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(databaseNameKey{}).(string)
+	return name
+}
+
+// generate renders a Script() or Generate() migration.  Generators get
+// the database name in their context, see DatabaseNameFromContext.
+func (p *MySQL) generate(ctx context.Context, d *libschema.Database, tx *sql.Tx, pm *mmigration) (string, error) {
+	if pm.sqlText != "" {
+		return pm.sqlText, nil
+	}
+	name, err := p.migrationDatabase(ctx, d, tx, pm)
+	if err != nil {
+		return "", err
+	}
+	return pm.script(context.WithValue(ctx, databaseNameKey{}, name), tx), nil
+}
+
+// migrationDatabase is the database (schema) that a migration runs in:
+// the one from WithUseSchema, then WithDatabaseName, then
+// Options.SchemaOverride, then the current database of tx.
+func (p *MySQL) migrationDatabase(ctx context.Context, d *libschema.Database, tx *sql.Tx, pm *mmigration) (string, error) {
+	switch {
+	case pm.useSchema != "":
+		return pm.useSchema, nil
+	case p.databaseName != "":
+		return p.databaseName, nil
+	case d.Options.SchemaOverride != "":
+		return d.Options.SchemaOverride, nil
+	}
+	var current sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT DATABASE()`).Scan(&current)
+	if err != nil {
+		return "", errors.Wrapf(err, "select database() for %s", pm.Base().Name)
+	}
+	return current.String, nil
+}
+
+// rewriteScript applies WithSQLRewriter
+func (p *MySQL) rewriteScript(script string) (string, error) {
+	if p.sqlRewriter == nil {
+		return script, nil
+	}
+	rewritten, err := p.sqlRewriter(script)
+	if err != nil {
+		return script, errors.Wrap(err, "rewrite SQL")
+	}
+	return rewritten, nil
 }
 
 // CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
@@ -219,10 +799,23 @@ func (p *MySQL) DoOneMigration(ctx context.Context, log *internal.Log, d *libsch
 // called internally which means that is safe to override
 // in types that embed MySQL.
 func (p *MySQL) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	err := p.detectANSIQuotes(ctx, d.DB())
+	if err != nil {
+		return err
+	}
 	schema, tableName, err := p.trackingSchemaTable(d)
 	if err != nil {
 		return err
 	}
+	tableOptions, err := p.trackingTableOptions()
+	if err != nil {
+		return err
+	}
+	schemaExists, tableExists, err := TrackingTableExists(ctx, d.DB(), schema, tableName)
+	if err != nil {
+		return err
+	}
+	p.setTrackingCreated(false, false)
 	if schema != "" {
 		_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
 				CREATE SCHEMA IF NOT EXISTS %s
@@ -237,17 +830,324 @@ func (p *MySQL) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Lo
 			migration	varchar(255) NOT NULL,
 			done		boolean NOT NULL,
 			error		text NOT NULL,
+			applied_by	varchar(255),
 			updated_at	timestamp DEFAULT now(),
+			duration_ms	bigint NOT NULL DEFAULT 0,
+			run_id		varchar(255),
+			created_at	timestamp NULL DEFAULT NULL,
+			comment		text,
+			backup_tables	text,
 			PRIMARY KEY	(library, migration)
-		) ENGINE = InnoDB`, tableName))
+		) %s`, tableName, tableOptions))
 	if err != nil {
 		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
 	}
+	p.setTrackingCreated(schema != "" && !schemaExists, !tableExists)
+	return AddTrackingColumns(ctx, d, schema, tableName)
+}
+
+// DropTrackingTable drops the migration tracking table and, if the lock
+// strategy could use RowLock, the lock table.  If the tracking table is in a database and that
+// database is now empty, the database is dropped too.
+//
+// It is expected to be called by libschema.
+func (p *MySQL) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	err := p.detectANSIQuotes(ctx, d.DB())
+	if err != nil {
+		return err
+	}
+	schema, tableName, err := p.trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	tables := tableName
+	if p.lockStrategy == RowLock || p.lockStrategy == DetectLock || p.flavor == FlavorTiDB || p.connectionLimit(d.DB()) == 1 {
+		tables += ", " + lockTableName(tableName)
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP TABLE IF EXISTS `+tables)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	if schema == "" {
+		return nil
+	}
+	var count int
+	err = d.DB().QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = ?`, unquoteIdentifier(schema)).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check if libschema database '%s' is empty", schema)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP DATABASE IF EXISTS `+schema)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema database '%s'", schema)
+	}
+	return nil
+}
+
+// addedTrackingColumns were added after the tracking table was first
+// defined
+var addedTrackingColumns = []struct {
+	name       string
+	definition string
+	fill       string // value for rows that existed before the column
+}{
+	{name: "applied_by", definition: "varchar(255)"},
+	{name: "duration_ms", definition: "bigint NOT NULL DEFAULT 0"},
+	{name: "run_id", definition: "varchar(255)"},
+	// the first time a migration was applied is not known for existing
+	// rows: the last time is the best approximation
+	{name: "created_at", definition: "timestamp NULL DEFAULT NULL", fill: "updated_at"},
+	{name: "comment", definition: "text"},
+	{name: "backup_tables", definition: "text"},
+}
+
+// TrackingCreated reports if the last call to CreateSchemaTableIfNotExists
+// (which Migrate() calls) created the schema (database) of the tracking
+// table and if it created the tracking table.  Use it to run first-time
+// setup, like granting permissions.  The schema is only created if the
+// tracking table name includes one.  Existence is checked just before
+// the CREATE statements so if two processes create the tracking table
+// at the same moment, both may report that they created it.
+func (p *MySQL) TrackingCreated() (schemaCreated bool, tableCreated bool) {
+	p.createdLock.Lock()
+	defer p.createdLock.Unlock()
+	return p.schemaCreated, p.tableCreated
+}
+
+func (p *MySQL) setTrackingCreated(schemaCreated bool, tableCreated bool) {
+	p.createdLock.Lock()
+	defer p.createdLock.Unlock()
+	p.schemaCreated, p.tableCreated = schemaCreated, tableCreated
+}
+
+// TrackingTableExists reports if the schema and the tracking table
+// exist.  schema and tableName are as returned by the function given
+// to WithTrackingTableQuoter: tableName may include the schema and
+// either can be quoted.  If schema is empty, the current database is
+// used and schemaExists is true.
+func TrackingTableExists(ctx context.Context, db *sql.DB, schema string, tableName string) (schemaExists bool, tableExists bool, err error) {
+	table := tableName[strings.LastIndex(tableName, ".")+1:]
+	var schemaCount, tableCount int
+	err = db.QueryRowContext(ctx, `
+		SELECT	(SELECT	COUNT(*)
+			FROM	information_schema.schemata
+			WHERE	schema_name = COALESCE(NULLIF(?, ''), DATABASE())),
+			(SELECT	COUNT(*)
+			FROM	information_schema.tables
+			WHERE	table_schema = COALESCE(NULLIF(?, ''), DATABASE())
+			AND	table_name = ?)`,
+		unquoteIdentifier(schema), unquoteIdentifier(schema), unquoteIdentifier(table)).Scan(&schemaCount, &tableCount)
+	if err != nil {
+		return false, false, errors.Wrapf(err, "Could not check for libschema migrations table '%s'", tableName)
+	}
+	return schemaCount != 0, tableCount != 0, nil
+}
+
+// AddTrackingColumns adds the columns that were added to the tracking
+// table after it was first defined to a tracking table that does not
+// have them.  schema and tableName are as for TrackingTableExists.
+func AddTrackingColumns(ctx context.Context, d *libschema.Database, schema string, tableName string) error {
+	for _, column := range addedTrackingColumns {
+		err := addColumn(ctx, d, schema, tableName, column.name, column.definition, column.fill)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// addColumn adds a column to tracking tables that were created before
+// it was defined.  MySQL does not support ADD COLUMN IF NOT EXISTS.
+func addColumn(ctx context.Context, d *libschema.Database, schema string, tableName string, column string, definition string, fill string) error {
+	table := tableName[strings.LastIndex(tableName, ".")+1:]
+	var count int
+	err := d.DB().QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.columns
+		WHERE	table_schema = COALESCE(NULLIF(?, ''), DATABASE())
+		AND	table_name = ?
+		AND	column_name = ?`,
+		unquoteIdentifier(schema), unquoteIdentifier(table), column).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check libschema migrations table '%s' for %s", tableName, column)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		ALTER TABLE %s ADD COLUMN %s %s`, tableName, column, definition))
+	if err != nil {
+		return errors.Wrapf(err, "Could not add %s to libschema migrations table '%s'", column, tableName)
+	}
+	if fill == "" {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s SET %s = %s`, tableName, column, fill))
+	return errors.Wrapf(err, "Could not fill %s in libschema migrations table '%s'", column, tableName)
+}
+
 var simpleIdentifierRE = regexp.MustCompile(`\A[A-Za-z][A-Za-z0-9_]*\z`)
 
+var trackingSuffixRE = regexp.MustCompile(`\A[A-Za-z0-9_]+\z`)
+
+// withTrackingSuffix wraps a trackingSchemaTable function so that the
+// tracking table name that it returns ends with suffix.
+func withTrackingSuffix(f func(*libschema.Database) (string, string, error), suffix string) func(*libschema.Database) (string, string, error) {
+	return func(d *libschema.Database) (string, string, error) {
+		schema, tableName, err := f(d)
+		if err != nil {
+			return "", "", err
+		}
+		return schema, appendToTableName(tableName, suffix), nil
+	}
+}
+
+// validTableReference checks for table or schema.table where both
+// parts are simple identifiers
+func validTableReference(table string) bool {
+	parts := strings.Split(table, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !simpleIdentifierRE.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// analyzeTables refreshes table statistics.  Problems are logged but
+// not returned because the migration has already been committed.
+func (p *MySQL) analyzeTables(ctx context.Context, log *internal.Log, d *libschema.Database, tables []string) {
+	qualified := make([]string, len(tables))
+	for i, table := range tables {
+		if d.Options.SchemaOverride != "" && !strings.Contains(table, ".") {
+			table = d.Options.SchemaOverride + "." + table
+		}
+		qualified[i] = table
+	}
+	rows, err := d.DB().QueryContext(ctx, `ANALYZE TABLE `+strings.Join(qualified, ", "))
+	if err != nil {
+		log.Warn("Could not analyze tables", map[string]interface{}{
+			"tables": tables,
+			"error":  err,
+		})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, op, msgType, msgText string
+		err := rows.Scan(&table, &op, &msgType, &msgText)
+		if err != nil {
+			log.Warn("Could not read analyze tables result", map[string]interface{}{
+				"tables": tables,
+				"error":  err,
+			})
+			return
+		}
+		if strings.EqualFold(msgType, "error") {
+			log.Warn("Analyze table failed", map[string]interface{}{
+				"table": table,
+				"error": msgText,
+			})
+		}
+	}
+}
+
+func (p *MySQL) trackingTableOptions() (string, error) {
+	var opts []string
+	for _, o := range []struct {
+		name  string
+		value string
+	}{
+		{"ENGINE", p.trackingEngine},
+		{"DEFAULT CHARSET", p.trackingCharset},
+		{"COLLATE", p.trackingCollation},
+	} {
+		if o.value == "" {
+			continue
+		}
+		if !simpleIdentifierRE.MatchString(o.value) {
+			return "", errors.Errorf("Tracking table %s must be a simple identifier, not '%s'", o.name, o.value)
+		}
+		opts = append(opts, o.name+" = "+o.value)
+	}
+	return strings.Join(opts, " "), nil
+}
+
+// useSchema switches the default database for the connection underlying
+// tx and returns a function to switch it back.  If there was no default
+// database, there is nothing to switch back to so the caller must
+// discard the connection.
+func useSchema(tx *sql.Tx, schema string) (func() error, error) {
+	if !simpleIdentifierRE.MatchString(schema) {
+		return nil, errors.Errorf("schema for WithUseSchema must be a simple identifier, not '%s'", schema)
+	}
+	var prior sql.NullString
+	err := tx.QueryRow(`SELECT DATABASE()`).Scan(&prior)
+	if err != nil {
+		return nil, errors.Wrap(err, "select database()")
+	}
+	_, err = tx.Exec(`USE ` + schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "use %s", schema)
+	}
+	return func() error {
+		if !prior.Valid || prior.String == "" {
+			// the connection is discarded
+			return nil
+		}
+		_, err := tx.Exec("USE `" + strings.ReplaceAll(prior.String, "`", "``") + "`")
+		return errors.Wrapf(err, "restore database to %s", prior.String)
+	}, nil
+}
+
+// WithTrackingTable sets the schema (database) and name of the
+// tracking table, overriding Options.TrackingTable.  Unlike
+// Options.TrackingTable, the two parts are given separately so there is
+// no parsing of a dotted name.  If schema is empty, the tracking table
+// is in the current database.  Names that are not simple identifiers
+// are quoted with backquotes; they cannot contain backquotes.
+func WithTrackingTable(schema, table string) MySQLOpt {
+	return func(p *MySQL) {
+		p.trackingSchemaTable = func(*libschema.Database) (string, string, error) {
+			return p.explicitSchemaTable(schema, table)
+		}
+	}
+}
+
+func (p *MySQL) explicitSchemaTable(schema, table string) (string, string, error) {
+	q := p.identifierQuote()
+	quote := func(kind, name string) (string, error) {
+		switch {
+		case name == "" || strings.Contains(name, q):
+			return "", errors.Errorf("Tracking table %s name must not be empty or contain '%s', not '%s'", kind, q, name)
+		case simpleIdentifierRE.MatchString(name):
+			return name, nil
+		}
+		return q + name + q, nil
+	}
+	quotedTable, err := quote("table", table)
+	if err != nil {
+		return "", "", err
+	}
+	if schema == "" {
+		return "", quotedTable, nil
+	}
+	quotedSchema, err := quote("schema", schema)
+	if err != nil {
+		return "", "", err
+	}
+	return quotedSchema, quotedSchema + "." + quotedTable, nil
+}
+
 func WithTrackingTableQuoter(f func(*libschema.Database) (schemaName string, tableName string, err error)) MySQLOpt {
 	return func(p *MySQL) {
 		p.trackingSchemaTable = f
@@ -255,26 +1155,25 @@ func WithTrackingTableQuoter(f func(*libschema.Database) (schemaName string, tab
 }
 
 // When MySQL is in ANSI_QUOTES mode, it allows "table_name" quotes but when
-// it is not then it does not.  There is no prefect option: in ANSI_QUOTES
-// mode, you could have a table called `table` (eg: `CREATE TABLE "table"`) but
-// if you're not in ANSI_QUOTES mode then you cannot.  We're going to assume
-// that we're not in ANSI_QUOTES mode because we cannot assume that we are.
-func trackingSchemaTable(d *libschema.Database) (string, string, error) {
+// it is not then it does not.  Names in Options.TrackingTable must be simple
+// identifiers unless the server is known to be in ANSI_QUOTES mode (see
+// WithANSIQuotes) in which case they may also be "quoted".
+func (p *MySQL) defaultTrackingSchemaTable(d *libschema.Database) (string, string, error) {
 	tableName := d.Options.TrackingTable
 	s := strings.Split(tableName, ".")
 	switch len(s) {
 	case 2:
 		schema := s[0]
-		if !simpleIdentifierRE.MatchString(schema) {
+		if !p.validTrackingName(schema) {
 			return "", "", errors.Errorf("Tracking table schema name must be a simple identifier, not '%s'", schema)
 		}
 		table := s[1]
-		if !simpleIdentifierRE.MatchString(table) {
+		if !p.validTrackingName(table) {
 			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", table)
 		}
 		return schema, schema + "." + table, nil
 	case 1:
-		if !simpleIdentifierRE.MatchString(tableName) {
+		if !p.validTrackingName(tableName) {
 			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", tableName)
 		}
 		return "", tableName, nil
@@ -283,6 +1182,65 @@ func trackingSchemaTable(d *libschema.Database) (string, string, error) {
 	}
 }
 
+var ansiQuotedIdentifierRE = regexp.MustCompile(`\A"[^"]+"\z`)
+
+func (p *MySQL) validTrackingName(name string) bool {
+	if simpleIdentifierRE.MatchString(name) {
+		return true
+	}
+	return p.usesANSIQuotes() && ansiQuotedIdentifierRE.MatchString(name)
+}
+
+// identifierQuote returns the character used to quote identifiers
+func (p *MySQL) identifierQuote() string {
+	if p.usesANSIQuotes() {
+		return `"`
+	}
+	return "`"
+}
+
+func (p *MySQL) usesANSIQuotes() bool {
+	p.ansiQuotesLock.Lock()
+	defer p.ansiQuotesLock.Unlock()
+	return p.ansiQuotes
+}
+
+// detectANSIQuotes checks @@SESSION.sql_mode for ANSI_QUOTES unless
+// it was set with WithANSIQuotes or has already been checked.
+func (p *MySQL) detectANSIQuotes(ctx context.Context, db *sql.DB) error {
+	p.ansiQuotesLock.Lock()
+	defer p.ansiQuotesLock.Unlock()
+	if p.ansiQuotesKnown {
+		return nil
+	}
+	var mode sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT @@SESSION.sql_mode`).Scan(&mode)
+	if err != nil {
+		return errors.Wrap(err, "Could not check sql_mode for ANSI_QUOTES")
+	}
+	p.ansiQuotes = hasANSIQuotes(mode.String)
+	p.ansiQuotesKnown = true
+	return nil
+}
+
+// hasANSIQuotes reports if a sql_mode includes ANSI_QUOTES.  The ANSI
+// mode is a combination that includes ANSI_QUOTES.
+func hasANSIQuotes(sqlMode string) bool {
+	for _, mode := range strings.Split(sqlMode, ",") {
+		switch strings.ToUpper(strings.TrimSpace(mode)) {
+		case "ANSI_QUOTES", "ANSI":
+			return true
+		}
+	}
+	return false
+}
+
+// unquoteIdentifier removes backquotes or ANSI double quotes from a
+// name so that it can be compared with information_schema
+func unquoteIdentifier(name string) string {
+	return strings.Trim(name, "`\"")
+}
+
 // trackingTable returns the schema+table reference for the migration tracking table.
 // The name is already quoted properly for use as a save mysql identifier.
 func (p *MySQL) trackingTable(d *libschema.Database) string {
@@ -290,22 +1248,89 @@ func (p *MySQL) trackingTable(d *libschema.Database) string {
 	return table
 }
 
-func (p *MySQL) saveStatus(log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
-	var estr string
-	if migrationError != nil {
-		estr = migrationError.Error()
+// saveStatus records the status of a migration and how long the
+// latest attempt to run it took.  It updates the existing row, rather
+// than using REPLACE INTO, so that columns it does not set keep their
+// values when a migration is retried.  created_at is only set when the
+// row is first inserted.
+func (p *MySQL) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error, duration time.Duration) error {
+	err := libschema.StatusSaver{
+		Placeholder: p.placeholder,
+		Query: func(table string, ph libschema.Placeholder) string {
+			return fmt.Sprintf(`
+				INSERT INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at, duration_ms, created_at)
+				VALUES (%s, %s, %s, %s, %s, %s, %s, now(), %d, now())
+				ON DUPLICATE KEY UPDATE
+					done = VALUES(done),
+					error = VALUES(error),
+					applied_by = VALUES(applied_by),
+					run_id = VALUES(run_id),
+					comment = VALUES(comment),
+					updated_at = VALUES(updated_at),
+					duration_ms = VALUES(duration_ms)`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7), duration.Milliseconds())
+		},
+	}.Save(ctx, log, tx, d, p.trackingTable(d), m, done, migrationError)
+	if err != nil {
+		return err
+	}
+	if pm, ok := m.(*mmigration); ok && len(pm.backupsMade) != 0 {
+		return p.saveBackupTables(ctx, tx, d, pm)
+	}
+	return nil
+}
+
+// MarkMigrationDone records a migration as done without running it.
+//
+// It is expected to be called by libschema and is not
+// called internally which means that is safe to override
+// in types that embed MySQL.
+func (p *MySQL) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.setStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.
+//
+// It is expected to be called by libschema and is not
+// called internally which means that is safe to override
+// in types that embed MySQL.
+func (p *MySQL) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	return p.setStatus(ctx, log, d, m, done)
+}
+
+func (p *MySQL) setStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
 	}
-	log.Info("Saving migration status", map[string]interface{}{
-		"migration": m.Base().Name,
-		"done":      done,
-		"error":     migrationError,
-	})
-	q := fmt.Sprintf(`
-		REPLACE INTO %s (library, migration, done, error, updated_at)
-		VALUES (?, ?, ?, ?, now())`, p.trackingTable(d))
-	_, err := tx.Exec(q, m.Base().Name.Library, m.Base().Name.Name, done, estr)
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil, 0)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// CheckTrackingTableWrite inserts a row into the tracking table and
+// rolls it back.  It is used by libschema.Database.Preflight to find a
+// missing INSERT grant before migrations run.
+func (p *MySQL) CheckTrackingTableWrite(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	tableName := p.trackingTable(d)
+	tx, err := d.DB().BeginTx(ctx, nil)
 	if err != nil {
-		return errors.Wrapf(err, "Save status for %s", m.Base().Name)
+		return errors.Wrap(err, "begin tx to check writing the tracking table")
+	}
+	defer func() { _ = tx.Rollback() }()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (library, migration, done, error)
+		VALUES (%s, %s, false, '')`, tableName, p.placeholder(1), p.placeholder(2)),
+		"libschema-preflight", "write check")
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1142 || mysqlErr.Number == 1044) {
+			return errors.Wrapf(err, "no permission to write the tracking table %s, INSERT and UPDATE must be granted", tableName)
+		}
+		return errors.Wrapf(err, "could not write the tracking table %s", tableName)
 	}
 	return nil
 }
@@ -320,32 +1345,121 @@ func (p *MySQL) saveStatus(log *internal.Log, tx *sql.Tx, d *libschema.Database,
 // In MySQL, locks are _not_ tied to transactions so closing the transaction
 // does not release the lock.  We'll use a transaction just to make sure that
 // we're using the same connection.  If LockMigrationsTable succeeds, be sure to
-// call UnlockMigrationsTable.
-func (p *MySQL) LockMigrationsTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+// call UnlockMigrationsTable.  Waiting for the lock stops when ctx is
+// cancelled.  If another libschema.Database that shares this driver holds
+// the lock, LockMigrationsTable first waits for it to be released.
+func (p *MySQL) LockMigrationsTable(ctx context.Context, log *internal.Log, d *libschema.Database) error {
 	// LockMigrationsTable is overridden for SingleStore
 	p.lock.Lock()
-	defer p.lock.Unlock()
+	for p.lockHolder != nil && p.lockHolder != d {
+		holder, released := p.lockHolder.Name, p.lockReleased
+		p.lock.Unlock()
+		log.Debug("Waiting for another database that shares the driver to release the migrations lock", map[string]interface{}{
+			"database": d.Name,
+			"holder":   holder,
+		})
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "Could not get lock for libschema migrations, database %s that shares the driver holds it", holder)
+		case <-released:
+		}
+		p.lock.Lock()
+	}
+	if p.lockHolder == d {
+		p.lock.Unlock()
+		return errors.Errorf("libschema migrations for %s already locked", d.Name)
+	}
+	// d holds the driver while it waits for the lock so that other
+	// databases wait, each with its own ctx, without holding p.lock
+	released := make(chan struct{})
+	p.lockHolder = d
+	p.lockReleased = released
+	p.lock.Unlock()
+	err := p.lockMigrationsTable(ctx, log, d)
+	if err != nil {
+		p.lock.Lock()
+		p.lockHolder = nil
+		p.lockReleased = nil
+		p.lock.Unlock()
+		close(released)
+	}
+	return err
+}
+
+func (p *MySQL) lockMigrationsTable(ctx context.Context, log *internal.Log, d *libschema.Database) error {
 	_, tableName, err := p.trackingSchemaTable(d)
 	if err != nil {
 		return err
 	}
-	if p.lockTx != nil {
+	if p.lockConn != nil || p.rowLock != nil || p.noLockHeld {
 		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
 	}
-	tx, err := d.DB().BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
-		return errors.Wrap(err, "Could not start transaction: %s")
+	switch p.resolveLockStrategy(ctx, log, d) {
+	case RowLock:
+		return p.lockWithRow(ctx, log, d, tableName)
+	case NoLock:
+		log.Warn("Running migrations without a lock", map[string]interface{}{
+			"database": d.Name,
+		})
+		p.noLockHeld = true
+		return nil
 	}
 	p.lockStr = "libschema_" + tableName
-	var gotLock int
-	err = tx.QueryRow(`SELECT GET_LOCK(?, -1)`, p.lockStr).Scan(&gotLock)
+	if p.lockBackoffInitial != 0 {
+		return p.lockWithBackoff(ctx, log, d)
+	}
+	conn, err := getAdvisoryLock(ctx, d.DB(), p.lockStr, -1)
 	if err != nil {
 		return errors.Wrapf(err, "Could not get lock for libschema migrations")
 	}
-	p.lockTx = tx
+	if conn == nil {
+		return errors.New("Could not get lock for libschema migrations")
+	}
+	p.holdAdvisoryLock(log, conn)
 	return nil
 }
 
+// lockWithBackoff polls for the lock with a non-blocking GET_LOCK.  The
+// connection is returned to the pool between attempts.
+func (p *MySQL) lockWithBackoff(ctx context.Context, log *internal.Log, d *libschema.Database) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := getAdvisoryLock(ctx, d.DB(), p.lockStr, 0)
+		if err != nil {
+			return errors.Wrapf(err, "Could not get lock for libschema migrations")
+		}
+		if conn != nil {
+			p.holdAdvisoryLock(log, conn)
+			return nil
+		}
+		delay := p.lockBackoff(attempt)
+		log.Debug("Waiting for libschema migrations lock", map[string]interface{}{
+			"attempt": attempt + 1,
+			"delay":   delay.String(),
+		})
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "Could not get lock for libschema migrations")
+		case <-time.After(delay):
+		}
+	}
+}
+
+// lockBackoff returns the delay after the nth (starting at 0) failed attempt
+// to get the lock
+func (p *MySQL) lockBackoff(n int) time.Duration {
+	delay := p.lockBackoffInitial
+	for i := 0; i < n && delay < p.lockBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > p.lockBackoffMax {
+		delay = p.lockBackoffMax
+	}
+	if p.lockBackoffJitter && delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
 // UnlockMigrationsTable unlocks the migration tracking table.
 //
 // It is expected to be called by libschema and is not
@@ -355,14 +1469,30 @@ func (p *MySQL) UnlockMigrationsTable(_ *internal.Log) error {
 	// UnlockMigrationsTable is overridden for SingleStore
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	if p.lockTx == nil {
+	if p.lockHolder != nil {
+		defer func() {
+			close(p.lockReleased)
+			p.lockHolder = nil
+			p.lockReleased = nil
+		}()
+	}
+	switch {
+	case p.rowLock != nil:
+		return p.unlockRow()
+	case p.noLockHeld:
+		p.noLockHeld = false
+		return nil
+	case p.lockConn == nil:
 		return errors.Errorf("libschema migrations table, not locked")
 	}
 	defer func() {
-		_ = p.lockTx.Rollback()
-		p.lockTx = nil
+		p.lockConn = nil
 	}()
-	_, err := p.lockTx.Exec(`SELECT RELEASE_LOCK(?)`, p.lockStr)
+	p.stopKeepalive()
+	err := releaseAdvisoryLock(p.lockConn, p.lockStr)
+	if lost := p.lockLostError(); lost != nil {
+		return lost
+	}
 	if err != nil {
 		return errors.Wrap(err, "Could not release explicit lock for schema migrations")
 	}
@@ -377,8 +1507,8 @@ func (p *MySQL) UnlockMigrationsTable(_ *internal.Log) error {
 func (p *MySQL) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
 	// TODO: DRY
 	tableName := p.trackingTable(d)
-	rows, err := d.DB().QueryContext(ctx, fmt.Sprintf(`
-		SELECT	library, migration, done
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
 		FROM	%s`, tableName))
 	if err != nil {
 		return nil, errors.Wrap(err, "Cannot query migration status")
@@ -390,7 +1520,7 @@ func (p *MySQL) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Da
 			name   libschema.MigrationName
 			status libschema.MigrationStatus
 		)
-		err := rows.Scan(&name.Library, &name.Name, &status.Done)
+		err := rows.Scan(&name.Library, &name.Name, &status.Done, &status.Error)
 		if err != nil {
 			return nil, errors.Wrap(err, "Cannot scan migration status")
 		}
@@ -403,6 +1533,74 @@ func (p *MySQL) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Da
 	return unknowns, nil
 }
 
+// RenderScript returns the SQL that a migration would run, after
+// WithSQLRewriter.  Generate() migrations are rendered in a transaction
+// that is rolled back.  It implements libschema.ScriptRenderer for
+// Database.ExportSQL.
+func (p *MySQL) RenderScript(ctx context.Context, _ *internal.Log, d *libschema.Database, migration libschema.Migration) (script string, computed bool, err error) {
+	pm, ok := migration.(*mmigration)
+	if !ok {
+		return "", false, fmt.Errorf("Non-mysql migration %s registered with mysql migrations", migration.Base().Name)
+	}
+	switch {
+	case pm.computed != nil:
+		return "", true, nil
+	case pm.sqlText != "":
+		script = pm.sqlText
+	default:
+		script, err = p.renderGenerate(ctx, d, pm)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	script, err = p.rewriteScript(script)
+	return script, false, err
+}
+
+// renderGenerate runs the generator of a Generate() migration in a
+// transaction that is rolled back.  The schema is restored and the
+// transaction rolled back even if the generator panics.  Like
+// DoOneMigration, WithUseSchema migrations use a connection that is
+// discarded afterwards.
+func (p *MySQL) renderGenerate(ctx context.Context, d *libschema.Database, pm *mmigration) (script string, err error) {
+	var conn *sql.Conn
+	if pm.useSchema != "" {
+		conn, err = d.DB().Conn(ctx)
+		if err != nil {
+			return "", errors.Wrapf(err, "Get connection for migration %s", pm.Base().Name)
+		}
+		defer internal.DiscardConn(conn)
+	}
+	tx, restoreSchema, err := p.beginMigration(ctx, d, conn, pm)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if restoreSchema != nil {
+		defer func() {
+			rerr := restoreSchema()
+			if err == nil {
+				err = rerr
+			}
+		}()
+	}
+	return p.generate(ctx, d, tx, pm)
+}
+
+// CheckMigrationScript applies the checks that are made to Script() and
+// Generate() migrations just before they run: CheckScript, with
+// WithCheckSeverity and the per-migration allowances.  It implements
+// libschema.ScriptChecker for Database.DryRender.
+func (p *MySQL) CheckMigrationScript(log *internal.Log, d *libschema.Database, migration libschema.Migration, script string) error {
+	pm, ok := migration.(*mmigration)
+	if !ok {
+		return fmt.Errorf("Non-mysql migration %s registered with mysql migrations", migration.Base().Name)
+	}
+	return p.checkMigration(log, pm, script, p.trackingTable(d))
+}
+
 // IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
 // should always return nil.
 //
@@ -414,11 +1612,24 @@ func (p *MySQL) IsMigrationSupported(d *libschema.Database, _ *internal.Log, mig
 	if !ok {
 		return fmt.Errorf("Non-mysql migration %s registered with mysql migrations", migration.Base().Name)
 	}
-	if m.script != nil {
-		return nil
+	if m.renderErr != nil {
+		return m.renderErr
 	}
-	if m.computed != nil {
-		return nil
+	for _, table := range m.analyze {
+		if !validTableReference(table) {
+			return errors.Errorf("Table '%s' for WithPostMigrationAnalyze in migration %s must be a simple identifier", table, m.Name)
+		}
+	}
+	for _, table := range m.backup {
+		if !validBackupTable(table) {
+			return errors.Errorf("Table '%s' for WithBackupTables in migration %s must be a simple identifier of at most %d characters", table, m.Name, maxBackupSourceLength)
+		}
+	}
+	if m.osc != nil && m.script == nil {
+		return errors.Errorf("WithOnlineSchemaChange in migration %s requires Script() or Generate()", m.Name)
+	}
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
 	}
-	return errors.Errorf("Migration %s is not supported", m.Name)
+	return d.ValidateMigration(m, m.sqlText)
 }
@@ -0,0 +1,1113 @@
+package lsmysql_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/lsmysql"
+	"github.com/muir/libschema/lstesting"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseSchema(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+	other := "lstest_" + lstesting.RandomString(15)
+	defer func() {
+		_, err := db.Exec(`DROP SCHEMA IF EXISTS ` + other)
+		assert.NoError(t, err, "drop other schema")
+	}()
+	options.DebugLogging = true
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("S1", `CREATE SCHEMA IF NOT EXISTS `+other),
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`,
+			lsmysql.WithUseSchema(other)),
+		lsmysql.Script("T2", `CREATE TABLE IF NOT EXISTS T2 (id text) ENGINE = InnoDB`),
+	)
+
+	err = s.Migrate(context.Background())
+	require.NoError(t, err)
+
+	tableSchema := func(table string) string {
+		var schema string
+		err := db.QueryRow(`
+			SELECT	table_schema
+			FROM	information_schema.tables
+			WHERE	table_name = ?
+			AND	table_schema IN (?, ?)`, table, options.SchemaOverride, other).Scan(&schema)
+		require.NoError(t, err, table)
+		return schema
+	}
+	assert.Equal(t, other, tableSchema("T1"), "T1")
+	assert.Equal(t, options.SchemaOverride, tableSchema("T2"), "T2")
+}
+
+func TestUseSchemaInvalid(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`,
+			lsmysql.WithUseSchema("foo;bar")),
+	)
+
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "must be a simple identifier")
+	}
+}
+
+func TestPostMigrationAnalyze(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+		lsmysql.Script("T1data", `INSERT INTO T1 (id) VALUES ('a'), ('b')`,
+			lsmysql.WithPostMigrationAnalyze("T1")),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	s = libschema.New(context.Background(), options)
+	dbase, _, err = lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L2",
+		lsmysql.Script("T2", `INSERT INTO T1 (id) VALUES ('c')`,
+			lsmysql.WithPostMigrationAnalyze("T1; DROP TABLE T1")),
+	)
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "must be a simple identifier")
+	}
+}
+
+func TestBackupTables(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int) ENGINE = InnoDB`),
+		lsmysql.Script("T1data", `INSERT INTO T1 (id) VALUES (1), (2)`),
+		lsmysql.Script("T1delete", `DELETE FROM T1 WHERE id = 1`,
+			lsmysql.WithBackupTables("T1")),
+		lsmysql.Script("T1skipped", `DELETE FROM T1 WHERE id = 2`,
+			lsmysql.WithBackupTables("T1"),
+			libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) { return true, nil })),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var backups string
+	require.NoError(t, db.QueryRow(`
+		SELECT	backup_tables
+		FROM	`+options.TrackingTable+`
+		WHERE	library = 'L1' AND migration = 'T1delete'`).Scan(&backups))
+	assert.Regexp(t, `\A`+options.SchemaOverride+`\.T1_bak_\d{14}\z`, backups)
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+backups).Scan(&count))
+	assert.Equal(t, 2, count, "backup made before the delete")
+	require.NoError(t, db.QueryRow(`
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = ?
+		AND	table_name LIKE 'T1\\_bak\\_%'`, options.SchemaOverride).Scan(&count))
+	assert.Equal(t, 1, count, "no backup for the skipped migration")
+
+	s = libschema.New(context.Background(), options)
+	dbase, _, err = lsmysql.New(libschema.LogFromLog(t), "test", s, db, lsmysql.WithBackupSizeLimit(1))
+	require.NoError(t, err)
+	dbase.Migrations("L2",
+		lsmysql.Script("T1delete", `DELETE FROM T1 WHERE id = 2`,
+			lsmysql.WithBackupTables("T1")),
+	)
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "more than the backup limit")
+	}
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+options.SchemaOverride+".T1").Scan(&count))
+	assert.Equal(t, 1, count, "migration not run without a backup")
+}
+
+func TestDedicatedConn(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Computed("C1", func(_ context.Context, tx *sql.Tx) error {
+			_, err := tx.Exec(`SET @libschema_dedicated = 'leaked'`)
+			return err
+		}, libschema.WithDedicatedConn()),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		var value sql.NullString
+		require.NoError(t, conn.QueryRowContext(context.Background(), `SELECT @libschema_dedicated`).Scan(&value))
+		assert.False(t, value.Valid, "session variable leaked into pool")
+	}
+}
+
+func TestWithSkipIf(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	var called int
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int, INDEX T1_id (id)) ENGINE = InnoDB`),
+		lsmysql.Script("T1idx-again", `CREATE INDEX T1_id ON T1 (id)`,
+			libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+				called++
+				return m.TableHasIndex("T1", "T1_id")
+			})),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 1, called, "predicate called")
+
+	s = libschema.New(context.Background(), options)
+	dbase, _, err = lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int, INDEX T1_id (id)) ENGINE = InnoDB`),
+		lsmysql.Script("T1idx-again", `CREATE INDEX T1_id ON T1 (id)`,
+			libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+				called++
+				return true, nil
+			})),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 1, called, "skipped migration was marked done")
+}
+
+func TestLockAcquireBackoff(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db,
+		lsmysql.WithLockAcquireBackoff(time.Millisecond, 10*time.Millisecond, true))
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+}
+
+func TestCreateDatabaseIfNotExists(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, m, err := lsmysql.New(libschema.LogFromLog(t), "test", nil, db, lsmysql.WithoutDatabase)
+	require.NoError(t, err)
+
+	name := "lstest_" + lstesting.RandomString(15)
+	defer func() {
+		_, err := db.Exec(`DROP SCHEMA IF EXISTS ` + name)
+		assert.NoError(t, err, "drop schema")
+	}()
+	require.NoError(t, m.CreateDatabaseIfNotExists(context.Background(), name))
+	require.NoError(t, m.CreateDatabaseIfNotExists(context.Background(), name), "again")
+
+	var found string
+	require.NoError(t, db.QueryRow(`
+		SELECT	schema_name
+		FROM	information_schema.schemata
+		WHERE	schema_name = ?`, name).Scan(&found))
+	assert.Equal(t, name, found)
+
+	assert.Error(t, m.CreateDatabaseIfNotExists(context.Background(), "foo; DROP DATABASE bar"))
+}
+
+func TestRowLock(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db,
+		lsmysql.WithLockStrategy(lsmysql.RowLock))
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+options.TrackingTable+`_lock`).Scan(&count))
+	assert.Equal(t, 0, count, "lock released")
+}
+
+func TestMaxConnections(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db,
+		lsmysql.WithMaxConnections(1))
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+		lsmysql.Script("T2", `CREATE TABLE IF NOT EXISTS T2 (id text) ENGINE = InnoDB`,
+			libschema.WithDedicatedConn()),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, s.Migrate(ctx), "no deadlock")
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+options.TrackingTable+`_lock`).Scan(&count))
+	assert.Equal(t, 0, count, "row lock used and released")
+}
+
+type fakeOSC struct {
+	calls []string
+}
+
+func (f *fakeOSC) Command(ctx context.Context, database, table, alter string) *exec.Cmd {
+	f.calls = append(f.calls, database+"."+table+": "+alter)
+	return exec.CommandContext(ctx, "true")
+}
+
+func TestOnlineSchemaChange(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	osc := &fakeOSC{}
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int) ENGINE = InnoDB`),
+		lsmysql.Script("T1level", `ALTER TABLE T1 ADD COLUMN level int`,
+			lsmysql.WithOnlineSchemaChange(osc),
+			libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) {
+				return m.DoesColumnExist("T1", "level")
+			})),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{options.SchemaOverride + ".T1: ADD COLUMN level int"}, osc.calls)
+
+	var done bool
+	require.NoError(t, db.QueryRow(`
+		SELECT	done
+		FROM	`+options.TrackingTable+`
+		WHERE	library = 'L1'
+		AND	migration = 'T1level'`).Scan(&done))
+	assert.True(t, done, "recorded as done")
+}
+
+func TestDumpSchema(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	options, cleanup := lstesting.FakeSchema(t, "")
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("users", `
+			CREATE TABLE users (
+				id	bigint NOT NULL AUTO_INCREMENT,
+				name	varchar(255),
+				PRIMARY KEY (id)
+			) ENGINE = InnoDB`),
+		lsmysql.Script("orders", `
+			CREATE TABLE orders (
+				id	bigint NOT NULL AUTO_INCREMENT,
+				user_id	bigint NOT NULL,
+				price	int NOT NULL,
+				qty	int NOT NULL,
+				total	bigint AS (price * qty) STORED,
+				note	varchar(255),
+				PRIMARY KEY (id),
+				FULLTEXT KEY note_text (note),
+				CONSTRAINT orders_user FOREIGN KEY (user_id) REFERENCES users (id)
+			) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	before, err := lsmysql.DumpSchema(context.Background(), db, options.SchemaOverride)
+	require.NoError(t, err)
+	assert.Contains(t, before, "CREATE TABLE `orders`")
+	assert.Contains(t, before, "CONSTRAINT `orders_user` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)")
+	assert.Regexp(t, "`total` bigint GENERATED ALWAYS AS \\(.*`price`.*`qty`.*\\) STORED", before)
+	assert.Contains(t, before, "FULLTEXT KEY `note_text` (`note`)")
+	assert.NotContains(t, before, "AUTO_INCREMENT=", "no counters")
+
+	_, err = db.Exec(`INSERT INTO ` + options.SchemaOverride + `.users (name) VALUES ('a'), ('b')`)
+	require.NoError(t, err)
+	after, err := lsmysql.DumpSchema(context.Background(), db, options.SchemaOverride)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "data does not change the dump")
+}
+
+func TestTryLock(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, m, err := lsmysql.New(libschema.LogFromLog(t), "test", nil, db, lsmysql.WithoutDatabase)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	name := "lstest_" + lstesting.RandomString(15)
+	got, release, err := m.TryLock(ctx, name, 0)
+	require.NoError(t, err)
+	require.True(t, got, "first lock")
+
+	got, _, err = m.TryLock(ctx, name, time.Second)
+	require.NoError(t, err)
+	assert.False(t, got, "already locked")
+
+	require.NoError(t, release())
+	got, release, err = m.TryLock(ctx, name, 0)
+	require.NoError(t, err)
+	require.True(t, got, "after release")
+	require.NoError(t, release())
+}
+
+func TestLockCancel(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	// hold the migrations lock the way another process would
+	got, release, err := m.TryLock(context.Background(), "libschema_"+options.TrackingTable, 0)
+	require.NoError(t, err)
+	require.True(t, got)
+	defer func() {
+		assert.NoError(t, release())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.LockMigrationsTable(ctx, libschema.LogFromLog(t), dbase)
+	assert.Error(t, err, "lock is held")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "returned promptly")
+}
+
+func TestLockKeepalive(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db,
+		lsmysql.WithLockKeepalive(10*time.Millisecond))
+	require.NoError(t, err)
+
+	require.NoError(t, m.LockMigrationsTable(context.Background(), libschema.LogFromLog(t), dbase))
+	var holder int64
+	require.NoError(t, db.QueryRow(`SELECT IS_USED_LOCK(?)`, "libschema_"+options.TrackingTable).Scan(&holder))
+	_, err = db.Exec(fmt.Sprintf("KILL %d", holder))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	err = m.UnlockMigrationsTable(libschema.LogFromLog(t))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "lock")
+	}
+}
+
+func TestBeginTx(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	var begun int
+	var appTx *sql.Tx
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int) ENGINE = InnoDB`),
+		lsmysql.Computed("T2", func(_ context.Context, tx *sql.Tx) error {
+			assert.Equal(t, appTx, tx, "runs in the app's transaction")
+			_, err := tx.Exec(`INSERT INTO T1 (id) VALUES (1)`)
+			return err
+		}, libschema.WithBeginTx(func(ctx context.Context, db *sql.DB, opts *sql.TxOptions) (*sql.Tx, error) {
+			begun++
+			var err error
+			appTx, err = db.BeginTx(ctx, opts)
+			return appTx, err
+		})),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, 1, begun)
+
+	var done bool
+	require.NoError(t, db.QueryRow(`SELECT done FROM `+options.TrackingTable+` WHERE library = 'L1' AND migration = 'T2'`).Scan(&done))
+	assert.True(t, done)
+}
+
+func TestExportSQL(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int) ENGINE = InnoDB`),
+		lsmysql.Generate("T2", func(_ context.Context, _ *sql.Tx) string {
+			return `ALTER TABLE T1 ADD COLUMN level int`
+		}, libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) { return false, nil })),
+		lsmysql.Computed("T3", func(context.Context, *sql.Tx) error { return nil }),
+	)
+
+	var buf bytes.Buffer
+	require.NoError(t, dbase.ExportSQL(context.Background(), &buf))
+	assert.Equal(t, "-- Migration L1: T1\n"+
+		"CREATE TABLE IF NOT EXISTS T1 (id int) ENGINE = InnoDB\n\n"+
+		"-- Migration L1: T2\n"+
+		"-- Has a SkipIf: it may be skipped\n"+
+		"ALTER TABLE T1 ADD COLUMN level int\n\n"+
+		"-- Migration L1: T3\n"+
+		"-- Computed: runs Go code, there is no SQL to show\n\n", buf.String())
+
+	m.UseDatabase(options.SchemaOverride)
+	exists, err := m.HasTable(context.Background(), nil, "T1")
+	require.NoError(t, err)
+	assert.False(t, exists, "nothing was run")
+}
+
+func TestTrackingCreated(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	require.NoError(t, m.CreateSchemaTableIfNotExists(context.Background(), libschema.LogFromLog(t), dbase))
+	schemaCreated, tableCreated := m.TrackingCreated()
+	assert.True(t, schemaCreated, "schema created")
+	assert.True(t, tableCreated, "table created")
+
+	require.NoError(t, m.CreateSchemaTableIfNotExists(context.Background(), libschema.LogFromLog(t), dbase))
+	schemaCreated, tableCreated = m.TrackingCreated()
+	assert.False(t, schemaCreated, "schema existed")
+	assert.False(t, tableCreated, "table existed")
+}
+
+func TestANSIQuotes(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	require.NoError(t, err)
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["sql_mode"] = "'ANSI_QUOTES'"
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+	options.TrackingTable = options.SchemaOverride + `."tracking-table"`
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE "T1" (id text) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = ?
+		AND	table_name = 'tracking-table'`, options.SchemaOverride).Scan(&count))
+	assert.Equal(t, 1, count, "tracking table")
+}
+
+func TestSaveStatusKeepsOtherColumns(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	_, err = db.Exec(`ALTER TABLE ` + options.TrackingTable + ` ADD COLUMN note varchar(20)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE ` + options.TrackingTable + ` SET note = 'keep'`)
+	require.NoError(t, err)
+
+	migration, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "T1"})
+	require.True(t, ok)
+	require.NoError(t, m.MarkMigrationDone(context.Background(), libschema.LogFromLog(t), dbase, migration))
+
+	var note sql.NullString
+	require.NoError(t, db.QueryRow(`SELECT note FROM `+options.TrackingTable+` WHERE migration = 'T1'`).Scan(&note))
+	assert.Equal(t, "keep", note.String, "not clobbered by saving the status")
+}
+
+func TestCreatedAt(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	require.NoError(t, err)
+	cfg.ParseTime = true
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text) ENGINE = InnoDB`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var createdAt sql.NullTime
+	query := `SELECT created_at FROM ` + options.TrackingTable + ` WHERE migration = 'T1'`
+	require.NoError(t, db.QueryRow(query).Scan(&createdAt))
+	assert.True(t, createdAt.Valid, "set on insert")
+
+	_, err = db.Exec(`UPDATE ` + options.TrackingTable + ` SET created_at = '2001-02-03 04:05:06'`)
+	require.NoError(t, err)
+	migration, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "T1"})
+	require.True(t, ok)
+	require.NoError(t, m.MarkMigrationDone(context.Background(), libschema.LogFromLog(t), dbase, migration))
+	require.NoError(t, db.QueryRow(query).Scan(&createdAt))
+	assert.Equal(t, 2001, createdAt.Time.Year(), "preserved when the status is saved again")
+}
+
+func TestComputedRetryable(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	var backfillCalls, brokenCalls int
+	dbase.Migrations("L1",
+		lsmysql.ComputedRetryable("backfill", func(context.Context, *sql.Tx) error {
+			backfillCalls++
+			if backfillCalls < 3 {
+				return &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+			}
+			return nil
+		}, 3),
+		lsmysql.ComputedRetryable("broken", func(context.Context, *sql.Tx) error {
+			brokenCalls++
+			return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		}, 3),
+	)
+	err = s.Migrate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Duplicate entry")
+	}
+	assert.Equal(t, 3, backfillCalls, "retried after deadlocks")
+	assert.Equal(t, 1, brokenCalls, "not retried")
+}
+
+func TestSavepoints(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Script("T1", `
+			CREATE TABLE IF NOT EXISTS T1 (
+				id	int NOT NULL,
+				PRIMARY KEY (id)
+			) ENGINE = InnoDB`),
+		lsmysql.Computed("fill", func(ctx context.Context, tx *sql.Tx) error {
+			stx := lsmysql.Savepoints(tx)
+			for _, id := range []int{1, 2, 3} {
+				if err := stx.Savepoint(ctx, "row"); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `INSERT INTO T1 (id) VALUES (?)`, id); err != nil {
+					return err
+				}
+				if id == 2 {
+					if err := stx.RollbackTo(ctx, "row"); err != nil {
+						return err
+					}
+				}
+				if err := stx.Release(ctx, "row"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	rows, err := db.Query(`SELECT id FROM ` + options.SchemaOverride + `.T1 ORDER BY id`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 3}, ids)
+}
+
+func TestDurationRecorded(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+
+	dbase.Migrations("L1",
+		lsmysql.Computed("slow", func(context.Context, *sql.Tx) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}),
+		lsmysql.Computed("broken", func(context.Context, *sql.Tx) error {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("broken")
+		}),
+	)
+	assert.Error(t, s.Migrate(context.Background()))
+
+	for _, name := range []string{"slow", "broken"} {
+		var durationMS int64
+		require.NoError(t, db.QueryRow(`
+			SELECT	duration_ms
+			FROM	`+options.TrackingTable+`
+			WHERE	library = 'L1'
+			AND	migration = ?`, name).Scan(&durationMS), name)
+		assert.GreaterOrEqual(t, durationMS, int64(50), name)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	var called int
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			lsmysql.Script("users", `
+				CREATE TABLE IF NOT EXISTS users (
+					id	bigint NOT NULL AUTO_INCREMENT,
+					PRIMARY KEY (id)
+				) ENGINE = InnoDB`),
+			lsmysql.Script("orders", `
+				CREATE TABLE IF NOT EXISTS orders (
+					id	bigint NOT NULL AUTO_INCREMENT,
+					user_id	bigint NOT NULL,
+					price	int NOT NULL,
+					qty	int NOT NULL,
+					total	bigint AS (price * qty) STORED,
+					note	varchar(255),
+					PRIMARY KEY (id),
+					FULLTEXT KEY note_text (note),
+					CONSTRAINT orders_user FOREIGN KEY (user_id) REFERENCES users (id)
+				) ENGINE = InnoDB`),
+			lsmysql.Computed("count", func(context.Context, *sql.Tx) error {
+				called++
+				return nil
+			}),
+		)
+	}
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+	s := libschema.New(ctx, options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	define(dbase)
+	require.NoError(t, s.Migrate(ctx))
+	snapshot, err := m.Snapshot(ctx, dbase)
+	require.NoError(t, err)
+	assert.Len(t, snapshot.Tables, 2, "tracking table left out")
+	assert.Contains(t, strings.Join(snapshot.Tables, "\n"), "GENERATED ALWAYS AS", "generated column")
+	assert.Len(t, snapshot.Status, 3)
+	before, err := lsmysql.DumpSchema(ctx, db, options.SchemaOverride)
+	require.NoError(t, err)
+
+	encoded, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	var decoded lsmysql.Snapshot
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	options2, cleanup2 := lstesting.FakeSchema(t, "")
+	defer cleanup2(db)
+	s2 := libschema.New(ctx, options2)
+	dbase2, m2, err := lsmysql.New(libschema.LogFromLog(t), "test", s2, db)
+	require.NoError(t, err)
+	define(dbase2)
+	require.NoError(t, m2.CreateDatabaseIfNotExists(ctx, options2.SchemaOverride))
+	require.NoError(t, m2.Restore(ctx, dbase2, &decoded))
+	require.NoError(t, s2.Migrate(ctx))
+	assert.Equal(t, 1, called, "restored migrations are not run again")
+
+	after, err := lsmysql.DumpSchema(ctx, db, options2.SchemaOverride)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestSharedDriver(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options1, cleanup1 := lstesting.FakeSchema(t, "")
+	defer cleanup1(db)
+	options2, cleanup2 := lstesting.FakeSchema(t, "")
+	defer cleanup2(db)
+
+	s1 := libschema.New(context.Background(), options1)
+	s2 := libschema.New(context.Background(), options2)
+	dbase1, m, err := lsmysql.New(libschema.LogFromLog(t), "one", s1, db)
+	require.NoError(t, err)
+	dbase2, err := s2.NewDatabase(libschema.LogFromLog(t), "two", db, m)
+	require.NoError(t, err)
+	dbase1.Migrations("L1",
+		lsmysql.Script("T1", "CREATE TABLE IF NOT EXISTS "+options1.SchemaOverride+".t1 (id int)"),
+	)
+	dbase2.Migrations("L1",
+		lsmysql.Script("T1", "CREATE TABLE IF NOT EXISTS "+options2.SchemaOverride+".t1 (id int)"),
+	)
+
+	errs := make(chan error, 2)
+	for _, s := range []*libschema.Schema{s1, s2} {
+		s := s
+		go func() {
+			errs <- s.Migrate(context.Background())
+		}()
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	for _, dbase := range []*libschema.Database{dbase1, dbase2} {
+		m, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "T1"})
+		require.True(t, ok)
+		assert.True(t, m.Base().Status().Done, dbase.Name)
+	}
+}
+
+func TestTrackingTableSuffix(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	for _, side := range []string{"_blue", "_green"} {
+		s := libschema.New(context.Background(), options)
+		dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db, lsmysql.WithTrackingTableSuffix(side))
+		require.NoError(t, err)
+		dbase.Migrations("L1",
+			lsmysql.Script("T1", "CREATE TABLE IF NOT EXISTS "+options.SchemaOverride+".t1"+side+" (id int)"),
+		)
+		require.NoError(t, s.Migrate(context.Background()), side)
+	}
+	for _, side := range []string{"_blue", "_green"} {
+		var count int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+options.TrackingTable+side).Scan(&count), side)
+		assert.Equal(t, 1, count, side)
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM " + options.TrackingTable).Scan(&count)
+	assert.Error(t, err, "the tracking table without a suffix is not created")
+}
+
+func TestPreflight(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1", lsmysql.Script("T1", "CREATE TABLE IF NOT EXISTS "+options.SchemaOverride+".t1 (id int)"))
+
+	require.NoError(t, dbase.Preflight(context.Background()))
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+options.TrackingTable).Scan(&count))
+	assert.Equal(t, 0, count, "write check rolled back")
+}
+
+func TestGenerateDatabaseName(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_MYSQL_TEST_DSN to test libschema/lsmysql")
+	}
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, m, err := lsmysql.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	var generated string
+	dbase.Migrations("L1",
+		lsmysql.Generate("T1", func(ctx context.Context, _ *sql.Tx) string {
+			generated = lsmysql.DatabaseNameFromContext(ctx)
+			return "CREATE TABLE IF NOT EXISTS " + generated + ".t1 (id int)"
+		}),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, options.SchemaOverride, generated)
+	m.UseDatabase(options.SchemaOverride)
+	hasTable, err := m.HasTable(context.Background(), nil, "t1")
+	require.NoError(t, err)
+	assert.True(t, hasTable)
+}
@@ -0,0 +1,226 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// OSCTool is an online schema change tool, like gh-ost or
+// pt-online-schema-change, that can apply an ALTER TABLE without
+// locking the table for the duration of the change.
+type OSCTool interface {
+	// Command returns the command that applies alter (the part of
+	// the ALTER TABLE statement after the table name) to
+	// database.table.
+	Command(ctx context.Context, database, table, alter string) *exec.Cmd
+}
+
+// GhOst runs github.com/github/gh-ost.  Args should have the connection
+// flags (--host, --user, --password, etc) and any tuning flags.  The
+// --database, --table, --alter, and --execute flags are added.
+type GhOst struct {
+	// Path defaults to "gh-ost"
+	Path string
+	Args []string
+}
+
+// Command is part of OSCTool
+func (g GhOst) Command(ctx context.Context, database, table, alter string) *exec.Cmd {
+	path := g.Path
+	if path == "" {
+		path = "gh-ost"
+	}
+	args := make([]string, len(g.Args), len(g.Args)+4)
+	copy(args, g.Args)
+	args = append(args,
+		"--database="+database,
+		"--table="+table,
+		"--alter="+alter,
+		"--execute")
+	return exec.CommandContext(ctx, path, args...)
+}
+
+// PTOnlineSchemaChange runs pt-online-schema-change from the Percona
+// Toolkit.  DSN is the connection part of the Percona DSN, for example
+// "h=db1,u=admin,p=secret".  The D= and t= parts of the DSN are added.
+// Args can have tuning flags.  The --alter and --execute flags are
+// added.
+type PTOnlineSchemaChange struct {
+	// Path defaults to "pt-online-schema-change"
+	Path string
+	DSN  string
+	Args []string
+}
+
+// Command is part of OSCTool
+func (pt PTOnlineSchemaChange) Command(ctx context.Context, database, table, alter string) *exec.Cmd {
+	path := pt.Path
+	if path == "" {
+		path = "pt-online-schema-change"
+	}
+	dsn := "D=" + database + ",t=" + table
+	if pt.DSN != "" {
+		dsn = pt.DSN + "," + dsn
+	}
+	args := make([]string, len(pt.Args), len(pt.Args)+4)
+	copy(args, pt.Args)
+	args = append(args,
+		"--alter", alter,
+		"--execute",
+		dsn)
+	return exec.CommandContext(ctx, path, args...)
+}
+
+// WithOnlineSchemaChange runs a Script() or Generate() migration that
+// is a single ALTER TABLE with an online schema change tool instead of
+// running it directly.  The migration is still recorded in the tracking
+// table.  The tool does not run inside a transaction: if the program is
+// killed while the tool is running, the migration will be retried.  The
+// script is checked like any other (see WithCheckSeverity) so an ALTER
+// TABLE that cannot be repeated needs libschema.WithSkipIf.  Unless the
+// table name is qualified with a database, the database is the one from
+// WithUseSchema, then WithDatabaseName, then Options.SchemaOverride, then
+// the current database.
+func WithOnlineSchemaChange(tool OSCTool) libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if mm, ok := m.(*mmigration); ok {
+			mm.osc = tool
+		}
+	}
+}
+
+const oscIdentifier = "(?:[A-Za-z_][A-Za-z0-9_$]*|`[^`]+`)"
+
+var alterTableRE = regexp.MustCompile(`(?is)\A\s*ALTER\s+TABLE\s+(` + oscIdentifier + `(?:\s*\.\s*` + oscIdentifier + `)?)\s+(.*?)[\s;]*\z`)
+
+// parseAlterTable splits an ALTER TABLE statement into the database
+// (empty if not given), the table, and everything after the table.
+func parseAlterTable(script string) (database string, table string, alter string, err error) {
+	match := alterTableRE.FindStringSubmatch(script)
+	if match == nil || match[2] == "" {
+		return "", "", "", errors.Errorf("online schema change requires a single ALTER TABLE statement")
+	}
+	if strings.Contains(match[2], ";") {
+		return "", "", "", errors.Errorf("online schema change requires a single ALTER TABLE statement, found ';'")
+	}
+	parts := strings.SplitN(match[1], ".", 2)
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), "`")
+	}
+	if len(parts) == 2 {
+		return parts[0], parts[1], match[2], nil
+	}
+	return "", parts[0], match[2], nil
+}
+
+// doOnlineSchemaChange runs a migration with its OSCTool and then
+// records the status
+func (p *MySQL) doOnlineSchemaChange(ctx context.Context, log *internal.Log, d *libschema.Database, pm *mmigration) (err error) {
+	m := libschema.Migration(pm)
+	start := time.Now()
+	var skip bool
+	var database, table, alter string
+	func() {
+		var tx *sql.Tx
+		tx, err = d.BeginTx(ctx, m)
+		if err != nil {
+			err = errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+			return
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		skip, err = m.Base().SkipIfTx(ctx, tx)
+		if err != nil || skip {
+			return
+		}
+		var script string
+		script, err = p.generate(ctx, d, tx, pm)
+		if err != nil {
+			return
+		}
+		err = p.checkMigration(log, pm, script, p.trackingTable(d))
+		if err != nil {
+			return
+		}
+		database, table, alter, err = parseAlterTable(script)
+		if err != nil || database != "" {
+			return
+		}
+		database, err = p.migrationDatabase(ctx, d, tx, pm)
+	}()
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	default:
+		if len(pm.backup) != 0 {
+			pm.backupsMade, err = p.backupTables(ctx, log, d, pm)
+			if err != nil {
+				break
+			}
+		}
+		cmd := pm.osc.Command(ctx, database, table, alter)
+		log.Info("Starting online schema change", map[string]interface{}{
+			"migration": m.Base().Name,
+			"command":   cmd.Path,
+			"database":  database,
+			"table":     table,
+		})
+		output, cerr := cmd.CombinedOutput()
+		if cerr != nil {
+			err = errors.Wrapf(cerr, "%s: %s", cmd.Path, lastLines(string(output), 10))
+		} else {
+			log.Info("Online schema change complete", map[string]interface{}{
+				"migration": m.Base().Name,
+				"output":    lastLines(string(output), 10),
+			})
+		}
+	}
+	duration := time.Since(start)
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		if d.Options.WithoutFailureStatus {
+			return err
+		}
+	}
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		if err != nil {
+			return errors.Wrapf(err, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+		}
+		return errors.Wrapf(txerr, "Tx for saving status for %s", m.Base().Name)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, err == nil, err, duration)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		if err == nil {
+			return txerr
+		}
+		return errors.Wrapf(err, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return err
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,66 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// SavepointTx adds savepoints to the transaction that is given to a
+// Computed migration so that a long migration can roll back part of its
+// work without failing the whole migration:
+//
+//	lsmysql.Computed("backfill", func(ctx context.Context, tx *sql.Tx) error {
+//		stx := lsmysql.Savepoints(tx)
+//		for _, chunk := range chunks {
+//			if err := stx.Savepoint(ctx, "chunk"); err != nil {
+//				return err
+//			}
+//			if err := backfill(ctx, tx, chunk); err != nil {
+//				if err := stx.RollbackTo(ctx, "chunk"); err != nil {
+//					return err
+//				}
+//				continue
+//			}
+//			if err := stx.Release(ctx, "chunk"); err != nil {
+//				return err
+//			}
+//		}
+//		return nil
+//	})
+//
+// DDL commits the transaction in MySQL and that discards all savepoints.
+type SavepointTx struct {
+	*sql.Tx
+}
+
+// Savepoints wraps a transaction to add savepoints
+func Savepoints(tx *sql.Tx) SavepointTx {
+	return SavepointTx{Tx: tx}
+}
+
+// Savepoint sets a savepoint.  Setting a savepoint with the same name
+// as an existing one replaces it.  Names must be simple identifiers.
+func (tx SavepointTx) Savepoint(ctx context.Context, name string) error {
+	return tx.savepointCommand(ctx, "SAVEPOINT ", name)
+}
+
+// RollbackTo undoes everything done since the savepoint was set.  The
+// savepoint is kept so it can be rolled back to again.
+func (tx SavepointTx) RollbackTo(ctx context.Context, name string) error {
+	return tx.savepointCommand(ctx, "ROLLBACK TO SAVEPOINT ", name)
+}
+
+// Release removes a savepoint without undoing anything.
+func (tx SavepointTx) Release(ctx context.Context, name string) error {
+	return tx.savepointCommand(ctx, "RELEASE SAVEPOINT ", name)
+}
+
+func (tx SavepointTx) savepointCommand(ctx context.Context, command string, name string) error {
+	if !simpleIdentifierRE.MatchString(name) {
+		return errors.Errorf("Savepoint name must be a simple identifier, not '%s'", name)
+	}
+	_, err := tx.ExecContext(ctx, command+name)
+	return errors.Wrap(err, command+name)
+}
@@ -1,7 +1,10 @@
 package lsmysql
 
 import (
+	"context"
 	"database/sql"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,13 +18,13 @@ func (p *MySQL) ColumnDefault(table, column string) (*string, error) {
 		return nil, err
 	}
 	var dflt *string
-	err = p.db.QueryRow(`
+	err = p.scanRow(context.Background(), nil, `
 		SELECT	column_default
 		FROM	information_schema.columns
 		WHERE	table_schema = ?
 		AND	table_name = ?
 		AND	column_name = ?`,
-		database, table, column).Scan(&dflt)
+		[]interface{}{database, table, column}, &dflt)
 	return dflt, errors.Wrapf(err, "get default for %s.%s", table, column)
 }
 
@@ -33,16 +36,42 @@ func (p *MySQL) HasPrimaryKey(table string) (bool, error) {
 		return false, err
 	}
 	var count int
-	err = p.db.QueryRow(`
+	err = p.scanRow(context.Background(), nil, `
 		SELECT	COUNT(*)
 		FROM	information_schema.columns
 		WHERE	table_schema = ?
 		AND	table_name = ?
 		AND	column_key = 'PRI'`,
-		database, table).Scan(&count)
+		[]interface{}{database, table}, &count)
 	return count != 0, errors.Wrapf(err, "has primary key %s.%s", database, table)
 }
 
+// PrimaryKeyColumns returns the columns of the table's primary key in
+// key order.  If the table does not have a primary key (or does not
+// exist), the list is empty.  Like ColumnIsNullable, tx can be nil.
+// The table is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) PrimaryKeyColumns(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	err = p.scanRows(ctx, tx, `
+		SELECT	column_name
+		FROM	information_schema.statistics
+		WHERE	table_schema = ?
+		AND	table_name = ?
+		AND	index_name = 'PRIMARY'
+		ORDER	BY seq_in_index`,
+		[]interface{}{database, table}, func(rows *sql.Rows) error {
+			var column string
+			err := rows.Scan(&column)
+			columns = append(columns, column)
+			return err
+		})
+	return columns, errors.Wrapf(err, "primary key columns %s.%s", database, table)
+}
+
 // TableHasIndex returns true if there is an index matching the
 // name given.
 // The table is assumed to be in the current database unless m.UseDatabase() has been called.
@@ -52,13 +81,13 @@ func (p *MySQL) TableHasIndex(table, indexName string) (bool, error) {
 		return false, err
 	}
 	var count int
-	err = p.db.QueryRow(`
+	err = p.scanRow(context.Background(), nil, `
 		SELECT	COUNT(*)
 		FROM	information_schema.statistics
 		WHERE	table_schema = ?
 		AND	table_name = ?
 		AND	index_name = ?`,
-		database, table, indexName).Scan(&count)
+		[]interface{}{database, table, indexName}, &count)
 	return count != 0, errors.Wrapf(err, "has table index %s.%s", table, indexName)
 }
 
@@ -70,16 +99,193 @@ func (p *MySQL) DoesColumnExist(table, column string) (bool, error) {
 		return false, err
 	}
 	var count int
-	err = p.db.QueryRow(`
+	err = p.scanRow(context.Background(), nil, `
 		SELECT	COUNT(*)
 		FROM	information_schema.columns
 		WHERE	table_schema = ?
 		AND	table_name = ?
 		AND	column_name = ?`,
-		database, table, column).Scan(&count)
+		[]interface{}{database, table, column}, &count)
 	return count != 0, errors.Wrapf(err, "get column exist %s.%s", table, column)
 }
 
+// ColumnIsNullable returns true if the column allows NULL.  It is meant
+// for WithSkipIf so that it reads through the migration transaction, but
+// tx can be nil.  It is an error if the column does not exist.
+// The table is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) ColumnIsNullable(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return false, err
+	}
+	var nullable string
+	err = p.scanRow(ctx, tx, `
+		SELECT	is_nullable
+		FROM	information_schema.columns
+		WHERE	table_schema = ?
+		AND	table_name = ?
+		AND	column_name = ?`,
+		[]interface{}{database, table, column}, &nullable)
+	if err == sql.ErrNoRows {
+		return false, errors.Errorf("column %s.%s.%s does not exist", database, table, column)
+	}
+	return nullable == "YES", errors.Wrapf(err, "get nullable %s.%s", table, column)
+}
+
+// EnumHasValue returns true if the ENUM column already allows value.
+// Adding a value to an ENUM with MODIFY COLUMN cannot be repeated, so use
+// EnumHasValue with WithSkipIf.  Like ColumnIsNullable, tx can be nil.
+// The values are parsed from information_schema.columns.column_type and
+// are compared exactly, without regard to the column's collation.  It is
+// an error if the column does not exist or is not an ENUM.
+// The table is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) EnumHasValue(ctx context.Context, tx *sql.Tx, table, column, value string) (bool, error) {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return false, err
+	}
+	var columnType string
+	err = p.scanRow(ctx, tx, `
+		SELECT	column_type
+		FROM	information_schema.columns
+		WHERE	table_schema = ?
+		AND	table_name = ?
+		AND	column_name = ?`,
+		[]interface{}{database, table, column}, &columnType)
+	if err == sql.ErrNoRows {
+		return false, errors.Errorf("column %s.%s.%s does not exist", database, table, column)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "get column type %s.%s", table, column)
+	}
+	values, err := parseEnumValues(columnType)
+	if err != nil {
+		return false, errors.Wrapf(err, "column %s.%s", table, column)
+	}
+	for _, v := range values {
+		if v == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseEnumValues parses a column_type like enum('a','b').  A quote
+// inside a value is doubled and backslash escapes are used for backslash
+// and control characters.
+func parseEnumValues(columnType string) ([]string, error) {
+	if len(columnType) < len("enum()") || !strings.EqualFold(columnType[:len("enum(")], "enum(") || columnType[len(columnType)-1] != ')' {
+		return nil, errors.Errorf("column type '%s' is not an ENUM", columnType)
+	}
+	body := columnType[len("enum(") : len(columnType)-1]
+	var values []string
+	for i := 0; i < len(body); {
+		if body[i] != '\'' {
+			return nil, errors.Errorf("could not parse ENUM values in '%s'", columnType)
+		}
+		var value strings.Builder
+		i++
+		for {
+			if i >= len(body) {
+				return nil, errors.Errorf("unterminated ENUM value in '%s'", columnType)
+			}
+			c := body[i]
+			if c == '\'' {
+				if i+1 < len(body) && body[i+1] == '\'' {
+					value.WriteByte('\'')
+					i += 2
+					continue
+				}
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(body) {
+				i++
+				switch body[i] {
+				case '0':
+					value.WriteByte(0)
+				case 'n':
+					value.WriteByte('\n')
+				case 'r':
+					value.WriteByte('\r')
+				case 'Z':
+					value.WriteByte('\032')
+				default:
+					value.WriteByte(body[i])
+				}
+				i++
+				continue
+			}
+			value.WriteByte(c)
+			i++
+		}
+		values = append(values, value.String())
+		if i < len(body) {
+			if body[i] != ',' {
+				return nil, errors.Errorf("could not parse ENUM values in '%s'", columnType)
+			}
+			i++
+		}
+	}
+	return values, nil
+}
+
+// HasForeignKey returns true if the table has a foreign key constraint
+// with the given name.  Like ColumnIsNullable, tx can be nil.  The table
+// and constraint names must be simple identifiers.
+// The table is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) HasForeignKey(ctx context.Context, tx *sql.Tx, table, constraintName string) (bool, error) {
+	for _, name := range []string{table, constraintName} {
+		if !simpleIdentifierRE.MatchString(name) {
+			return false, errors.Errorf("Name must be a simple identifier, not '%s'", name)
+		}
+	}
+	database, err := p.DatabaseName()
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = p.scanRow(ctx, tx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.table_constraints
+		WHERE	constraint_schema = ?
+		AND	table_name = ?
+		AND	constraint_name = ?
+		AND	constraint_type = 'FOREIGN KEY'`,
+		[]interface{}{database, table, constraintName}, &count)
+	return count != 0, errors.Wrapf(err, "has foreign key %s.%s", table, constraintName)
+}
+
+// HasTable returns true if there is a table (not a view) with the given
+// name.  Like ColumnIsNullable, tx can be nil.
+// The table is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) HasTable(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	return p.hasTableType(ctx, tx, name, "BASE TABLE")
+}
+
+// HasView returns true if there is a view with the given name.  Like
+// ColumnIsNullable, tx can be nil.
+// The view is assumed to be in the current database unless m.UseDatabase() has been called.
+func (p *MySQL) HasView(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	return p.hasTableType(ctx, tx, name, "VIEW")
+}
+
+func (p *MySQL) hasTableType(ctx context.Context, tx *sql.Tx, name string, tableType string) (bool, error) {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = p.scanRow(ctx, tx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = ?
+		AND	table_name = ?
+		AND	table_type = ?`,
+		[]interface{}{database, name, tableType}, &count)
+	return count != 0, errors.Wrapf(err, "has %s %s.%s", tableType, database, name)
+}
+
 // GetTableConstraints returns the type of constraint and if it is enforced.
 // The table is assumed to be in the current database unless m.UseDatabase() has been called.
 func (p *MySQL) GetTableConstraint(table, constraintName string) (string, bool, error) {
@@ -89,13 +295,13 @@ func (p *MySQL) GetTableConstraint(table, constraintName string) (string, bool,
 	}
 	var typ *string
 	var enforced *string
-	err = p.db.QueryRow(`
+	err = p.scanRow(context.Background(), nil, `
 		SELECT	constraint_type, enforced
 		FROM	information_schema.table_constraints
 		WHERE	constraint_schema = ?
 		AND	table_name = ?
 		AND	constraint_name = ?`,
-		database, table, constraintName).Scan(&typ, &enforced)
+		[]interface{}{database, table, constraintName}, &typ, &enforced)
 	if err == sql.ErrNoRows {
 		return "", false, nil
 	}
@@ -112,18 +318,122 @@ func (m *MySQL) DatabaseName() (string, error) {
 		return m.databaseName, nil
 	}
 	var database string
-	err := m.db.QueryRow(`SELECT DATABASE()`).Scan(&database)
+	err := m.scanRow(context.Background(), nil, `SELECT DATABASE()`, nil, &database)
 	return database, errors.Wrap(err, "select database()")
 }
 
+// SetDatabaseName is like UseDatabase() except that the name is validated:
+// it must be a simple identifier.
+func (m *MySQL) SetDatabaseName(name string) error {
+	if !simpleIdentifierRE.MatchString(name) {
+		return errors.Errorf("Database name must be a simple identifier, not '%s'", name)
+	}
+	m.databaseName = name
+	return nil
+}
+
 // UseDatabase() overrides the default database for DatabaseName(), ColumnDefault(), HasPrimaryKey(),
-// HasTableIndex(), DoesColumnExist(), and GetTableConstraint().
+// PrimaryKeyColumns(), HasTableIndex(), DoesColumnExist(), ColumnIsNullable(), HasForeignKey(),
+// HasTable(), HasView(), and GetTableConstraint().
 // If name is empty then the override is removed and the database will be queried from
 // the mysql server.  Due to connection pooling in Go, that's a bad idea.
 func (m *MySQL) UseDatabase(name string) {
 	m.databaseName = name
 }
 
+// WithHelperTimeout limits how long each query made by DatabaseName(),
+// ColumnDefault(), HasPrimaryKey(), PrimaryKeyColumns(), TableHasIndex(), DoesColumnExist(),
+// ColumnIsNullable(), EnumHasValue(), HasForeignKey(), HasTable(), HasView(), and
+// GetTableConstraint() can take.  information_schema queries can be slow
+// or hang on some managed servers; with a timeout, the migration that
+// uses the helper fails instead of waiting forever.  The default is no
+// timeout beyond the context.
+func WithHelperTimeout(timeout time.Duration) MySQLOpt {
+	return func(p *MySQL) {
+		p.helperTimeout = timeout
+	}
+}
+
+// HelperTimeout returns the timeout set with WithHelperTimeout
+func (p *MySQL) HelperTimeout() time.Duration {
+	return p.helperTimeout
+}
+
+// WithHelperQueryPrefix puts prefix in front of each query made by the
+// functions listed for WithHelperTimeout.  This is for proxies, like
+// ProxySQL and Vitess, that route queries based upon a comment or hint
+// so that information_schema reads go to the right backend.  For example:
+//
+//	lsmysql.WithHelperQueryPrefix("/* hostgroup=10 */")
+//
+// A newline is put between the prefix and the query so that a "--"
+// comment works too.  The default is no prefix.
+func WithHelperQueryPrefix(prefix string) MySQLOpt {
+	return func(p *MySQL) {
+		p.helperQueryPrefix = prefix
+	}
+}
+
+// helperQuery applies WithHelperQueryPrefix
+func (p *MySQL) helperQuery(query string) string {
+	if p.helperQueryPrefix == "" {
+		return query
+	}
+	return p.helperQueryPrefix + "\n" + query
+}
+
+// scanRow queries a single row, in tx if there is one, applying
+// WithHelperTimeout and WithHelperQueryPrefix.
+func (p *MySQL) scanRow(ctx context.Context, tx *sql.Tx, query string, args []interface{}, dest ...interface{}) error {
+	query = p.helperQuery(query)
+	if p.helperTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, p.helperTimeout)
+		defer cancel()
+	}
+	var row *sql.Row
+	if tx != nil {
+		row = tx.QueryRowContext(ctx, query, args...)
+	} else {
+		row = p.db.QueryRowContext(ctx, query, args...)
+	}
+	err := row.Scan(dest...)
+	if err != nil && p.helperTimeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(err, "query did not finish within %s", p.helperTimeout)
+	}
+	return err
+}
+
+// scanRows is like scanRow but calls scan for each row
+func (p *MySQL) scanRows(ctx context.Context, tx *sql.Tx, query string, args []interface{}, scan func(*sql.Rows) error) error {
+	query = p.helperQuery(query)
+	if p.helperTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, p.helperTimeout)
+		defer cancel()
+	}
+	var rows *sql.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.QueryContext(ctx, query, args...)
+	} else {
+		rows, err = p.db.QueryContext(ctx, query, args...)
+	}
+	if err == nil {
+		defer rows.Close()
+		for err == nil && rows.Next() {
+			err = scan(rows)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil && p.helperTimeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(err, "query did not finish within %s", p.helperTimeout)
+	}
+	return err
+}
+
 func asString(s *string) string {
 	if s == nil {
 		return ""
@@ -59,6 +59,39 @@ func TestSkipFunctions(t *testing.T) {
 				b, err := m.TableHasIndex("users", "level_idx")
 				return b, err
 			})),
+		lsmysql.Script("setup5", `
+			ALTER TABLE accounts
+				ADD CONSTRAINT accounts_user
+					FOREIGN KEY (id) REFERENCES users (id)`,
+			libschema.WithSkipIf(func(ctx context.Context, tx *sql.Tx) (bool, error) {
+				return m.HasForeignKey(ctx, tx, "accounts", "accounts_user")
+			})),
+		lsmysql.Script("setup6", `
+			CREATE VIEW user_levels AS SELECT id, level FROM users`,
+			libschema.WithSkipIf(func(ctx context.Context, tx *sql.Tx) (bool, error) {
+				return m.HasView(ctx, tx, "user_levels")
+			})),
+		lsmysql.Script("setup7", `
+			CREATE TABLE IF NOT EXISTS memberships (
+				user_id		varchar(255) NOT NULL,
+				account_id	varchar(255) NOT NULL
+			) ENGINE=InnoDB`),
+		lsmysql.Script("setup8", `
+			ALTER TABLE memberships ADD PRIMARY KEY (account_id, user_id)`,
+			libschema.WithSkipIf(func(ctx context.Context, tx *sql.Tx) (bool, error) {
+				columns, err := m.PrimaryKeyColumns(ctx, tx, "memberships")
+				return len(columns) != 0, err
+			})),
+		lsmysql.Script("setup9", `
+			CREATE TABLE IF NOT EXISTS tickets (
+				id	integer,
+				state	ENUM('open', 'it''s', 'back\\slash')
+			) ENGINE=InnoDB`),
+		lsmysql.Script("setup10", `
+			ALTER TABLE tickets MODIFY COLUMN state ENUM('open', 'it''s', 'back\\slash', 'closed')`,
+			libschema.WithSkipIf(func(ctx context.Context, tx *sql.Tx) (bool, error) {
+				return m.EnumHasValue(ctx, tx, "tickets", "state", "closed")
+			})),
 	)
 
 	err = s.Migrate(context.Background())
@@ -78,6 +111,14 @@ func TestSkipFunctions(t *testing.T) {
 	if assert.NoError(t, err, "accounts has pk") {
 		assert.False(t, hasPK, "accounts has pk")
 	}
+	pkColumns, err := m.PrimaryKeyColumns(context.Background(), nil, "memberships")
+	if assert.NoError(t, err, "memberships pk columns") {
+		assert.Equal(t, []string{"account_id", "user_id"}, pkColumns, "memberships pk columns")
+	}
+	pkColumns, err = m.PrimaryKeyColumns(context.Background(), nil, "accounts")
+	if assert.NoError(t, err, "accounts pk columns") {
+		assert.Empty(t, pkColumns, "accounts pk columns")
+	}
 	dflt, err := m.ColumnDefault("users", "id")
 	if assert.NoError(t, err, "user id default") {
 		assert.Nil(t, dflt, "user id default")
@@ -96,6 +137,54 @@ func TestSkipFunctions(t *testing.T) {
 	if assert.NoError(t, err, "users has level") {
 		assert.True(t, exists, "users has level")
 	}
+	nullable, err := m.ColumnIsNullable(context.Background(), nil, "users", "id")
+	if assert.NoError(t, err, "users id nullable") {
+		assert.False(t, nullable, "users id nullable")
+	}
+	nullable, err = m.ColumnIsNullable(context.Background(), nil, "users", "level")
+	if assert.NoError(t, err, "users level nullable") {
+		assert.True(t, nullable, "users level nullable")
+	}
+	_, err = m.ColumnIsNullable(context.Background(), nil, "users", "foo")
+	assert.Error(t, err, "users foo nullable")
+	hasFK, err := m.HasForeignKey(context.Background(), nil, "accounts", "accounts_user")
+	if assert.NoError(t, err, "accounts_user fk") {
+		assert.True(t, hasFK, "accounts_user fk")
+	}
+	hasFK, err = m.HasForeignKey(context.Background(), nil, "users", "hi_level")
+	if assert.NoError(t, err, "hi_level is not a fk") {
+		assert.False(t, hasFK, "hi_level is not a fk")
+	}
+	for _, value := range []string{"open", "it's", `back\slash`, "closed"} {
+		hasValue, err := m.EnumHasValue(context.Background(), nil, "tickets", "state", value)
+		if assert.NoError(t, err, "tickets state %s", value) {
+			assert.True(t, hasValue, "tickets state %s", value)
+		}
+	}
+	hasValue, err := m.EnumHasValue(context.Background(), nil, "tickets", "state", "Open")
+	if assert.NoError(t, err, "tickets state Open") {
+		assert.False(t, hasValue, "tickets state Open")
+	}
+	_, err = m.EnumHasValue(context.Background(), nil, "users", "level", "1")
+	assert.Error(t, err, "users level is not an enum")
+	_, err = m.HasForeignKey(context.Background(), nil, "users; DROP", "x")
+	assert.Error(t, err, "invalid table name")
+	hasTable, err := m.HasTable(context.Background(), nil, "users")
+	if assert.NoError(t, err, "has users table") {
+		assert.True(t, hasTable, "has users table")
+	}
+	hasTable, err = m.HasTable(context.Background(), nil, "user_levels")
+	if assert.NoError(t, err, "has user_levels table") {
+		assert.False(t, hasTable, "user_levels is a view")
+	}
+	hasView, err := m.HasView(context.Background(), nil, "user_levels")
+	if assert.NoError(t, err, "has user_levels view") {
+		assert.True(t, hasView, "has user_levels view")
+	}
+	hasView, err = m.HasView(context.Background(), nil, "users")
+	if assert.NoError(t, err, "has users view") {
+		assert.False(t, hasView, "users is a table")
+	}
 	typ, enf, err := m.GetTableConstraint("users", "hi_level")
 	if assert.NoError(t, err, "users hi_level constraint") {
 		assert.Equal(t, "CHECK", typ, "users hi_level constraint")
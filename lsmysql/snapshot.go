@@ -0,0 +1,164 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is the state of a database after migrating: its tables and
+// the migration status.  It can be saved (it marshals to JSON) and
+// restored into an empty database so that tests do not have to run all
+// of the migrations each time.
+type Snapshot struct {
+	Tables []string         `json:"tables"` // CREATE TABLE statements
+	Status []SnapshotStatus `json:"status"`
+}
+
+// SnapshotStatus is one row of the migration tracking table
+type SnapshotStatus struct {
+	Library   string `json:"library"`
+	Migration string `json:"migration"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Snapshot captures the tables (as SHOW CREATE TABLE gives them, less
+// the AUTO_INCREMENT counters) of the database that DatabaseName()
+// returns and the contents of the migration tracking table.  Data in
+// the tables, views, triggers, and routines are not captured so
+// restoring a snapshot is not a replacement for migrations that load
+// data.
+func (p *MySQL) Snapshot(ctx context.Context, d *libschema.Database) (*Snapshot, error) {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return nil, err
+	}
+	trackingSchema, trackingTable, err := p.trackingSchemaTable(d)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	rows, err := d.DB().QueryContext(ctx, `
+		SELECT	table_name
+		FROM	information_schema.tables
+		WHERE	table_schema = ?
+		AND	table_type = 'BASE TABLE'
+		ORDER	BY table_name`, database)
+	if err != nil {
+		return nil, errors.Wrapf(err, "List tables in %s", database)
+	}
+	err = scanRows(rows, func() error {
+		var table string
+		err := rows.Scan(&table)
+		tables = append(tables, table)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "List tables in %s", database)
+	}
+	// the tracking table (and the lock table next to it) are restored
+	// from the status instead
+	trackingName := unquoteIdentifier(strings.TrimPrefix(trackingTable, trackingSchema+"."))
+	trackingHere := trackingSchema == "" || unquoteIdentifier(trackingSchema) == database
+	var snapshot Snapshot
+	for _, table := range tables {
+		if trackingHere && (table == trackingName || table == trackingName+"_lock") {
+			continue
+		}
+		create, err := showCreateTable(ctx, d.DB(), database, table)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Tables = append(snapshot.Tables, create)
+	}
+	rows, err = d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s
+		ORDER	BY library, migration`, trackingTable))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	err = scanRows(rows, func() error {
+		var status SnapshotStatus
+		err := rows.Scan(&status.Library, &status.Migration, &status.Done, &status.Error)
+		snapshot.Status = append(snapshot.Status, status)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	return &snapshot, nil
+}
+
+var autoIncrementRE = regexp.MustCompile(`\s+AUTO_INCREMENT=\d+`)
+
+// showCreateTable uses the server's own CREATE TABLE so that everything
+// (generated columns, index types, CHECK constraints, comments) survives
+// a Restore
+func showCreateTable(ctx context.Context, db *sql.DB, database, table string) (string, error) {
+	var name, create string
+	err := db.QueryRowContext(ctx, `SHOW CREATE TABLE `+quoteName(database)+`.`+quoteName(table)).Scan(&name, &create)
+	if err != nil {
+		return "", errors.Wrapf(err, "Show create table %s.%s", database, table)
+	}
+	return autoIncrementRE.ReplaceAllString(create, ""), nil
+}
+
+// Restore creates the tables from a Snapshot in the database that
+// DatabaseName() returns and fills in the migration tracking table so
+// that the migrations in the snapshot are not run again.  The database
+// must exist (see CreateDatabaseIfNotExists) and should be empty:
+// Restore fails if a table already exists.
+func (p *MySQL) Restore(ctx context.Context, d *libschema.Database, snapshot *Snapshot) error {
+	database, err := p.DatabaseName()
+	if err != nil {
+		return err
+	}
+	if !simpleIdentifierRE.MatchString(database) {
+		return errors.Errorf("Database name must be a simple identifier, not '%s'", database)
+	}
+	conn, err := d.DB().Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Get connection to restore snapshot")
+	}
+	// USE and SET change the connection state
+	defer internal.DiscardConn(conn)
+	_, err = conn.ExecContext(ctx, `USE `+database)
+	if err != nil {
+		return errors.Wrapf(err, "Use %s to restore snapshot", database)
+	}
+	// the tables are in name order, not dependency order
+	_, err = conn.ExecContext(ctx, `SET foreign_key_checks = 0`)
+	if err != nil {
+		return errors.Wrap(err, "Disable foreign key checks to restore snapshot")
+	}
+	for _, table := range snapshot.Tables {
+		_, err = conn.ExecContext(ctx, table)
+		if err != nil {
+			return errors.Wrap(err, table)
+		}
+	}
+	err = p.CreateSchemaTableIfNotExists(ctx, nil, d)
+	if err != nil {
+		return err
+	}
+	ph := p.placeholder
+	query := fmt.Sprintf(`
+		REPLACE INTO %s (library, migration, done, error, applied_by, updated_at, created_at)
+		VALUES (%s, %s, %s, %s, %s, now(), now())`, p.trackingTable(d), ph(1), ph(2), ph(3), ph(4), ph(5))
+	for _, status := range snapshot.Status {
+		_, err = d.DB().ExecContext(ctx, query, status.Library, status.Migration, status.Done, status.Error, d.AppliedBy())
+		if err != nil {
+			return errors.Wrapf(err, "Restore status of %s: %s", status.Library, status.Migration)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package lsmysql
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/muir/sqltoken"
+	"github.com/pkg/errors"
+)
+
+// SplitScript breaks a script into statements the way that the mysql
+// command line client does.  DELIMITER directives are honored so that
+// the bodies of stored procedures, functions, and triggers, which
+// contain semicolons, are kept together:
+//
+//	DELIMITER $$
+//	CREATE PROCEDURE p()
+//	BEGIN
+//		INSERT INTO t VALUES (1);
+//	END $$
+//	DELIMITER ;
+//
+// The delimiters and the DELIMITER directives are not included in the
+// statements.  Statements that are empty or only comments are dropped.
+//
+// Script() and Generate() migrations that have DELIMITER directives
+// are split with SplitScript and run one statement at a time.
+func SplitScript(script string) []string {
+	chunks, _ := splitDelimited(script)
+	statements := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		if hasContent(c.text) {
+			statements = append(statements, strings.TrimSpace(c.text))
+		}
+	}
+	return statements
+}
+
+// execScript runs a script.  Scripts with DELIMITER directives are
+// run one statement at a time and the result is from the last one.
+func execScript(tx *sql.Tx, script string) (sql.Result, error) {
+	if _, custom := splitDelimited(script); !custom {
+		return tx.Exec(script)
+	}
+	var result sql.Result
+	for _, statement := range SplitScript(script) {
+		r, err := tx.Exec(statement)
+		if err != nil {
+			return nil, errors.Wrap(err, statement)
+		}
+		result = r
+	}
+	return result, nil
+}
+
+type chunk struct {
+	text   string
+	offset int // byte offset of text within the script
+}
+
+var delimiterRE = regexp.MustCompile(`(?i)\ADELIMITER[ \t]+(\S+)[^\n]*(?:\n|\z)`)
+
+// splitDelimited splits on the current delimiter, outside of quotes and
+// comments, and processes DELIMITER directives.  It also reports if
+// there were any DELIMITER directives.
+func splitDelimited(s string) ([]chunk, bool) {
+	var chunks []chunk
+	delimiter := ";"
+	var sawDirective bool
+	start := 0
+	blank := true // only whitespace and comments since start
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case blank && (c == 'd' || c == 'D') && delimiterRE.MatchString(s[i:]):
+			match := delimiterRE.FindStringSubmatch(s[i:])
+			delimiter = match[1]
+			sawDirective = true
+			i += len(match[0])
+			start = i
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(s, i)
+			blank = false
+		case c == '#' || isDashComment(s[i:]):
+			if n := strings.IndexByte(s[i:], '\n'); n != -1 {
+				i += n + 1
+			} else {
+				i = len(s)
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			if n := strings.Index(s[i+2:], "*/"); n != -1 {
+				i += n + 4
+			} else {
+				i = len(s)
+			}
+		case strings.HasPrefix(s[i:], delimiter):
+			chunks = append(chunks, chunk{text: s[start:i], offset: start})
+			i += len(delimiter)
+			start = i
+			blank = true
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				blank = false
+			}
+			i++
+		}
+	}
+	if start < len(s) {
+		chunks = append(chunks, chunk{text: s[start:], offset: start})
+	}
+	return chunks, sawDirective
+}
+
+// skipQuoted returns the index just past the quoted string that starts at i
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			if j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// isDashComment is true for "-- " comments.  MySQL requires whitespace
+// (or the end of input) after the dashes.
+func isDashComment(s string) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	return len(s) == 2 || unicode.IsSpace(rune(s[2]))
+}
+
+// hasContent is true if there is anything other than comments and
+// whitespace
+func hasContent(s string) bool {
+	for _, token := range sqltoken.TokenizeMySQL(s) {
+		// nolint:exhaustive
+		switch token.Type {
+		case sqltoken.Comment, sqltoken.Whitespace, sqltoken.Semicolon:
+		default:
+			return true
+		}
+	}
+	return false
+}
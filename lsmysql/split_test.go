@@ -0,0 +1,112 @@
+package lsmysql_test
+
+import (
+	"testing"
+
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitScript(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "plain",
+			script: "CREATE TABLE x (id int); INSERT INTO x VALUES (1);\n",
+			want:   []string{"CREATE TABLE x (id int)", "INSERT INTO x VALUES (1)"},
+		},
+		{
+			name:   "quotes and comments",
+			script: "INSERT INTO x VALUES ('a;b', \"c;d\", 'it''s;'); -- one; two\nSELECT `a;b` FROM x /* ; */; # three;\n",
+			want: []string{
+				"INSERT INTO x VALUES ('a;b', \"c;d\", 'it''s;')",
+				"-- one; two\nSELECT `a;b` FROM x /* ; */",
+			},
+		},
+		{
+			name:   "escaped quote",
+			script: `INSERT INTO x VALUES ('a\';b'); SELECT 1`,
+			want:   []string{`INSERT INTO x VALUES ('a\';b')`, "SELECT 1"},
+		},
+		{
+			name: "nested procedure",
+			script: `
+DROP PROCEDURE IF EXISTS p;
+DELIMITER $$
+CREATE PROCEDURE p(IN n int)
+BEGIN
+	DECLARE i int DEFAULT 0;
+	WHILE i < n DO
+		BEGIN
+			INSERT INTO x VALUES (i);
+			IF i > 10 THEN
+				BEGIN
+					UPDATE x SET id = id + 1;
+				END;
+			END IF;
+		END;
+		SET i = i + 1;
+	END WHILE;
+END $$
+DELIMITER ;
+CALL p(3);
+`,
+			want: []string{
+				"DROP PROCEDURE IF EXISTS p",
+				"CREATE PROCEDURE p(IN n int)\nBEGIN\n\tDECLARE i int DEFAULT 0;\n\tWHILE i < n DO\n\t\tBEGIN\n\t\t\tINSERT INTO x VALUES (i);\n\t\t\tIF i > 10 THEN\n\t\t\t\tBEGIN\n\t\t\t\t\tUPDATE x SET id = id + 1;\n\t\t\t\tEND;\n\t\t\tEND IF;\n\t\tEND;\n\t\tSET i = i + 1;\n\tEND WHILE;\nEND",
+				"CALL p(3)",
+			},
+		},
+		{
+			name: "trigger with //",
+			script: `delimiter //
+CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW
+BEGIN
+	SET NEW.id = NEW.id + 1;
+END//
+CREATE FUNCTION f() RETURNS int DETERMINISTIC
+BEGIN
+	RETURN 1;
+END
+//
+`,
+			want: []string{
+				"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW\nBEGIN\n\tSET NEW.id = NEW.id + 1;\nEND",
+				"CREATE FUNCTION f() RETURNS int DETERMINISTIC\nBEGIN\n\tRETURN 1;\nEND",
+			},
+		},
+		{
+			name:   "delimiter in a string",
+			script: "DELIMITER $$\nSELECT '$$' $$\n",
+			want:   []string{"SELECT '$$'"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, lsmysql.SplitScript(tc.script))
+		})
+	}
+}
+
+func TestCheckScriptDelimiter(t *testing.T) {
+	check := lsmysql.CheckScriptDetails(`
+DELIMITER $$
+CREATE PROCEDURE IF NOT EXISTS p()
+BEGIN
+	INSERT INTO x VALUES (1);
+	UPDATE x SET id = 2;
+END $$
+DELIMITER ;
+CREATE TABLE IF NOT EXISTS y (id int);
+`)
+	assert.Equal(t, lsmysql.Safe, check.Result, "procedure body is not data")
+	require.NotNil(t, check.FirstDDL)
+	assert.Equal(t, lsmysql.StatementPosition{Index: 0, Line: 3, Column: 1, Word: "create"}, *check.FirstDDL)
+	assert.Nil(t, check.FirstData)
+	assert.Nil(t, check.FirstConnectionStateChange, "SET inside the body")
+}
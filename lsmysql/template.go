@@ -0,0 +1,61 @@
+package lsmysql
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/muir/libschema"
+
+	"github.com/pkg/errors"
+)
+
+// ScriptTemplate creates a libschema.Migration from a text/template
+// that is rendered with data into a SQL script.  It is for values that
+// differ between deployments, like tablespace names, in places where
+// MySQL does not allow bind parameters.
+//
+// Only identifiers should be templated and they should be written with
+// the ident function, which rejects anything that is not a simple
+// identifier:
+//
+//	lsmysql.ScriptTemplate("archive", `
+//		CREATE TABLE {{ ident .Table }} (id bigint) TABLESPACE {{ ident .Tablespace }}`,
+//		map[string]string{"Table": "archive", "Tablespace": "ts_cold"})
+//
+// Values should not be templated: use Computed with placeholders
+// instead.  The template is rendered right away so that
+// Options.MigrationValidators and the script checks see the rendered
+// SQL.  If it cannot be rendered, Migrate fails before any migration
+// runs.
+func ScriptTemplate(name string, tmpl string, data interface{}, opts ...libschema.MigrationOption) libschema.Migration {
+	sqlText, err := renderTemplate(name, tmpl, data)
+	m := Script(name, sqlText, opts...)
+	if err != nil {
+		m.(*mmigration).renderErr = errors.Wrapf(err, "Render template for migration %s", name)
+	}
+	return m
+}
+
+var templateFuncs = template.FuncMap{
+	"ident": func(name interface{}) (string, error) {
+		s := fmt.Sprint(name)
+		if !simpleIdentifierRE.MatchString(s) {
+			return "", errors.Errorf("'%s' is not a simple identifier", s)
+		}
+		return "`" + s + "`", nil
+	},
+}
+
+func renderTemplate(name string, tmpl string, data interface{}) (string, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
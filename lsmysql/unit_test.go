@@ -0,0 +1,1259 @@
+package lsmysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal/fakesql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackingTableOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		opt     MySQLOpt
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: "ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin",
+		},
+		{
+			name: "engine only",
+			opt:  WithTrackingTableOptions("MyISAM", "", ""),
+			want: "ENGINE = MyISAM",
+		},
+		{
+			name: "none",
+			opt:  WithTrackingTableOptions("", "", ""),
+			want: "",
+		},
+		{
+			name:    "bad",
+			opt:     WithTrackingTableOptions("InnoDB; DROP TABLE x", "", ""),
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &MySQL{
+				trackingEngine:    "InnoDB",
+				trackingCharset:   "utf8mb4",
+				trackingCollation: "utf8mb4_bin",
+			}
+			if tc.opt != nil {
+				tc.opt(p)
+			}
+			got, err := p.trackingTableOptions()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWithTrackingTable(t *testing.T) {
+	d := &libschema.Database{
+		Options: libschema.Options{
+			TrackingTable: "ignored.table",
+		},
+	}
+	cases := []struct {
+		schema, table       string
+		wantSchema, wantRef string
+		wantErr             bool
+	}{
+		{schema: "", table: "tracking", wantSchema: "", wantRef: "tracking"},
+		{schema: "meta", table: "tracking", wantSchema: "meta", wantRef: "meta.tracking"},
+		{schema: "meta.v2", table: "tracking-table", wantSchema: "`meta.v2`", wantRef: "`meta.v2`.`tracking-table`"},
+		{schema: "meta", table: "", wantErr: true},
+		{schema: "me`ta", table: "tracking", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.schema+"/"+tc.table, func(t *testing.T) {
+			p := &MySQL{}
+			WithTrackingTable(tc.schema, tc.table)(p)
+			schema, ref, err := p.trackingSchemaTable(d)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.wantSchema, schema, "schema")
+				assert.Equal(t, tc.wantRef, ref, "reference")
+			}
+		})
+	}
+	assert.Equal(t, "meta.tracking_lock", lockTableName("meta.tracking"))
+	assert.Equal(t, "`meta.v2`.`tracking-table_lock`", lockTableName("`meta.v2`.`tracking-table`"))
+}
+
+func TestWithTrackingTableSuffix(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	d := &libschema.Database{
+		Options: libschema.Options{
+			TrackingTable: "libschema.migrations",
+		},
+	}
+	_, p, err := New(log, "test", nil, nil, WithoutDatabase, WithTrackingTableSuffix("_blue"))
+	require.NoError(t, err)
+	schema, ref, err := p.trackingSchemaTable(d)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "libschema", schema, "schema is not changed")
+		assert.Equal(t, "libschema.migrations_blue", ref)
+	}
+
+	_, p, err = New(log, "test", nil, nil, WithoutDatabase, WithTrackingTableSuffix("_green"), WithTrackingTable("meta.v2", "tracking-table"))
+	require.NoError(t, err)
+	_, ref, err = p.trackingSchemaTable(d)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "`meta.v2`.`tracking-table_green`", ref, "option order does not matter")
+	}
+	assert.Equal(t, "`meta.v2`.`tracking-table_green_lock`", lockTableName(ref))
+
+	_, _, err = New(log, "test", nil, nil, WithoutDatabase, WithTrackingTableSuffix("-blue"))
+	assert.Error(t, err)
+}
+
+func TestANSIQuotes(t *testing.T) {
+	assert.True(t, hasANSIQuotes("ANSI_QUOTES"))
+	assert.True(t, hasANSIQuotes("STRICT_TRANS_TABLES,ansi_quotes,NO_ZERO_DATE"))
+	assert.True(t, hasANSIQuotes("REAL_AS_FLOAT,PIPES_AS_CONCAT,ANSI"))
+	assert.False(t, hasANSIQuotes("STRICT_TRANS_TABLES,NO_ENGINE_SUBSTITUTION"))
+	assert.False(t, hasANSIQuotes(""))
+
+	d := &libschema.Database{
+		Options: libschema.Options{
+			TrackingTable: `"meta"."tracking-table"`,
+		},
+	}
+	p := &MySQL{}
+	_, _, err := p.defaultTrackingSchemaTable(d)
+	assert.Error(t, err, "double quotes are strings without ANSI_QUOTES")
+
+	WithANSIQuotes(true)(p)
+	schema, ref, err := p.defaultTrackingSchemaTable(d)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"meta"`, schema)
+		assert.Equal(t, `"meta"."tracking-table"`, ref)
+	}
+	assert.Equal(t, `"meta"."tracking-table_lock"`, lockTableName(ref))
+	assert.Equal(t, "tracking-table", unquoteIdentifier(`"tracking-table"`))
+
+	WithTrackingTable("meta.v2", "tracking-table")(p)
+	schema, ref, err = p.trackingSchemaTable(d)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"meta.v2"`, schema)
+		assert.Equal(t, `"meta.v2"."tracking-table"`, ref)
+	}
+	WithTrackingTable("meta", `tracking"table`)(p)
+	_, _, err = p.trackingSchemaTable(d)
+	assert.Error(t, err)
+}
+
+func TestValidTableReference(t *testing.T) {
+	assert.True(t, validTableReference("users"))
+	assert.True(t, validTableReference("app.users"))
+	assert.False(t, validTableReference("a.b.c"))
+	assert.False(t, validTableReference("users; DROP TABLE x"))
+	assert.False(t, validTableReference(""))
+}
+
+func TestLockBackoff(t *testing.T) {
+	p := &MySQL{}
+	WithLockAcquireBackoff(10*time.Millisecond, 50*time.Millisecond, false)(p)
+	assert.Equal(t, 10*time.Millisecond, p.lockBackoff(0))
+	assert.Equal(t, 20*time.Millisecond, p.lockBackoff(1))
+	assert.Equal(t, 40*time.Millisecond, p.lockBackoff(2))
+	assert.Equal(t, 50*time.Millisecond, p.lockBackoff(3))
+	assert.Equal(t, 50*time.Millisecond, p.lockBackoff(100))
+
+	WithLockAcquireBackoff(10*time.Millisecond, 50*time.Millisecond, true)(p)
+	for i := 0; i < 100; i++ {
+		d := p.lockBackoff(1)
+		assert.GreaterOrEqual(t, d, 10*time.Millisecond)
+		assert.LessOrEqual(t, d, 20*time.Millisecond)
+	}
+
+	WithLockAcquireBackoff(0, 0, false)(p)
+	assert.Equal(t, time.Millisecond, p.lockBackoff(5), "defaults")
+}
+
+func TestCheckErrorConnectionState(t *testing.T) {
+	check := CheckScriptDetails("SET foreign_key_checks = 0; DELETE FROM x WHERE id = 1")
+	assert.Error(t, checkError(check, false, false, false), "shared connection")
+	assert.NoError(t, checkError(check, false, true, false), "dedicated connection")
+
+	check = CheckScriptDetails("SET foreign_key_checks = 0; DROP TABLE x")
+	assert.Error(t, checkError(check, false, true, false), "still non-idempotent")
+	assert.NoError(t, checkError(check, true, true, false), "skipIf and dedicated")
+}
+
+func TestCheckErrorUnboundedMutation(t *testing.T) {
+	check := CheckScriptDetails("DELETE FROM x")
+	assert.Error(t, checkError(check, false, false, false), "rejected by default")
+	assert.NoError(t, checkError(check, false, false, true), "allowed")
+}
+
+func TestIsVitess(t *testing.T) {
+	assert.True(t, isVitess("8.0.30-Vitess", ""))
+	assert.True(t, isVitess("8.0.30", "PlanetScale Vitess"))
+	assert.False(t, isVitess("8.0.34", "MySQL Community Server - GPL"))
+	assert.False(t, isVitess("5.5.5-10.11.2-MariaDB", "mariadb.org binary distribution"))
+}
+
+func TestDetectFlavor(t *testing.T) {
+	assert.Equal(t, FlavorTiDB, detectFlavor("8.0.11-TiDB-v7.5.1", "TiDB Server (Apache License 2.0) Community Edition, MySQL 8.0 compatible"))
+	assert.Equal(t, FlavorTiDB, detectFlavor("5.7.25-TiDB-v6.5.0", ""))
+	assert.Equal(t, FlavorVitess, detectFlavor("8.0.30-Vitess", ""))
+	assert.Equal(t, FlavorMySQL, detectFlavor("8.0.34", "MySQL Community Server - GPL"))
+	assert.Equal(t, FlavorMySQL, detectFlavor("5.5.5-10.11.2-MariaDB", "mariadb.org binary distribution"))
+}
+
+func TestRowLockTTL(t *testing.T) {
+	p := &MySQL{}
+	assert.Equal(t, DefaultRowLockTTL, p.rowLockTTL())
+	WithRowLockTTL(time.Minute)(p)
+	assert.Equal(t, time.Minute, p.rowLockTTL())
+}
+
+func TestParseAlterTable(t *testing.T) {
+	cases := []struct {
+		script   string
+		database string
+		table    string
+		alter    string
+		err      bool
+	}{
+		{
+			script: "ALTER TABLE users ADD COLUMN level int",
+			table:  "users",
+			alter:  "ADD COLUMN level int",
+		},
+		{
+			script:   "\n\talter table `app`.`users`\n\t\tADD INDEX level_idx (level),\n\t\tDROP COLUMN old;\n",
+			database: "app",
+			table:    "users",
+			alter:    "ADD INDEX level_idx (level),\n\t\tDROP COLUMN old",
+		},
+		{
+			script: "ALTER TABLE users ADD COLUMN a int; ALTER TABLE users ADD COLUMN b int",
+			err:    true,
+		},
+		{
+			script: "CREATE TABLE users (id int)",
+			err:    true,
+		},
+		{
+			script: "ALTER TABLE users",
+			err:    true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.script, func(t *testing.T) {
+			database, table, alter, err := parseAlterTable(tc.script)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.database, database, "database")
+				assert.Equal(t, tc.table, table, "table")
+				assert.Equal(t, tc.alter, alter, "alter")
+			}
+		})
+	}
+}
+
+func TestOSCToolCommands(t *testing.T) {
+	cmd := GhOst{Args: []string{"--host=db1"}}.Command(context.Background(), "app", "users", "ADD COLUMN level int")
+	assert.Equal(t, []string{"gh-ost", "--host=db1", "--database=app", "--table=users", "--alter=ADD COLUMN level int", "--execute"}, cmd.Args)
+
+	cmd = PTOnlineSchemaChange{
+		Path: "/usr/bin/pt-online-schema-change",
+		DSN:  "h=db1,u=admin",
+		Args: []string{"--max-load", "Threads_running=50"},
+	}.Command(context.Background(), "app", "users", "ADD COLUMN level int")
+	assert.Equal(t, []string{"/usr/bin/pt-online-schema-change", "--max-load", "Threads_running=50",
+		"--alter", "ADD COLUMN level int", "--execute", "h=db1,u=admin,D=app,t=users"}, cmd.Args)
+}
+
+type oscRecorder struct {
+	calls []string
+}
+
+func (o *oscRecorder) Command(ctx context.Context, database, table, alter string) *exec.Cmd {
+	o.calls = append(o.calls, database+"."+table+": "+alter)
+	return exec.CommandContext(ctx, "true")
+}
+
+func TestOnlineSchemaChangeChecks(t *testing.T) {
+	fake := &fakesql.DB{}
+	db := fake.Open()
+	defer db.Close()
+	ctx := context.Background()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(ctx, libschema.Options{SchemaOverride: "over"})
+	d, p, err := New(log, "test", s, db, WithDatabaseName("app"))
+	require.NoError(t, err)
+	osc := &oscRecorder{}
+	skipIf := libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) { return false, nil })
+	d.Migrations("L",
+		Script("tracking", `ALTER TABLE libschema.migration_status ADD COLUMN x int`, WithOnlineSchemaChange(osc), skipIf),
+		Script("unconditional", `ALTER TABLE users ADD COLUMN level int`, WithOnlineSchemaChange(osc)),
+		Script("level", `ALTER TABLE users ADD COLUMN level int`, WithOnlineSchemaChange(osc), skipIf),
+	)
+	migrate := func(name string) error {
+		m, ok := d.Lookup(libschema.MigrationName{Library: "L", Name: name})
+		require.True(t, ok, name)
+		_, err := p.DoOneMigration(ctx, log, d, m)
+		return err
+	}
+
+	err = migrate("tracking")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tracking table")
+	}
+	err = migrate("unconditional")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "non-idempotent")
+	}
+	assert.Empty(t, osc.calls, "the tool is not run when the check fails")
+
+	require.NoError(t, migrate("level"))
+	assert.Equal(t, []string{"app.users: ADD COLUMN level int"}, osc.calls, "WithDatabaseName before SchemaOverride")
+}
+
+func TestDatabaseName(t *testing.T) {
+	_, m, err := New(nil, "test", nil, nil, WithoutDatabase, WithDatabaseName("app"))
+	require.NoError(t, err)
+	name, err := m.DatabaseName()
+	require.NoError(t, err)
+	assert.Equal(t, "app", name)
+
+	require.NoError(t, m.SetDatabaseName("other"))
+	name, err = m.DatabaseName()
+	require.NoError(t, err)
+	assert.Equal(t, "other", name)
+
+	assert.Error(t, m.SetDatabaseName("other; DROP DATABASE app"))
+	name, err = m.DatabaseName()
+	require.NoError(t, err)
+	assert.Equal(t, "other", name, "unchanged")
+
+	_, _, err = New(nil, "test", nil, nil, WithoutDatabase, WithDatabaseName("a-b"))
+	assert.Error(t, err)
+}
+
+func TestDumpTable(t *testing.T) {
+	table := &dumpTable{
+		name:      "orders",
+		engine:    "InnoDB",
+		collation: "utf8mb4_bin",
+		columns: []dumpColumn{
+			{name: "id", columnType: "bigint", extra: "auto_increment"},
+			{name: "user_id", columnType: "bigint"},
+			{name: "note", columnType: "varchar(255)", nullable: true, collation: "utf8mb4_bin"},
+			{name: "status", columnType: "varchar(10)", defaultValue: sql.NullString{String: "it's new", Valid: true}},
+			{name: "updated", columnType: "timestamp", defaultValue: sql.NullString{String: "CURRENT_TIMESTAMP", Valid: true},
+				extra: "DEFAULT_GENERATED on update CURRENT_TIMESTAMP"},
+			{name: "total", columnType: "decimal(10,2)", nullable: true, generation: "(`price` * `qty`)", extra: "STORED GENERATED"},
+			{name: "lower_note", columnType: "varchar(255)", generation: "lower(`note`)", extra: "VIRTUAL GENERATED"},
+		},
+		indexes: map[string]*dumpIndex{
+			"user_note": {indexType: "BTREE", columns: []string{"`user_id`", "`note`(10)"}},
+			"PRIMARY":   {unique: true, indexType: "BTREE", columns: []string{"`id`"}},
+			"by_status": {unique: true, indexType: "BTREE", columns: []string{"`status`", "`id`"}},
+			"note_text": {indexType: "FULLTEXT", columns: []string{"`note`"}},
+		},
+		foreignKeys: map[string]*dumpForeignKey{
+			"orders_user": {
+				columns:    []string{"`user_id`"},
+				refTable:   "users",
+				refColumns: []string{"`id`"},
+				onUpdate:   "RESTRICT",
+				onDelete:   "CASCADE",
+			},
+		},
+	}
+	assert.Equal(t, "CREATE TABLE `orders` (\n"+
+		"\t`id` bigint NOT NULL auto_increment,\n"+
+		"\t`user_id` bigint NOT NULL,\n"+
+		"\t`note` varchar(255) COLLATE utf8mb4_bin DEFAULT NULL,\n"+
+		"\t`status` varchar(10) NOT NULL DEFAULT 'it''s new',\n"+
+		"\t`updated` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP on update CURRENT_TIMESTAMP,\n"+
+		"\t`total` decimal(10,2) GENERATED ALWAYS AS ((`price` * `qty`)) STORED,\n"+
+		"\t`lower_note` varchar(255) GENERATED ALWAYS AS (lower(`note`)) VIRTUAL NOT NULL,\n"+
+		"\tPRIMARY KEY (`id`),\n"+
+		"\tUNIQUE KEY `by_status` (`status`, `id`),\n"+
+		"\tFULLTEXT KEY `note_text` (`note`),\n"+
+		"\tKEY `user_note` (`user_id`, `note`(10)),\n"+
+		"\tCONSTRAINT `orders_user` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON UPDATE RESTRICT ON DELETE CASCADE\n"+
+		") ENGINE=InnoDB COLLATE=utf8mb4_bin;\n", table.String())
+}
+
+func TestMariaDBDefault(t *testing.T) {
+	cases := []struct {
+		name     string
+		raw      sql.NullString
+		nullable bool
+		want     string
+	}{
+		{name: "none", want: "`c` int NOT NULL"},
+		{name: "null", raw: sql.NullString{String: "NULL", Valid: true}, nullable: true, want: "`c` int DEFAULT NULL"},
+		{name: "string", raw: sql.NullString{String: "'it''s new'", Valid: true}, want: "`c` int NOT NULL DEFAULT 'it''s new'"},
+		{name: "number", raw: sql.NullString{String: "-1.5", Valid: true}, want: "`c` int NOT NULL DEFAULT '-1.5'"},
+		{name: "expression", raw: sql.NullString{String: "current_timestamp()", Valid: true}, want: "`c` int NOT NULL DEFAULT current_timestamp()"},
+		{name: "function", raw: sql.NullString{String: "uuid()", Valid: true}, want: "`c` int NOT NULL DEFAULT uuid()"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dumpColumn{name: "c", columnType: "int", nullable: tc.nullable, defaultValue: tc.raw}
+			c.mariaDBDefault()
+			assert.Equal(t, tc.want, c.String())
+		})
+	}
+	assert.True(t, isMariaDB("10.6.12-MariaDB-log"))
+	assert.False(t, isMariaDB("8.0.32"))
+}
+
+func TestShowCreateTable(t *testing.T) {
+	create := "CREATE TABLE `orders` (\n" +
+		"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+		"  `price` int NOT NULL,\n" +
+		"  `qty` int NOT NULL,\n" +
+		"  `total` bigint GENERATED ALWAYS AS ((`price` * `qty`)) STORED,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB AUTO_INCREMENT=42 DEFAULT CHARSET=utf8mb4"
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			if query != "SHOW CREATE TABLE `shop`.`orders`" {
+				return nil, errors.Errorf("unexpected %s", query)
+			}
+			return &fakesql.Rows{
+				Columns: []string{"Table", "Create Table"},
+				Values:  [][]driver.Value{{"orders", create}},
+			}, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+
+	got, err := showCreateTable(context.Background(), db, "shop", "orders")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Replace(create, " AUTO_INCREMENT=42", "", 1), got, "only the counter is removed")
+
+	_, err = showCreateTable(context.Background(), db, "shop", "missing")
+	assert.Error(t, err)
+}
+
+func TestAddTrackingColumns(t *testing.T) {
+	present := map[string]bool{"applied_by": true, "duration_ms": true, "run_id": true, "backup_tables": true}
+	fake := &fakesql.DB{
+		Respond: func(query string, args []driver.Value) (*fakesql.Rows, error) {
+			if !strings.HasPrefix(query, "SELECT COUNT(*) FROM information_schema.columns") {
+				return nil, nil
+			}
+			assert.Equal(t, []driver.Value{"libschema", "migration_status"}, args[:2], "unquoted")
+			var count int64
+			if present[args[2].(string)] {
+				count = 1
+			}
+			return &fakesql.Rows{Columns: []string{"count"}, Values: [][]driver.Value{{count}}}, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+	ctx := context.Background()
+	d, _, err := New(libschema.LogFromLog(t), "test", libschema.New(ctx, libschema.Options{}), db)
+	require.NoError(t, err)
+
+	require.NoError(t, AddTrackingColumns(ctx, d, "`libschema`", "`libschema`.`migration_status`"))
+	assert.Len(t, fake.Matching("SELECT COUNT(*) FROM information_schema.columns"), 6)
+	assert.True(t, fake.Sequence(
+		"ALTER TABLE `libschema`.`migration_status` ADD COLUMN created_at timestamp NULL DEFAULT NULL",
+		"UPDATE `libschema`.`migration_status` SET created_at = updated_at",
+		"ALTER TABLE `libschema`.`migration_status` ADD COLUMN comment text",
+	), "statements:\n%s", fake)
+	assert.Len(t, fake.Matching("ALTER TABLE"), 2, "only missing columns are added")
+}
+
+func TestBackupAfterSkipIf(t *testing.T) {
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			switch {
+			case strings.HasPrefix(query, "SELECT data_length"):
+				return &fakesql.Rows{Columns: []string{"data_length"}, Values: [][]driver.Value{{int64(100)}}}, nil
+			case strings.HasPrefix(query, "SET SESSION information_schema_stats_expiry"):
+				// as from MySQL 5.7 and MariaDB
+				return nil, &mysql.MySQLError{Number: 1193, Message: "Unknown system variable 'information_schema_stats_expiry'"}
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+	ctx := context.Background()
+	log := libschema.LogFromLog(t)
+	d, p, err := New(log, "test", libschema.New(ctx, libschema.Options{}), db)
+	require.NoError(t, err)
+	skipIf := func(skip bool) libschema.MigrationOption {
+		return libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) { return skip, nil })
+	}
+	d.Migrations("L",
+		Script("skipped", `DELETE FROM t1 WHERE id = 1`, WithBackupTables("t1"), skipIf(true)),
+		Script("run", `DELETE FROM t1 WHERE id = 2`, WithBackupTables("t1"), skipIf(false)),
+	)
+	migrate := func(name string) error {
+		m, ok := d.Lookup(libschema.MigrationName{Library: "L", Name: name})
+		require.True(t, ok, name)
+		_, err := p.DoOneMigration(ctx, log, d, m)
+		return err
+	}
+
+	require.NoError(t, migrate("skipped"))
+	assert.Empty(t, fake.Matching("CREATE TABLE"), "no backup of a skipped migration")
+
+	require.NoError(t, migrate("run"))
+	assert.True(t, fake.Sequence("BEGIN", "SET SESSION information_schema_stats_expiry = 0", "SELECT data_length", "CREATE TABLE t1_bak_", "DELETE FROM t1 WHERE id = 2", "COMMIT"),
+		"statements:\n%s", fake)
+
+	db.SetMaxOpenConns(1)
+	err = migrate("run")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "needs a second connection")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(&mysql.MySQLError{Number: 1213}), "deadlock")
+	assert.True(t, isRetryable(errors.Wrap(&mysql.MySQLError{Number: 1205}, "backfill")), "wrapped lock wait timeout")
+	assert.False(t, isRetryable(&mysql.MySQLError{Number: 1062}), "duplicate key")
+	assert.False(t, isRetryable(errors.New("Deadlock found")), "not a MySQLError")
+
+	p := &MySQL{}
+	var _ libschema.ErrorClassifier = p
+	assert.True(t, p.IsRetryable(&mysql.MySQLError{Number: 1213}), "deadlock")
+	assert.True(t, p.IsRetryable(&mysql.MySQLError{Number: 2006}), "gone away")
+	assert.True(t, p.IsRetryable(errors.Wrap(mysql.ErrInvalidConn, "exec")), "invalid connection")
+	assert.True(t, p.IsRetryable(driver.ErrBadConn), "bad connection")
+	assert.False(t, p.IsRetryable(&mysql.MySQLError{Number: 1050}), "table exists")
+	assert.True(t, p.IsAlreadyExists(errors.Wrap(&mysql.MySQLError{Number: 1050}, "create")), "table exists")
+	assert.True(t, p.IsAlreadyExists(&mysql.MySQLError{Number: 1061}), "duplicate key name")
+	assert.False(t, p.IsAlreadyExists(&mysql.MySQLError{Number: 1213}), "deadlock")
+	assert.False(t, p.IsAlreadyExists(errors.New("Table 'x' already exists")), "not a MySQLError")
+}
+
+func TestDeadlockRetry(t *testing.T) {
+	script := Script("T1", "UPDATE x SET a = 1 WHERE b = 2").(*mmigration)
+	computed := Computed("T2", func(context.Context, *sql.Tx) error { return nil }).(*mmigration)
+	retryable := ComputedRetryable("T3", func(context.Context, *sql.Tx) error { return nil }, 2).(*mmigration)
+
+	p := &MySQL{}
+	assert.Equal(t, 0, p.maxRetries(script), "default")
+	assert.Equal(t, 2, p.maxRetries(retryable), "default retryable")
+	assert.Equal(t, time.Duration(0), p.retryDelay(3), "no backoff")
+
+	WithDeadlockRetry(3, 100*time.Millisecond)(p)
+	assert.Equal(t, 3, p.maxRetries(script), "script")
+	assert.Equal(t, 0, p.maxRetries(computed), "computed is not retried")
+	assert.Equal(t, 2, p.maxRetries(retryable), "retryable keeps its own count")
+	assert.Equal(t, 100*time.Millisecond, p.retryDelay(1))
+	assert.Equal(t, 400*time.Millisecond, p.retryDelay(3))
+}
+
+func TestSavepointName(t *testing.T) {
+	tx := Savepoints(nil)
+	assert.Error(t, tx.Savepoint(context.Background(), "bad name"))
+	assert.Error(t, tx.RollbackTo(context.Background(), "x; COMMIT"))
+	assert.Error(t, tx.Release(context.Background(), ""))
+}
+
+func TestConnectionLimit(t *testing.T) {
+	db, err := sql.Open("mysql", "user@tcp(127.0.0.1:1)/test")
+	require.NoError(t, err)
+	defer db.Close()
+	p := &MySQL{}
+	assert.Equal(t, 0, p.connectionLimit(db), "no limit")
+	WithMaxConnections(3)(p)
+	assert.Equal(t, 3, p.connectionLimit(db), "option")
+	db.SetMaxOpenConns(2)
+	assert.Equal(t, 2, p.connectionLimit(db), "pool is smaller")
+	WithMaxConnections(1)(p)
+	assert.Equal(t, 1, p.connectionLimit(db), "option is smaller")
+	WithMaxConnections(0)(p)
+	assert.Equal(t, 2, p.connectionLimit(db), "pool only")
+}
+
+func TestScriptTemplate(t *testing.T) {
+	data := map[string]string{
+		"Table":      "archive",
+		"Tablespace": "ts_cold",
+		"Bad":        "x; DROP TABLE users",
+	}
+	m := ScriptTemplate("ok", `CREATE TABLE {{ ident .Table }} (id bigint) TABLESPACE {{ ident .Tablespace }}`, data).(*mmigration)
+	assert.NoError(t, m.renderErr)
+	assert.Equal(t, "CREATE TABLE `archive` (id bigint) TABLESPACE `ts_cold`", m.sqlText)
+
+	m = ScriptTemplate("bad", `DROP TABLE {{ ident .Bad }}`, data).(*mmigration)
+	if assert.Error(t, m.renderErr) {
+		assert.Contains(t, m.renderErr.Error(), "not a simple identifier")
+	}
+
+	m = ScriptTemplate("missing", `DROP TABLE {{ ident .Missing }}`, data).(*mmigration)
+	assert.Error(t, m.renderErr, "missing key")
+
+	m = ScriptTemplate("syntax", `DROP TABLE {{ ident .Table `, data).(*mmigration)
+	assert.Error(t, m.renderErr, "parse error")
+}
+
+// hangConnector never connects
+type hangConnector struct{}
+
+func (hangConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hangConnector) Driver() driver.Driver { return nil }
+
+// blockingConn is a connection where every query waits for its context
+type blockingConn struct{}
+
+func (blockingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (blockingConn) Close() error                        { return nil }
+func (blockingConn) Begin() (driver.Tx, error)           { return blockingConn{}, nil }
+func (blockingConn) Commit() error                       { return nil }
+func (blockingConn) Rollback() error                     { return nil }
+
+func (blockingConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type blockingConnector struct{}
+
+func (blockingConnector) Connect(context.Context) (driver.Conn, error) { return blockingConn{}, nil }
+func (blockingConnector) Driver() driver.Driver                        { return nil }
+
+func TestAdvisoryLockCancel(t *testing.T) {
+	db := sql.OpenDB(blockingConnector{})
+	defer db.Close()
+	p := &MySQL{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	got, _, err := p.TryLock(ctx, "lstest", -1)
+	assert.False(t, got)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Gave up waiting for GET_LOCK")
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "returned promptly")
+}
+
+// lockingConn grants every GET_LOCK and records the statements it runs
+type lockingConn struct {
+	blockingConn
+	statements *[]string
+}
+
+func (c lockingConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	*c.statements = append(*c.statements, query)
+	return &oneValueRows{value: int64(1)}, nil
+}
+
+func (c lockingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	*c.statements = append(*c.statements, query)
+	return driver.RowsAffected(0), nil
+}
+
+type lockingConnector struct{ statements *[]string }
+
+func (c lockingConnector) Connect(context.Context) (driver.Conn, error) {
+	return lockingConn{statements: c.statements}, nil
+}
+func (lockingConnector) Driver() driver.Driver { return nil }
+
+// oneValueRows is a result with one row of one column
+type oneValueRows struct {
+	value driver.Value
+	done  bool
+}
+
+func (r *oneValueRows) Columns() []string { return []string{"value"} }
+func (r *oneValueRows) Close() error      { return nil }
+
+func (r *oneValueRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+func TestTryLockCancelWhileHeld(t *testing.T) {
+	var statements []string
+	db := sql.OpenDB(lockingConnector{statements: &statements})
+	defer db.Close()
+	p := &MySQL{db: db}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got, release, err := p.TryLock(ctx, "lstest", time.Second)
+	require.NoError(t, err)
+	require.True(t, got)
+	cancel()
+	// give database/sql a chance to react to the cancellation
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, db.Stats().InUse, "the lock keeps its connection")
+
+	require.NoError(t, release())
+	assert.Equal(t, "SELECT RELEASE_LOCK(?)", statements[len(statements)-1])
+	assert.Equal(t, 0, db.Stats().InUse, "connection returned to the pool")
+}
+
+func TestMigrationsLockDeadline(t *testing.T) {
+	var statements []string
+	db := sql.OpenDB(lockingConnector{statements: &statements})
+	defer db.Close()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(context.Background(), libschema.Options{TrackingTable: "libschema.tracking"})
+	d, p, err := New(log, "test", s, db, WithLockKeepalive(time.Millisecond))
+	require.NoError(t, err)
+	p.flavor = FlavorMySQL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	require.NoError(t, p.LockMigrationsTable(ctx, log, d))
+	<-ctx.Done()
+	// let the keepalive check the lock after the deadline
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, p.lockLostError(), "the lock is not lost when the deadline passes")
+
+	require.NoError(t, p.UnlockMigrationsTable(log))
+	assert.Equal(t, "SELECT RELEASE_LOCK(?)", statements[len(statements)-1])
+	assert.Equal(t, 0, db.Stats().InUse, "lock connection returned to the pool")
+}
+
+// noDatabaseConn has no default database: SELECT DATABASE() is NULL
+type noDatabaseConn struct {
+	lockingConn
+	closed *int
+}
+
+func (c noDatabaseConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "DATABASE()") {
+		*c.statements = append(*c.statements, query)
+		return &oneValueRows{}, nil
+	}
+	return c.lockingConn.QueryContext(ctx, query, args)
+}
+
+func (c noDatabaseConn) Close() error {
+	*c.closed++
+	return nil
+}
+
+type noDatabaseConnector struct {
+	statements *[]string
+	closed     *int
+}
+
+func (c noDatabaseConnector) Connect(context.Context) (driver.Conn, error) {
+	return noDatabaseConn{lockingConn: lockingConn{statements: c.statements}, closed: c.closed}, nil
+}
+func (noDatabaseConnector) Driver() driver.Driver { return nil }
+
+func TestUseSchemaWithoutDefaultDatabase(t *testing.T) {
+	var statements []string
+	var closed int
+	db := sql.OpenDB(noDatabaseConnector{statements: &statements, closed: &closed})
+	defer db.Close()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(context.Background(), libschema.Options{TrackingTable: "libschema.tracking"})
+	d, p, err := New(log, "test", s, db)
+	require.NoError(t, err)
+	m := Script("T1", "CREATE TABLE IF NOT EXISTS t1 (id int)", WithUseSchema("other"))
+	m.Base().Name.Library = "L1"
+
+	_, err = p.DoOneMigration(context.Background(), log, d, m)
+	require.NoError(t, err)
+	assert.Contains(t, statements, "USE other")
+	assert.Equal(t, 1, closed, "connection with USE other is closed")
+	assert.Equal(t, 0, db.Stats().Idle, "and not returned to the pool")
+
+	statements = nil
+	script, computed, err := p.RenderScript(context.Background(), log, d, m)
+	require.NoError(t, err)
+	assert.False(t, computed)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS t1 (id int)", script)
+	m = Generate("T2", func(context.Context, *sql.Tx) string { return "SELECT 1" }, WithUseSchema("other"))
+	_, _, err = p.RenderScript(context.Background(), log, d, m)
+	require.NoError(t, err)
+	assert.Contains(t, statements, "USE other")
+	assert.Equal(t, 2, closed, "rendering closes its connection too")
+	assert.Equal(t, 0, db.Stats().Idle)
+}
+
+func TestHelperTimeout(t *testing.T) {
+	db := sql.OpenDB(hangConnector{})
+	defer db.Close()
+	p := &MySQL{db: db}
+	WithHelperTimeout(10 * time.Millisecond)(p)
+	assert.Equal(t, 10*time.Millisecond, p.HelperTimeout())
+
+	_, err := p.DatabaseName()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 10ms")
+	}
+	p.UseDatabase("test")
+	_, err = p.HasTable(context.Background(), nil, "users")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 10ms")
+	}
+	_, err = p.DoesColumnExist("users", "id")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 10ms")
+	}
+}
+
+func TestSharedDriverLock(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	p := &MySQL{}
+	p.trackingSchemaTable = p.defaultTrackingSchemaTable
+	WithLockStrategy(NoLock)(p)
+	d1 := &libschema.Database{Name: "one", Options: libschema.Options{TrackingTable: "one.tracking"}}
+	d2 := &libschema.Database{Name: "two", Options: libschema.Options{TrackingTable: "two.tracking"}}
+	ctx := context.Background()
+
+	require.NoError(t, p.LockMigrationsTable(ctx, log, d1))
+	err := p.LockMigrationsTable(ctx, log, d1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "already locked")
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = p.LockMigrationsTable(short, log, d2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "database one that shares the driver holds it")
+	}
+
+	locked := make(chan error)
+	go func() {
+		locked <- p.LockMigrationsTable(ctx, log, d2)
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("got the lock while it was held: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, p.UnlockMigrationsTable(log))
+	require.NoError(t, <-locked)
+	require.NoError(t, p.UnlockMigrationsTable(log))
+	require.NoError(t, p.LockMigrationsTable(ctx, log, d1), "free again")
+	require.NoError(t, p.UnlockMigrationsTable(log))
+}
+
+func TestSharedDriverLockWait(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	db := sql.OpenDB(blockingConnector{})
+	defer db.Close()
+	s := libschema.New(context.Background(), libschema.Options{TrackingTable: "libschema.tracking"})
+	d1, p, err := New(log, "one", s, db)
+	require.NoError(t, err)
+	p.flavor = FlavorMySQL
+	d2, err := s.NewDatabase(log, "two", db, p)
+	require.NoError(t, err)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	locked := make(chan error)
+	go func() {
+		// blocks in GET_LOCK until ctx1 is cancelled
+		locked <- p.LockMigrationsTable(ctx1, log, d1)
+	}()
+	require.Eventually(t, func() bool {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return p.lockHolder == d1
+	}, 5*time.Second, time.Millisecond)
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	start := time.Now()
+	err = p.LockMigrationsTable(ctx2, log, d2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "database one that shares the driver holds it")
+	}
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "ctx is honored while the other database waits")
+
+	cancel1()
+	assert.Error(t, <-locked)
+	p.lock.Lock()
+	assert.Nil(t, p.lockHolder, "a failed lock frees the driver")
+	p.lock.Unlock()
+}
+
+func TestSharedDriverLoadStatusFailure(t *testing.T) {
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			if strings.HasPrefix(query, "SELECT library, migration, done, error") && strings.Contains(query, "one.tracking") {
+				return nil, errors.New("no status for one")
+			}
+			switch {
+			case strings.HasPrefix(query, "SELECT (SELECT COUNT(*) FROM information_schema.schemata"):
+				return &fakesql.Rows{Columns: []string{"schemata", "tables"}, Values: [][]driver.Value{{int64(1), int64(1)}}}, nil
+			case strings.HasPrefix(query, "SELECT COUNT(*) FROM information_schema.columns"):
+				return &fakesql.Rows{Columns: []string{"count"}, Values: [][]driver.Value{{int64(1)}}}, nil
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+	log := libschema.LogFromLog(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := libschema.New(ctx, libschema.Options{})
+	d1, p, err := New(log, "one", s, db, WithLockStrategy(NoLock), WithANSIQuotes(false))
+	require.NoError(t, err)
+	p.flavor = FlavorMySQL
+	d2, err := s.NewDatabase(log, "two", db, p)
+	require.NoError(t, err)
+	d1.Options.TrackingTable = "one.tracking"
+	d2.Options.TrackingTable = "two.tracking"
+	d1.Migrations("L", Script("T1", `CREATE TABLE IF NOT EXISTS one.t1 (id int)`))
+	d2.Migrations("L", Script("T1", `CREATE TABLE IF NOT EXISTS two.t1 (id int)`))
+
+	err = s.Migrate(ctx)
+	var dbErrors *libschema.DatabaseErrors
+	require.True(t, errors.As(err, &dbErrors), "error: %v", err)
+	assert.Equal(t, []string{"one"}, dbErrors.Failed)
+	assert.Contains(t, dbErrors.Results["one"].Error(), "no status for one")
+	assert.NoError(t, dbErrors.Results["two"])
+	assert.Len(t, fake.Matching("CREATE TABLE IF NOT EXISTS two.t1"), 1, "statements:\n%s", fake)
+	p.lock.Lock()
+	assert.Nil(t, p.lockHolder, "the driver is free")
+	p.lock.Unlock()
+}
+
+func TestUnlockRowUsesLockDB(t *testing.T) {
+	var statements []string
+	db := sql.OpenDB(lockingConnector{statements: &statements})
+	defer db.Close()
+	done := make(chan struct{})
+	close(done)
+	p := &MySQL{}
+	p.rowLock = &rowLock{db: db, table: "t_lock", owner: "me", stop: make(chan struct{}), done: done}
+
+	require.NoError(t, p.unlockRow())
+	require.Len(t, statements, 1)
+	assert.Contains(t, statements[0], "DELETE FROM t_lock")
+	assert.Nil(t, p.rowLock)
+}
+
+func TestParseEnumValues(t *testing.T) {
+	cases := []struct {
+		columnType string
+		want       []string
+		wantErr    bool
+	}{
+		{columnType: "enum('a','b')", want: []string{"a", "b"}},
+		{columnType: "ENUM('open')", want: []string{"open"}},
+		{columnType: "enum('it''s','a,b','(x)')", want: []string{"it's", "a,b", "(x)"}},
+		{columnType: `enum('back\\slash','new\nline','')`, want: []string{`back\slash`, "new\nline", ""}},
+		{columnType: "enum()", want: nil},
+		{columnType: "varchar(10)", wantErr: true},
+		{columnType: "enum('a'", wantErr: true},
+		{columnType: "enum('a)", wantErr: true},
+		{columnType: "enum('a' 'b')", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.columnType, func(t *testing.T) {
+			got, err := parseEnumValues(tc.columnType)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGenerateDatabaseName(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", DatabaseNameFromContext(ctx), "outside of a generator")
+	gen := Generate("T1", func(ctx context.Context, _ *sql.Tx) string {
+		return "CREATE TABLE IF NOT EXISTS " + DatabaseNameFromContext(ctx) + ".t1 (id int)"
+	}).(*mmigration)
+	d := &libschema.Database{Options: libschema.Options{SchemaOverride: "override"}}
+
+	p := &MySQL{}
+	script, err := p.generate(ctx, d, nil, gen)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS override.t1 (id int)", script, "SchemaOverride")
+
+	p.databaseName = "named"
+	script, err = p.generate(ctx, d, nil, gen)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS named.t1 (id int)", script, "WithDatabaseName")
+
+	WithUseSchema("other")(gen)
+	script, err = p.generate(ctx, d, nil, gen)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS other.t1 (id int)", script, "WithUseSchema")
+
+	script, err = p.generate(ctx, d, nil, Script("T2", "SELECT 1").(*mmigration))
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1", script, "Script")
+}
+
+func TestMigrationString(t *testing.T) {
+	m := Script("T1", "SELECT 1")
+	m.Base().Name.Library = "L1"
+	assert.Equal(t, "L1: T1 [script]", fmt.Sprint(m))
+
+	m = Computed("T2", func(context.Context, *sql.Tx) error { return nil }, WithUseSchema("other"), libschema.WithDedicatedConn())
+	m.Base().Name.Library = "L1"
+	assert.Equal(t, "L1: T2 [computed, useSchema=other, dedicatedConn]", fmt.Sprint(m))
+
+	m = Generate("T3", func(context.Context, *sql.Tx) string { return "" }, WithAllowUnboundedMutation())
+	m.Base().Name.Library = "L1"
+	assert.Equal(t, "L1: T3 [generate, allowUnboundedMutation]", m.(fmt.Stringer).String())
+}
+
+// recordingConn records queries and fails them
+type recordingConn struct {
+	blockingConn
+	queries *[]string
+}
+
+func (c recordingConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	*c.queries = append(*c.queries, query)
+	return nil, errors.New("recorded")
+}
+
+type recordingConnector struct{ queries *[]string }
+
+func (c recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{queries: c.queries}, nil
+}
+func (recordingConnector) Driver() driver.Driver { return nil }
+
+func TestHelperQueryPrefix(t *testing.T) {
+	var queries []string
+	db := sql.OpenDB(recordingConnector{queries: &queries})
+	defer db.Close()
+	p := &MySQL{db: db, databaseName: "test"}
+
+	_, _ = p.HasTable(context.Background(), nil, "users")
+	require.Len(t, queries, 1)
+	assert.False(t, strings.HasPrefix(queries[0], "/*"), "no prefix by default")
+
+	WithHelperQueryPrefix("/* hostgroup=10 */")(p)
+	_, _ = p.HasTable(context.Background(), nil, "users")
+	_, _ = p.PrimaryKeyColumns(context.Background(), nil, "users")
+	require.Len(t, queries, 3)
+	assert.True(t, strings.HasPrefix(queries[1], "/* hostgroup=10 */\n"), queries[1])
+	assert.True(t, strings.HasPrefix(queries[2], "/* hostgroup=10 */\n"), queries[2])
+}
+
+func TestParseAlter(t *testing.T) {
+	alter, err := ParseAlter("ALTER TABLE `app`.users\n" +
+		"\tADD COLUMN level decimal(10, 2) DEFAULT '1,5' COMMENT 'a, b',\n" +
+		"\tADD INDEX `level,idx` (level, id), -- why, not\n" +
+		"\tMODIFY name enum('a,b', 'c') /* x, y */;")
+	require.NoError(t, err)
+	assert.Equal(t, "app", alter.Database)
+	assert.Equal(t, "users", alter.Table)
+	assert.Equal(t, []string{
+		"ADD COLUMN level decimal(10, 2) DEFAULT '1,5' COMMENT 'a, b'",
+		"ADD INDEX `level,idx` (level, id)",
+		"-- why, not\n\tMODIFY name enum('a,b', 'c') /* x, y */",
+	}, alter.Clauses)
+
+	alter.Clauses = alter.Clauses[1:2]
+	assert.Equal(t, "ALTER TABLE `app`.`users`\n\tADD INDEX `level,idx` (level, id)", alter.String())
+	alter.Clauses = nil
+	assert.Equal(t, "", alter.String())
+
+	for _, bad := range []string{
+		"ALTER TABLE users ADD COLUMN a int,, ADD COLUMN b int",
+		"ALTER TABLE users ADD COLUMN a decimal(10, 2",
+		"ALTER TABLE users ADD COLUMN a int)",
+		"ALTER TABLE users ADD COLUMN a int; ALTER TABLE users ADD COLUMN b int",
+		"CREATE TABLE users (id int)",
+	} {
+		_, err := ParseAlter(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSQLRewriter(t *testing.T) {
+	p := &MySQL{}
+	script, err := p.rewriteScript("ALTER TABLE users ADD COLUMN level int")
+	require.NoError(t, err)
+	assert.Equal(t, "ALTER TABLE users ADD COLUMN level int", script)
+
+	WithSQLRewriter(func(script string) (string, error) {
+		if strings.Contains(script, "DROP") {
+			return "", errors.New("no drops")
+		}
+		return script + ", ALGORITHM=INPLACE, LOCK=NONE", nil
+	})(p)
+	script, err = p.rewriteScript("ALTER TABLE users ADD COLUMN level int")
+	require.NoError(t, err)
+	assert.Equal(t, "ALTER TABLE users ADD COLUMN level int, ALGORITHM=INPLACE, LOCK=NONE", script)
+
+	_, err = p.rewriteScript("ALTER TABLE users DROP COLUMN level")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no drops")
+	}
+}
+
+func TestCheckSeverity(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	pm := Script("T1", "").(*mmigration)
+	script := "CREATE TABLE x (id int); INSERT INTO x VALUES (1); DELETE FROM y"
+
+	p := &MySQL{}
+	err := p.checkMigration(log, pm, script, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "combines DDL")
+	}
+
+	WithCheckSeverity(map[CheckResult]Severity{
+		DataAndDDL:       SeverityWarn,
+		NonIdempotentDDL: SeverityIgnore,
+	})(p)
+	err = p.checkMigration(log, pm, script, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "without a WHERE clause", "unbounded mutation is still an error")
+	}
+
+	WithCheckSeverity(map[CheckResult]Severity{
+		DataAndDDL:        SeverityWarn,
+		NonIdempotentDDL:  SeverityIgnore,
+		UnboundedMutation: SeverityWarn,
+	})(p)
+	assert.NoError(t, p.checkMigration(log, pm, script, ""))
+}
+
+func TestCheckTrackingTableAccess(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	script := "DROP TABLE IF EXISTS libschema.tracking"
+	p := &MySQL{}
+
+	pm := Script("T1", script).(*mmigration)
+	assert.NoError(t, p.checkMigration(log, pm, script, ""), "no tracking table")
+	err := p.checkMigration(log, pm, script, "libschema.tracking")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "references the libschema tracking table")
+	}
+
+	pm = Script("T1", script, WithAllowTrackingTableAccess()).(*mmigration)
+	assert.NoError(t, p.checkMigration(log, pm, script, "libschema.tracking"))
+	assert.True(t, pm.Copy().(*mmigration).allowTracking)
+}
+
+// goneConn is a connection that the server has closed
+type goneConn struct{ blockingConn }
+
+func (goneConn) Begin() (driver.Tx, error) { return goneConn{}, nil }
+
+func (goneConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return nil, errors.New("server has gone away")
+}
+
+type goneConnector struct{}
+
+func (goneConnector) Connect(context.Context) (driver.Conn, error) { return goneConn{}, nil }
+func (goneConnector) Driver() driver.Driver                        { return nil }
+
+func TestLockKeepalive(t *testing.T) {
+	db := sql.OpenDB(goneConnector{})
+	defer db.Close()
+	p := &MySQL{db: db, lockStr: "libschema_test"}
+	WithLockKeepalive(time.Millisecond)(p)
+
+	conn, err := db.Conn(context.Background())
+	require.NoError(t, err)
+	p.holdAdvisoryLock(libschema.LogFromLog(t), conn)
+	require.Eventually(t, func() bool {
+		return p.lockLostError() != nil
+	}, 5*time.Second, time.Millisecond)
+
+	_, err = p.DoOneMigration(context.Background(), libschema.LogFromLog(t), nil, Script("T1", "CREATE TABLE x (id int)"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "lock is lost")
+	}
+	err = p.UnlockMigrationsTable(libschema.LogFromLog(t))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "lock is lost")
+	}
+	assert.Nil(t, p.lockConn)
+}
+
+func TestCheckMigrationScript(t *testing.T) {
+	log := libschema.LogFromLog(t)
+	d := &libschema.Database{Options: libschema.Options{TrackingTable: "libschema.tracking"}}
+	p := &MySQL{}
+	p.trackingSchemaTable = p.defaultTrackingSchemaTable
+
+	err := p.CheckMigrationScript(log, d, Script("T1", ""), "DROP TABLE IF EXISTS libschema.tracking")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "references the libschema tracking table")
+	}
+	err = p.CheckMigrationScript(log, d, Script("T2", ""), "DELETE FROM users")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "without a WHERE clause")
+	}
+	assert.NoError(t, p.CheckMigrationScript(log, d, Script("T3", "", WithAllowUnboundedMutation()), "DELETE FROM users"))
+}
+
+func TestBackupTableNames(t *testing.T) {
+	at := time.Date(2024, 3, 5, 7, 8, 9, 0, time.UTC)
+	assert.Equal(t, "users_bak_20240305070809", backupTableName("users", at))
+	assert.Equal(t, "users_bak_20240305070809", backupTableName("users", at.In(time.FixedZone("east", 3600))), "UTC")
+
+	assert.True(t, validBackupTable("users"))
+	assert.True(t, validBackupTable("app.users"))
+	assert.True(t, validBackupTable(strings.Repeat("u", maxBackupSourceLength)))
+	assert.False(t, validBackupTable(strings.Repeat("u", maxBackupSourceLength+1)), "backup name would be too long")
+	assert.False(t, validBackupTable("users; DROP TABLE x"))
+	assert.Equal(t, 64, len(backupTableName(strings.Repeat("u", maxBackupSourceLength), at)))
+
+	p := &MySQL{}
+	d := &libschema.Database{}
+	m := Script("T1", "DELETE FROM users WHERE id = 1", WithBackupTables("users"), WithBackupTables("app.accounts"))
+	assert.NoError(t, p.IsMigrationSupported(d, libschema.LogFromLog(t), m))
+	assert.Equal(t, []string{"users", "app.accounts"}, m.Copy().(*mmigration).backup)
+	assert.Contains(t, fmt.Sprint(m), "backup=users,app.accounts")
+
+	m = Script("T2", "DELETE FROM users WHERE id = 1", WithBackupTables("users`"))
+	err := p.IsMigrationSupported(d, libschema.LogFromLog(t), m)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "for WithBackupTables")
+	}
+}
@@ -0,0 +1,69 @@
+package lsmysql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Upsert builds an INSERT ... ON DUPLICATE KEY UPDATE statement and its
+// argument list.  It is meant for seeding reference data from a Computed()
+// migration in a way that is idempotent:
+//
+//	lsmysql.Computed("seedColors", func(ctx context.Context, tx *sql.Tx) error {
+//		q, args := lsmysql.Upsert("colors", []string{"id"}, map[string]interface{}{
+//			"id":   1,
+//			"name": "red",
+//		})
+//		_, err := tx.ExecContext(ctx, q, args...)
+//		return err
+//	})
+//
+// cols holds all the values to insert, including the values for the keys.
+// keys are the columns of the unique key that identifies the row.  When the row
+// already exists, the non-key columns are updated.  Columns are emitted in
+// sorted order so the generated SQL is deterministic.  The table and the column
+// names must be simple identifiers.  Since the arguments are expected to be
+// constants in the migration code, Upsert panics if they are not valid.
+func Upsert(table string, keys []string, cols map[string]interface{}) (string, []interface{}) {
+	if !validTableReference(table) {
+		panic(errors.Errorf("Upsert table name must be a simple identifier, not '%s'", table))
+	}
+	if len(keys) == 0 {
+		panic(errors.Errorf("Upsert into %s requires at least one key column", table))
+	}
+	isKey := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := cols[key]; !ok {
+			panic(errors.Errorf("Upsert into %s: key column '%s' has no value", table, key))
+		}
+		isKey[key] = true
+	}
+	names := make([]string, 0, len(cols))
+	for name := range cols {
+		if !simpleIdentifierRE.MatchString(name) {
+			panic(errors.Errorf("Upsert into %s: column name must be a simple identifier, not '%s'", table, name))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]interface{}, len(names))
+	placeholders := make([]string, len(names))
+	var updates []string
+	for i, name := range names {
+		args[i] = cols[name]
+		placeholders[i] = "?"
+		if !isKey[name] {
+			updates = append(updates, name+" = VALUES("+name+")")
+		}
+	}
+	if len(updates) == 0 {
+		// every column is part of the key: nothing to update
+		updates = append(updates, keys[0]+" = "+keys[0])
+	}
+	q := "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ")" +
+		" VALUES (" + strings.Join(placeholders, ", ") + ")" +
+		" ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	return q, args
+}
@@ -0,0 +1,39 @@
+package lsmysql_test
+
+import (
+	"testing"
+
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsert(t *testing.T) {
+	q, args := lsmysql.Upsert("colors", []string{"id"}, map[string]interface{}{
+		"name": "red",
+		"id":   1,
+		"hex":  "#f00",
+	})
+	assert.Equal(t, "INSERT INTO colors (hex, id, name) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE hex = VALUES(hex), name = VALUES(name)", q)
+	assert.Equal(t, []interface{}{"#f00", 1, "red"}, args)
+
+	q, args = lsmysql.Upsert("app.tags", []string{"a", "b"}, map[string]interface{}{
+		"a": 1,
+		"b": 2,
+	})
+	assert.Equal(t, "INSERT INTO app.tags (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE a = a", q)
+	assert.Equal(t, []interface{}{1, 2}, args)
+
+	assert.Panics(t, func() {
+		lsmysql.Upsert("colors; DROP TABLE x", []string{"id"}, map[string]interface{}{"id": 1})
+	}, "bad table")
+	assert.Panics(t, func() {
+		lsmysql.Upsert("colors", []string{"id"}, map[string]interface{}{"id": 1, "na-me": 2})
+	}, "bad column")
+	assert.Panics(t, func() {
+		lsmysql.Upsert("colors", []string{"id"}, map[string]interface{}{"name": 2})
+	}, "missing key")
+	assert.Panics(t, func() {
+		lsmysql.Upsert("colors", nil, map[string]interface{}{"name": 2})
+	}, "no keys")
+}
@@ -0,0 +1,220 @@
+package lsoracle
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+type token struct {
+	word      string // upper case, empty for punctuation
+	depth     int    // parenthesis depth
+	semicolon bool
+}
+
+// tokenize breaks an Oracle script into words, parenthesis depth, and
+// semicolons.  Comments, string literals (including q'[...]' quoting),
+// and quoted identifiers are dropped.  A "/" on a line by itself (the
+// SQL*Plus terminator) is dropped too.
+func tokenize(s string) []token {
+	var tokens []token
+	var depth int
+	lineStart := true
+	r := []rune(s)
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == '\n':
+			lineStart = true
+			continue
+		case unicode.IsSpace(c):
+			continue
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+			i--
+			continue
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			for i += 2; i+1 < len(r) && !(r[i] == '*' && r[i+1] == '/'); i++ {
+			}
+			i++
+		case c == '/' && lineStart && restOfLineBlank(r[i+1:]):
+		case c == '\'':
+			i = skipString(r, i)
+		case c == '"':
+			for i++; i < len(r) && r[i] != '"'; i++ {
+			}
+			tokens = append(tokens, token{depth: depth})
+		case (c == 'q' || c == 'Q') && i+2 < len(r) && r[i+1] == '\'':
+			i = skipQuoted(r, i+2)
+		case (c == 'n' || c == 'N') && i+3 < len(r) && (r[i+1] == 'q' || r[i+1] == 'Q') && r[i+2] == '\'':
+			i = skipQuoted(r, i+3)
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ';':
+			tokens = append(tokens, token{depth: depth, semicolon: true})
+		case isWordRune(c):
+			start := i
+			for i+1 < len(r) && isWordRune(r[i+1]) {
+				i++
+			}
+			tokens = append(tokens, token{word: strings.ToUpper(string(r[start : i+1])), depth: depth})
+		}
+		lineStart = false
+	}
+	return tokens
+}
+
+func isWordRune(c rune) bool {
+	return c == '_' || c == '$' || c == '#' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func restOfLineBlank(r []rune) bool {
+	for _, c := range r {
+		if c == '\n' {
+			return true
+		}
+		if !unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipString returns the index of the quote that ends the string that
+// starts at r[i].  Doubled quotes are part of the string.
+func skipString(r []rune, i int) int {
+	for i++; i < len(r); i++ {
+		if r[i] != '\'' {
+			continue
+		}
+		if i+1 < len(r) && r[i+1] == '\'' {
+			i++
+			continue
+		}
+		return i
+	}
+	return i
+}
+
+// skipQuoted returns the index of the quote that ends a q'[...]' string
+// whose delimiter is r[i].
+func skipQuoted(r []rune, i int) int {
+	closing := r[i]
+	switch closing {
+	case '[':
+		closing = ']'
+	case '{':
+		closing = '}'
+	case '<':
+		closing = '>'
+	case '(':
+		closing = ')'
+	}
+	for i++; i+1 < len(r); i++ {
+		if r[i] == closing && r[i+1] == '\'' {
+			return i + 1
+		}
+	}
+	return len(r)
+}
+
+// plsqlUnits can follow CREATE [OR REPLACE] [EDITIONABLE|NONEDITIONABLE]
+// and are followed by PL/SQL
+var plsqlUnits = map[string]bool{
+	"PROCEDURE": true,
+	"FUNCTION":  true,
+	"PACKAGE":   true,
+	"TRIGGER":   true,
+	"TYPE":      true,
+}
+
+// checkScript checks an Oracle Script() or Generate() migration.  Since
+// each migration is a single statement or PL/SQL block, the checks are
+// simpler than lsmysql.CheckScriptError: PL/SQL blocks are not checked
+// at all, and a single statement is checked for non-idempotent DDL
+// (unless hasSkipIf), ALTER SESSION (unless dedicatedConn), and UPDATE or
+// DELETE without a WHERE clause (unless allowUnbounded).
+func checkScript(script string, hasSkipIf bool, dedicatedConn bool, allowUnbounded bool) error {
+	tokens := tokenize(script)
+	var words []string
+	for _, t := range tokens {
+		if t.word != "" {
+			words = append(words, t.word)
+		}
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	first := words[0]
+	if first == "BEGIN" || first == "DECLARE" {
+		return nil
+	}
+	next := func(i int) string {
+		if i < len(words) {
+			return words[i]
+		}
+		return ""
+	}
+	if first == "CREATE" {
+		i := 1
+		if next(i) == "OR" && next(i+1) == "REPLACE" {
+			i += 2
+		}
+		if next(i) == "EDITIONABLE" || next(i) == "NONEDITIONABLE" {
+			i++
+		}
+		if plsqlUnits[next(i)] {
+			return nil
+		}
+	}
+	for i, t := range tokens {
+		if t.semicolon && t.depth == 0 && i+1 < len(tokens) {
+			return errors.Errorf("Migration has more than one statement (after %s): Oracle runs one statement per migration, use a PL/SQL block", first)
+		}
+	}
+	has := func(want ...string) bool {
+		for i := range words {
+			match := true
+			for j, w := range want {
+				if next(i+j) != w {
+					match = false
+					break
+				}
+			}
+			if match {
+				return true
+			}
+		}
+		return false
+	}
+	switch first {
+	case "CREATE", "ALTER", "DROP", "RENAME":
+		switch {
+		case first == "ALTER" && next(1) == "SESSION":
+			if !dedicatedConn {
+				return errors.Errorf("Migration changes the connection state (which leaks into the connection pool) with ALTER SESSION: use libschema.WithDedicatedConn()")
+			}
+		case hasSkipIf:
+		case first == "CREATE" && next(1) == "OR" && next(2) == "REPLACE":
+		case has("IF", "NOT", "EXISTS"), first != "CREATE" && has("IF", "EXISTS"):
+		default:
+			return errors.Errorf("Unconditional migration has non-idempotent DDL (Data Definition Language [schema changes]) in %s %s", first, next(1))
+		}
+	case "UPDATE", "DELETE":
+		if allowUnbounded {
+			return nil
+		}
+		for _, t := range tokens {
+			if t.word == "WHERE" && t.depth == 0 {
+				return nil
+			}
+		}
+		return errors.Errorf("Migration has an UPDATE or DELETE without a WHERE clause in %s: use WithAllowUnboundedMutation() if that is intended", first)
+	}
+	return nil
+}
@@ -0,0 +1,514 @@
+// Package lsoracle has a libschema.Driver support Oracle
+package lsoracle
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// Oracle is a libschema.Driver for connecting to Oracle databases.  It
+// uses only database/sql so it should work with either
+// github.com/godror/godror or github.com/sijms/go-ora.
+//
+// Oracle databases have the following characteristics:
+// * CANNOT do DDL commands inside transactions
+// * Support UPSERT using MERGE INTO
+// * No boolean column type (NUMBER(1) is used instead)
+// * Locks are available with DBMS_LOCK
+// * Only one statement can be executed per Exec()
+//
+// Because Oracle DDL commands cause transactions to autocommit, tracking the schema changes in
+// a secondary table (like libschema does) is inherently unsafe.  The Oracle driver will
+// record if a migration attempt succeeds or fails, but if the program terminates mid-transaction,
+// it is beyond the scope of libschema to determine if the transaction succeeded or failed.
+// Such transactions will be retried.  For this reason, DDL commands should be written such
+// that they are idempotent.  Scripts that are not PL/SQL blocks are checked for non-idempotent
+// DDL and since Oracle (before 23c) does not support IF NOT EXISTS, most DDL will need a SkipIf.
+//
+// Each Script() or Generate() migration must be a single statement or a single
+// PL/SQL block.
+//
+// Schemas in Oracle are users.  libschema will not create the schema used for the
+// tracking table: it must already exist.  The default tracking table,
+// libschema.migration_status, requires a LIBSCHEMA user.  Set Options.TrackingTable
+// to a table name without a schema to put the tracking table in the current schema.
+type Oracle struct {
+	lockConn *sql.Conn
+	lockStr  string
+	lock     sync.Mutex
+}
+
+// New creates a libschema.Database with an Oracle driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (*libschema.Database, *Oracle, error) {
+	o := &Oracle{}
+	d, err := schema.NewDatabase(log, name, db, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, o, nil
+}
+
+type omigration struct {
+	libschema.MigrationBase
+	sqlText        string // set by Script()
+	script         func(context.Context, *sql.Tx) string
+	computed       func(context.Context, *sql.Tx) error
+	allowUnbounded bool
+}
+
+func (m *omigration) Copy() libschema.Migration {
+	return &omigration{
+		MigrationBase:  m.MigrationBase.Copy(),
+		sqlText:        m.sqlText,
+		script:         m.script,
+		computed:       m.computed,
+		allowUnbounded: m.allowUnbounded,
+	}
+}
+
+func (m *omigration) Base() *libschema.MigrationBase {
+	return &m.MigrationBase
+}
+
+// String describes the migration for logs and test failures
+func (m *omigration) String() string {
+	var details []string
+	switch {
+	case m.computed != nil:
+		details = append(details, "computed")
+	case m.sqlText != "":
+		details = append(details, "script")
+	default:
+		details = append(details, "generate")
+	}
+	if m.allowUnbounded {
+		details = append(details, "allowUnboundedMutation")
+	}
+	return m.Describe(details...)
+}
+
+// WithAllowUnboundedMutation allows a Script or Generate migration to
+// have UPDATE or DELETE statements without a WHERE clause.  Without it,
+// such migrations fail.
+func WithAllowUnboundedMutation() libschema.MigrationOption {
+	return func(m libschema.Migration) {
+		if pm, ok := m.(*omigration); ok {
+			pm.allowUnbounded = true
+		}
+	}
+}
+
+// Script creates a libschema.Migration from a SQL string
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := Generate(name, func(_ context.Context, _ *sql.Tx) string {
+		return sqlText
+	}, opts...)
+	m.(*omigration).sqlText = sqlText
+	return m
+}
+
+// Generate creates a libschema.Migration from a function that returns a SQL string
+func Generate(
+	name string,
+	generator func(context.Context, *sql.Tx) string,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return omigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		script: generator,
+	}.applyOpts(opts)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return omigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		computed: action,
+	}.applyOpts(opts)
+}
+
+func (m omigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
+	lsm := libschema.Migration(&m)
+	for _, opt := range opts {
+		opt(lsm)
+	}
+	return lsm
+}
+
+// DoOneMigration applies a single migration.
+// It is expected to be called by libschema.
+func (p *Oracle) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (result sql.Result, err error) {
+	defer func() {
+		if err == nil {
+			m.Base().SetStatus(libschema.MigrationStatus{
+				Done: true,
+			})
+		}
+	}()
+	conn, release, err := d.DedicatedConn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var tx *sql.Tx
+	if conn != nil {
+		tx, err = conn.BeginTx(ctx, d.TxOptions(m))
+	} else {
+		tx, err = d.BeginTx(ctx, m)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = errors.Wrapf(tx.Commit(), "Commit migration %s", m.Base().Name)
+		}
+	}()
+	if d.Options.SchemaOverride != "" {
+		if !simpleIdentifierRE.MatchString(d.Options.SchemaOverride) {
+			return nil, errors.Errorf("Options.SchemaOverride must be a simple identifier, not '%s'", d.Options.SchemaOverride)
+		}
+		_, err := tx.ExecContext(ctx, `ALTER SESSION SET CURRENT_SCHEMA = `+d.Options.SchemaOverride)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Set current schema to %s for %s", d.Options.SchemaOverride, m.Base().Name)
+		}
+	}
+	pm := m.(*omigration)
+	var skip bool
+	skip, err = m.Base().SkipIfTx(ctx, tx)
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	case pm.script != nil:
+		script := pm.script(ctx, tx)
+		err = checkScript(script, m.Base().HasSkipIf(), m.Base().HasDedicatedConn(), pm.allowUnbounded)
+		if err == nil {
+			result, err = tx.ExecContext(ctx, script)
+		}
+		err = errors.Wrap(err, script)
+	default:
+		err = libschema.ComputedResult(ctx, log, m.Base().Name, pm.computed(ctx, tx))
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		_ = tx.Rollback()
+		if d.Options.WithoutFailureStatus {
+			return nil, err
+		}
+		release()
+		return nil, p.saveFailure(ctx, log, d, m, err)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil)
+	return
+}
+
+// saveFailure records a failed migration.  The migration transaction
+// has been rolled back so the status is saved in a transaction of its own.
+func (p *Oracle) saveFailure(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error) error {
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, false, migrationError)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
+}
+
+// CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
+// The schema (user) that holds the tracking table must already exist.
+// It is expected to be called by libschema.
+func (p *Oracle) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	_, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	// ORA-00955: name is already used by an existing object
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		BEGIN
+			EXECUTE IMMEDIATE '
+				CREATE TABLE %s (
+					library		VARCHAR2(255) NOT NULL,
+					migration	VARCHAR2(255) NOT NULL,
+					done		NUMBER(1) NOT NULL,
+					error		CLOB,
+					applied_by	VARCHAR2(255),
+					run_id		VARCHAR2(255),
+					"COMMENT"	VARCHAR2(4000),
+					updated_at	TIMESTAMP WITH TIME ZONE DEFAULT SYSTIMESTAMP,
+					PRIMARY KEY	(library, migration)
+				)';
+		EXCEPTION
+			WHEN OTHERS THEN
+				IF SQLCODE != -955 THEN
+					RAISE;
+				END IF;
+		END;`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Oracle) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	_, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	// ORA-00942: table or view does not exist
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		BEGIN
+			EXECUTE IMMEDIATE 'DROP TABLE %s';
+		EXCEPTION
+			WHEN OTHERS THEN
+				IF SQLCODE != -942 THEN
+					RAISE;
+				END IF;
+		END;`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+var simpleIdentifierRE = regexp.MustCompile(`\A[A-Za-z][A-Za-z0-9_$#]*\z`)
+
+// Identifiers are left unquoted so that Oracle will treat them as
+// case-insensitive (upper case).
+func trackingSchemaTable(d *libschema.Database) (string, string, error) {
+	tableName := d.Options.TrackingTable
+	s := strings.Split(tableName, ".")
+	switch len(s) {
+	case 2:
+		schema := s[0]
+		if !simpleIdentifierRE.MatchString(schema) {
+			return "", "", errors.Errorf("Tracking table schema name must be a simple identifier, not '%s'", schema)
+		}
+		table := s[1]
+		if !simpleIdentifierRE.MatchString(table) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", table)
+		}
+		return schema, schema + "." + table, nil
+	case 1:
+		if !simpleIdentifierRE.MatchString(tableName) {
+			return "", "", errors.Errorf("Tracking table table name must be a simple identifier, not '%s'", tableName)
+		}
+		return "", tableName, nil
+	default:
+		return "", "", errors.Errorf("Tracking table '%s' is not valid", tableName)
+	}
+}
+
+// trackingTable returns the schema+table reference for the migration tracking table.
+func trackingTable(d *libschema.Database) string {
+	_, table, _ := trackingSchemaTable(d)
+	return table
+}
+
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.ColonPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			MERGE INTO %s t
+			USING (SELECT %s AS library, %s AS migration, %s AS done, TO_CLOB(%s) AS error, %s AS applied_by, %s AS run_id, %s AS "COMMENT" FROM dual) s
+			ON (t.library = s.library AND t.migration = s.migration)
+			WHEN MATCHED THEN UPDATE
+				SET	t.done = s.done,
+					t.error = s.error,
+					t.applied_by = s.applied_by,
+					t.run_id = s.run_id,
+					t."COMMENT" = s."COMMENT",
+					t.updated_at = SYSTIMESTAMP
+			WHEN NOT MATCHED THEN
+				INSERT (library, migration, done, error, applied_by, run_id, "COMMENT", updated_at)
+				VALUES (s.library, s.migration, s.done, s.error, s.applied_by, s.run_id, s."COMMENT", SYSTIMESTAMP)`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+	DoneValue: func(done bool) interface{} {
+		return boolToNumber(done)
+	},
+}
+
+func (p *Oracle) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	return statusSaver.Save(ctx, log, tx, d, trackingTable(d), m, done, migrationError)
+}
+
+func boolToNumber(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *Oracle) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.SetMigrationStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *Oracle) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// LockMigrationsTable locks the migration tracking table for exclusive use by the
+// migrations running now.
+// It is expected to be called by libschema.
+//
+// DBMS_LOCK.ALLOCATE_UNIQUE commits so the lock is held on a dedicated
+// connection rather than inside a transaction.  The lock is not released
+// on commit.  The connection user must have EXECUTE on DBMS_LOCK.
+func (p *Oracle) LockMigrationsTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if p.lockConn != nil {
+		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
+	}
+	conn, err := d.DB().Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Could not get connection for lock")
+	}
+	p.lockStr = "libschema_" + tableName
+	var status int
+	_, err = conn.ExecContext(ctx, `
+		DECLARE
+			handle VARCHAR2(128);
+		BEGIN
+			DBMS_LOCK.ALLOCATE_UNIQUE(:1, handle);
+			:2 := DBMS_LOCK.REQUEST(handle, DBMS_LOCK.X_MODE, DBMS_LOCK.MAXWAIT, FALSE);
+		END;`, p.lockStr, sql.Out{Dest: &status})
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrapf(err, "Could not get lock for libschema migrations")
+	}
+	// 0 is success, 4 is already owned by this session
+	if status != 0 && status != 4 {
+		_ = conn.Close()
+		return errors.Errorf("Could not get lock for libschema migrations, DBMS_LOCK.REQUEST returned %d", status)
+	}
+	p.lockConn = conn
+	return nil
+}
+
+// UnlockMigrationsTable unlocks the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Oracle) UnlockMigrationsTable(_ *internal.Log) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.lockConn == nil {
+		return errors.Errorf("libschema migrations table, not locked")
+	}
+	defer func() {
+		_ = p.lockConn.Close()
+		p.lockConn = nil
+	}()
+	var status int
+	_, err := p.lockConn.ExecContext(context.Background(), `
+		DECLARE
+			handle VARCHAR2(128);
+		BEGIN
+			DBMS_LOCK.ALLOCATE_UNIQUE(:1, handle);
+			:2 := DBMS_LOCK.RELEASE(handle);
+		END;`, p.lockStr, sql.Out{Dest: &status})
+	if err != nil {
+		return errors.Wrap(err, "Could not release explicit lock for schema migrations")
+	}
+	if status != 0 {
+		return errors.Errorf("Could not release explicit lock for schema migrations, DBMS_LOCK.RELEASE returned %d", status)
+	}
+	return nil
+}
+
+// LoadStatus loads the current status of all migrations from the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Oracle) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	tableName := trackingTable(d)
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s`, tableName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	defer rows.Close()
+	var unknowns []libschema.MigrationName
+	for rows.Next() {
+		var (
+			name   libschema.MigrationName
+			done   int
+			estr   sql.NullString
+			status libschema.MigrationStatus
+		)
+		err := rows.Scan(&name.Library, &name.Name, &done, &estr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot scan migration status")
+		}
+		status.Done = done != 0
+		status.Error = estr.String
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(status)
+		} else if status.Done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+// IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
+// should always return nil.
+// It is expected to be called by libschema.
+func (p *Oracle) IsMigrationSupported(d *libschema.Database, _ *internal.Log, migration libschema.Migration) error {
+	m, ok := migration.(*omigration)
+	if !ok {
+		return fmt.Errorf("Non-oracle migration %s registered with oracle migrations", migration.Base().Name)
+	}
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
+	}
+	return d.ValidateMigration(m, m.sqlText)
+}
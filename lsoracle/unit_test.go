@@ -0,0 +1,198 @@
+package lsoracle
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const statusQuery = "SELECT library, migration, done, error FROM libschema.migration_status"
+
+// fakeOracle grants the DBMS_LOCK requests, answers the status query, and
+// fails the statement fail
+func fakeOracle(status [][]driver.Value, fail string) *fakesql.DB {
+	return &fakesql.DB{
+		Respond: func(query string, args []driver.Value) (*fakesql.Rows, error) {
+			switch {
+			case strings.HasPrefix(query, "DECLARE handle"):
+				*args[1].(sql.Out).Dest.(*int) = 0
+			case query == statusQuery:
+				return &fakesql.Rows{
+					Columns: []string{"library", "migration", "done", "error"},
+					Values:  status,
+				}, nil
+			case query == fail:
+				return nil, errors.New("ORA-00001: unique constraint violated")
+			}
+			return nil, nil
+		},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	fake := fakesql.Scenario{
+		StatusQuery: statusQuery,
+		SaveStatus:  "MERGE INTO libschema.migration_status",
+		True:        int64(1),
+		False:       int64(0),
+		Failure:     errors.New("ORA-00001: unique constraint violated"),
+		Respond:     fakeOracle(nil, "").Respond,
+		New: func(log *internal.Log, s *libschema.Schema, db *sql.DB) (*libschema.Database, libschema.Driver, error) {
+			return New(log, "test", s, db)
+		},
+		Script: Script,
+		// one for the lock and one for the migrations
+		Pool: 2,
+	}.Run(t)
+
+	assert.True(t, fake.Sequence(
+		"DECLARE handle VARCHAR2(128); BEGIN DBMS_LOCK.ALLOCATE_UNIQUE(:1, handle); :2 := DBMS_LOCK.REQUEST",
+		statusQuery,
+		"BEGIN", "INSERT INTO t2", "MERGE INTO libschema.migration_status", "COMMIT",
+		"BEGIN", "INSERT INTO t3", "ROLLBACK",
+		"BEGIN", "MERGE INTO libschema.migration_status", "COMMIT",
+		"DECLARE handle VARCHAR2(128); BEGIN DBMS_LOCK.ALLOCATE_UNIQUE(:1, handle); :2 := DBMS_LOCK.RELEASE",
+	), "statements:\n%s", fake)
+	saved := fake.Matching("MERGE INTO libschema.migration_status")
+	require.Len(t, saved, 2)
+	assert.Contains(t, saved[1].Query, "USING (SELECT :1 AS library, :2 AS migration, :3 AS done, TO_CLOB(:4) AS error", "errors with the script can be longer than VARCHAR2")
+	assert.Contains(t, saved[1].Query, "WHEN MATCHED THEN UPDATE SET t.done = s.done, t.error = s.error")
+	assert.Contains(t, saved[1].Query, "WHEN NOT MATCHED THEN INSERT")
+}
+
+func TestNonIdempotentDDL(t *testing.T) {
+	fake := fakeOracle(nil, "")
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	s := libschema.New(ctx, libschema.Options{})
+	dbase, _, err := New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L", Script("T1", `CREATE TABLE t1 (id NUMBER)`))
+
+	err = s.Migrate(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "non-idempotent")
+	assert.Empty(t, fake.Matching("CREATE TABLE t1"), "not run")
+	saved := fake.Matching("MERGE INTO libschema.migration_status")
+	require.Len(t, saved, 1)
+	assert.Equal(t, []driver.Value{"L", "T1", int64(0)}, saved[0].Args[:3])
+}
+
+func TestUnboundedMutation(t *testing.T) {
+	fake := fakeOracle(nil, "")
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	s := libschema.New(ctx, libschema.Options{})
+	dbase, _, err := New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L",
+		Script("T1", `DELETE FROM t1`, WithAllowUnboundedMutation()),
+		Script("T2", `UPDATE t2 SET x = 1`),
+	)
+
+	err = s.Migrate(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "without a WHERE clause")
+	assert.Len(t, fake.Matching("DELETE FROM t1"), 1, "allowed")
+	assert.Empty(t, fake.Matching("UPDATE t2"), "not run")
+}
+
+func TestCheckScript(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"insert", `INSERT INTO t (id) VALUES (1)`, ""},
+		{"create", `CREATE TABLE t (id NUMBER)`, "non-idempotent"},
+		{"create if not exists", `CREATE TABLE IF NOT EXISTS t (id NUMBER)`, ""},
+		{"drop if exists", `DROP TABLE t IF EXISTS`, ""},
+		{"create or replace", `CREATE OR REPLACE VIEW v AS SELECT 1 AS x FROM dual`, ""},
+		{"alter", `ALTER TABLE t ADD (x NUMBER)`, "non-idempotent"},
+		{"alter session", `ALTER SESSION SET NLS_DATE_FORMAT = 'YYYY-MM-DD'`, "ALTER SESSION"},
+		{"update", `UPDATE t SET x = (SELECT y FROM u WHERE u.id = t.id)`, "without a WHERE clause"},
+		{"update where", `UPDATE t SET x = 1 WHERE id = 2`, ""},
+		{"delete", `DELETE FROM t`, "without a WHERE clause"},
+		{"where in q quote", `UPDATE t SET x = q'[it's WHERE]'`, "without a WHERE clause"},
+		{"where in comment", "DELETE FROM t -- WHERE id = 1\n", "without a WHERE clause"},
+		{"q quote semicolon", `INSERT INTO t (s) VALUES (q'{a; DROP TABLE t}')`, ""},
+		{"terminator", "INSERT INTO t (id) VALUES (1);\n/\n", ""},
+		{"two statements", `INSERT INTO t (id) VALUES (1); INSERT INTO t (id) VALUES (2)`, "more than one statement"},
+		{"plsql", `BEGIN EXECUTE IMMEDIATE 'CREATE TABLE t (id NUMBER)'; DELETE FROM u; END;`, ""},
+		{"declare", "DECLARE n NUMBER; BEGIN SELECT 1 INTO n FROM dual; END;\n/", ""},
+		{"procedure", `CREATE OR REPLACE PROCEDURE p AS BEGIN DELETE FROM t; END;`, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkScript(tc.script, false, false, false)
+			if tc.want == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.want)
+			}
+		})
+	}
+	assert.NoError(t, checkScript(`CREATE TABLE t (id NUMBER)`, true, false, false), "SkipIf")
+	assert.NoError(t, checkScript(`ALTER SESSION SET CURRENT_SCHEMA = x`, false, true, false), "dedicated connection")
+	assert.NoError(t, checkScript(`DELETE FROM t`, false, false, true), "allowed")
+}
+
+func TestLock(t *testing.T) {
+	requestStatus := 4 // already owned by this session
+	fake := &fakesql.DB{
+		Respond: func(query string, args []driver.Value) (*fakesql.Rows, error) {
+			switch {
+			case strings.Contains(query, "DBMS_LOCK.REQUEST"):
+				*args[1].(sql.Out).Dest.(*int) = requestStatus
+			case strings.Contains(query, "DBMS_LOCK.RELEASE"):
+				*args[1].(sql.Out).Dest.(*int) = 0
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(ctx, libschema.Options{})
+	d, p, err := New(log, "test", s, db)
+	require.NoError(t, err)
+
+	fakesql.CheckLocking(t,
+		func() error { return p.LockMigrationsTable(ctx, log, d) },
+		func() error { return p.UnlockMigrationsTable(log) })
+	assert.Equal(t, "libschema_libschema.migration_status", fake.Statements()[0].Args[0], "lock name")
+	assert.Len(t, fake.Matching("DECLARE handle VARCHAR2(128); BEGIN DBMS_LOCK.ALLOCATE_UNIQUE(:1, handle); :2 := DBMS_LOCK.RELEASE"), 2)
+	assert.Equal(t, 0, db.Stats().InUse, "unlock returns the connection")
+
+	require.NoError(t, p.LockMigrationsTable(ctx, log, d))
+	assert.Equal(t, 1, db.Stats().InUse, "the lock holds a connection")
+	require.NoError(t, p.UnlockMigrationsTable(log))
+
+	requestStatus = 1 // timeout
+	err = p.LockMigrationsTable(ctx, log, d)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "returned 1")
+	}
+	assert.Equal(t, 0, db.Stats().InUse, "failed lock returns the connection")
+}
+
+func TestBoolToNumber(t *testing.T) {
+	assert.Equal(t, 1, boolToNumber(true))
+	assert.Equal(t, 0, boolToNumber(false))
+}
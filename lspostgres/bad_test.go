@@ -88,6 +88,16 @@ func TestBadMigrationsPostgres(t *testing.T) {
 				dbase.Migrations("L2", lspostgres.Script("T5", `CREATE TABLE T2 (id text)`))
 			},
 		},
+		{
+			name:  "duplicate migration",
+			error: `library 'L2' has duplicate migration names: 'T4'`,
+			define: func(dbase *libschema.Database) {
+				dbase.Migrations("L2",
+					lspostgres.Script("T4", `CREATE TABLE T1 (id text)`),
+					lspostgres.Script("T4", `CREATE TABLE T2 (id text)`),
+				)
+			},
+		},
 		{
 			name:  "bad table",
 			error: `Tracking table 'foo.bar.baz' is not valid`,
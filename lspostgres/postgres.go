@@ -4,6 +4,7 @@ package lspostgres
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"strings"
 
@@ -29,6 +30,7 @@ func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (
 
 type pmigration struct {
 	libschema.MigrationBase
+	sqlText  string // set by Script()
 	script   func(context.Context, *sql.Tx) string
 	computed func(context.Context, *sql.Tx) error
 }
@@ -36,6 +38,7 @@ type pmigration struct {
 func (m *pmigration) Copy() libschema.Migration {
 	return &pmigration{
 		MigrationBase: m.MigrationBase.Copy(),
+		sqlText:       m.sqlText,
 		script:        m.script,
 		computed:      m.computed,
 	}
@@ -45,11 +48,25 @@ func (m *pmigration) Base() *libschema.MigrationBase {
 	return &m.MigrationBase
 }
 
+// String describes the migration for logs and test failures
+func (m *pmigration) String() string {
+	switch {
+	case m.computed != nil:
+		return m.Describe("computed")
+	case m.sqlText != "":
+		return m.Describe("script")
+	default:
+		return m.Describe("generate")
+	}
+}
+
 // Script creates a libschema.Migration from a SQL string
 func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
-	return Generate(name, func(_ context.Context, _ *sql.Tx) string {
+	m := Generate(name, func(_ context.Context, _ *sql.Tx) string {
 		return sqlText
 	}, opts...)
+	m.(*pmigration).sqlText = sqlText
+	return m
 }
 
 // Generate creates a libschema.Migration from a function that returns a
@@ -102,7 +119,17 @@ func (p *Postgres) DoOneMigration(ctx context.Context, log *internal.Log, d *lib
 			})
 		}
 	}()
-	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	conn, release, err := d.DedicatedConn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var tx *sql.Tx
+	if conn != nil {
+		tx, err = conn.BeginTx(ctx, d.TxOptions(m))
+	} else {
+		tx, err = d.BeginTx(ctx, m)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
 	}
@@ -120,31 +147,63 @@ func (p *Postgres) DoOneMigration(ctx context.Context, log *internal.Log, d *lib
 		}
 	}()
 	pm := m.(*pmigration)
-	if pm.script != nil {
+	var skip bool
+	skip, err = m.Base().SkipIfTx(ctx, tx)
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	case pm.script != nil:
 		script := pm.script(ctx, tx)
 		result, err = tx.Exec(script)
 		err = errors.Wrap(err, script)
-	} else {
-		err = pm.computed(ctx, tx)
+	default:
+		err = libschema.ComputedResult(ctx, log, m.Base().Name, pm.computed(ctx, tx))
+	}
+	if err == nil && d.HasTrackingDB() {
+		// The status is in another database so it cannot be saved in
+		// the same transaction.
+		err = tx.Commit()
+		if err == nil {
+			ntx, txerr := d.TrackingDB().BeginTx(ctx, d.Options.MigrationTxOptions)
+			if txerr != nil {
+				return nil, errors.Wrapf(txerr, "Tx for saving status for %s", m.Base().Name)
+			}
+			tx = ntx
+		}
 	}
 	if err != nil {
 		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
 		_ = tx.Rollback()
-		ntx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
-		if txerr != nil {
-			return nil, errors.Wrapf(err, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+		if d.Options.WithoutFailureStatus {
+			return nil, err
 		}
-		tx = ntx
+		release()
+		return nil, p.saveFailure(ctx, log, d, m, err)
 	}
-	txerr := p.saveStatus(log, tx, d, m, err == nil, err)
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil)
+	return
+}
+
+// saveFailure records a failed migration.  The migration transaction
+// has been rolled back so the status is saved in a transaction of its own.
+func (p *Postgres) saveFailure(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error) error {
+	tx, txerr := d.TrackingDB().BeginTx(ctx, d.Options.MigrationTxOptions)
 	if txerr != nil {
-		if err == nil {
-			err = txerr
-		} else {
-			err = errors.Wrapf(err, "Save status for %s also failed: %s", m.Base().Name, txerr)
-		}
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
 	}
-	return
+	txerr = p.saveStatus(ctx, log, tx, d, m, false, migrationError)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
 }
 
 // CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
@@ -155,26 +214,79 @@ func (p *Postgres) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal
 		return err
 	}
 	if schema != "" {
-		_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
+		_, err := d.TrackingDB().ExecContext(ctx, fmt.Sprintf(`
 				CREATE SCHEMA IF NOT EXISTS %s
 				`, schema))
 		if err != nil {
 			return errors.Wrapf(err, "Could not create libschema schema '%s'", schema)
 		}
 	}
-	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+	_, err = d.TrackingDB().ExecContext(ctx, fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
 			metadata	varchar(255) NOT NULL DEFAULT '',
 			library		varchar(255) NOT NULL,
 			migration	varchar(255) NOT NULL,
 			done		boolean NOT NULL,
 			error		text NOT NULL,
+			applied_by	varchar(255),
+			run_id		varchar(255),
+			comment		text,
 			updated_at	timestamp with time zone DEFAULT now(),
 			PRIMARY KEY	(metadata, library, migration)
 		)`, tableName))
 	if err != nil {
 		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
 	}
+	// applied_by, run_id, and comment were added after the tracking
+	// table was first defined
+	for _, column := range []struct {
+		name       string
+		definition string
+	}{
+		{name: "applied_by", definition: "varchar(255)"},
+		{name: "run_id", definition: "varchar(255)"},
+		{name: "comment", definition: "text"},
+	} {
+		_, err = d.TrackingDB().ExecContext(ctx, fmt.Sprintf(`
+			ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`, tableName, column.name, column.definition))
+		if err != nil {
+			return errors.Wrapf(err, "Could not add %s to libschema migrations table '%s'", column.name, tableName)
+		}
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table.  If the tracking
+// table is in a schema and that schema is now empty, the schema is dropped
+// too.
+// It is expected to be called by libschema.
+func (p *Postgres) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	_, err = d.TrackingDB().ExecContext(ctx, `DROP TABLE IF EXISTS `+tableName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	if schema == "" {
+		return nil
+	}
+	var count int
+	err = d.TrackingDB().QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = $1`, strings.Split(d.Options.TrackingTable, ".")[0]).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check if libschema schema '%s' is empty", schema)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.TrackingDB().ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema schema '%s'", schema)
+	}
 	return nil
 }
 
@@ -200,27 +312,68 @@ func trackingTable(d *libschema.Database) string {
 	return table
 }
 
-func (p *Postgres) saveStatus(log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
-	var estr string
-	if migrationError != nil {
-		estr = migrationError.Error()
-	}
-	log.Info("Saving migration status", map[string]interface{}{
-		"migration": m.Base().Name,
-		"done":      done,
-		"error":     migrationError,
-	})
-	q := fmt.Sprintf(`
-		INSERT INTO %s (library, migration, done, error, updated_at)
-		VALUES ($1, $2, $3, $4, now())
-		ON CONFLICT (metadata, library, migration) DO UPDATE
-		SET	done = EXCLUDED.done,
-			error = EXCLUDED.error,
-			updated_at = EXCLUDED.updated_at
-			`, trackingTable(d))
-	_, err := tx.Exec(q, m.Base().Name.Library, m.Base().Name.Name, done, estr)
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.DollarPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			INSERT INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at)
+			VALUES (%s, %s, %s, %s, %s, %s, %s, now())
+			ON CONFLICT (metadata, library, migration) DO UPDATE
+			SET	done = EXCLUDED.done,
+				error = EXCLUDED.error,
+				applied_by = EXCLUDED.applied_by,
+				run_id = EXCLUDED.run_id,
+				comment = EXCLUDED.comment,
+				updated_at = EXCLUDED.updated_at
+				`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+}
+
+func (p *Postgres) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	return statusSaver.Save(ctx, log, tx, d, trackingTable(d), m, done, migrationError)
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *Postgres) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.SetMigrationStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *Postgres) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.TrackingDB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil)
 	if err != nil {
-		return errors.Wrapf(err, "Save status for %s", m.Base().Name)
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// CheckTrackingTableWrite inserts a row into the tracking table and
+// rolls it back.  It is used by libschema.Database.Preflight to find a
+// missing INSERT grant before migrations run.
+func (p *Postgres) CheckTrackingTableWrite(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	tableName := trackingTable(d)
+	tx, err := d.TrackingDB().BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin tx to check writing the tracking table")
+	}
+	defer func() { _ = tx.Rollback() }()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (library, migration, done, error)
+		VALUES ($1, $2, false, '')`, tableName),
+		"libschema-preflight", "write check")
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42501" {
+			return errors.Wrapf(err, "no permission to write the tracking table %s, INSERT and UPDATE must be granted", tableName)
+		}
+		return errors.Wrapf(err, "could not write the tracking table %s", tableName)
 	}
 	return nil
 }
@@ -233,14 +386,14 @@ func (p *Postgres) LockMigrationsTable(ctx context.Context, _ *internal.Log, d *
 	if p.lockTx != nil {
 		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
 	}
-	_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
+	_, err := d.TrackingDB().ExecContext(ctx, fmt.Sprintf(`
 		INSERT INTO %s (metadata, library, migration, done, error)
 		VALUES ('lock', '', '', true, '')
 		ON CONFLICT DO NOTHING`, tableName))
 	if err != nil {
 		return errors.Wrapf(err, "Could not add lock row to %s", tableName)
 	}
-	tx, err := d.DB().BeginTx(ctx, &sql.TxOptions{})
+	tx, err := d.TrackingDB().BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return errors.Wrap(err, "Could not start transaction: %s")
 	}
@@ -257,6 +410,10 @@ func (p *Postgres) LockMigrationsTable(ctx context.Context, _ *internal.Log, d *
 	return nil
 }
 
+// SupportsTrackingDB marks Postgres as supporting
+// libschema.Database.SetTrackingDB.
+func (p *Postgres) SupportsTrackingDB() {}
+
 // UnlockMigrationsTable unlocks the migration tracking table.
 // It is expected to be called by libschema.
 func (p *Postgres) UnlockMigrationsTable(_ *internal.Log) error {
@@ -272,8 +429,8 @@ func (p *Postgres) UnlockMigrationsTable(_ *internal.Log) error {
 // It is expected to be called by libschema.
 func (p *Postgres) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
 	tableName := trackingTable(d)
-	rows, err := d.DB().QueryContext(ctx, fmt.Sprintf(`
-		SELECT	library, migration, done
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
 		FROM	%s
 		WHERE	metadata = ''`, tableName))
 	if err != nil {
@@ -286,7 +443,7 @@ func (p *Postgres) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema
 			name   libschema.MigrationName
 			status libschema.MigrationStatus
 		)
-		err := rows.Scan(&name.Library, &name.Name, &status.Done)
+		err := rows.Scan(&name.Library, &name.Name, &status.Done, &status.Error)
 		if err != nil {
 			return nil, errors.Wrap(err, "Cannot scan migration status")
 		}
@@ -299,6 +456,36 @@ func (p *Postgres) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema
 	return unknowns, nil
 }
 
+// RenderScript returns the SQL that a migration would run.  Generate()
+// migrations are rendered in a transaction that is rolled back.  It
+// implements libschema.ScriptRenderer for Database.ExportSQL.
+func (p *Postgres) RenderScript(ctx context.Context, _ *internal.Log, d *libschema.Database, migration libschema.Migration) (string, bool, error) {
+	m, ok := migration.(*pmigration)
+	if !ok {
+		return "", false, fmt.Errorf("Non-postgres migration %s registered with postgres migrations", migration.Base().Name)
+	}
+	switch {
+	case m.computed != nil:
+		return "", true, nil
+	case m.sqlText != "":
+		return m.sqlText, false, nil
+	}
+	tx, err := d.BeginTx(ctx, m)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if d.Options.SchemaOverride != "" {
+		_, err := tx.Exec(`SET search_path TO ` + pq.QuoteIdentifier(d.Options.SchemaOverride))
+		if err != nil {
+			return "", false, errors.Wrapf(err, "Set search path to %s for %s", d.Options.SchemaOverride, m.Base().Name)
+		}
+	}
+	return m.script(ctx, tx), false, nil
+}
+
 // IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
 // should always return nil.
 // It is expected to be called by libschema.
@@ -307,11 +494,42 @@ func (p *Postgres) IsMigrationSupported(d *libschema.Database, _ *internal.Log,
 	if !ok {
 		return fmt.Errorf("Non-postgres migration %s registered with postgres migrations", migration.Base().Name)
 	}
-	if m.script != nil {
-		return nil
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
 	}
-	if m.computed != nil {
-		return nil
+	return d.ValidateMigration(m, m.sqlText)
+}
+
+// IsRetryable implements libschema.ErrorClassifier.  Serialization
+// failures (40001), deadlocks (40P01), lock timeouts (55P03), and lost
+// connections are retryable.
+func (p *Postgres) IsRetryable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", "40P01", "55P03":
+		return true
+	}
+	return pqErr.Code.Class() == "08" // connection exception
+}
+
+// IsAlreadyExists implements libschema.ErrorClassifier.  It returns true
+// for creating a table or index (42P07), column (42701), other object
+// like a constraint (42710), function (42723), schema (42P06), or
+// database (42P04) that already exists.
+func (p *Postgres) IsAlreadyExists(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "42P07", "42701", "42710", "42723", "42P06", "42P04":
+		return true
 	}
-	return errors.Errorf("Migration %s is not supported", m.Name)
+	return false
 }
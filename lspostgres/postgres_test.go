@@ -3,6 +3,7 @@ package lspostgres_test
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"os"
 	"testing"
@@ -10,6 +11,9 @@ import (
 	"github.com/muir/libschema"
 	"github.com/muir/libschema/lspostgres"
 	"github.com/muir/libschema/lstesting"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -182,3 +186,115 @@ func TestPostgresMigrations(t *testing.T) {
 		"COMPLETE",
 	}, actions)
 }
+
+func TestErrorClassifier(t *testing.T) {
+	var p libschema.ErrorClassifier = &lspostgres.Postgres{}
+	assert.True(t, p.IsRetryable(&pq.Error{Code: "40001"}), "serialization failure")
+	assert.True(t, p.IsRetryable(errors.Wrap(&pq.Error{Code: "40P01"}, "exec")), "deadlock")
+	assert.True(t, p.IsRetryable(&pq.Error{Code: "08006"}), "connection failure")
+	assert.True(t, p.IsRetryable(driver.ErrBadConn), "bad connection")
+	assert.False(t, p.IsRetryable(&pq.Error{Code: "42P07"}), "table exists")
+	assert.True(t, p.IsAlreadyExists(&pq.Error{Code: "42P07"}), "table exists")
+	assert.True(t, p.IsAlreadyExists(&pq.Error{Code: "42701"}), "column exists")
+	assert.False(t, p.IsAlreadyExists(&pq.Error{Code: "40001"}), "serialization failure")
+	assert.False(t, p.IsAlreadyExists(errors.New("already exists")), "not a pq.Error")
+}
+
+func TestDropTrackingTable(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_POSTGRES_TEST_DSN to test libschema/lspostgres")
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "CASCADE")
+	defer cleanup(db)
+	options.AllowDestructive = true
+
+	s := libschema.New(context.Background(), options)
+	dbase, err := lspostgres.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lspostgres.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text)`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	require.NoError(t, dbase.DropTrackingTable(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = $1
+		AND	table_name = 'tracking_table'`, options.SchemaOverride).Scan(&count))
+	assert.Equal(t, 0, count, "tracking table dropped")
+
+	require.NoError(t, s.Migrate(context.Background()), "migrate again")
+}
+
+func TestTrackingDB(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_POSTGRES_TEST_DSN to test libschema/lspostgres")
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	metadata, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer metadata.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "CASCADE")
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, err := lspostgres.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.SetTrackingDB(metadata)
+	dbase.Migrations("L1",
+		lspostgres.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text)`),
+		lspostgres.Script("T2", `CREATE TABLE IF NOT EXISTS T2 (id text)`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var count int
+	require.NoError(t, metadata.QueryRow(fmt.Sprintf(`
+		SELECT	COUNT(*)
+		FROM	%s
+		WHERE	library = 'L1'
+		AND	done`, options.TrackingTable)).Scan(&count))
+	assert.Equal(t, 2, count, "status saved in tracking DB")
+
+	require.NoError(t, s.Migrate(context.Background()), "migrate again")
+}
+
+func TestWithoutFailureStatus(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_POSTGRES_TEST_DSN to test libschema/lspostgres")
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	options, cleanup := lstesting.FakeSchema(t, "CASCADE")
+	defer cleanup(db)
+	options.WithoutFailureStatus = true
+
+	s := libschema.New(context.Background(), options)
+	dbase, err := lspostgres.New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		lspostgres.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id text)`),
+		lspostgres.Script("broken", `CREATE TABLE T1 (id text)`),
+	)
+	require.Error(t, s.Migrate(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(fmt.Sprintf(`
+		SELECT	COUNT(*)
+		FROM	%s
+		WHERE	library = 'L1'`, options.TrackingTable)).Scan(&count))
+	assert.Equal(t, 1, count, "only the successful migration is recorded")
+}
@@ -0,0 +1,52 @@
+package lspostgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedicatedConnFailure(t *testing.T) {
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			if query == "INSERT INTO t1 (id) VALUES (1)" {
+				return nil, errors.New("pq: duplicate key value violates unique constraint")
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+	// the dedicated connection must be released before the status is saved
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := libschema.New(ctx, libschema.Options{})
+	log := libschema.LogFromLog(t)
+	d, err := New(log, "test", s, db)
+	require.NoError(t, err)
+	d.Migrations("L", Script("T1", `INSERT INTO t1 (id) VALUES (1)`, libschema.WithDedicatedConn()))
+	m, ok := d.Lookup(libschema.MigrationName{Library: "L", Name: "T1"})
+	require.True(t, ok)
+
+	_, err = (&Postgres{}).DoOneMigration(ctx, log, d, m)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate key")
+	assert.NotContains(t, err.Error(), "also failed")
+	assert.True(t, fake.Sequence(
+		"BEGIN", "INSERT INTO t1", "ROLLBACK",
+		"BEGIN", `INSERT INTO "libschema"."migration_status"`, "COMMIT",
+	), "statements:\n%s", fake)
+	saved := fake.Matching(`INSERT INTO "libschema"."migration_status"`)
+	require.Len(t, saved, 1)
+	assert.Equal(t, []driver.Value{"L", "T1", false}, saved[0].Args[:3])
+}
@@ -0,0 +1,585 @@
+// Package lsredshift has a libschema.Driver support Amazon Redshift
+package lsredshift
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+
+	"github.com/lib/pq"
+	"github.com/muir/sqltoken"
+	"github.com/pkg/errors"
+)
+
+// Redshift is a libschema.Driver for connecting to Amazon Redshift.
+// Redshift speaks the PostgreSQL wire protocol so github.com/lib/pq
+// can be used to connect.
+//
+// Redshift differs from PostgreSQL in ways that matter for migrations:
+// * There are no advisory locks and no SELECT ... FOR UPDATE
+// * There is no UPSERT (INSERT ... ON CONFLICT)
+// * There is no CREATE INDEX
+// * Some statements, like VACUUM, cannot run inside a transaction
+//
+// The migration lock is an exclusive LOCK on a lock table (the tracking
+// table name with "_lock" appended) that is held in a transaction until
+// the migrations are done.
+type Redshift struct {
+	lockTx *sql.Tx
+}
+
+// New creates a libschema.Database with a Redshift driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (*libschema.Database, error) {
+	return schema.NewDatabase(log, name, db, &Redshift{})
+}
+
+type rmigration struct {
+	libschema.MigrationBase
+	sqlText  string // set by Script()
+	script   func(context.Context, *sql.Tx) string
+	computed func(context.Context, *sql.Tx) error
+}
+
+func (m *rmigration) Copy() libschema.Migration {
+	return &rmigration{
+		MigrationBase: m.MigrationBase.Copy(),
+		sqlText:       m.sqlText,
+		script:        m.script,
+		computed:      m.computed,
+	}
+}
+
+func (m *rmigration) Base() *libschema.MigrationBase {
+	return &m.MigrationBase
+}
+
+// String describes the migration for logs and test failures
+func (m *rmigration) String() string {
+	switch {
+	case m.computed != nil:
+		return m.Describe("computed")
+	case m.sqlText != "":
+		return m.Describe("script")
+	default:
+		return m.Describe("generate")
+	}
+}
+
+// Script creates a libschema.Migration from a SQL string.  Scripts that
+// have statements that cannot run inside a transaction are run one
+// statement at a time outside of a transaction.  See DoOneMigration.
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	m := Generate(name, func(_ context.Context, _ *sql.Tx) string {
+		return sqlText
+	}, opts...)
+	m.(*rmigration).sqlText = sqlText
+	return m
+}
+
+// Generate creates a libschema.Migration from a function that returns a
+// SQL string
+func Generate(
+	name string,
+	generator func(context.Context, *sql.Tx) string,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return rmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		script: generator,
+	}.applyOpts(opts)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return rmigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		computed: action,
+	}.applyOpts(opts)
+}
+
+func (m rmigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
+	lsm := libschema.Migration(&m)
+	for _, opt := range opts {
+		opt(lsm)
+	}
+	return lsm
+}
+
+// DoOneMigration applies a single migration.  Usually the migration and
+// its status are committed together.  Redshift refuses to run some
+// statements (VACUUM, ALTER TABLE ... APPEND, ALTER TABLE ... ALTER COLUMN
+// ... TYPE, external tables, and CREATE/DROP DATABASE) inside a
+// transaction.  Scripts that have any of them are run one statement at a
+// time, outside of a transaction, and then the status is saved.  If one
+// of those statements fails, the statements before it are not rolled back.
+// It is expected to be called by libschema.
+func (p *Redshift) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (result sql.Result, err error) {
+	defer func() {
+		if err == nil {
+			m.Base().SetStatus(libschema.MigrationStatus{
+				Done: true,
+			})
+		}
+	}()
+	conn, release, err := d.DedicatedConn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var tx *sql.Tx
+	if conn != nil {
+		tx, err = conn.BeginTx(ctx, d.TxOptions(m))
+	} else {
+		tx, err = d.BeginTx(ctx, m)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	}
+	if d.Options.SchemaOverride != "" {
+		_, err := tx.ExecContext(ctx, `SET search_path TO `+pq.QuoteIdentifier(d.Options.SchemaOverride))
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, errors.Wrapf(err, "Set search path to %s for %s", d.Options.SchemaOverride, m.Base().Name)
+		}
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = errors.Wrapf(tx.Commit(), "Commit migration %s", m.Base().Name)
+		}
+	}()
+	pm := m.(*rmigration)
+	var skip bool
+	var outsideTx []string
+	skip, err = m.Base().SkipIfTx(ctx, tx)
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	case pm.script != nil:
+		script := pm.script(ctx, tx)
+		if statements := splitStatements(script); needsNoTransaction(statements) {
+			outsideTx = statements
+			break
+		}
+		result, err = tx.ExecContext(ctx, script)
+		err = errors.Wrap(err, script)
+	default:
+		err = libschema.ComputedResult(ctx, log, m.Base().Name, pm.computed(ctx, tx))
+	}
+	if outsideTx != nil {
+		_ = tx.Rollback()
+		log.Info("Running migration outside of a transaction", map[string]interface{}{
+			"migration":  m.Base().Name,
+			"statements": len(outsideTx),
+		})
+		result, err = execWithoutTx(ctx, d, conn, outsideTx)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		_ = tx.Rollback()
+		if d.Options.WithoutFailureStatus {
+			return nil, err
+		}
+		release()
+		return nil, p.saveFailure(ctx, log, d, m, err)
+	}
+	if outsideTx != nil {
+		release()
+		ntx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+		if txerr != nil {
+			return nil, errors.Wrapf(txerr, "Tx for saving status for %s", m.Base().Name)
+		}
+		tx = ntx
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil)
+	return
+}
+
+// saveFailure records a failed migration.  The migration transaction
+// has been rolled back so the status is saved in a transaction of its own.
+func (p *Redshift) saveFailure(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error) error {
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, false, migrationError)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
+}
+
+// execWithoutTx runs statements one at a time in autocommit mode.  The
+// statements run on conn if there is one.  Otherwise a connection is
+// taken from the pool and then discarded since the search path may
+// have been changed.
+func execWithoutTx(ctx context.Context, d *libschema.Database, conn *sql.Conn, statements []string) (sql.Result, error) {
+	if conn == nil {
+		var err error
+		conn, err = d.DB().Conn(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get connection")
+		}
+		defer internal.DiscardConn(conn)
+	}
+	if d.Options.SchemaOverride != "" {
+		_, err := conn.ExecContext(ctx, `SET search_path TO `+pq.QuoteIdentifier(d.Options.SchemaOverride))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Set search path to %s", d.Options.SchemaOverride)
+		}
+	}
+	var result sql.Result
+	for _, statement := range statements {
+		r, err := conn.ExecContext(ctx, statement)
+		if err != nil {
+			return nil, errors.Wrap(err, statement)
+		}
+		result = r
+	}
+	return result, nil
+}
+
+// splitStatements breaks a script into statements.  Statements that are
+// only comments are dropped.
+func splitStatements(script string) []string {
+	var statements []string
+	var current sqltoken.Tokens
+	var hasContent bool
+	flush := func() {
+		if hasContent {
+			statements = append(statements, strings.TrimSpace(current.String()))
+		}
+		current = nil
+		hasContent = false
+	}
+	for _, token := range sqltoken.TokenizePostgreSQL(script) {
+		// nolint:exhaustive
+		switch token.Type {
+		case sqltoken.Semicolon:
+			flush()
+			continue
+		case sqltoken.Comment, sqltoken.Whitespace:
+		default:
+			hasContent = true
+		}
+		current = append(current, token)
+	}
+	flush()
+	return statements
+}
+
+var noTransactionRE = regexp.MustCompile(`(?is)\A(?:` + strings.Join([]string{
+	`VACUUM\b`,
+	`(?:CREATE|DROP)\s+DATABASE\b`,
+	`(?:CREATE|ALTER|DROP)\s+EXTERNAL\s+(?:TABLE|SCHEMA)\b`,
+	`ALTER\s+TABLE\s+.*\sAPPEND\s+FROM\b`,
+	`ALTER\s+TABLE\s+.*\sALTER\s+(?:COLUMN\s+)?\S+\s+TYPE\b`,
+}, "|") + `)`)
+
+// needsNoTransaction is true if any of the statements cannot be run
+// inside a transaction
+func needsNoTransaction(statements []string) bool {
+	for _, statement := range statements {
+		if noTransactionRE.MatchString(stripLeadingComments(statement)) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripLeadingComments(statement string) string {
+	tokens := sqltoken.TokenizePostgreSQL(statement)
+	for i, token := range tokens {
+		// nolint:exhaustive
+		switch token.Type {
+		case sqltoken.Comment, sqltoken.Whitespace:
+		default:
+			return tokens[i:].String()
+		}
+	}
+	return ""
+}
+
+var createIndexRE = regexp.MustCompile(`(?is)\ACREATE\s+(?:UNIQUE\s+)?INDEX\b`)
+
+// CreateSchemaTableIfNotExists creates the migration tracking table and
+// the lock table for libschema.
+// It is expected to be called by libschema.
+func (p *Redshift) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, lockTable, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if schema != "" {
+		_, err := d.DB().ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema)
+		if err != nil {
+			return errors.Wrapf(err, "Could not create libschema schema '%s'", schema)
+		}
+	}
+	// Redshift does not enforce primary keys.  The status is saved with
+	// a DELETE and an INSERT in one transaction.
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			library		VARCHAR(255) NOT NULL,
+			migration	VARCHAR(255) NOT NULL,
+			done		BOOLEAN NOT NULL,
+			error		VARCHAR(65535) NOT NULL,
+			applied_by	VARCHAR(255),
+			run_id		VARCHAR(255),
+			comment		VARCHAR(4096),
+			updated_at	TIMESTAMP DEFAULT GETDATE(),
+			PRIMARY KEY	(library, migration)
+		)`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
+	}
+	// run_id and comment were added after the tracking table was first
+	// defined.  Redshift does not support ADD COLUMN IF NOT EXISTS.
+	for _, column := range []struct {
+		name       string
+		definition string
+	}{
+		{name: "run_id", definition: "VARCHAR(255)"},
+		{name: "comment", definition: "VARCHAR(4096)"},
+	} {
+		var count int
+		err = d.DB().QueryRowContext(ctx, `
+			SELECT	COUNT(*)
+			FROM	information_schema.columns
+			WHERE	table_schema = COALESCE(NULLIF($1, ''), current_schema())
+			AND	table_name = $2
+			AND	column_name = $3`,
+			strings.Trim(schema, `"`), strings.Trim(tableName[strings.LastIndex(tableName, ".")+1:], `"`), column.name).Scan(&count)
+		if err != nil {
+			return errors.Wrapf(err, "Could not check libschema migrations table '%s' for %s", tableName, column.name)
+		}
+		if count == 0 {
+			_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+				ALTER TABLE %s ADD COLUMN %s %s`, tableName, column.name, column.definition))
+			if err != nil {
+				return errors.Wrapf(err, "Could not add %s to libschema migrations table '%s'", column.name, tableName)
+			}
+		}
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id		INTEGER
+		)`, lockTable))
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema lock table '%s'", lockTable)
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table and the lock
+// table.  If the tracking table is in a schema and that schema is now
+// empty, the schema is dropped too.
+// It is expected to be called by libschema.
+func (p *Redshift) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	schema, tableName, lockTable, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{tableName, lockTable} {
+		_, err = d.DB().ExecContext(ctx, `DROP TABLE IF EXISTS `+table)
+		if err != nil {
+			return errors.Wrapf(err, "Could not drop libschema table '%s'", table)
+		}
+	}
+	if schema == "" {
+		return nil
+	}
+	var count int
+	err = d.DB().QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	information_schema.tables
+		WHERE	table_schema = $1`, strings.Split(d.Options.TrackingTable, ".")[0]).Scan(&count)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check if libschema schema '%s' is empty", schema)
+	}
+	if count != 0 {
+		return nil
+	}
+	_, err = d.DB().ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema)
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema schema '%s'", schema)
+	}
+	return nil
+}
+
+// trackingSchemaTable returns the schema, the tracking table, and the
+// lock table.  The names are quoted for use as identifiers.
+func trackingSchemaTable(d *libschema.Database) (string, string, string, error) {
+	tableName := d.Options.TrackingTable
+	s := strings.Split(tableName, ".")
+	switch len(s) {
+	case 2:
+		schema := pq.QuoteIdentifier(s[0])
+		return schema, schema + "." + pq.QuoteIdentifier(s[1]), schema + "." + pq.QuoteIdentifier(s[1]+"_lock"), nil
+	case 1:
+		return "", pq.QuoteIdentifier(tableName), pq.QuoteIdentifier(tableName + "_lock"), nil
+	default:
+		return "", "", "", errors.Errorf("Tracking table '%s' is not valid", tableName)
+	}
+}
+
+// trackingTable returns the schema+table reference for the migration tracking table.
+// The name is already quoted properly for use as a save identifier.
+func trackingTable(d *libschema.Database) string {
+	_, table, _, _ := trackingSchemaTable(d)
+	return table
+}
+
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.DollarPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			INSERT INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at)
+			VALUES (%s, %s, %s, %s, %s, %s, %s, GETDATE())`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+}
+
+// saveStatus replaces the status row.  Redshift does not have UPSERT.
+func (p *Redshift) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	tableName := trackingTable(d)
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE	library = $1
+		AND	migration = $2`, tableName), m.Base().Name.Library, m.Base().Name.Name)
+	if err != nil {
+		return errors.Wrapf(err, "Save status for %s", m.Base().Name)
+	}
+	return statusSaver.Save(ctx, log, tx, d, tableName, m, done, migrationError)
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *Redshift) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.SetMigrationStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *Redshift) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// LockMigrationsTable locks the migration tracking table for exclusive use by the
+// migrations running now.  The lock is an exclusive LOCK of the lock table
+// that is held in a transaction.
+// It is expected to be called by libschema.
+func (p *Redshift) LockMigrationsTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	_, tableName, lockTable, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	if p.lockTx != nil {
+		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
+	}
+	tx, err := d.DB().BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Could not start transaction")
+	}
+	_, err = tx.ExecContext(ctx, `LOCK `+lockTable)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "Could not lock libschema lock table '%s'", lockTable)
+	}
+	p.lockTx = tx
+	return nil
+}
+
+// UnlockMigrationsTable unlocks the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Redshift) UnlockMigrationsTable(_ *internal.Log) error {
+	if p.lockTx == nil {
+		return errors.Errorf("libschema migrations table, not locked")
+	}
+	_ = p.lockTx.Rollback()
+	p.lockTx = nil
+	return nil
+}
+
+// LoadStatus loads the current status of all migrations from the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Redshift) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	tableName := trackingTable(d)
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s`, tableName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	defer rows.Close()
+	var unknowns []libschema.MigrationName
+	for rows.Next() {
+		var (
+			name   libschema.MigrationName
+			status libschema.MigrationStatus
+		)
+		err := rows.Scan(&name.Library, &name.Name, &status.Done, &status.Error)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot scan migration status")
+		}
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(status)
+		} else if status.Done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+// IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
+// should always return nil.  Script() migrations that use CREATE INDEX are
+// rejected since Redshift does not have indexes.
+// It is expected to be called by libschema.
+func (p *Redshift) IsMigrationSupported(d *libschema.Database, _ *internal.Log, migration libschema.Migration) error {
+	m, ok := migration.(*rmigration)
+	if !ok {
+		return fmt.Errorf("Non-redshift migration %s registered with redshift migrations", migration.Base().Name)
+	}
+	if m.script == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
+	}
+	for _, statement := range splitStatements(m.sqlText) {
+		if createIndexRE.MatchString(stripLeadingComments(statement)) {
+			return errors.Errorf("Migration %s uses CREATE INDEX which Redshift does not support: use SORTKEY or DISTKEY instead", m.Name)
+		}
+	}
+	return d.ValidateMigration(m, m.sqlText)
+}
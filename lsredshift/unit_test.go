@@ -0,0 +1,155 @@
+package lsredshift
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackingSchemaTable(t *testing.T) {
+	cases := []struct {
+		tt     string
+		err    bool
+		schema string
+		table  string
+		lock   string
+	}{
+		{
+			tt:     "libschema.migration_status",
+			schema: `"libschema"`,
+			table:  `"libschema"."migration_status"`,
+			lock:   `"libschema"."migration_status_lock"`,
+		},
+		{
+			tt:    "foo",
+			table: `"foo"`,
+			lock:  `"foo_lock"`,
+		},
+		{
+			tt:  "x.y.z",
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tt, func(t *testing.T) {
+			d := &libschema.Database{
+				Options: libschema.Options{
+					TrackingTable: tc.tt,
+				},
+			}
+			schema, table, lock, err := trackingSchemaTable(d)
+			if tc.err {
+				assert.Error(t, err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.schema, schema, "schema")
+				assert.Equal(t, tc.table, table, "table")
+				assert.Equal(t, tc.lock, lock, "lock")
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	assert.Equal(t, []string{
+		"CREATE TABLE t (id INTEGER, s VARCHAR(10) DEFAULT 'a;b')",
+		"-- stats\n\t\tVACUUM t",
+	}, splitStatements(`
+		CREATE TABLE t (id INTEGER, s VARCHAR(10) DEFAULT 'a;b');
+		-- stats
+		VACUUM t;
+		/* done */;
+	`))
+	assert.Empty(t, splitStatements(""))
+}
+
+func TestNeedsNoTransaction(t *testing.T) {
+	cases := []struct {
+		script string
+		want   bool
+	}{
+		{script: "CREATE TABLE t (id INTEGER)"},
+		{script: "INSERT INTO t VALUES (1); VACUUM t", want: true},
+		{script: "-- reclaim space\nvacuum delete only t", want: true},
+		{script: "ALTER TABLE t APPEND FROM staging", want: true},
+		{script: "ALTER TABLE t ALTER COLUMN name TYPE VARCHAR(512)", want: true},
+		{script: "ALTER TABLE t ADD COLUMN name VARCHAR(512)"},
+		{script: "CREATE EXTERNAL TABLE spectrum.t (id INTEGER) STORED AS PARQUET LOCATION 's3://bucket/t/'", want: true},
+		{script: "DROP DATABASE old", want: true},
+		{script: "UPDATE t SET note = 'VACUUM later'"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, needsNoTransaction(splitStatements(tc.script)), tc.script)
+	}
+}
+
+func TestIsMigrationSupported(t *testing.T) {
+	p := &Redshift{}
+	d := &libschema.Database{}
+	assert.NoError(t, p.IsMigrationSupported(d, nil, Script("x", `CREATE TABLE t (id INTEGER) SORTKEY (id)`)))
+	err := p.IsMigrationSupported(d, nil, Script("x", `CREATE TABLE t (id INTEGER);
+		CREATE UNIQUE INDEX t_id ON t (id)`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "CREATE INDEX")
+	}
+}
+
+const statusInsert = `INSERT INTO "libschema"."migration_status"`
+
+func TestDedicatedConn(t *testing.T) {
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			if query == "INSERT INTO t2 (id) VALUES (1)" {
+				return nil, errors.New("pq: duplicate key value violates unique constraint")
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+	// the dedicated connection must be released before the status is saved
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := libschema.New(ctx, libschema.Options{})
+	log := libschema.LogFromLog(t)
+	d, err := New(log, "test", s, db)
+	require.NoError(t, err)
+	d.Migrations("L",
+		Script("T1", `VACUUM users`, libschema.WithDedicatedConn()),
+		Script("T2", `INSERT INTO t2 (id) VALUES (1)`, libschema.WithDedicatedConn()),
+	)
+	p := &Redshift{}
+
+	m, ok := d.Lookup(libschema.MigrationName{Library: "L", Name: "T1"})
+	require.True(t, ok)
+	_, err = p.DoOneMigration(ctx, log, d, m)
+	require.NoError(t, err, "outside of a transaction")
+
+	m, ok = d.Lookup(libschema.MigrationName{Library: "L", Name: "T2"})
+	require.True(t, ok)
+	_, err = p.DoOneMigration(ctx, log, d, m)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate key")
+	assert.NotContains(t, err.Error(), "also failed")
+
+	assert.True(t, fake.Sequence(
+		"BEGIN", "ROLLBACK", "VACUUM users",
+		"BEGIN", statusInsert, "COMMIT",
+		"BEGIN", "INSERT INTO t2", "ROLLBACK",
+		"BEGIN", statusInsert, "COMMIT",
+	), "statements:\n%s", fake)
+	saved := fake.Matching(statusInsert)
+	require.Len(t, saved, 2)
+	assert.Equal(t, []driver.Value{"L", "T1", true}, saved[0].Args[:3], "success")
+	assert.Equal(t, []driver.Value{"L", "T2", false}, saved[1].Args[:3], "failure")
+}
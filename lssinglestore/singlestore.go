@@ -35,17 +35,30 @@ import (
 // functions to interrogate data defintion status.
 type SingleStore struct {
 	*lsmysql.MySQL
-	lockTx *sql.Tx
-	lock   sync.Mutex
-	db     *sql.DB
+	lockTx        *sql.Tx
+	lock          sync.Mutex
+	db            *sql.DB
+	createdLock   sync.Mutex
+	schemaCreated bool // set by CreateSchemaTableIfNotExists
+	tableCreated  bool // set by CreateSchemaTableIfNotExists
 }
 
 // New creates a libschema.Database with a Singlestore driver built in.
-func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB) (*libschema.Database, *SingleStore, error) {
-	_, mysql, err := lsmysql.New(log, name, schema, db,
+// SingleStore does not support GET_LOCK so migrations are locked by
+// holding an uncommitted row in a lock table next to the tracking table.
+// The tracking table is created without MySQL-specific table options.
+//
+// lsmysql options, like lsmysql.WithDatabaseName, can be passed.
+// Options that change locking (WithLockStrategy, WithRowLockTTL,
+// WithLockAcquireBackoff, WithMaxConnections) or the tracking table
+// (WithTrackingTable, WithTrackingTableOptions, WithTrackingTableQuoter) do not apply to
+// SingleStore and are ignored.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB, opts ...lsmysql.MySQLOpt) (*libschema.Database, *SingleStore, error) {
+	opts = append(opts,
 		lsmysql.WithoutDatabase,
 		lsmysql.WithTrackingTableQuoter(trackingSchemaTable),
 	)
+	_, mysql, err := lsmysql.New(log, name, schema, db, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -122,6 +135,8 @@ func (p *SingleStore) LockMigrationsTable(ctx context.Context, _ *internal.Log,
 	return nil
 }
 
+// UnlockMigrationsTable releases the lock taken by LockMigrationsTable.
+// It is expected to be called by libschema.
 func (p *SingleStore) UnlockMigrationsTable(_ *internal.Log) error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -176,12 +191,45 @@ func trackingSchemaTable(d *libschema.Database) (string, string, error) {
 	}
 }
 
+// DropTrackingTable drops the lock table and then, like
+// lsmysql.MySQL.DropTrackingTable, the tracking table.
+// It is expected to be called by libschema.
+func (p *SingleStore) DropTrackingTable(ctx context.Context, log *internal.Log, d *libschema.Database) error {
+	_, tableName, err := trackingSchemaTable(d)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB().ExecContext(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s_lock`, tableName))
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema lock table '%s_lock'", tableName)
+	}
+	return p.MySQL.DropTrackingTable(ctx, log, d)
+}
+
+// TrackingCreated is like lsmysql.MySQL.TrackingCreated
+func (p *SingleStore) TrackingCreated() (schemaCreated bool, tableCreated bool) {
+	p.createdLock.Lock()
+	defer p.createdLock.Unlock()
+	return p.schemaCreated, p.tableCreated
+}
+
+func (p *SingleStore) setTrackingCreated(schemaCreated bool, tableCreated bool) {
+	p.createdLock.Lock()
+	defer p.createdLock.Unlock()
+	p.schemaCreated, p.tableCreated = schemaCreated, tableCreated
+}
+
 // CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
 func (p *SingleStore) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
 	schema, tableName, err := trackingSchemaTable(d)
 	if err != nil {
 		return err
 	}
+	schemaExists, tableExists, err := lsmysql.TrackingTableExists(ctx, d.DB(), schema, tableName)
+	if err != nil {
+		return err
+	}
+	p.setTrackingCreated(false, false)
 	if schema != "" {
 		_, err := d.DB().ExecContext(ctx, fmt.Sprintf(`
 				CREATE DATABASE IF NOT EXISTS %s
@@ -196,7 +244,13 @@ func (p *SingleStore) CreateSchemaTableIfNotExists(ctx context.Context, _ *inter
 			migration	varchar(255) NOT NULL,
 			done		boolean NOT NULL,
 			error		text NOT NULL,
+			applied_by	varchar(255),
 			updated_at	timestamp DEFAULT now(),
+			duration_ms	bigint NOT NULL DEFAULT 0,
+			run_id		varchar(255),
+			created_at	timestamp NULL DEFAULT NULL,
+			comment		text,
+			backup_tables	text,
 			SORT KEY	(library, migration),
 			SHARD KEY	(library, migration),
 			PRIMARY KEY	(library, migration)
@@ -204,7 +258,8 @@ func (p *SingleStore) CreateSchemaTableIfNotExists(ctx context.Context, _ *inter
 	if err != nil {
 		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
 	}
-	return nil
+	p.setTrackingCreated(schema != "" && !schemaExists, !tableExists)
+	return lsmysql.AddTrackingColumns(ctx, d, schema, tableName)
 }
 
 // GetTableConstraints returns the type of constraint and if it is enforced.
@@ -214,8 +269,14 @@ func (p *SingleStore) GetTableConstraint(table, constraintName string) (string,
 	if err != nil {
 		return "", false, err
 	}
+	ctx := context.Background()
+	if timeout := p.HelperTimeout(); timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	var typ *string
-	err = p.db.QueryRow(`
+	err = p.db.QueryRowContext(ctx, `
 		SELECT	constraint_type
 		FROM	information_schema.table_constraints
 		WHERE	constraint_schema = ?
@@ -8,6 +8,7 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/muir/libschema"
+	"github.com/muir/libschema/lsmysql"
 	"github.com/muir/libschema/lssinglestore"
 	"github.com/muir/libschema/lstesting"
 	"github.com/stretchr/testify/assert"
@@ -136,3 +137,37 @@ func TestSingleStoreSkipFunctions(t *testing.T) {
 func pointerToString(s string) *string {
 	return &s
 }
+
+func TestSingleStoreDropTrackingTable(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_SINGLESTORE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_SINGLESTORE_TEST_DSN to test SingleStore support in libschema/lssinglestore")
+	}
+
+	options, _ := lstesting.FakeSchema(t, "")
+	s := libschema.New(context.Background(), options)
+
+	db, err := sql.Open("mysql", dsn)
+	require.NoError(t, err, "open database")
+	defer db.Close()
+
+	dbase, _, err := lssinglestore.New(libschema.LogFromLog(t), "test", s, db,
+		lsmysql.WithDatabaseName(options.SchemaOverride))
+	require.NoError(t, err, "libschema NewDatabase")
+
+	dbase.Migrations("L1",
+		lssinglestore.Script("T1", `CREATE TABLE IF NOT EXISTS T1 (id int)`),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	_, err = db.Exec(`DROP TABLE ` + options.SchemaOverride + `.T1`)
+	require.NoError(t, err)
+	require.NoError(t, dbase.DropTrackingTable(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`
+		SELECT	COUNT(*)
+		FROM	information_schema.schemata
+		WHERE	schema_name = ?`, options.SchemaOverride).Scan(&count))
+	assert.Equal(t, 0, count, "lock table and tracking table dropped with the database")
+}
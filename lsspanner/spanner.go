@@ -0,0 +1,584 @@
+// Package lsspanner has a libschema.Driver support Google Cloud Spanner
+package lsspanner
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/lsmysql"
+
+	"github.com/pkg/errors"
+)
+
+// Spanner is a libschema.Driver for connecting to Google Cloud Spanner
+// (GoogleSQL dialect).  It uses only database/sql so it expects
+// github.com/googleapis/go-sql-spanner.
+//
+// Spanner databases have the following characteristics:
+// * DDL is applied asynchronously with UpdateDatabaseDdl long-running operations
+// * DDL cannot be run inside transactions
+// * DML runs in read-write transactions
+// * Support UPSERT using INSERT OR UPDATE
+// * NO advisory locks
+//
+// DDL migrations are submitted and then awaited: go-sql-spanner does this
+// when DDL is executed outside of a transaction.  To submit DDL some other way
+// (for example with the database admin client so that several statements are
+// batched into one operation) use WithDDLRunner.
+//
+// Because DDL and the recording of its status are separate steps, a DDL
+// migration that is interrupted will be retried.  DDL should be idempotent
+// (CREATE TABLE IF NOT EXISTS, etc) or guarded with libschema.SkipIf.
+//
+// Locking is done with a singleton row in a lock table (the tracking table
+// name with a "_lock" suffix).  If a process dies while holding the lock,
+// the row must be deleted by hand.
+type Spanner struct {
+	lockTable string
+	lockOwner string
+	lockDB    *sql.DB
+	lock      sync.Mutex
+	ddlRunner func(ctx context.Context, statements []string) error
+}
+
+// SpannerOpt are options for New
+type SpannerOpt func(*Spanner)
+
+// WithDDLRunner overrides how DDL statements are applied.  The runner must
+// submit the statements (as one UpdateDatabaseDdl operation) and wait for
+// the operation to complete.  By default, each statement is executed
+// with the *sql.DB outside of a transaction.
+func WithDDLRunner(runner func(ctx context.Context, statements []string) error) SpannerOpt {
+	return func(p *Spanner) {
+		p.ddlRunner = runner
+	}
+}
+
+// LockPollInterval is how often LockMigrationsTable checks to see if
+// a lock held by another process has been released.
+var LockPollInterval = time.Second
+
+// New creates a libschema.Database with a Spanner driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB, options ...SpannerOpt) (*libschema.Database, *Spanner, error) {
+	p := &Spanner{}
+	for _, opt := range options {
+		opt(p)
+	}
+	d, err := schema.NewDatabase(log, name, db, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, p, nil
+}
+
+type smigration struct {
+	libschema.MigrationBase
+	ddl      []string
+	script   string
+	computed func(context.Context, *sql.Tx) error
+}
+
+func (m *smigration) Copy() libschema.Migration {
+	return &smigration{
+		MigrationBase: m.MigrationBase.Copy(),
+		ddl:           m.ddl,
+		script:        m.script,
+		computed:      m.computed,
+	}
+}
+
+func (m *smigration) Base() *libschema.MigrationBase {
+	return &m.MigrationBase
+}
+
+// String describes the migration for logs and test failures
+func (m *smigration) String() string {
+	switch {
+	case m.computed != nil:
+		return m.Describe("computed")
+	case len(m.ddl) != 0:
+		return m.Describe("ddl")
+	default:
+		return m.Describe("script")
+	}
+}
+
+// Script creates a libschema.Migration from a single SQL statement.  DDL
+// statements are applied as DDL and other statements are run in a
+// read-write transaction.
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	return smigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		script: sqlText,
+	}.applyOpts(opts)
+}
+
+// DDL creates a libschema.Migration from DDL statements that are applied
+// together.
+func DDL(name string, statements []string, opts ...libschema.MigrationOption) libschema.Migration {
+	return smigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		ddl: statements,
+	}.applyOpts(opts)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.  The function is run in a read-write
+// transaction so it can only do DML.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return smigration{
+		MigrationBase: libschema.MigrationBase{
+			Name: libschema.MigrationName{
+				Name: name,
+			},
+		},
+		computed: action,
+	}.applyOpts(opts)
+}
+
+func (m smigration) applyOpts(opts []libschema.MigrationOption) libschema.Migration {
+	lsm := libschema.Migration(&m)
+	for _, opt := range opts {
+		opt(lsm)
+	}
+	return lsm
+}
+
+// ddlStatements returns the DDL statements of a migration, if it is
+// a DDL migration.
+func (m *smigration) ddlStatements() ([]string, error) {
+	if m.ddl != nil {
+		for _, statement := range m.ddl {
+			if err := checkDDL(statement, m.HasSkipIf()); err != nil {
+				return nil, err
+			}
+		}
+		return m.ddl, nil
+	}
+	if m.computed != nil {
+		return nil, nil
+	}
+	check := lsmysql.CheckScriptDetails(m.script)
+	if check.FirstDDL == nil {
+		return nil, nil
+	}
+	if err := checkDDL(m.script, m.HasSkipIf()); err != nil {
+		return nil, err
+	}
+	return []string{m.script}, nil
+}
+
+func checkDDL(statement string, hasSkipIf bool) error {
+	switch lsmysql.CheckScript(statement) {
+	case lsmysql.DataAndDDL:
+		return errors.New("Migration combines DDL (Data Definition Language [schema changes]) and data manipulation")
+	case lsmysql.NonIdempotentDDL:
+		if !hasSkipIf {
+			return errors.New("Unconditional migration has non-idempotent DDL (Data Definition Language [schema changes])")
+		}
+	case lsmysql.ConnectionStateChange:
+		return errors.New("Migration changes the connection state")
+	}
+	return nil
+}
+
+// DoOneMigration applies a single migration.
+// It is expected to be called by libschema.
+func (p *Spanner) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (result sql.Result, err error) {
+	defer func() {
+		if err == nil {
+			m.Base().SetStatus(libschema.MigrationStatus{
+				Done: true,
+			})
+		}
+	}()
+	if d.Options.SchemaOverride != "" {
+		return nil, errors.Errorf("Options.SchemaOverride is not supported by lsspanner (migration %s)", m.Base().Name)
+	}
+	pm := m.(*smigration)
+	ddl, err := pm.ddlStatements()
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+	} else if ddl != nil {
+		err = p.runDDL(ctx, d, ddl)
+		if err != nil {
+			err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		}
+	} else {
+		return p.runDML(ctx, log, d, pm)
+	}
+	if err != nil && d.Options.WithoutFailureStatus {
+		return nil, err
+	}
+	return nil, p.saveStatusTx(ctx, log, d, m, err)
+}
+
+// saveStatusTx records the outcome of a migration that is not running
+// in a transaction (DDL, or DML that failed and was rolled back) in a
+// transaction of its own.  It returns the migration error, if any.
+func (p *Spanner) saveStatusTx(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, migrationError error) error {
+	tx, txerr := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if txerr != nil {
+		if migrationError == nil {
+			return errors.Wrapf(txerr, "Tx for saving status for %s", m.Base().Name)
+		}
+		return errors.Wrapf(migrationError, "Tx for saving status for %s also failed with %s", m.Base().Name, txerr)
+	}
+	txerr = p.saveStatus(ctx, log, tx, d, m, migrationError == nil, migrationError)
+	if txerr == nil {
+		txerr = errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+	} else {
+		_ = tx.Rollback()
+	}
+	if txerr != nil {
+		if migrationError == nil {
+			return txerr
+		}
+		return errors.Wrapf(migrationError, "Save status for %s also failed: %s", m.Base().Name, txerr)
+	}
+	return migrationError
+}
+
+func (p *Spanner) runDDL(ctx context.Context, d *libschema.Database, statements []string) error {
+	if p.ddlRunner != nil {
+		return p.ddlRunner(ctx, statements)
+	}
+	for _, statement := range statements {
+		_, err := d.DB().ExecContext(ctx, statement)
+		if err != nil {
+			return errors.Wrap(err, statement)
+		}
+	}
+	return nil
+}
+
+// runDML runs a migration and saves its status in one read-write transaction
+func (p *Spanner) runDML(ctx context.Context, log *internal.Log, d *libschema.Database, pm *smigration) (result sql.Result, err error) {
+	m := libschema.Migration(pm)
+	tx, err := d.BeginTx(ctx, m)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Begin Tx for migration %s", m.Base().Name)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = errors.Wrapf(tx.Commit(), "Commit migration %s", m.Base().Name)
+		}
+	}()
+	var skip bool
+	skip, err = m.Base().SkipIfTx(ctx, tx)
+	switch {
+	case err != nil:
+	case skip:
+		log.Info("Migration skipped, marking it done", map[string]interface{}{
+			"migration": m.Base().Name,
+		})
+	case pm.computed != nil:
+		err = libschema.ComputedResult(ctx, log, m.Base().Name, pm.computed(ctx, tx))
+	default:
+		result, err = tx.ExecContext(ctx, pm.script)
+		err = errors.Wrap(err, pm.script)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Problem with migration %s", m.Base().Name)
+		_ = tx.Rollback()
+		if d.Options.WithoutFailureStatus {
+			return nil, err
+		}
+		return nil, p.saveStatusTx(ctx, log, d, m, err)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, true, nil)
+	return
+}
+
+// CreateSchemaTableIfNotExists creates the migration tracking table for libschema.
+// It is expected to be called by libschema.
+func (p *Spanner) CreateSchemaTableIfNotExists(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	tableName, err := trackingTableName(d)
+	if err != nil {
+		return err
+	}
+	err = p.runDDL(ctx, d, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				library		STRING(255) NOT NULL,
+				migration	STRING(255) NOT NULL,
+				done		BOOL NOT NULL,
+				error		STRING(MAX) NOT NULL,
+				applied_by	STRING(255),
+				run_id		STRING(255),
+				comment		STRING(MAX),
+				updated_at	TIMESTAMP OPTIONS (allow_commit_timestamp = true),
+			) PRIMARY KEY (library, migration)`, tableName),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s_lock (
+				id		INT64 NOT NULL,
+				owner		STRING(255) NOT NULL,
+				locked_at	TIMESTAMP OPTIONS (allow_commit_timestamp = true),
+			) PRIMARY KEY (id)`, tableName),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not create libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+// DropTrackingTable drops the migration tracking table and its lock table.
+// It is expected to be called by libschema.
+func (p *Spanner) DropTrackingTable(ctx context.Context, _ *internal.Log, d *libschema.Database) error {
+	tableName, err := trackingTableName(d)
+	if err != nil {
+		return err
+	}
+	err = p.runDDL(ctx, d, []string{
+		`DROP TABLE IF EXISTS ` + tableName,
+		`DROP TABLE IF EXISTS ` + tableName + `_lock`,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not drop libschema migrations table '%s'", tableName)
+	}
+	return nil
+}
+
+var simpleIdentifierRE = regexp.MustCompile(`\A[A-Za-z][A-Za-z0-9_]*\z`)
+
+// trackingTableName returns the name of the tracking table.  Spanner does
+// not have schemas so a schema.table name becomes schema_table.
+func trackingTableName(d *libschema.Database) (string, error) {
+	tableName := d.Options.TrackingTable
+	s := strings.Split(tableName, ".")
+	switch len(s) {
+	case 1, 2:
+		for _, part := range s {
+			if !simpleIdentifierRE.MatchString(part) {
+				return "", errors.Errorf("Tracking table '%s' must be made of simple identifiers", tableName)
+			}
+		}
+		return strings.Join(s, "_"), nil
+	default:
+		return "", errors.Errorf("Tracking table '%s' is not valid", tableName)
+	}
+}
+
+var statusSaver = libschema.StatusSaver{
+	Placeholder: libschema.AtPPlaceholder,
+	Query: func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf(`
+			INSERT OR UPDATE INTO %s (library, migration, done, error, applied_by, run_id, comment, updated_at)
+			VALUES (%s, %s, %s, %s, %s, %s, %s, PENDING_COMMIT_TIMESTAMP())`, table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	},
+}
+
+func (p *Spanner) saveStatus(ctx context.Context, log *internal.Log, tx *sql.Tx, d *libschema.Database, m libschema.Migration, done bool, migrationError error) error {
+	tableName, err := trackingTableName(d)
+	if err != nil {
+		return err
+	}
+	return statusSaver.Save(ctx, log, tx, d, tableName, m, done, migrationError)
+}
+
+// MarkMigrationDone records a migration as done without running it.
+// It is expected to be called by libschema.
+func (p *Spanner) MarkMigrationDone(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) error {
+	return p.SetMigrationStatus(ctx, log, d, m, true)
+}
+
+// SetMigrationStatus records a migration as done, or not done, without
+// running it.  It is expected to be called by libschema.
+func (p *Spanner) SetMigrationStatus(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration, done bool) error {
+	tx, err := d.DB().BeginTx(ctx, d.Options.MigrationTxOptions)
+	if err != nil {
+		return errors.Wrapf(err, "Tx for saving status for %s", m.Base().Name)
+	}
+	err = p.saveStatus(ctx, log, tx, d, m, done, nil)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrapf(tx.Commit(), "Commit status for %s", m.Base().Name)
+}
+
+// LockMigrationsTable locks the migration tracking table for exclusive use by the
+// migrations running now.
+// It is expected to be called by libschema.
+//
+// The lock is a singleton row that is inserted in a read-write transaction.
+// If the row already exists, LockMigrationsTable waits until it is deleted
+// or the context is cancelled.
+func (p *Spanner) LockMigrationsTable(ctx context.Context, log *internal.Log, d *libschema.Database) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	tableName, err := trackingTableName(d)
+	if err != nil {
+		return err
+	}
+	if p.lockTable != "" {
+		return errors.Errorf("libschema migrations table, '%s' already locked", tableName)
+	}
+	lockTable := tableName + "_lock"
+	owner := fmt.Sprintf("%s-%d", d.Name, time.Now().UnixNano())
+	for {
+		got, err := tryLock(ctx, d.DB(), lockTable, owner)
+		if err != nil {
+			return errors.Wrapf(err, "Could not get lock for libschema migrations")
+		}
+		if got {
+			p.lockTable = lockTable
+			p.lockOwner = owner
+			p.lockDB = d.DB()
+			return nil
+		}
+		log.Info("Waiting for libschema migrations lock", map[string]interface{}{
+			"lockTable": lockTable,
+		})
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "Could not get lock for libschema migrations")
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
+
+func tryLock(ctx context.Context, db *sql.DB, lockTable string, owner string) (bool, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var holder string
+	err = tx.QueryRowContext(ctx, `SELECT owner FROM `+lockTable+` WHERE id = 1`).Scan(&holder)
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, sql.ErrNoRows):
+	default:
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO `+lockTable+` (id, owner, locked_at)
+		VALUES (1, @p1, PENDING_COMMIT_TIMESTAMP())`, owner)
+	if err != nil {
+		if isLockContention(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		if isLockContention(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+var contentionRE = regexp.MustCompile(`\bcode = "?(?:Aborted|AlreadyExists)\b`)
+
+// isLockContention reports if err is the Aborted or AlreadyExists error
+// that Spanner returns when a concurrent transaction inserted the lock
+// row first.  Spanner errors are matched by their text since this
+// package does not depend upon the gRPC packages.
+func isLockContention(err error) bool {
+	return contentionRE.MatchString(err.Error())
+}
+
+// UnlockMigrationsTable unlocks the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Spanner) UnlockMigrationsTable(_ *internal.Log) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.lockTable == "" {
+		return errors.Errorf("libschema migrations table, not locked")
+	}
+	_, err := p.lockDB.Exec(`DELETE FROM `+p.lockTable+` WHERE id = 1 AND owner = @p1`, p.lockOwner)
+	if err != nil {
+		return errors.Wrap(err, "Could not release lock for schema migrations")
+	}
+	p.lockTable = ""
+	p.lockOwner = ""
+	p.lockDB = nil
+	return nil
+}
+
+// LoadStatus loads the current status of all migrations from the migration tracking table.
+// It is expected to be called by libschema.
+func (p *Spanner) LoadStatus(ctx context.Context, _ *internal.Log, d *libschema.Database) ([]libschema.MigrationName, error) {
+	tableName, err := trackingTableName(d)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.StatusDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT	library, migration, done, error
+		FROM	%s`, tableName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot query migration status")
+	}
+	defer rows.Close()
+	var unknowns []libschema.MigrationName
+	for rows.Next() {
+		var (
+			name   libschema.MigrationName
+			status libschema.MigrationStatus
+		)
+		err := rows.Scan(&name.Library, &name.Name, &status.Done, &status.Error)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot scan migration status")
+		}
+		if m, ok := d.Lookup(name); ok {
+			m.Base().SetStatus(status)
+		} else if status.Done {
+			unknowns = append(unknowns, name)
+		}
+	}
+	return unknowns, nil
+}
+
+// IsMigrationSupported checks to see if a migration is well-formed.  Absent a code change, this
+// should always return nil.
+// It is expected to be called by libschema.
+func (p *Spanner) IsMigrationSupported(d *libschema.Database, _ *internal.Log, migration libschema.Migration) error {
+	m, ok := migration.(*smigration)
+	if !ok {
+		return fmt.Errorf("Non-spanner migration %s registered with spanner migrations", migration.Base().Name)
+	}
+	if m.HasDedicatedConn() {
+		return errors.Errorf("Migration %s uses WithDedicatedConn which is not supported by lsspanner", m.Name)
+	}
+	ddl, err := m.ddlStatements()
+	if err != nil {
+		return errors.Wrapf(err, "Migration %s", m.Name)
+	}
+	if ddl != nil && m.HasSkipIfTx() {
+		return errors.Errorf("Migration %s uses WithSkipIf but DDL cannot run in a transaction: use SkipIf instead", m.Name)
+	}
+	if m.script == "" && m.ddl == nil && m.computed == nil {
+		return errors.Errorf("Migration %s is not supported", m.Name)
+	}
+	script := m.script
+	if m.ddl != nil {
+		script = strings.Join(m.ddl, ";\n")
+	}
+	return d.ValidateMigration(m, script)
+}
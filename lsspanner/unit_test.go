@@ -0,0 +1,286 @@
+package lsspanner
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackingTableName(t *testing.T) {
+	cases := []struct {
+		tt    string
+		err   bool
+		table string
+	}{
+		{
+			tt:    "libschema.migration_status",
+			table: "libschema_migration_status",
+		},
+		{
+			tt:    "foo",
+			table: "foo",
+		},
+		{
+			tt:  "foo'bar.baz",
+			err: true,
+		},
+		{
+			tt:  "x.y.z",
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tt, func(t *testing.T) {
+			d := &libschema.Database{
+				Options: libschema.Options{
+					TrackingTable: tc.tt,
+				},
+			}
+			table, err := trackingTableName(d)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				if assert.NoError(t, err) {
+					assert.Equal(t, tc.table, table)
+				}
+			}
+		})
+	}
+}
+
+func TestDDLStatements(t *testing.T) {
+	skipTx := libschema.WithSkipIf(func(context.Context, *sql.Tx) (bool, error) { return false, nil })
+	cases := []struct {
+		name      string
+		migration libschema.Migration
+		ddl       []string
+		err       bool
+	}{
+		{
+			name:      "dml",
+			migration: Script("x", `UPDATE users SET level = 1 WHERE TRUE`),
+		},
+		{
+			name:      "ddl",
+			migration: Script("x", `CREATE TABLE IF NOT EXISTS users (id INT64) PRIMARY KEY (id)`),
+			ddl:       []string{`CREATE TABLE IF NOT EXISTS users (id INT64) PRIMARY KEY (id)`},
+		},
+		{
+			name:      "non-idempotent",
+			migration: Script("x", `CREATE INDEX users_level ON users (level)`),
+			err:       true,
+		},
+		{
+			name: "batch",
+			migration: DDL("x", []string{
+				`CREATE TABLE IF NOT EXISTS a (id INT64) PRIMARY KEY (id)`,
+				`CREATE TABLE IF NOT EXISTS b (id INT64) PRIMARY KEY (id)`,
+			}),
+			ddl: []string{
+				`CREATE TABLE IF NOT EXISTS a (id INT64) PRIMARY KEY (id)`,
+				`CREATE TABLE IF NOT EXISTS b (id INT64) PRIMARY KEY (id)`,
+			},
+		},
+		{
+			name:      "computed",
+			migration: Computed("x", func(context.Context, *sql.Tx) error { return nil }),
+		},
+		{
+			name:      "ddl with WithSkipIf",
+			migration: Script("x", `CREATE INDEX users_level ON users (level)`, skipTx),
+			ddl:       []string{`CREATE INDEX users_level ON users (level)`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ddl, err := tc.migration.(*smigration).ddlStatements()
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.ddl, ddl)
+			}
+		})
+	}
+
+	p := &Spanner{}
+	d := &libschema.Database{}
+	assert.Error(t, p.IsMigrationSupported(d, nil, Script("x", `CREATE INDEX users_level ON users (level)`, skipTx)),
+		"WithSkipIf with DDL")
+	assert.NoError(t, p.IsMigrationSupported(d, nil, Script("x", `DELETE FROM users WHERE level = 0`, skipTx)),
+		"WithSkipIf with DML")
+
+	d.Options.MigrationValidators = []libschema.MigrationValidator{libschema.BanStatements("DROP TABLE")}
+	assert.Error(t, p.IsMigrationSupported(d, nil, DDL("x", []string{`CREATE TABLE a (id INT64) PRIMARY KEY (id)`, `DROP TABLE b`})),
+		"banned DDL")
+	assert.NoError(t, p.IsMigrationSupported(d, nil, Script("x", `DELETE FROM users WHERE level = 0`)),
+		"allowed DML")
+}
+
+func TestDropTrackingTable(t *testing.T) {
+	var got []string
+	p := &Spanner{
+		ddlRunner: func(_ context.Context, statements []string) error {
+			got = append(got, statements...)
+			return nil
+		},
+	}
+	d := &libschema.Database{
+		Options: libschema.Options{
+			TrackingTable: "libschema.migration_status",
+		},
+	}
+	assert.NoError(t, p.DropTrackingTable(context.Background(), nil, d))
+	assert.Equal(t, []string{
+		"DROP TABLE IF EXISTS libschema_migration_status",
+		"DROP TABLE IF EXISTS libschema_migration_status_lock",
+	}, got)
+}
+
+const (
+	statusQuery  = "SELECT library, migration, done, error FROM libschema_migration_status"
+	lockQuery    = "SELECT owner FROM libschema_migration_status_lock WHERE id = 1"
+	lockInsert   = "INSERT INTO libschema_migration_status_lock"
+	statusUpsert = "INSERT OR UPDATE INTO libschema_migration_status"
+	lockDelete   = "DELETE FROM libschema_migration_status_lock"
+)
+
+func TestMigrate(t *testing.T) {
+	fake := fakesql.Scenario{
+		StatusQuery: statusQuery,
+		SaveStatus:  statusUpsert,
+		True:        true,
+		False:       false,
+		Failure:     errors.New("spanner: code = AlreadyExists"),
+		New: func(log *internal.Log, s *libschema.Schema, db *sql.DB) (*libschema.Database, libschema.Driver, error) {
+			return New(log, "test", s, db)
+		},
+		Script: Script,
+		T2:     `CREATE TABLE IF NOT EXISTS t2 (id INT64) PRIMARY KEY (id)`,
+	}.Run(t)
+
+	assert.True(t, fake.Sequence(
+		"BEGIN", lockQuery, lockInsert, "COMMIT",
+		statusQuery,
+		"CREATE TABLE IF NOT EXISTS t2",
+		"BEGIN", statusUpsert, "COMMIT",
+		"BEGIN", "INSERT INTO t3", "ROLLBACK",
+		"BEGIN", statusUpsert, "COMMIT",
+		lockDelete,
+	), "DDL runs outside of transactions, statements:\n%s", fake)
+}
+
+func TestDML(t *testing.T) {
+	fake := &fakesql.DB{}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	s := libschema.New(ctx, libschema.Options{})
+	dbase, _, err := New(libschema.LogFromLog(t), "test", s, db)
+	require.NoError(t, err)
+	dbase.Migrations("L", Script("T1", `INSERT INTO t1 (id) VALUES (1)`))
+
+	require.NoError(t, s.Migrate(ctx))
+	assert.True(t, fake.Sequence(
+		"BEGIN", "INSERT INTO t1", statusUpsert, "COMMIT",
+	), "DML and its status are in one transaction, statements:\n%s", fake)
+}
+
+func TestLockWait(t *testing.T) {
+	defer func(interval time.Duration) {
+		LockPollInterval = interval
+	}(LockPollInterval)
+	LockPollInterval = time.Millisecond
+
+	var checks, commits int
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			switch query {
+			case lockQuery:
+				checks++
+				rows := &fakesql.Rows{Columns: []string{"owner"}}
+				if checks == 1 {
+					rows.Values = [][]driver.Value{{"someone-else"}}
+				}
+				return rows, nil
+			case "COMMIT":
+				commits++
+				if commits == 1 {
+					return nil, errors.New("spanner: code = Aborted")
+				}
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx := context.Background()
+	log := libschema.LogFromLog(t)
+	s := libschema.New(ctx, libschema.Options{})
+	d, p, err := New(log, "test", s, db)
+	require.NoError(t, err)
+
+	require.NoError(t, p.LockMigrationsTable(ctx, log, d))
+	// held by someone else, then lost to a concurrent insert
+	assert.Equal(t, 3, checks, "lock checks")
+	inserts := fake.Matching(lockInsert)
+	require.Len(t, inserts, 2)
+	owner := inserts[1].Args[0]
+	assert.Equal(t, inserts[0].Args[0], owner, "the same owner for each attempt")
+
+	require.NoError(t, p.UnlockMigrationsTable(log))
+	deletes := fake.Matching(lockDelete)
+	require.Len(t, deletes, 1)
+	assert.Equal(t, []driver.Value{owner}, deletes[0].Args, "only our lock is removed")
+
+	fakesql.CheckLocking(t,
+		func() error { return p.LockMigrationsTable(ctx, log, d) },
+		func() error { return p.UnlockMigrationsTable(log) })
+}
+
+func TestLockCommitError(t *testing.T) {
+	fake := &fakesql.DB{
+		Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+			if query == "COMMIT" {
+				return nil, errors.New(`spanner: code = "PermissionDenied", desc = "no write access"`)
+			}
+			return nil, nil
+		},
+	}
+	db := fake.Open()
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	log := libschema.LogFromLog(t)
+	d, p, err := New(log, "test", libschema.New(ctx, libschema.Options{}), db)
+	require.NoError(t, err)
+
+	err = p.LockMigrationsTable(ctx, log, d)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "PermissionDenied")
+	}
+	assert.Len(t, fake.Matching(lockInsert), 1, "not retried")
+}
+
+func TestIsLockContention(t *testing.T) {
+	assert.True(t, isLockContention(errors.New(`spanner: code = "Aborted", desc = "Transaction was aborted."`)))
+	assert.True(t, isLockContention(errors.New(`spanner: code = "AlreadyExists", desc = "Row [1] in table lock already exists"`)))
+	assert.True(t, isLockContention(errors.Wrap(errors.New(`rpc error: code = Aborted desc = aborted`), "commit")))
+	assert.False(t, isLockContention(errors.New(`spanner: code = "PermissionDenied", desc = "no write access"`)))
+	assert.False(t, isLockContention(errors.New(`spanner: code = "Unavailable", desc = "connection reset"`)))
+}
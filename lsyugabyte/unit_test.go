@@ -0,0 +1,100 @@
+package lsyugabyte
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal/fakesql"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSerializationFailure(t *testing.T) {
+	conflict := &pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"}
+	assert.True(t, isSerializationFailure(conflict))
+	assert.True(t, isSerializationFailure(errors.Wrap(errors.Wrap(conflict, "CREATE TABLE"), "Problem with migration")), "wrapped")
+	assert.False(t, isSerializationFailure(&pq.Error{Code: "42P07"}), "duplicate table")
+	assert.False(t, isSerializationFailure(errors.New("40001")))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &YugabyteDB{}
+	WithRetry(0, 10*time.Millisecond, 50*time.Millisecond)(p)
+	assert.Equal(t, 1, p.retryAttempts, "at least one attempt")
+	for n, max := range []time.Duration{10, 20, 40, 50, 50} {
+		max *= time.Millisecond
+		delay := p.retryBackoff(n)
+		assert.LessOrEqual(t, int64(delay), int64(max), n)
+		assert.GreaterOrEqual(t, int64(delay), int64(max/2), n)
+	}
+}
+
+const statusInsert = `INSERT INTO "libschema"."migration_status"`
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures int   // how many times the migration fails
+		err      error // how it fails
+		attempts int
+		done     bool
+	}{
+		{name: "retried", failures: 1, err: &pq.Error{Code: "40001"}, attempts: 2, done: true},
+		{name: "gives up", failures: 5, err: &pq.Error{Code: "40001"}, attempts: 3},
+		{name: "not retried", failures: 1, err: &pq.Error{Code: "23505"}, attempts: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int
+			fake := &fakesql.DB{
+				Respond: func(query string, _ []driver.Value) (*fakesql.Rows, error) {
+					if query == "INSERT INTO t1 (id) VALUES (1)" {
+						attempts++
+						if attempts <= tc.failures {
+							return nil, tc.err
+						}
+					}
+					return nil, nil
+				},
+			}
+			db := fake.Open()
+			defer db.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			log := libschema.LogFromLog(t)
+			d, p, err := New(log, "test", libschema.New(ctx, libschema.Options{}), db, WithRetry(3, time.Millisecond, time.Millisecond))
+			require.NoError(t, err)
+			d.Migrations("L", Script("T1", `INSERT INTO t1 (id) VALUES (1)`))
+			m, ok := d.Lookup(libschema.MigrationName{Library: "L", Name: "T1"})
+			require.True(t, ok)
+
+			_, err = p.DoOneMigration(ctx, log, d, m)
+			assert.Equal(t, tc.attempts, attempts, "attempts")
+			saved := fake.Matching(statusInsert)
+			require.Len(t, saved, tc.attempts, "each failure is saved, statements:\n%s", fake)
+			last := saved[len(saved)-1]
+			if tc.done {
+				require.NoError(t, err)
+				assert.Equal(t, []driver.Value{"L", "T1", true, ""}, last.Args[:4], "done after the failure was saved")
+				assert.True(t, fake.Sequence(
+					"BEGIN", "INSERT INTO t1", "ROLLBACK",
+					"BEGIN", statusInsert, "COMMIT",
+					"BEGIN", "INSERT INTO t1", statusInsert, "COMMIT",
+				), "statements:\n%s", fake)
+				return
+			}
+			require.Error(t, err)
+			var pqErr *pq.Error
+			require.True(t, errors.As(err, &pqErr), "pq.Error")
+			assert.Equal(t, tc.err.(*pq.Error).Code, pqErr.Code)
+			assert.Equal(t, []driver.Value{"L", "T1", false}, last.Args[:3], "failed")
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package lsyugabyte has a libschema.Driver support YugabyteDB
+package lsyugabyte
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/internal"
+	"github.com/muir/libschema/lspostgres"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// YugabyteDB is a libschema.Driver for connecting to YugabyteDB using
+// its PostgreSQL-compatible YSQL API.  It is the lspostgres driver with
+// one addition: migrations that fail with a serialization failure
+// (SQLSTATE 40001) are retried.  YugabyteDB reports conflicts between
+// concurrent transactions that way much more often than PostgreSQL does.
+//
+// DDL is transactional so, as with PostgreSQL, each migration and the
+// recording of its status are committed together.  A retried migration
+// has been rolled back so Computed() migrations may be called more than
+// once.
+type YugabyteDB struct {
+	*lspostgres.Postgres
+	retryAttempts int
+	retryInitial  time.Duration
+	retryMax      time.Duration
+}
+
+// Defaults for WithRetry
+const (
+	DefaultRetryAttempts = 5
+	DefaultRetryInitial  = 100 * time.Millisecond
+	DefaultRetryMax      = 5 * time.Second
+)
+
+// YugabyteOpt are options for New
+type YugabyteOpt func(*YugabyteDB)
+
+// WithRetry changes how migrations that fail with serialization failures
+// are retried.  attempts is the total number of tries: use 1 to disable
+// retries.  The delay between attempts starts at initial and doubles up
+// to max.  Each delay is randomized to between half and all of its
+// value.
+func WithRetry(attempts int, initial, max time.Duration) YugabyteOpt {
+	return func(p *YugabyteDB) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		if initial <= 0 {
+			initial = time.Millisecond
+		}
+		if max < initial {
+			max = initial
+		}
+		p.retryAttempts = attempts
+		p.retryInitial = initial
+		p.retryMax = max
+	}
+}
+
+// New creates a libschema.Database with a YugabyteDB driver built in.
+func New(log *internal.Log, name string, schema *libschema.Schema, db *sql.DB, options ...YugabyteOpt) (*libschema.Database, *YugabyteDB, error) {
+	p := &YugabyteDB{
+		Postgres:      &lspostgres.Postgres{},
+		retryAttempts: DefaultRetryAttempts,
+		retryInitial:  DefaultRetryInitial,
+		retryMax:      DefaultRetryMax,
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	d, err := schema.NewDatabase(log, name, db, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, p, nil
+}
+
+// Script creates a libschema.Migration from a SQL string
+func Script(name string, sqlText string, opts ...libschema.MigrationOption) libschema.Migration {
+	return lspostgres.Script(name, sqlText, opts...)
+}
+
+// Generate creates a libschema.Migration from a function that returns a
+// SQL string
+func Generate(
+	name string,
+	generator func(context.Context, *sql.Tx) string,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return lspostgres.Generate(name, generator, opts...)
+}
+
+// Computed creates a libschema.Migration from a Go function to run
+// the migration directly.
+func Computed(
+	name string,
+	action func(context.Context, *sql.Tx) error,
+	opts ...libschema.MigrationOption) libschema.Migration {
+	return lspostgres.Computed(name, action, opts...)
+}
+
+// DoOneMigration applies a single migration, retrying it if it fails
+// with a serialization failure.
+// It is expected to be called by libschema.
+func (p *YugabyteDB) DoOneMigration(ctx context.Context, log *internal.Log, d *libschema.Database, m libschema.Migration) (sql.Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := p.Postgres.DoOneMigration(ctx, log, d, m)
+		if err == nil || attempt >= p.retryAttempts || !isSerializationFailure(err) {
+			return result, err
+		}
+		delay := p.retryBackoff(attempt - 1)
+		log.Info("Serialization failure, retrying migration", map[string]interface{}{
+			"migration": m.Base().Name,
+			"attempt":   attempt,
+			"delay":     delay.String(),
+			"error":     err.Error(),
+		})
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "Retry migration %s after %s", m.Base().Name, err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
+func (p *YugabyteDB) retryBackoff(n int) time.Duration {
+	delay := p.retryInitial
+	for i := 0; i < n && delay < p.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > p.retryMax {
+		delay = p.retryMax
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
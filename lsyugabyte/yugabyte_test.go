@@ -0,0 +1,56 @@
+package lsyugabyte_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/muir/libschema"
+	"github.com/muir/libschema/lstesting"
+	"github.com/muir/libschema/lsyugabyte"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+
+docker run -d --name yugabyte -p 5433:5433 yugabytedb/yugabyte:latest bin/yugabyted start --background=false
+
+LIBSCHEMA_YUGABYTE_TEST_DSN="postgresql://yugabyte@localhost:5433/yugabyte?sslmode=disable"
+
+*/
+
+func TestYugabyteMigrations(t *testing.T) {
+	dsn := os.Getenv("LIBSCHEMA_YUGABYTE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("Set $LIBSCHEMA_YUGABYTE_TEST_DSN to test libschema/lsyugabyte")
+	}
+
+	options, cleanup := lstesting.FakeSchema(t, "CASCADE")
+	options.ErrorOnUnknownMigrations = true
+
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err, "open database")
+	defer db.Close()
+	defer cleanup(db)
+
+	s := libschema.New(context.Background(), options)
+	dbase, _, err := lsyugabyte.New(libschema.LogFromLog(t), "test", s, db,
+		lsyugabyte.WithRetry(3, 10*time.Millisecond, 100*time.Millisecond))
+	require.NoError(t, err, "libschema NewDatabase")
+	dbase.Migrations("L1",
+		lsyugabyte.Script("T1", `CREATE TABLE T1 (id text PRIMARY KEY)`),
+		lsyugabyte.Computed("T2", func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO T1 (id) VALUES ('T2')`)
+			return err
+		}),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+options.SchemaOverride+`.T1`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,64 @@
+package libschema
+
+// NaturalNameOrder is a comparator for Options.MigrationOrder.  It
+// compares migration names so that runs of digits compare numerically:
+// "9_add_users" sorts before "10_add_orgs".  Other characters compare
+// byte by byte.
+func NaturalNameOrder(a, b MigrationName) bool {
+	return naturalLess(a.Name, b.Name)
+}
+
+func naturalLess(a, b string) bool {
+	for len(a) > 0 && len(b) > 0 {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			var da, db string
+			da, a = digitRun(a)
+			db, b = digitRun(b)
+			if c := compareNumbers(da, db); c != 0 {
+				return c < 0
+			}
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// digitRun splits s into its leading digits and the remainder
+func digitRun(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareNumbers compares two strings of digits numerically.  When they
+// are numerically equal, the one with fewer leading zeros comes first.
+func compareNumbers(a, b string) int {
+	ta, tb := trimZeros(a), trimZeros(b)
+	switch {
+	case len(ta) != len(tb):
+		return len(ta) - len(tb)
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	default:
+		return len(a) - len(b)
+	}
+}
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNaturalNameOrder(t *testing.T) {
+	less := func(a, b string) bool {
+		return libschema.NaturalNameOrder(libschema.MigrationName{Name: a}, libschema.MigrationName{Name: b})
+	}
+	assert.True(t, less("9", "10"))
+	assert.False(t, less("10", "9"))
+	assert.True(t, less("9_add_users", "10_add_orgs"))
+	assert.True(t, less("20240101_a", "20240102_a"))
+	assert.True(t, less("a", "b"))
+	assert.True(t, less("a", "a1"))
+	assert.True(t, less("v2", "v10"))
+	assert.True(t, less("7", "007"))
+	assert.False(t, less("x", "x"))
+}
+
+func TestMigrationOrder(t *testing.T) {
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{
+		MigrationOrder: libschema.NaturalNameOrder,
+	}, driver, func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("10"),
+			fake("9"),
+			fake("11"),
+		)
+	})
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"L1: 9",
+		"L1: 10",
+		"L1: 11",
+	}, driver.applied)
+
+	driver.applied = nil
+	s = fakeSchema(t, libschema.Options{}, driver, func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("10"),
+			fake("9"),
+			fake("11"),
+			fake("12"),
+		)
+	})
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: 12"}, driver.applied, "status is by name")
+}
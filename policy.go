@@ -0,0 +1,56 @@
+package libschema
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MigrationValidator enforces a policy on migrations.  Validators are
+// run by the driver's IsMigrationSupported which is called for every
+// registered migration before the migration lock is taken.  script is
+// the SQL of migrations created with a driver's Script() (or DDL()
+// for lsspanner).  It is empty for Generate() and Computed() migrations
+// since their SQL is not known until they run.
+type MigrationValidator func(d *Database, m Migration, script string) error
+
+// ValidateMigration runs Options.MigrationValidators.  It is expected to
+// be called by drivers from IsMigrationSupported.
+func (d *Database) ValidateMigration(m Migration, script string) error {
+	for _, validator := range d.Options.MigrationValidators {
+		err := validator(d, m, script)
+		if err != nil {
+			return errors.Wrapf(err, "Migration %s rejected", m.Base().Name)
+		}
+	}
+	return nil
+}
+
+// BanStatements returns a MigrationValidator that rejects scripts that
+// use any of the statements, for example:
+//
+//	BanStatements("TRUNCATE", "DROP DATABASE")
+//
+// Matching is case-insensitive, any whitespace matches the spaces
+// between words, and only whole words match.  The scripts are not
+// parsed so a banned statement that is in a comment or a string is
+// also rejected.
+func BanStatements(statements ...string) MigrationValidator {
+	patterns := make([]*regexp.Regexp, len(statements))
+	for i, statement := range statements {
+		words := strings.Fields(statement)
+		for j, word := range words {
+			words[j] = regexp.QuoteMeta(word)
+		}
+		patterns[i] = regexp.MustCompile(`(?i)\b` + strings.Join(words, `\s+`) + `\b`)
+	}
+	return func(_ *Database, _ Migration, script string) error {
+		for i, re := range patterns {
+			if re.MatchString(script) {
+				return errors.Errorf("%s is not allowed", statements[i])
+			}
+		}
+		return nil
+	}
+}
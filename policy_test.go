@@ -0,0 +1,72 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanStatements(t *testing.T) {
+	ban := libschema.BanStatements("TRUNCATE", "DROP DATABASE")
+	m := fake("m")
+	cases := []struct {
+		script string
+		err    string
+	}{
+		{script: "TRUNCATE users", err: "TRUNCATE is not allowed"},
+		{script: "INSERT INTO t VALUES (1);\ntruncate table users;", err: "TRUNCATE is not allowed"},
+		{script: "DROP  \n\tdatabase foo", err: "DROP DATABASE is not allowed"},
+		{script: "DROP TABLE foo"},
+		{script: "ALTER TABLE t ADD COLUMN truncated boolean"},
+		{script: "DROP DATABASES_OLD"},
+		{script: ""},
+	}
+	for _, tc := range cases {
+		err := ban(nil, m, tc.script)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.script)
+		} else if assert.Error(t, err, tc.script) {
+			assert.Equal(t, tc.err, err.Error(), tc.script)
+		}
+	}
+}
+
+func TestMigrationValidators(t *testing.T) {
+	var validated []string
+	options := libschema.Options{
+		MigrationValidators: []libschema.MigrationValidator{
+			func(_ *libschema.Database, m libschema.Migration, _ string) error {
+				validated = append(validated, m.Base().Name.String())
+				return nil
+			},
+			libschema.BanStatements("TRUNCATE"),
+		},
+	}
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fakeScript("a1", "CREATE TABLE users (id int)"),
+			fakeScript("a2", "TRUNCATE users"),
+		)
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, options, driver, define)
+	err := s.Migrate(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Migration L1: a2 rejected: TRUNCATE is not allowed")
+	assert.Equal(t, []string{"L1: a1", "L1: a2"}, validated)
+	assert.Equal(t, 0, driver.locks, "rejected before locking")
+	assert.Empty(t, driver.applied, "nothing run")
+
+	validated = nil
+	options.MigrationValidators = options.MigrationValidators[:1]
+	driver = newFakeDriver()
+	s = fakeSchema(t, options, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: a1", "L1: a2"}, validated)
+	assert.Equal(t, []string{"L1: a1", "L1: a2"}, driver.applied)
+}
@@ -0,0 +1,53 @@
+package libschema
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// Preflight checks, without taking the migration lock or running any
+// migrations, that Migrate will be able to record its progress: that
+// the database (and the tracking database, see SetTrackingDB) can be
+// reached, that the tracking table exists or can be created, that it
+// can be read, and, if the driver implements TrackingTableWriteChecker,
+// that a row can be written to it.  The write is rolled back.  Run
+// Preflight at the start of a deploy so that a missing grant is found
+// before any migration runs instead of when the first status is saved.
+func (d *Database) Preflight(ctx context.Context) error {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	err := d.checkTrackingDB()
+	if err != nil {
+		return err
+	}
+	for _, db := range []*sql.DB{d.DB(), d.TrackingDB(), d.StatusDB()} {
+		if db == nil {
+			continue
+		}
+		err := db.PingContext(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "Preflight %s: could not connect", d.Name)
+		}
+	}
+	err = d.driver.CreateSchemaTableIfNotExists(ctx, d.log, d)
+	if err != nil {
+		return errors.Wrapf(err, "Preflight %s: the tracking table does not exist and could not be created", d.Name)
+	}
+	_, err = d.driver.LoadStatus(ctx, d.log, d)
+	if err != nil {
+		return errors.Wrapf(err, "Preflight %s: could not read the tracking table", d.Name)
+	}
+	checker, ok := d.driver.(TrackingTableWriteChecker)
+	if !ok {
+		d.log.Info("Preflight: the driver cannot check writes to the tracking table", map[string]interface{}{
+			"database": d.Name,
+		})
+		return nil
+	}
+	err = checker.CheckTrackingTableWrite(ctx, d.log, d)
+	return errors.Wrapf(err, "Preflight %s", d.Name)
+}
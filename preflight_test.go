@@ -0,0 +1,36 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight(t *testing.T) {
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	dbase.Migrations("L1", fake("a1"))
+
+	require.NoError(t, dbase.Preflight(context.Background()))
+	assert.False(t, driver.locked, "no lock")
+	assert.Equal(t, 0, driver.locks, "no lock")
+	assert.Empty(t, driver.applied, "nothing run")
+
+	driver.writeErr = errors.New("INSERT command denied")
+	err = dbase.Preflight(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Preflight test: INSERT command denied")
+	}
+
+	s = libschema.New(context.Background(), libschema.Options{})
+	dbase, err = s.NewDatabase(libschema.LogFromLog(t), "test", nil, noDropDriver{Driver: driver})
+	require.NoError(t, err)
+	assert.NoError(t, dbase.Preflight(context.Background()), "write check is skipped")
+}
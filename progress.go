@@ -0,0 +1,74 @@
+package libschema
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ProgressLogInterval limits how often progress is logged for each
+// migration.  Options.OnMigrationProgress is called for every report.
+var ProgressLogInterval = 10 * time.Second
+
+// ProgressReporter lets a long-running migration, like a Computed()
+// backfill, report how far along it is.  See Progress.
+type ProgressReporter struct {
+	d       *Database
+	name    MigrationName
+	lock    sync.Mutex
+	lastLog time.Time
+}
+
+type progressKey struct{}
+
+// Progress returns the ProgressReporter for the migration that is
+// running.  Generate() and Computed() migrations should pass the
+// context.Context that they are given.  Outside of a migration it
+// returns nil.  Report can be called on a nil ProgressReporter so
+// migrations do not need to check.
+//
+//	libschema.Progress(ctx).Report(rowsDone, rowsTotal)
+func Progress(ctx context.Context) *ProgressReporter {
+	p, _ := ctx.Value(progressKey{}).(*ProgressReporter)
+	return p
+}
+
+func withProgress(ctx context.Context, d *Database, name MigrationName) context.Context {
+	return context.WithValue(ctx, progressKey{}, &ProgressReporter{
+		d:    d,
+		name: name,
+	})
+}
+
+// Report records that done units of work, out of total, are complete.
+// Use zero for total if it is not known.  Progress is logged, at most
+// once per ProgressLogInterval (and always when done reaches total), and
+// passed to Options.OnMigrationProgress.  It is safe for concurrent use.
+func (p *ProgressReporter) Report(done, total int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	now := time.Now()
+	logIt := now.Sub(p.lastLog) >= ProgressLogInterval || (total > 0 && done >= total)
+	if logIt {
+		p.lastLog = now
+	}
+	p.lock.Unlock()
+	if logIt {
+		fields := map[string]interface{}{
+			"database": p.d.Name,
+			"library":  p.name.Library,
+			"name":     p.name.Name,
+			"done":     done,
+		}
+		if total > 0 {
+			fields["total"] = total
+			fields["percent"] = done * 100 / total
+		}
+		p.d.log.Info("Migration progress", fields)
+	}
+	if p.d.Options.OnMigrationProgress != nil {
+		p.d.Options.OnMigrationProgress(p.d, p.name, done, total)
+	}
+}
@@ -0,0 +1,55 @@
+package libschema_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	assert.Nil(t, libschema.Progress(context.Background()), "outside of a migration")
+	libschema.Progress(context.Background()).Report(1, 2) // nil is okay
+
+	type report struct {
+		name        string
+		done, total int
+	}
+	var reports []report
+	var logs captureLog
+	s := libschema.New(context.Background(), libschema.Options{
+		OnMigrationProgress: func(_ *libschema.Database, n libschema.MigrationName, done, total int) {
+			reports = append(reports, report{name: n.String(), done: done, total: total})
+		},
+	})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(&logs), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fakeAction("backfill", func(ctx context.Context) error {
+			for i := 1; i <= 3; i++ {
+				libschema.Progress(ctx).Report(i, 3)
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []report{
+		{name: "L1: backfill", done: 1, total: 3},
+		{name: "L1: backfill", done: 2, total: 3},
+		{name: "L1: backfill", done: 3, total: 3},
+	}, reports)
+
+	var logged []string
+	for _, line := range logs.lines {
+		if strings.Contains(line, "Migration progress") {
+			logged = append(logged, line)
+		}
+	}
+	if assert.Len(t, logged, 2, "first and last are logged") {
+		assert.Contains(t, logged[1], "percent")
+	}
+}
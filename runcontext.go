@@ -0,0 +1,83 @@
+package libschema
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// RunContext is a key/value scratch space that is scoped to a single
+// call to Schema.Migrate().  It lets one migration stash a value (for
+// example, a generated partition name) that a later migration reads.
+// It is safe for concurrent use.
+type RunContext struct {
+	lock   sync.Mutex
+	values map[string]interface{}
+	runID  string
+}
+
+type runContextKey struct{}
+
+// GetRunContext returns the RunContext for the current Migrate() run.
+// Generate() and Computed() migrations should pass the context.Context
+// that they are given.  Outside of Migrate(), it returns nil.
+func GetRunContext(ctx context.Context) *RunContext {
+	rc, _ := ctx.Value(runContextKey{}).(*RunContext)
+	return rc
+}
+
+func withRunContext(ctx context.Context, runID string) context.Context {
+	if runID == "" {
+		runID = newRunID()
+	}
+	return context.WithValue(ctx, runContextKey{}, &RunContext{
+		values: make(map[string]interface{}),
+		runID:  runID,
+	})
+}
+
+// RunID returns Options.RunID or, if that was not set, a random UUID
+// that was generated for this run.  It is recorded in the run_id column
+// of the tracking table for every migration status saved during the run.
+func (rc *RunContext) RunID() string {
+	return rc.runID
+}
+
+// newRunID returns a random (version 4) UUID
+func newRunID() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Get returns the value stored with Set
+func (rc *RunContext) Get(key string) (interface{}, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	v, ok := rc.values[key]
+	return v, ok
+}
+
+// Set stores a value for later migrations in the same Migrate() run
+func (rc *RunContext) Set(key string, value interface{}) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.values[key] = value
+}
+
+// Values returns a copy of everything that has been Set
+func (rc *RunContext) Values() map[string]interface{} {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	values := make(map[string]interface{}, len(rc.values))
+	for k, v := range rc.values {
+		values[k] = v
+	}
+	return values
+}
@@ -0,0 +1,67 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunContext(t *testing.T) {
+	assert.Nil(t, libschema.GetRunContext(context.Background()), "outside Migrate")
+
+	var got []interface{}
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fakeAction("a1", func(ctx context.Context) error {
+				_, ok := libschema.GetRunContext(ctx).Get("partition")
+				assert.False(t, ok, "fresh for each run")
+				libschema.GetRunContext(ctx).Set("partition", "p2024")
+				return nil
+			}),
+		)
+		dbase.Migrations("L2",
+			fakeAction("b1", func(ctx context.Context) error {
+				rc := libschema.GetRunContext(ctx)
+				v, ok := rc.Get("partition")
+				assert.True(t, ok)
+				got = append(got, v)
+				assert.Equal(t, map[string]interface{}{"partition": "p2024"}, rc.Values())
+				return nil
+			}),
+		)
+	}
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []interface{}{"p2024"}, got)
+
+	s = fakeSchema(t, libschema.Options{}, newFakeDriver(), define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []interface{}{"p2024", "p2024"}, got)
+}
+
+type deployKey string
+
+func TestContextValues(t *testing.T) {
+	var got []interface{}
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fakeAction("a1", func(ctx context.Context) error {
+				got = append(got, ctx.Value(deployKey("sha")), ctx.Value(deployKey("actor")))
+				return nil
+			}),
+		)
+	}
+	s := fakeSchema(t, libschema.Options{
+		ContextValues: map[interface{}]interface{}{
+			deployKey("sha"):   "abc123",
+			deployKey("actor"): "deployer",
+		},
+	}, newFakeDriver(), define)
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []interface{}{"abc123", "deployer"}, got)
+}
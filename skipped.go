@@ -0,0 +1,45 @@
+package libschema
+
+import (
+	"context"
+
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSkipped can be returned by a Computed() migration that checked
+// the state of the database and found that there is nothing to do.
+// Like returning nil, the migration is marked done, but it is logged
+// and counted as skipped rather than applied.  It may be wrapped.
+var ErrSkipped = errors.New("migration skipped")
+
+type skippedKey struct{}
+
+func withSkipped(ctx context.Context) (context.Context, *bool) {
+	var skipped bool
+	return context.WithValue(ctx, skippedKey{}, &skipped), &skipped
+}
+
+// ComputedResult is expected to be called by drivers with the error
+// returned by a Computed() action.  If the error is ErrSkipped, the
+// migration is noted as skipped and nil is returned so that the
+// migration is marked done.  Other errors are returned unchanged.
+func ComputedResult(ctx context.Context, log *internal.Log, name MigrationName, err error) error {
+	if err == nil || !errors.Is(err, ErrSkipped) {
+		return err
+	}
+	log.Info("Migration skipped, marking it done", map[string]interface{}{
+		"migration": name,
+	})
+	noteSkipped(ctx)
+	return nil
+}
+
+// noteSkipped records that the migration being run was skipped so that
+// it is counted as skipped rather than applied
+func noteSkipped(ctx context.Context) {
+	if skipped, ok := ctx.Value(skippedKey{}).(*bool); ok {
+		*skipped = true
+	}
+}
@@ -0,0 +1,97 @@
+package libschema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/muir/libschema/internal"
+
+	"github.com/pkg/errors"
+)
+
+// Placeholder returns the bind parameter for the nth argument of
+// a statement.  n starts at 1.
+type Placeholder func(n int) string
+
+// QuestionPlaceholder is for drivers that use "?" (MySQL, SingleStore, ClickHouse)
+func QuestionPlaceholder(int) string { return "?" }
+
+// DollarPlaceholder is for drivers that use "$1" (PostgreSQL)
+func DollarPlaceholder(n int) string { return "$" + strconv.Itoa(n) }
+
+// AtPPlaceholder is for drivers that use "@p1" (SQL Server)
+func AtPPlaceholder(n int) string { return "@p" + strconv.Itoa(n) }
+
+// ColonPlaceholder is for drivers that use ":1" (Oracle)
+func ColonPlaceholder(n int) string { return ":" + strconv.Itoa(n) }
+
+// Execer is satisfied by *sql.DB, *sql.Conn, and *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// StatusSaver records the status of a migration in the tracking table.
+// It exists so that drivers can share the status-saving logic.
+type StatusSaver struct {
+	// Placeholder generates the bind parameters.  If nil,
+	// QuestionPlaceholder is used.
+	Placeholder Placeholder
+
+	// Query generates the statement that saves the status.  The
+	// arguments are, in order: library, migration, done, error,
+	// applied_by, run_id, comment.  run_id is NULL outside of Migrate().
+	// comment (from WithComment) is NULL if not set.
+	Query func(table string, p Placeholder) string
+
+	// DoneValue converts done into the value that is stored.  If nil,
+	// the bool is used as-is.
+	DoneValue func(done bool) interface{}
+}
+
+// Save records the status of a migration
+func (s StatusSaver) Save(ctx context.Context, log *internal.Log, exec Execer, d *Database, table string, m Migration, done bool, migrationError error) error {
+	var estr string
+	if migrationError != nil {
+		estr = migrationError.Error()
+	}
+	log.Info("Saving migration status", map[string]interface{}{
+		"migration": m.Base().Name,
+		"done":      done,
+		"error":     migrationError,
+	})
+	placeholder := s.Placeholder
+	if placeholder == nil {
+		placeholder = QuestionPlaceholder
+	}
+	var doneValue interface{} = done
+	if s.DoneValue != nil {
+		doneValue = s.DoneValue(done)
+	}
+	var runID sql.NullString
+	if rc := GetRunContext(ctx); rc != nil {
+		runID = sql.NullString{String: rc.RunID(), Valid: true}
+	}
+	comment := sql.NullString{String: m.Base().Comment(), Valid: m.Base().Comment() != ""}
+	_, err := exec.ExecContext(ctx, s.Query(table, placeholder), m.Base().Name.Library, m.Base().Name.Name, doneValue, estr, d.AppliedBy(), runID, comment)
+	if err != nil {
+		return errors.Wrapf(err, "Save status for %s", m.Base().Name)
+	}
+	return nil
+}
+
+// AppliedBy returns the value that is recorded in the applied_by column
+// of the tracking table: Options.AppliedBy or, if that is not set,
+// hostname:pid.
+func (d *Database) AppliedBy() string {
+	if d.Options.AppliedBy != "" {
+		return d.Options.AppliedBy
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
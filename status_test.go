@@ -0,0 +1,157 @@
+package libschema_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type captureExec struct {
+	query string
+	args  []interface{}
+}
+
+func (c *captureExec) ExecContext(_ context.Context, query string, args ...interface{}) (sql.Result, error) {
+	c.query = query
+	c.args = args
+	return nil, nil
+}
+
+func TestPlaceholders(t *testing.T) {
+	assert.Equal(t, "?", libschema.QuestionPlaceholder(2))
+	assert.Equal(t, "$2", libschema.DollarPlaceholder(2))
+	assert.Equal(t, "@p2", libschema.AtPPlaceholder(2))
+	assert.Equal(t, ":2", libschema.ColonPlaceholder(2))
+}
+
+func TestStatusSaver(t *testing.T) {
+	m := fake("m1")
+	m.Base().Name.Library = "L1"
+	query := func(table string, ph libschema.Placeholder) string {
+		return fmt.Sprintf("UPSERT %s %s %s %s %s %s %s %s", table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7))
+	}
+	s := libschema.New(context.Background(), libschema.Options{AppliedBy: "pod-1"})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+
+	var exec captureExec
+	err = libschema.StatusSaver{
+		Query: query,
+	}.Save(context.Background(), libschema.LogFromLog(t), &exec, dbase, "t", m, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "UPSERT t ? ? ? ? ? ? ?", exec.query)
+	assert.Equal(t, []interface{}{"L1", "m1", true, "", "pod-1", sql.NullString{}, sql.NullString{}}, exec.args)
+
+	err = libschema.StatusSaver{
+		Placeholder: libschema.AtPPlaceholder,
+		Query:       query,
+		DoneValue: func(done bool) interface{} {
+			if done {
+				return 1
+			}
+			return 0
+		},
+	}.Save(context.Background(), libschema.LogFromLog(t), &exec, dbase, "t", m, false, errors.New("oops"))
+	assert.NoError(t, err)
+	assert.Equal(t, "UPSERT t @p1 @p2 @p3 @p4 @p5 @p6 @p7", exec.query)
+	assert.Equal(t, []interface{}{"L1", "m1", 0, "oops", "pod-1", sql.NullString{}, sql.NullString{}}, exec.args)
+
+	m = fake("m2", libschema.WithComment("TICKET-123"))
+	m.Base().Name.Library = "L1"
+	err = libschema.StatusSaver{
+		Query: query,
+	}.Save(context.Background(), libschema.LogFromLog(t), &exec, dbase, "t", m, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, sql.NullString{String: "TICKET-123", Valid: true}, exec.args[6])
+}
+
+func TestRunID(t *testing.T) {
+	var runIDs []string
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fakeAction("a1", func(ctx context.Context) error {
+				runIDs = append(runIDs, libschema.GetRunContext(ctx).RunID())
+				return nil
+			}),
+		)
+	}
+
+	s := fakeSchema(t, libschema.Options{RunID: "deploy-7"}, newFakeDriver(), define)
+	require.NoError(t, s.Migrate(context.Background()))
+	require.Len(t, runIDs, 1)
+	assert.Equal(t, "deploy-7", runIDs[0])
+
+	uuid := regexp.MustCompile(`\A[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\z`)
+	for i := 0; i < 2; i++ {
+		s = fakeSchema(t, libschema.Options{}, newFakeDriver(), define)
+		require.NoError(t, s.Migrate(context.Background()))
+	}
+	require.Len(t, runIDs, 3)
+	assert.Regexp(t, uuid, runIDs[1])
+	assert.Regexp(t, uuid, runIDs[2])
+	assert.NotEqual(t, runIDs[1], runIDs[2], "each Migrate() has its own run ID")
+}
+
+func TestAppliedBy(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%s:%d", host, os.Getpid()), dbase.AppliedBy())
+
+	dbase.Options.AppliedBy = "deploy-42"
+	assert.Equal(t, "deploy-42", dbase.AppliedBy())
+}
+
+func TestStatusDB(t *testing.T) {
+	primary := &sql.DB{}
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", primary, newFakeDriver())
+	require.NoError(t, err)
+	assert.Same(t, primary, dbase.StatusDB(), "defaults to DB()")
+
+	writer := &sql.DB{}
+	dbase.SetStatusDB(writer)
+	assert.Same(t, writer, dbase.StatusDB())
+	assert.Same(t, primary, dbase.DB(), "DB() unchanged")
+}
+
+type captureLog struct {
+	lines []string
+}
+
+func (c *captureLog) Log(v ...interface{}) {
+	c.lines = append(c.lines, fmt.Sprint(v...))
+}
+
+func TestLastAttemptError(t *testing.T) {
+	var logs captureLog
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(&logs), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+	dbase.Migrations("L1", fake("m1"))
+	m, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "m1"})
+	require.True(t, ok)
+	m.Base().SetStatus(libschema.MigrationStatus{Error: "duplicate column"})
+
+	require.NoError(t, s.Migrate(context.Background()))
+	var found bool
+	for _, line := range logs.lines {
+		if strings.Contains(line, "Last attempt failed") && strings.Contains(line, "duplicate column") {
+			found = true
+		}
+	}
+	assert.True(t, found, "logged the prior error")
+	assert.Equal(t, libschema.MigrationStatus{Done: true}, m.Base().Status())
+}
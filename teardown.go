@@ -0,0 +1,30 @@
+package libschema
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// DropTrackingTable drops the migration tracking table (and its schema,
+// if libschema created it and it is now empty) and forgets the status of
+// all migrations.  It is meant for resetting state between integration
+// tests.  It returns an error unless Options.AllowDestructive is set and
+// the driver implements TrackingTableDropper.
+func (d *Database) DropTrackingTable(ctx context.Context) error {
+	if !d.Options.AllowDestructive {
+		return errors.Errorf("DropTrackingTable for %s requires Options.AllowDestructive", d.Name)
+	}
+	dropper, ok := d.driver.(TrackingTableDropper)
+	if !ok {
+		return errors.Errorf("The driver for %s does not support DropTrackingTable", d.Name)
+	}
+	err := dropper.DropTrackingTable(ctx, d.log, d)
+	if err != nil {
+		return err
+	}
+	for _, m := range d.migrations {
+		m.Base().SetStatus(MigrationStatus{})
+	}
+	return nil
+}
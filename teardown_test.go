@@ -0,0 +1,54 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropTrackingTable(t *testing.T) {
+	var dbase *libschema.Database
+	define := func(d *libschema.Database) {
+		dbase = d
+		d.Migrations("L1", fake("a1"), fake("a2"))
+	}
+
+	driver := newFakeDriver()
+	s := fakeSchema(t, libschema.Options{}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	err := dbase.DropTrackingTable(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AllowDestructive")
+	}
+	assert.Len(t, driver.done, 2, "not dropped")
+
+	driver = newFakeDriver()
+	s = fakeSchema(t, libschema.Options{AllowDestructive: true}, driver, define)
+	require.NoError(t, s.Migrate(context.Background()))
+	require.NoError(t, dbase.DropTrackingTable(context.Background()))
+	assert.Empty(t, driver.done, "dropped")
+	m, ok := dbase.Lookup(libschema.MigrationName{Library: "L1", Name: "a1"})
+	require.True(t, ok)
+	assert.False(t, m.Base().Status().Done, "status forgotten")
+
+	require.NoError(t, s.Migrate(context.Background()))
+	assert.Equal(t, []string{"L1: a1", "L1: a2", "L1: a1", "L1: a2"}, driver.applied, "migrated again")
+}
+
+type noDropDriver struct {
+	libschema.Driver
+}
+
+func TestDropTrackingTableUnsupported(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{AllowDestructive: true})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, noDropDriver{Driver: newFakeDriver()})
+	require.NoError(t, err)
+	err = dbase.DropTrackingTable(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support")
+	}
+}
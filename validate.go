@@ -0,0 +1,129 @@
+package libschema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// MigrationGap is a migration that has not been applied even though a
+// migration that depends upon it has been applied.
+type MigrationGap struct {
+	Missing   MigrationName
+	DoneAfter MigrationName
+}
+
+// ValidationError is returned by Database.Validate.  It enumerates all
+// of the problems found.
+type ValidationError struct {
+	Database string
+	Orphans  []MigrationName // applied in the database but not registered
+	Gaps     []MigrationGap
+}
+
+func (e *ValidationError) Error() string {
+	var problems []string
+	for _, o := range e.Orphans {
+		problems = append(problems, fmt.Sprintf("migration %s is applied but not registered", o))
+	}
+	for _, g := range e.Gaps {
+		problems = append(problems, fmt.Sprintf("migration %s is not applied but %s (which depends upon it) is", g.Missing, g.DoneAfter))
+	}
+	return fmt.Sprintf("database %s does not match the registered migrations: %s", e.Database, strings.Join(problems, "; "))
+}
+
+// Validate compares the migrations that have been applied to the database
+// with the migrations that are registered.  It does not run migrations and
+// it does not take the migration lock.  It reports migrations that are
+// applied but not registered (orphans) and migrations that have not been
+// applied even though a migration that depends upon them has been applied
+// (gaps).  Migrations that have a SkipIf or WithContinueOnError are not
+// reported as gaps since skipping them, or them failing, is expected.  Pending migrations are not a problem.
+//
+// If there are problems, the returned error is a *ValidationError that
+// lists all of them.
+func (d *Database) Validate(ctx context.Context) error {
+	if len(d.errors) != 0 {
+		return multierror.Append(d.errors[0], d.errors[1:]...)
+	}
+	err := d.checkTrackingDB()
+	if err != nil {
+		return err
+	}
+	err = d.computeSequence()
+	if err != nil {
+		return err
+	}
+	unknowns, err := d.driver.LoadStatus(ctx, d.log, d)
+	if err != nil {
+		return err
+	}
+	verr := &ValidationError{
+		Database: d.Name,
+		Orphans:  unknowns,
+	}
+	reported := make(map[int]bool)
+	for _, m := range d.sequence {
+		if !m.Base().Status().Done {
+			continue
+		}
+		visited := make(map[int]bool)
+		todo := append([]int{}, d.blockedBy[m.Base().order]...)
+		for len(todo) > 0 {
+			b := todo[0]
+			todo = todo[1:]
+			if visited[b] {
+				continue
+			}
+			visited[b] = true
+			blocker := d.migrations[b].Base()
+			if blocker.Status().Done {
+				continue
+			}
+			if blocker.HasSkipIf() || blocker.continueOnError {
+				// may have been skipped or failed: look past it
+				todo = append(todo, d.blockedBy[b]...)
+				continue
+			}
+			if !reported[b] {
+				reported[b] = true
+				verr.Gaps = append(verr.Gaps, MigrationGap{
+					Missing:   blocker.Name,
+					DoneAfter: m.Base().Name,
+				})
+			}
+		}
+	}
+	if len(verr.Orphans) == 0 && len(verr.Gaps) == 0 {
+		return nil
+	}
+	return verr
+}
+
+// VerifyOrder checks that the declared ordering of the migrations can
+// be satisfied: every migration referenced by After() must be
+// registered, libraries referenced by LibraryAfter must be registered,
+// and there cannot be cycles.  It does not use the databases, so it can
+// be called from tests and CI before any database exists.  All of the
+// problems found are returned.
+func (s *Schema) VerifyOrder() error {
+	var result *multierror.Error
+	err := s.checkLibraryDependencies()
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	for _, d := range s.databaseOrder {
+		if len(d.errors) != 0 {
+			result = multierror.Append(result, d.errors...)
+			continue
+		}
+		err := d.computeSequence()
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "database %s", d.Name))
+		}
+	}
+	return result.ErrorOrNil()
+}
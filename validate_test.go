@@ -0,0 +1,100 @@
+package libschema_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muir/libschema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	define := func(dbase *libschema.Database) {
+		dbase.Migrations("L1",
+			fake("a1"),
+			fake("a2", libschema.SkipIf(func() (bool, error) { return true, nil })),
+			fake("a3"),
+			fake("a4"),
+		)
+		dbase.Migrations("L2",
+			fake("b1"),
+			fake("b2"),
+		)
+	}
+	driver := newFakeDriver()
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, driver)
+	require.NoError(t, err)
+	define(dbase)
+
+	assert.NoError(t, dbase.Validate(context.Background()), "nothing applied")
+
+	driver.done[libschema.MigrationName{Library: "L1", Name: "a1"}] = true
+	driver.done[libschema.MigrationName{Library: "L1", Name: "a3"}] = true
+	assert.NoError(t, dbase.Validate(context.Background()), "skipped a2")
+
+	driver.done[libschema.MigrationName{Library: "L1", Name: "old"}] = true
+	driver.done[libschema.MigrationName{Library: "L2", Name: "b2"}] = true
+	driver.done[libschema.MigrationName{Library: "L3", Name: "gone"}] = true
+	err = dbase.Validate(context.Background())
+	require.Error(t, err)
+	var verr *libschema.ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, "test", verr.Database)
+	assert.ElementsMatch(t, []libschema.MigrationName{
+		{Library: "L1", Name: "old"},
+		{Library: "L3", Name: "gone"},
+	}, verr.Orphans, "orphans")
+	assert.Equal(t, []libschema.MigrationGap{
+		{
+			Missing:   libschema.MigrationName{Library: "L2", Name: "b1"},
+			DoneAfter: libschema.MigrationName{Library: "L2", Name: "b2"},
+		},
+	}, verr.Gaps, "gaps")
+	assert.Contains(t, err.Error(), "L1: old")
+	assert.Contains(t, err.Error(), "L2: b1")
+	assert.Empty(t, driver.applied, "validate does not migrate")
+}
+
+func TestVerifyOrder(t *testing.T) {
+	s := libschema.New(context.Background(), libschema.Options{})
+	dbase, err := s.NewDatabase(libschema.LogFromLog(t), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2", libschema.After("L2", "b1")),
+	)
+	dbase.Migrations("L2",
+		fake("b1"),
+		fake("b2"),
+	)
+	assert.NoError(t, s.VerifyOrder(), "valid")
+
+	dbase.Migrations("L3",
+		fake("c1", libschema.After("L2", "missing")),
+	)
+	err = s.VerifyOrder()
+	if assert.Error(t, err, "missing") {
+		assert.Contains(t, err.Error(), "database test")
+		assert.Contains(t, err.Error(), "after missing for L2")
+	}
+
+	s = libschema.New(context.Background(), libschema.Options{})
+	dbase, err = s.NewDatabase(libschema.LogFromLog(t), "test", nil, newFakeDriver())
+	require.NoError(t, err)
+	dbase.Migrations("L1",
+		fake("a1"),
+		fake("a2", libschema.After("L2", "b2")),
+	)
+	dbase.Migrations("L2",
+		fake("b1", libschema.After("L1", "a2")),
+		fake("b2"),
+	)
+	err = s.VerifyOrder()
+	if assert.Error(t, err, "cycle") {
+		assert.Contains(t, err.Error(), "Circular dependency")
+	}
+	assert.Empty(t, dbase.Current().Name, "nothing run")
+}